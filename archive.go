@@ -0,0 +1,207 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	fsutils "github.com/tmokmss/soci-wrapper/utils/fs"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"github.com/tmokmss/soci-wrapper/utils/logctx"
+	registryutils "github.com/tmokmss/soci-wrapper/utils/registry"
+	"os"
+	"path/filepath"
+
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// Name of the metadata file describing the SOCI indices in an archive written with --export-tar
+const archiveMetadataFile = "soci-wrapper.json"
+
+// The contents of an archive written with --export-tar, besides the OCI image layout
+type archiveMetadata struct {
+	SociVersion string         `json:"sociVersion"`
+	Indices     []archiveEntry `json:"indices"`
+}
+
+// A SOCI index in an archive, tagged in the OCI image layout with Tag
+type archiveEntry struct {
+	Tag         string `json:"tag"`
+	Digest      string `json:"digest"`
+	Repository  string `json:"repository"`
+	ImageDigest string `json:"imageDigest"`
+	Platform    string `json:"platform,omitempty"`
+}
+
+// Write the metadata of the SOCI indices exported to exportDir, and package the directory into a tar file.
+// Nothing is written if no SOCI index was exported, e.g. when every image was skipped.
+func writeExportArchive(exportDir string, tarPath string, results []imageResult) error {
+	metadata := archiveMetadata{SociVersion: sociVersion}
+	for _, result := range results {
+		for _, index := range result.build.Indices {
+			metadata.Indices = append(metadata.Indices, archiveEntry{
+				Tag:         exportTag(result.build.Digest, index.Platform),
+				Digest:      index.Digest,
+				Repository:  result.build.indexRepo,
+				ImageDigest: result.build.Digest,
+				Platform:    index.Platform,
+			})
+		}
+	}
+	if len(metadata.Indices) == 0 {
+		return nil
+	}
+
+	content, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(exportDir, archiveMetadataFile), content, 0644); err != nil {
+		return err
+	}
+	return fsutils.CreateTar(exportDir, tarPath)
+}
+
+// Read the metadata of an archive extracted to a directory
+func readArchiveMetadata(dir string) (*archiveMetadata, error) {
+	content, err := os.ReadFile(filepath.Join(dir, archiveMetadataFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s is missing, the archive was not written with --export-tar", archiveMetadataFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var metadata archiveMetadata
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		return nil, fmt.Errorf("Invalid %s: %w", archiveMetadataFile, err)
+	}
+	return &metadata, nil
+}
+
+// Push the SOCI indices of an archive written with --export-tar to the repositories of their images.
+// The images must already exist in the registry. Every SOCI index is pushed even if another one fails.
+func pushArchiveCommand(args []string) {
+	flags := flag.NewFlagSet("push-archive", flag.ContinueOnError)
+	archive := flags.String("archive", "", "Path of the tar file written with --export-tar")
+	repo := flags.String("repo", "", "Name of the repository to push every SOCI index to. Defaults to the repository recorded in the archive")
+	region := flags.String("region", "", "AWS region of the ECR registry. Defaults to the region of the AWS configuration, e.g. $AWS_REGION")
+	account := flags.String("account", "", "AWS account ID of the ECR registry. Defaults to the account of the AWS credentials")
+	fips := flags.Bool("fips", false, "Use the FIPS endpoints of ECR")
+	registryHost := flags.String("registry", "", "Hostname of an OCI registry to use instead of ECR, e.g. harbor.example.com")
+	username := flags.String("username", "", "Username for --registry. Defaults to the "+registryutils.RegistryUsernameEnv+" environment variable or the docker config file")
+	password := flags.String("password", "", "Password for --registry. Defaults to the "+registryutils.RegistryPasswordEnv+" environment variable or the docker config file")
+	dockerConfig := flags.String("docker-config", "", "Path of the docker config file to read registry credentials from. Defaults to $DOCKER_CONFIG/config.json or ~/.docker/config.json")
+	plainHttp := flags.Bool("plain-http", false, "Connect to the registry over plain HTTP, e.g. for a local test registry")
+	caCert := flags.String("ca-cert", "", "PEM bundle of CA certificates to trust in addition to the system ones when connecting to the registry")
+	referrers := referrersFlagVar(flags)
+	awsOptions := awsFlags(flags)
+	proxyUrl := proxyFlag(flags)
+	setRetryOptions := retryFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: soci-wrapper push-archive --archive FILE --region AWS_REGION --account AWS_ACCOUNT [--repo REPOSITORY_NAME]")
+		fmt.Fprintln(flags.Output(), "       soci-wrapper push-archive --archive FILE --registry REGISTRY [--repo REPOSITORY_NAME]")
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, args)
+
+	if *archive == "" || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.TODO()
+	if err := registryutils.ConfigureProxy(ctx, *proxyUrl); err != nil {
+		fmt.Fprintln(flags.Output(), err)
+		os.Exit(1)
+	}
+	if err := registryutils.ConfigureAws(ctx, awsOptions()); err != nil {
+		lambdaError(ctx, "AWS credentials configuration error", err)
+		os.Exit(1)
+	}
+	if *registryHost == "" {
+		detectRegionAndAccount(ctx, region, account)
+	}
+	registryUrl, ok := registryUrlFromFlags(*registryHost, *region, *account, *fips)
+	if !ok {
+		flags.Usage()
+		os.Exit(1)
+	}
+	ctx = logctx.WithRegistryURL(ctx, registryUrl)
+
+	dir, err := os.MkdirTemp("", "soci-archive-")
+	if err != nil {
+		lambdaError(ctx, "Archive extraction error", err)
+		os.Exit(1)
+	}
+	// os.Exit skips deferred calls, so the directory is removed before exiting
+	failed := pushArchive(ctx, *archive, dir, registryUrl, *repo, registryutils.RegistryOptions{
+		Credential:       auth.Credential{Username: *username, Password: *password},
+		DockerConfigFile: *dockerConfig,
+		PlainHttp:        *plainHttp,
+		CaCertFile:       *caCert,
+		Referrers:        string(*referrers),
+	}, setRetryOptions)
+	os.RemoveAll(dir)
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// Extract an archive to dir and push its SOCI indices, printing the outcome of each of them.
+// Returns true if anything failed.
+func pushArchive(ctx context.Context, archive string, dir string, registryUrl string, repo string, registryOptions registryutils.RegistryOptions, setRetryOptions func(*registryutils.RegistryOptions)) bool {
+	if err := fsutils.ExtractTar(archive, dir); err != nil {
+		lambdaError(ctx, "Archive extraction error", err)
+		return true
+	}
+	metadata, err := readArchiveMetadata(dir)
+	if err != nil {
+		lambdaError(ctx, "Archive metadata read error", err)
+		return true
+	}
+	layout, err := oci.NewWithContext(ctx, dir)
+	if err != nil {
+		lambdaError(ctx, "Archive metadata read error", err)
+		return true
+	}
+	sociStore := &store.SociStore{Store: layout}
+
+	setRetryOptions(&registryOptions)
+	registry, err := registryutils.Init(ctx, registryUrl, registryOptions)
+	if err != nil {
+		lambdaError(ctx, "Remote registry initialization error", err)
+		return true
+	}
+
+	results := make([]imageResult, 0, len(metadata.Indices))
+	for _, entry := range metadata.Indices {
+		indexRepo := registryutils.NormalizeRepositoryName(registryUrl, cmp.Or(repo, entry.Repository))
+		indexCtx := logctx.WithRepositoryName(ctx, indexRepo)
+		indexCtx = logctx.WithImageDigest(indexCtx, entry.ImageDigest)
+		indexCtx = logctx.WithSociIndexDigest(indexCtx, entry.Digest)
+		if entry.Platform != "" {
+			indexCtx = logctx.WithPlatform(indexCtx, entry.Platform)
+		}
+
+		result := imageResult{reference: indexRepo + "@" + entry.ImageDigest}
+		desc, err := layout.Resolve(indexCtx, entry.Tag)
+		if err == nil && desc.Digest.String() != entry.Digest {
+			err = fmt.Errorf("%s refers to %s instead of %s", entry.Tag, desc.Digest, entry.Digest)
+		}
+		if err != nil {
+			result.message, result.err = lambdaError(indexCtx, "SOCI index read error", err)
+		} else if mechanism, err := registry.PushReferrer(indexCtx, sociStore, desc, indexRepo); err != nil {
+			result.message, result.err = lambdaError(indexCtx, "SOCI index push error", err)
+		} else {
+			result.message = fmt.Sprintf("Successfully pushed SOCI index %s with the %s", entry.Digest, mechanism)
+			log.Info(indexCtx, result.message)
+		}
+		printResult(result)
+		results = append(results, result)
+	}
+	return printSummary(results) > 0
+}
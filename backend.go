@@ -0,0 +1,104 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/pkg/builder"
+	registryutils "github.com/tmokmss/soci-wrapper/utils/registry"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Default directory of the data directories of the images
+const defaultStoreDir = "/tmp"
+
+// Where the images and their SOCI artifacts are stored while they are processed, selected with --store-backend.
+// The zero value is the local backend, storing everything under /tmp, or --work-dir if given.
+type storeBackend struct {
+	// Directory the data directories of the images are created in, e.g. an EFS mount. defaultStoreDir if empty
+	dir string
+	// Bucket where the layers are staged instead of the data directory, which then holds a single layer at a time. Not staged if empty
+	stagingUrl string
+	// Opened from stagingUrl once AWS is configured
+	staging *registryutils.S3Staging
+}
+
+// Parse --store-backend: local, the path of a directory such as an EFS mount, or s3://bucket/prefix
+func parseStoreBackend(value string) (storeBackend, error) {
+	switch {
+	case value == "" || value == "local":
+		return storeBackend{}, nil
+	case strings.HasPrefix(value, "s3://"):
+		// The bucket is opened once AWS is configured, which must not happen before
+		if parsed, err := url.Parse(value); err != nil || parsed.Host == "" {
+			return storeBackend{}, fmt.Errorf("%s is not an s3://bucket/prefix URL", value)
+		}
+		return storeBackend{stagingUrl: value}, nil
+	case filepath.IsAbs(value):
+		if err := checkWorkDir(value); err != nil {
+			return storeBackend{}, err
+		}
+		return storeBackend{dir: value}, nil
+	default:
+		return storeBackend{}, fmt.Errorf("unknown store backend %q, expected local, the absolute path of a directory or s3://bucket/prefix", value)
+	}
+}
+
+// Set the directory the data directories of the images are created in from --work-dir, if given.
+// Fails if the directory does not exist or is not writable, including the default one.
+func (backend *storeBackend) setWorkDir(workDir string) error {
+	if workDir != "" {
+		if backend.dir != "" {
+			return errors.New("--work-dir cannot be combined with --store-backend DIRECTORY")
+		}
+		dir, err := filepath.Abs(workDir)
+		if err != nil {
+			return err
+		}
+		backend.dir = dir
+	}
+	if err := checkWorkDir(backend.dataDirRoot()); err != nil {
+		return fmt.Errorf("--work-dir: %w", err)
+	}
+	return nil
+}
+
+// Check that dir is a directory files can be created in
+func checkWorkDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	file, err := os.CreateTemp(dir, ".soci-wrapper-")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// Directory the data directories of the images are created in
+func (backend storeBackend) dataDirRoot() string {
+	return cmp.Or(backend.dir, defaultStoreDir)
+}
+
+// Wrap fetchLayer so that layers are read through the staging bucket, or return it as is if layers are not staged
+func (backend storeBackend) layerFetcher(fetchLayer builder.LayerFetcher) builder.LayerFetcher {
+	if backend.staging == nil {
+		return fetchLayer
+	}
+	return func(ctx context.Context, layer ocispec.Descriptor, file *os.File) error {
+		return backend.staging.FetchLayer(ctx, layer, file, func(file *os.File) error {
+			return fetchLayer(ctx, layer, file)
+		})
+	}
+}
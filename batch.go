@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Parse an image entry of a batch input, either REPOSITORY@DIGEST or REPOSITORY:TAG.
+// A bare digest refers to an image in the default repository.
+func parseImageEntry(entry string, defaultRepo string) (imageReference, error) {
+	ref := imageReference{repo: defaultRepo}
+	if i := strings.Index(entry, "@"); i != -1 {
+		ref.repo, ref.digest = entry[:i], entry[i+1:]
+	} else if _, err := digest.Parse(entry); err == nil {
+		ref.digest = entry
+	} else if i := strings.LastIndex(entry, ":"); i != -1 {
+		ref.repo, ref.tag = entry[:i], entry[i+1:]
+	} else {
+		return ref, fmt.Errorf("Invalid image entry %q, expected REPOSITORY@DIGEST or REPOSITORY:TAG", entry)
+	}
+
+	if ref.repo == "" {
+		return ref, fmt.Errorf("Invalid image entry %q, missing repository name", entry)
+	}
+	if ref.digest != "" {
+		if _, err := digest.Parse(ref.digest); err != nil {
+			return ref, fmt.Errorf("Invalid image entry %q: %v", entry, err)
+		}
+	}
+	return ref, nil
+}
+
+// Read newline-delimited image entries and pass each of them to yield as soon as it is read.
+// Empty lines and lines starting with # are ignored. Reading stops when yield returns false.
+func scanImageEntries(r io.Reader, defaultRepo string) func(yield func(imageReference) bool) error {
+	return func(yield func(imageReference) bool) error {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			ref, err := parseImageEntry(line, defaultRepo)
+			if err != nil {
+				return err
+			}
+			if !yield(ref) {
+				return nil
+			}
+		}
+		return scanner.Err()
+	}
+}
+
+// Pass each of the given images to yield
+func listImages(refs []imageReference) func(yield func(imageReference) bool) error {
+	return func(yield func(imageReference) bool) error {
+		for _, ref := range refs {
+			if !yield(ref) {
+				return nil
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration file read from the working directory when --config is not given
+const defaultConfigFile = "soci-wrapper.yaml"
+
+// Prefix of the environment variables holding flag defaults, e.g. SOCI_WRAPPER_REGION for --region
+const flagEnvPrefix = "SOCI_WRAPPER_"
+
+// Subcommands other than build, whose flags are read from a section of the configuration file named after them
+var configSections = []string{"reindex", "push-archive", "list", "gc", "verify", "preflight", "serve-sqs"}
+
+// Name of the environment variable holding the default of a flag
+func flagEnv(name string) string {
+	return flagEnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Flags whose values are secrets, printed as REDACTED by --print-config
+var secretFlags = []string{"password"}
+
+// Parse the command line arguments of a subcommand, then set the flags that were not given
+// from their environment variable, or else from the configuration file.
+// Exits if a value is invalid or the configuration file cannot be read, and after printing the configuration with --print-config.
+func parseFlags(flags *flag.FlagSet, args []string) {
+	configFile := flags.String("config", "", fmt.Sprintf("YAML file of flag defaults, keyed by flag name. Flags and their environment variables take precedence over it. Defaults to ./%s if it exists", defaultConfigFile))
+	printConfig := flags.Bool("print-config", false, "Print the value of every flag and where it was set, in the format of --config, then exit")
+	flags.VisitAll(func(f *flag.Flag) {
+		f.Usage += fmt.Sprintf(" [$%s]", flagEnv(f.Name))
+	})
+	// Invalid arguments exit with 1 rather than the 2 of flag.ExitOnError, which is the exit code of skipped builds
+	if err := flags.Parse(args); errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if err != nil {
+		os.Exit(1)
+	}
+	sources, err := applyFlagDefaults(flags, *configFile)
+	if err != nil {
+		fmt.Fprintln(flags.Output(), err)
+		os.Exit(1)
+	}
+	if *printConfig {
+		if err := writeConfig(os.Stdout, flags, sources); err != nil {
+			fmt.Fprintln(flags.Output(), err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+}
+
+// Set the flags that were not given from their environment variable or the configuration file,
+// and return where each flag was set: flag, $ENV, the configuration file, or default
+func applyFlagDefaults(flags *flag.FlagSet, configFile string) (map[string]string, error) {
+	sources := map[string]string{}
+	flags.Visit(func(f *flag.Flag) {
+		sources[f.Name] = "flag"
+	})
+	if sources["config"] == "" {
+		configFile = os.Getenv(flagEnv("config"))
+	}
+	config, path, err := readConfig(flags, configFile)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	flags.VisitAll(func(f *flag.Flag) {
+		if sources[f.Name] != "" {
+			return
+		}
+		if value, ok := os.LookupEnv(flagEnv(f.Name)); ok {
+			if err := f.Value.Set(value); err != nil {
+				errs = append(errs, fmt.Errorf("Invalid value %q of $%s: %v", value, flagEnv(f.Name), err))
+			}
+			sources[f.Name] = "$" + flagEnv(f.Name)
+			return
+		}
+		values, ok := config[f.Name]
+		if !ok {
+			sources[f.Name] = "default"
+			return
+		}
+		for _, value := range values {
+			if err := f.Value.Set(value); err != nil {
+				errs = append(errs, fmt.Errorf("Invalid value %q of %s in configuration file %s: %v", value, f.Name, path, err))
+			}
+		}
+		sources[f.Name] = path
+	})
+	return sources, errors.Join(errs...)
+}
+
+// Read the flag values of the subcommand of a flag set from a configuration file, or from ./soci-wrapper.yaml if path is empty and it exists,
+// and return the path read.
+// The flags of build are top-level keys, and those of other subcommands are in a section named after the subcommand.
+// Each key must be a flag of its subcommand, and lists are set as repeated flags.
+func readConfig(flags *flag.FlagSet, path string) (map[string][]string, string, error) {
+	if path == "" {
+		if _, err := os.Stat(defaultConfigFile); err != nil {
+			return nil, "", nil
+		}
+		path = defaultConfigFile
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to read the configuration file: %w", err)
+	}
+	var document yaml.Node
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, "", fmt.Errorf("Invalid configuration file %s: %w", path, err)
+	}
+	// An empty file has no document
+	if len(document.Content) == 0 {
+		return nil, "", nil
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, "", fmt.Errorf("Invalid configuration file %s: expected a mapping of flag names to values", path)
+	}
+
+	// Top-level keys are either flags of build or sections of other subcommands
+	topLevel := &yaml.Node{Kind: yaml.MappingNode}
+	var section *yaml.Node
+	for i := 0; i < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if !slices.Contains(configSections, key.Value) {
+			topLevel.Content = append(topLevel.Content, key, value)
+			continue
+		}
+		if value.Kind != yaml.MappingNode {
+			return nil, "", fmt.Errorf("Invalid configuration file %s: section %s must be a mapping of flag names to values", path, key.Value)
+		}
+		if key.Value == flags.Name() {
+			section = value
+		}
+	}
+	if flags.Name() == "build" {
+		section = topLevel
+	}
+	if section == nil {
+		return nil, "", nil
+	}
+
+	config := map[string][]string{}
+	for i := 0; i < len(section.Content); i += 2 {
+		key, value := section.Content[i], section.Content[i+1]
+		if flags.Lookup(key.Value) == nil {
+			return nil, "", fmt.Errorf("Unknown key %q in configuration file %s (line %d), expected a flag of soci-wrapper %s", key.Value, path, key.Line, flags.Name())
+		}
+		values, err := configValues(value)
+		if err != nil {
+			return nil, "", fmt.Errorf("Invalid value of %s in configuration file %s (line %d): %w", key.Value, path, value.Line, err)
+		}
+		config[key.Value] = values
+	}
+	return config, path, nil
+}
+
+// The flag values of a configuration file value: a scalar is set once and a list once per item
+func configValues(node *yaml.Node) ([]string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return []string{node.Value}, nil
+	case yaml.SequenceNode:
+		values := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return nil, errors.New("expected a list of values")
+			}
+			values = append(values, item.Value)
+		}
+		return values, nil
+	}
+	return nil, errors.New("expected a value or a list of values")
+}
+
+// Flags set once per value, printed as lists
+type listFlag interface {
+	values() []string
+}
+
+func (f *stringsFlag) values() []string {
+	return *f
+}
+
+func (f annotationsFlag) values() []string {
+	pairs := make([]string, 0, len(f))
+	for key, value := range f {
+		pairs = append(pairs, key+"="+value)
+	}
+	slices.Sort(pairs)
+	return pairs
+}
+
+// Write the value of every flag of a flag set as a configuration file, with where it was set as a comment
+func writeConfig(w io.Writer, flags *flag.FlagSet, sources map[string]string) error {
+	config := &yaml.Node{Kind: yaml.MappingNode}
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+		value := &yaml.Node{Kind: yaml.ScalarNode, Value: log.Redact(f.Value.String()), LineComment: sources[f.Name]}
+		// Empty values would be read back as null otherwise
+		if value.Value == "" {
+			value.Style = yaml.DoubleQuotedStyle
+		}
+		if list, ok := f.Value.(listFlag); ok {
+			value = &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle, LineComment: sources[f.Name]}
+			for _, item := range list.values() {
+				value.Content = append(value.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: log.Redact(item)})
+			}
+		} else if slices.Contains(secretFlags, f.Name) && value.Value != "" {
+			value.Value = "REDACTED"
+		}
+		config.Content = append(config.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: f.Name}, value)
+	})
+	// The flags of subcommands other than build are in a section named after the subcommand
+	if flags.Name() != "build" {
+		config = &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{{Kind: yaml.ScalarNode, Value: flags.Name()}, config}}
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(config); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
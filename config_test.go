@@ -0,0 +1,81 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyFlagDefaults(t *testing.T) {
+	const config = `region: file-region
+workers: 2
+serve-sqs:
+  queue-url: file-queue
+`
+	for _, tc := range []struct {
+		name string
+		// Subcommand of the flag set
+		command string
+		config  string
+		env     map[string]string
+		args    []string
+		// Flag checked, with its expected value and source, unless an error is expected
+		flag       string
+		want       string
+		wantSource string
+		wantErr    string
+	}{
+		{"default", "build", "", nil, nil, "region", "default-region", "default", ""},
+		{"file", "build", config, nil, nil, "region", "file-region", "CONFIG", ""},
+		{"env over file", "build", config, map[string]string{"SOCI_WRAPPER_REGION": "env-region"}, nil, "region", "env-region", "$SOCI_WRAPPER_REGION", ""},
+		{"flag over env", "build", config, map[string]string{"SOCI_WRAPPER_REGION": "env-region"}, []string{"--region", "flag-region"}, "region", "flag-region", "flag", ""},
+		{"config from env", "build", "", map[string]string{"SOCI_WRAPPER_CONFIG": "CONFIG"}, nil, "workers", "2", "CONFIG", ""},
+		{"section", "serve-sqs", config, nil, nil, "queue-url", "file-queue", "CONFIG", ""},
+		{"unknown key", "build", config + "regoin: typo\n", nil, nil, "", "", "", `Unknown key "regoin" in configuration file CONFIG (line 5), expected a flag of soci-wrapper build`},
+		{"unknown key in section", "serve-sqs", config + "  workers: 2\n", nil, nil, "", "", "", `Unknown key "workers" in configuration file CONFIG (line 5), expected a flag of soci-wrapper serve-sqs`},
+		{"invalid value", "build", "workers: two\n", nil, nil, "", "", "", `Invalid value "two" of workers in configuration file CONFIG`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// CONFIG stands for the path of the configuration file
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(cmp.Or(tc.config, config)), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if tc.config != "" {
+				tc.args = append(tc.args, "--config", path)
+			}
+			for name, value := range tc.env {
+				t.Setenv(name, strings.ReplaceAll(value, "CONFIG", path))
+			}
+			flags := flag.NewFlagSet(tc.command, flag.ContinueOnError)
+			if tc.command == "build" {
+				flags.String("region", "default-region", "")
+				flags.Int("workers", 1, "")
+			} else {
+				flags.String("queue-url", "default-queue", "")
+			}
+			configFile := flags.String("config", "", "")
+			if err := flags.Parse(tc.args); err != nil {
+				t.Fatal(err)
+			}
+
+			sources, err := applyFlagDefaults(flags, *configFile)
+			if tc.wantErr != "" {
+				if wantErr := strings.ReplaceAll(tc.wantErr, "CONFIG", path); err == nil || !strings.Contains(err.Error(), wantErr) {
+					t.Fatalf("Expected the error %q, got %v", wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			value, wantSource := flags.Lookup(tc.flag).Value.String(), strings.ReplaceAll(tc.wantSource, "CONFIG", path)
+			if value != tc.want || sources[tc.flag] != wantSource {
+				t.Errorf("Expected --%s to be %q from %s, got %q from %s", tc.flag, tc.want, wantSource, value, sources[tc.flag])
+			}
+		})
+	}
+}
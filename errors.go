@@ -0,0 +1,132 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	registryutils "github.com/tmokmss/soci-wrapper/utils/registry"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/containerd/containerd/errdefs"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+)
+
+// Categories of the errors builds fail with, telling whether they are worth retrying
+const (
+	errorCategoryValidation = "validation"
+	errorCategoryNotFound   = "notFound"
+	errorCategoryAuth       = "auth"
+	errorCategoryThrottled  = "throttled"
+	errorCategoryNetwork    = "network"
+	errorCategoryDisk       = "disk"
+	errorCategoryInternal   = "internal"
+)
+
+// Exit codes of a build, telling scripts why it did not build every image
+const (
+	// Any other failure, or failures of several categories
+	exitCodeOther = 1
+	// No image failed, but some were skipped because they were invalid or already indexed
+	exitCodeSkipped  = 2
+	exitCodeAuth     = 3
+	exitCodeNotFound = 4
+	exitCodeDisk     = 5
+	// Network and registry errors, including throttling and --timeout
+	exitCodeNetwork = 6
+	// SOCI indices pushed but not signed, whatever the error of the signature
+	exitCodeSignature = 7
+	// Stopped by SIGINT or SIGTERM, as shells report processes killed by SIGINT
+	exitCodeInterrupted = 130
+)
+
+// Exit code of a run whose failed images all failed with an error of the category.
+// Categories missing here exit with exitCodeOther.
+var errorCategoryExitCodes = map[string]int{
+	errorCategoryAuth:      exitCodeAuth,
+	errorCategoryNotFound:  exitCodeNotFound,
+	errorCategoryDisk:      exitCodeDisk,
+	errorCategoryNetwork:   exitCodeNetwork,
+	errorCategoryThrottled: exitCodeNetwork,
+}
+
+// The exit code of a run failing with an error of the category
+func categoryExitCode(category string) int {
+	return cmp.Or(errorCategoryExitCodes[category], exitCodeOther)
+}
+
+// Returned when an image does not fit in the free space of the temporary directory
+var errInsufficientDiskSpace = errors.New("Insufficient disk space")
+
+// Classify the error a build failed with
+func errorCategory(err error) string {
+	var responseErr *errcode.ErrorResponse
+	if errors.As(err, &responseErr) {
+		if category := httpStatusCategory(responseErr.StatusCode); category != "" {
+			return category
+		}
+	}
+	var requestErr awserr.RequestFailure
+	if errors.As(err, &requestErr) {
+		switch requestErr.Code() {
+		case "ThrottlingException", "Throttling", "TooManyRequestsException", "RequestLimitExceeded":
+			return errorCategoryThrottled
+		case "RepositoryNotFoundException", "ImageNotFoundException", "RepositoryPolicyNotFoundException":
+			return errorCategoryNotFound
+		case "AccessDeniedException", "UnrecognizedClientException", "ExpiredTokenException", "InvalidSignatureException":
+			return errorCategoryAuth
+		}
+		if category := httpStatusCategory(requestErr.StatusCode()); category != "" {
+			return category
+		}
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == "NoCredentialProviders" {
+		return errorCategoryAuth
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errInsufficientDiskSpace), errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return errorCategoryDisk
+	// An image pulled as another one than requested is served the same way again, unlike a corrupted blob
+	case errors.Is(err, errImageInvalid), errors.Is(err, registryutils.ErrInvalidImageManifest), errors.Is(err, registryutils.ErrUnsupportedPlatform), errors.Is(err, errdef.ErrUnsupported), errors.Is(err, errdef.ErrUnsupportedVersion),
+		errors.Is(err, errdef.ErrInvalidDigest), errors.Is(err, errdef.ErrInvalidReference), errors.Is(err, errdefs.ErrInvalidArgument), errors.Is(err, registryutils.ErrImageMismatch):
+		return errorCategoryValidation
+	case errors.Is(err, errdef.ErrNotFound), errors.Is(err, errdefs.ErrNotFound):
+		return errorCategoryNotFound
+	// A SOCI index found incomplete after its push was deleted, and pushing it again is likely to succeed.
+	// Likewise, content found corrupted after its pull is deleted, and is likely to be intact when pulled again
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED), errors.As(err, &netErr), errors.Is(err, registryutils.ErrPushVerification),
+		errors.Is(err, registryutils.ErrContentVerification):
+		return errorCategoryNetwork
+	}
+	return errorCategoryInternal
+}
+
+// Classify an HTTP error status of a registry or an AWS API, or return "" for other statuses
+func httpStatusCategory(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return errorCategoryAuth
+	case status == http.StatusNotFound:
+		return errorCategoryNotFound
+	case status == http.StatusTooManyRequests:
+		return errorCategoryThrottled
+	case status >= 500:
+		return errorCategoryNetwork
+	case status == http.StatusBadRequest || status == http.StatusUnsupportedMediaType:
+		return errorCategoryValidation
+	}
+	return ""
+}
+
+// Whether a build failing with an error of the category may succeed if retried
+func isRetryable(category string) bool {
+	return category == errorCategoryThrottled || category == errorCategoryNetwork || category == errorCategoryDisk
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	registryutils "github.com/tmokmss/soci-wrapper/utils/registry"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+)
+
+func TestExitCode(t *testing.T) {
+	registryError := func(status int) error {
+		return &errcode.ErrorResponse{Method: http.MethodGet, URL: &url.URL{Scheme: "https", Host: "registry", Path: "/v2/test/manifests/latest"}, StatusCode: status}
+	}
+	failed := func(err error) imageResult {
+		return imageResult{err: err, build: &buildResult{Error: newBuildError("Image pull error", err)}}
+	}
+	built := imageResult{build: &buildResult{}}
+	skippedInvalid := imageResult{err: errImageInvalid, build: &buildResult{}}
+	skippedIndexed := imageResult{err: errImageIndexed, build: &buildResult{}}
+	skippedNothingToIndex := imageResult{err: errImageNothingToIndex, build: &buildResult{}}
+	skippedUnsupportedPlatform := imageResult{err: errImageUnsupportedPlatform, build: &buildResult{}}
+	skippedDeleted := imageResult{err: errImageDeleted, build: &buildResult{}}
+
+	for _, tc := range []struct {
+		name    string
+		results []imageResult
+		err     error
+		// Run with --fail-on-skip
+		failOnSkip bool
+		want       int
+	}{
+		{"built", []imageResult{built, built}, nil, false, 0},
+		{"nothing to do", nil, nil, false, 0},
+		{"skipped invalid", []imageResult{built, skippedInvalid}, nil, false, exitCodeSkipped},
+		{"skipped indexed", []imageResult{skippedIndexed}, nil, false, exitCodeSkipped},
+		{"skipped nothing to index", []imageResult{skippedNothingToIndex}, nil, false, exitCodeSkipped},
+		{"skipped deleted", []imageResult{skippedDeleted, skippedNothingToIndex}, nil, false, exitCodeSkipped},
+		{"skipped unsupported platform", []imageResult{built, skippedUnsupportedPlatform}, nil, false, exitCodeSkipped},
+		{"skipped with fail on skip", []imageResult{built, skippedIndexed}, nil, true, exitCodeOther},
+		{"built with fail on skip", []imageResult{built}, nil, true, 0},
+		{"failed and skipped with fail on skip", []imageResult{failed(syscall.ENOSPC), skippedInvalid}, nil, true, exitCodeDisk},
+		{"unauthorized", []imageResult{failed(registryError(http.StatusUnauthorized))}, nil, false, exitCodeAuth},
+		{"access denied", []imageResult{failed(awserr.NewRequestFailure(awserr.New("AccessDeniedException", "denied", nil), http.StatusBadRequest, "c0ffee"))}, nil, false, exitCodeAuth},
+		{"not found", []imageResult{failed(fmt.Errorf("resolve: %w", errdef.ErrNotFound))}, nil, false, exitCodeNotFound},
+		{"disk", []imageResult{failed(errInsufficientDiskSpace), failed(syscall.ENOSPC)}, nil, false, exitCodeDisk},
+		{"network", []imageResult{failed(registryError(http.StatusBadGateway)), failed(syscall.ECONNRESET)}, nil, false, exitCodeNetwork},
+		{"incomplete push", []imageResult{failed(fmt.Errorf("SOCI index sha256:aa: %w: Blob sha256:bb is missing", registryutils.ErrPushVerification))}, nil, false, exitCodeNetwork},
+		{"corrupted pull", []imageResult{failed(fmt.Errorf("%w: Layer sha256:bb has digest sha256:cc and 5 bytes, expected 5 bytes", registryutils.ErrContentVerification))}, nil, false, exitCodeNetwork},
+		{"other image pulled", []imageResult{failed(fmt.Errorf("%w: manifest sha256:aa was pulled for image sha256:bb", registryutils.ErrImageMismatch))}, nil, false, exitCodeOther},
+		{"throttled", []imageResult{failed(registryError(http.StatusTooManyRequests))}, nil, false, exitCodeNetwork},
+		{"pushed but not signed", []imageResult{failed(fmt.Errorf("%w: %w", errSignature, awserr.NewRequestFailure(awserr.New("AccessDeniedException", "denied", nil), http.StatusBadRequest, "c0ffee")))}, nil, false, exitCodeSignature},
+		{"not signed and failed", []imageResult{failed(fmt.Errorf("%w: %w", errSignature, syscall.ECONNRESET)), failed(syscall.ECONNRESET)}, nil, false, exitCodeOther},
+		{"validation", []imageResult{failed(registryError(http.StatusBadRequest))}, nil, false, exitCodeOther},
+		{"invalid manifest", []imageResult{failed(fmt.Errorf("%w: empty config media type", registryutils.ErrInvalidImageManifest))}, nil, false, exitCodeOther},
+		{"internal", []imageResult{failed(errors.New("unexpected"))}, nil, false, exitCodeOther},
+		{"several categories", []imageResult{failed(registryError(http.StatusUnauthorized)), failed(syscall.ENOSPC)}, nil, false, exitCodeOther},
+		{"failed and skipped", []imageResult{failed(syscall.ENOSPC), skippedInvalid}, nil, false, exitCodeDisk},
+		{"timeout", []imageResult{built}, errTimeout, false, exitCodeNetwork},
+		{"run failed", nil, registryError(http.StatusForbidden), false, exitCodeAuth},
+		{"run failed internally", nil, errors.New("unexpected"), false, exitCodeOther},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := exitCode(tc.results, tc.err, tc.failOnSkip); got != tc.want {
+				t.Errorf("Expected exit code %d, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestKeepForResume(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"built", nil, false},
+		{"skipped nothing to index", errImageNothingToIndex, false},
+		{"skipped unsupported platform", errImageUnsupportedPlatform, false},
+		{"skipped deleted", errImageDeleted, false},
+		{"network", fmt.Errorf("Couldn't pull: %w", syscall.ECONNRESET), true},
+		{"disk", errInsufficientDiskSpace, true},
+		{"corrupted pull", fmt.Errorf("%w: Layer sha256:bb has digest sha256:cc and 5 bytes, expected 5 bytes", registryutils.ErrContentVerification), false},
+		{"other image pulled", fmt.Errorf("%w: manifest sha256:aa was pulled for image sha256:bb", registryutils.ErrImageMismatch), false},
+		{"invalid manifest", fmt.Errorf("%w: empty config media type", registryutils.ErrInvalidImageManifest), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := keepForResume(tc.err); got != tc.want {
+				t.Errorf("Expected keepForResume(%v) to be %v, got %v", tc.err, tc.want, got)
+			}
+		})
+	}
+}
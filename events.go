@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	registryutils "github.com/tmokmss/soci-wrapper/utils/registry"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Source and detail type of the events put to --emit-event-bus
+const (
+	eventSource               = "soci-wrapper"
+	eventDetailTypeIndexBuilt = "SOCI Index Built"
+)
+
+// Detail of the event put for each pushed SOCI index
+type indexBuiltEvent struct {
+	Repository  string `json:"repository"`
+	ImageDigest string `json:"imageDigest"`
+	IndexDigest string `json:"indexDigest"`
+	// Platform of the image manifest the SOCI index is for, only set for multi-platform images
+	Platform    string  `json:"platform,omitempty"`
+	SociVersion string  `json:"sociVersion"`
+	Seconds     float64 `json:"durationSeconds"`
+}
+
+// Put an event for each pushed SOCI index to the event bus of opts, in the region of the image unless the bus is an ARN.
+// A failure to put the events is logged without failing the build.
+func emitIndexBuiltEvents(ctx context.Context, region string, opts options, result *buildResult) {
+	if opts.emitEventBus == "" {
+		return
+	}
+	durations := result.Durations
+	details := make([]string, 0, len(result.Indices))
+	for _, index := range result.Indices {
+		detail, err := json.Marshal(indexBuiltEvent{
+			Repository:  result.Repository,
+			ImageDigest: result.Digest,
+			IndexDigest: index.Digest,
+			Platform:    index.Platform,
+			SociVersion: result.SociVersion,
+			Seconds:     durations.total(),
+		})
+		if err != nil {
+			log.Warn(ctx, fmt.Sprintf("Couldn't encode the event: %v", err))
+			return
+		}
+		details = append(details, string(detail))
+	}
+
+	err := registryutils.PutEvents(ctx, region, opts.emitEventBus, eventSource, eventDetailTypeIndexBuilt, details)
+	var awsErr awserr.Error
+	switch {
+	case errors.As(err, &awsErr) && awsErr.Code() == "AccessDeniedException":
+		log.Warn(ctx, fmt.Sprintf("Couldn't put events to %s because events:PutEvents is not allowed on it. Grant it to the IAM role of soci-wrapper: %v", opts.emitEventBus, err))
+	case err != nil:
+		log.Warn(ctx, fmt.Sprintf("Couldn't put events to %s: %v", opts.emitEventBus, err))
+	default:
+		log.Info(ctx, fmt.Sprintf("Put %d events to %s", len(details), opts.emitEventBus))
+	}
+}
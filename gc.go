@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"github.com/tmokmss/soci-wrapper/utils/logctx"
+	registryutils "github.com/tmokmss/soci-wrapper/utils/registry"
+	"os"
+	"strings"
+	"time"
+
+	"oras.land/oras-go/v2/errdef"
+)
+
+// Delete the SOCI indices of an ECR repository whose image no longer exists, e.g. after it was expired by a lifecycle policy
+func gcCommand(args []string) {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	repo := flags.String("repo", "", "Name of the ECR repository")
+	region := flags.String("region", "", "AWS region of the ECR repository. Defaults to the region of the AWS configuration, e.g. $AWS_REGION")
+	account := flags.String("account", "", "AWS account ID of the ECR repository. Defaults to the account of the AWS credentials")
+	fips := flags.Bool("fips", false, "Use the FIPS endpoints of ECR")
+	dryRun := flags.Bool("dry-run", false, "List the orphaned SOCI indices without deleting anything")
+	olderThan := flags.Duration("older-than", 0, "Only delete SOCI indices pushed longer ago than this, e.g. 720h. Every orphaned SOCI index is deleted if 0")
+	awsOptions := awsFlags(flags)
+	proxyUrl := proxyFlag(flags)
+	setRetryOptions := retryFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: soci-wrapper gc --repo REPOSITORY_NAME --region AWS_REGION --account AWS_ACCOUNT [--older-than DURATION] [--dry-run]")
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, args)
+
+	if *repo == "" || *olderThan < 0 || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.TODO()
+	if err := registryutils.ConfigureProxy(ctx, *proxyUrl); err != nil {
+		lambdaError(ctx, "Proxy configuration error", err)
+		os.Exit(1)
+	}
+	if err := registryutils.ConfigureAws(ctx, awsOptions()); err != nil {
+		lambdaError(ctx, "AWS credentials configuration error", err)
+		os.Exit(1)
+	}
+	detectRegionAndAccount(ctx, region, account)
+	if *region == "" || *account == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+	registryUrl := registryutils.BuildEcrRegistryUrl(*region, *account, *fips)
+	ctx = logctx.WithRegistryURL(ctx, registryUrl)
+	ctx = logctx.WithRepositoryName(ctx, *repo)
+
+	var registryOptions registryutils.RegistryOptions
+	setRetryOptions(&registryOptions)
+	registry, err := registryutils.Init(ctx, registryUrl, registryOptions)
+	if err != nil {
+		lambdaError(ctx, "Remote registry initialization error", err)
+		os.Exit(1)
+	}
+
+	orphans, artifacts, err := findOrphanedSociIndices(ctx, registry, registryUrl, *repo, *olderThan)
+	if err != nil {
+		lambdaError(ctx, "Orphaned SOCI index lookup error", err)
+		os.Exit(1)
+	}
+	for _, orphan := range orphans {
+		fmt.Printf("Orphaned SOCI index %s of missing image %s, pushed %s\n", orphan.Digest, orphan.Subject, orphan.Created.UTC().Format(time.RFC3339))
+	}
+	for _, artifact := range artifacts {
+		fmt.Printf("Related artifact %s\n", artifact)
+	}
+	if *dryRun || len(orphans) == 0 {
+		fmt.Printf("Found %d orphaned SOCI indices and %d related artifacts\n", len(orphans), len(artifacts))
+		return
+	}
+
+	// The referrers indices and signatures are deleted first, because ECR does not delete manifests referenced by an image index
+	if err := registryutils.BatchDeleteImages(ctx, registryUrl, *repo, artifacts); err != nil {
+		lambdaError(ctx, "Related artifact deletion error", err)
+		os.Exit(1)
+	}
+	orphanDigests := make([]string, 0, len(orphans))
+	for _, orphan := range orphans {
+		orphanDigests = append(orphanDigests, orphan.Digest)
+	}
+	if err := registryutils.BatchDeleteImages(ctx, registryUrl, *repo, orphanDigests); err != nil {
+		lambdaError(ctx, "Orphaned SOCI index deletion error", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Deleted %d orphaned SOCI indices and %d related artifacts\n", len(orphans), len(artifacts))
+}
+
+// Find the SOCI indices in an ECR repository whose image no longer exists, pushed longer ago than olderThan.
+// Also returns the digests of the artifacts of their missing images to delete with them: the referrers indices
+// of the tag schema, which refer to the SOCI indices, and the cosign signatures of the SOCI indices.
+func findOrphanedSociIndices(ctx context.Context, registry *registryutils.Registry, registryUrl string, repositoryName string, olderThan time.Duration) ([]registryutils.SociIndexInfo, []string, error) {
+	log.Info(ctx, "Listing manifests in the repository")
+	manifests, err := registryutils.ListRepositoryManifests(ctx, registryUrl, repositoryName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	existing := map[string]bool{}
+	taggedDigests := map[string]string{}
+	pushTimes := map[string]time.Time{}
+	var candidates []string
+	cutoff := time.Now().Add(-olderThan)
+	for _, manifest := range manifests {
+		existing[manifest.Digest] = true
+		for _, tag := range manifest.Tags {
+			taggedDigests[tag] = manifest.Digest
+		}
+		pushTimes[manifest.Digest] = manifest.PushedAt
+		if manifest.MayBeSociIndex() && manifest.PushedAt.Before(cutoff) {
+			candidates = append(candidates, manifest.Digest)
+		}
+	}
+	log.Info(ctx, fmt.Sprintf("Found %d possible SOCI indices out of %d manifests", len(candidates), len(manifests)))
+
+	indices, err := registryutils.DescribeRepositorySociIndices(ctx, registryUrl, repositoryName, candidates)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var orphans []registryutils.SociIndexInfo
+	var artifacts []string
+	missingSubjects := map[string]bool{}
+	for _, index := range indices {
+		if index.Subject == "" {
+			continue
+		}
+		// SOCI indices pushed with --output-repo refer to an image in another repository
+		imageRepo := repositoryName
+		if sourceImage, ok := index.Annotations[sourceImageAnnotation]; ok {
+			imageRepo, _, _ = strings.Cut(sourceImage, "@")
+		}
+		if imageRepo == repositoryName && existing[index.Subject] {
+			continue
+		}
+		// The image may have been pushed since the repository was listed
+		_, err := registry.HeadManifest(ctx, imageRepo, index.Subject)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, errdef.ErrNotFound) {
+			return nil, nil, fmt.Errorf("%s@%s: %w", imageRepo, index.Subject, err)
+		}
+
+		index.Created = pushTimes[index.Digest]
+		orphans = append(orphans, index)
+		if signature, ok := taggedDigests[referrersTag(index.Digest)+".sig"]; ok {
+			artifacts = append(artifacts, signature)
+		}
+		if referrersIndex, ok := taggedDigests[referrersTag(index.Subject)]; ok && !missingSubjects[index.Subject] {
+			artifacts = append(artifacts, referrersIndex)
+		}
+		missingSubjects[index.Subject] = true
+	}
+	return orphans, artifacts, nil
+}
+
+// Get the tag of the referrers of a manifest in the tag schema, e.g. sha256-DIGEST
+func referrersTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1)
+}
@@ -0,0 +1,174 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package metrics keeps the counters, gauges and histograms of the builds of a process,
+// and writes them in the Prometheus text exposition format
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Upper bounds of the buckets of the build duration histogram, in seconds
+var durationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+
+// The metrics of the builds of the process
+var (
+	BuildsTotal          = newMetric("soci_wrapper_builds_total", "Number of builds by status", typeCounter, nil, "status")
+	BytesPulledTotal     = newMetric("soci_wrapper_bytes_pulled_total", "Bytes of blobs pulled to build SOCI indices", typeCounter, nil)
+	BytesPushedTotal     = newMetric("soci_wrapper_bytes_pushed_total", "Bytes of blobs pushed, including the ones the registries already had", typeCounter, nil)
+	BuildDurationSeconds = newMetric("soci_wrapper_build_duration_seconds", "Time spent in each phase of the builds", typeHistogram, durationBuckets, "phase")
+	InflightBuilds       = newMetric("soci_wrapper_inflight_builds", "Number of builds in progress", typeGauge, nil)
+	TempDirBytesUsed     = newMetric("soci_wrapper_temp_dir_bytes_used", "Bytes pulled to the temporary directories of the builds in progress", typeGauge, nil)
+)
+
+// Every metric, in the order they are written
+var registered []*Metric
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// A counter, gauge or histogram, with a series for each combination of the values of its labels
+type Metric struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+	labels  []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// The value of a metric for some label values. A histogram has the number of observations in each bucket as well.
+type series struct {
+	labelValues []string
+	value       float64
+	count       uint64
+	buckets     []uint64
+}
+
+func newMetric(name string, help string, kind string, buckets []float64, labels ...string) *Metric {
+	metric := &Metric{name: name, help: help, kind: kind, buckets: buckets, labels: labels, series: map[string]*series{}}
+	registered = append(registered, metric)
+	return metric
+}
+
+// Get the series of the label values, which must be as many as the labels of the metric
+func (metric *Metric) get(labelValues []string) *series {
+	if len(labelValues) != len(metric.labels) {
+		panic(fmt.Sprintf("%s has %d labels, got %d values", metric.name, len(metric.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := metric.series[key]
+	if !ok {
+		s = &series{labelValues: labelValues, buckets: make([]uint64, len(metric.buckets))}
+		metric.series[key] = s
+	}
+	return s
+}
+
+// Add to a counter or a gauge. Counters only go up, so value must not be negative for them.
+func (metric *Metric) Add(value float64, labelValues ...string) {
+	metric.mu.Lock()
+	defer metric.mu.Unlock()
+	metric.get(labelValues).value += value
+}
+
+// Set a gauge
+func (metric *Metric) Set(value float64, labelValues ...string) {
+	metric.mu.Lock()
+	defer metric.mu.Unlock()
+	metric.get(labelValues).value = value
+}
+
+// Add an observation to a histogram
+func (metric *Metric) Observe(value float64, labelValues ...string) {
+	metric.mu.Lock()
+	defer metric.mu.Unlock()
+	s := metric.get(labelValues)
+	s.value += value
+	s.count++
+	for i, bound := range metric.buckets {
+		if value <= bound {
+			s.buckets[i]++
+		}
+	}
+}
+
+// Write every metric in the Prometheus text exposition format
+func Write(w io.Writer) error {
+	buffered := bufio.NewWriter(w)
+	for _, metric := range registered {
+		metric.write(buffered)
+	}
+	return buffered.Flush()
+}
+
+func (metric *Metric) write(w io.Writer) {
+	metric.mu.Lock()
+	defer metric.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+	// Metrics without labels have a single series, written even before it is updated
+	if len(metric.labels) == 0 {
+		metric.get(nil)
+	}
+	keys := make([]string, 0, len(metric.series))
+	for key := range metric.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		s := metric.series[key]
+		labels := formatLabels(metric.labels, s.labelValues)
+		if metric.kind != typeHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", metric.name, labels, formatValue(s.value))
+			continue
+		}
+		for i, bound := range metric.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", metric.name, formatLabels(append(slices.Clone(metric.labels), "le"), append(slices.Clone(s.labelValues), formatValue(bound))), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", metric.name, formatLabels(append(slices.Clone(metric.labels), "le"), append(slices.Clone(s.labelValues), "+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", metric.name, labels, formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", metric.name, labels, s.count)
+	}
+}
+
+// Format label pairs as {name="value",...}, or "" if there are none
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for i, name := range names {
+		pairs[i] = name + `="` + replacer.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Serve the metrics to Prometheus scrapes
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w)
+	})
+}
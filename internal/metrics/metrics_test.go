@@ -0,0 +1,44 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	BuildsTotal.Add(1, "succeeded")
+	BuildsTotal.Add(1, "succeeded")
+	BuildsTotal.Add(1, `fai"led`)
+	BytesPulledTotal.Add(1 << 30)
+	InflightBuilds.Add(1)
+	BuildDurationSeconds.Observe(3, "pull")
+	BuildDurationSeconds.Observe(45, "pull")
+
+	var out strings.Builder
+	if err := Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE soci_wrapper_builds_total counter",
+		`soci_wrapper_builds_total{status="succeeded"} 2`,
+		`soci_wrapper_builds_total{status="fai\"led"} 1`,
+		"soci_wrapper_bytes_pulled_total 1.073741824e+09",
+		"soci_wrapper_bytes_pushed_total 0",
+		"# TYPE soci_wrapper_inflight_builds gauge",
+		"soci_wrapper_inflight_builds 1",
+		"# TYPE soci_wrapper_build_duration_seconds histogram",
+		`soci_wrapper_build_duration_seconds_bucket{phase="pull",le="1"} 0`,
+		`soci_wrapper_build_duration_seconds_bucket{phase="pull",le="5"} 1`,
+		`soci_wrapper_build_duration_seconds_bucket{phase="pull",le="60"} 2`,
+		`soci_wrapper_build_duration_seconds_bucket{phase="pull",le="+Inf"} 2`,
+		`soci_wrapper_build_duration_seconds_sum{phase="pull"} 48`,
+		`soci_wrapper_build_duration_seconds_count{phase="pull"} 2`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("Expected the line %s, got:\n%s", line, out.String())
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Returned by process when the run was stopped by SIGINT or SIGTERM
+var errInterrupted = errors.New("Run interrupted")
+
+// How long an interrupted run waits for the images in progress to stop and remove their temporary directories
+const interruptGracePeriod = 10 * time.Second
+
+// Temporary directories of the images in progress, removed when the run is interrupted before they are cleaned up
+var tempDirs = struct {
+	sync.Mutex
+	dirs map[string]bool
+}{dirs: map[string]bool{}}
+
+// Remove dir if the run is interrupted, until the returned function is called once it is cleaned up
+func trackTempDir(dir string) func() {
+	tempDirs.Lock()
+	defer tempDirs.Unlock()
+	tempDirs.dirs[dir] = true
+	return func() {
+		tempDirs.Lock()
+		defer tempDirs.Unlock()
+		delete(tempDirs.dirs, dir)
+	}
+}
+
+// Remove the temporary directories of the images in progress
+func removeTempDirs(ctx context.Context) {
+	tempDirs.Lock()
+	defer tempDirs.Unlock()
+	for dir := range tempDirs.dirs {
+		cleanUp(ctx, dir)
+	}
+}
+
+// Cancel the returned context with errInterrupted on the first SIGINT or SIGTERM, so that the images in progress stop and clean up.
+// On a second signal, or if the run has not stopped within interruptGracePeriod, the temporary directories are removed
+// and the process exits with exitCodeInterrupted. The returned function stops handling signals and must be called once the run stopped.
+func handleInterrupts(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Warn(ctx, fmt.Sprintf("Received %s, stopping the images in progress. Send it again to exit immediately", sig))
+			cancel(errInterrupted)
+		case <-done:
+			return
+		}
+		select {
+		case sig := <-signals:
+			log.Warn(ctx, fmt.Sprintf("Received %s again, exiting immediately", sig))
+		case <-time.After(interruptGracePeriod):
+			log.Warn(ctx, fmt.Sprintf("The images in progress did not stop within %s, exiting", interruptGracePeriod))
+		case <-done:
+			return
+		}
+		removeTempDirs(ctx)
+		os.Exit(exitCodeInterrupted)
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// Whether the run of a context returned by handleInterrupts was interrupted
+func interrupted(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errInterrupted)
+}
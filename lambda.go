@@ -0,0 +1,210 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"github.com/tmokmss/soci-wrapper/utils/logctx"
+	registryutils "github.com/tmokmss/soci-wrapper/utils/registry"
+	"github.com/tmokmss/soci-wrapper/utils/tracing"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambda/messages"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// Time left to clean up and respond after a build is canceled by the deadline of the invocation
+const lambdaCleanupMargin = 10 * time.Second
+
+// The response of the Lambda function, so that Step Functions Choice states can route on $.status
+type lambdaResult struct {
+	// Either outcomeBuilt, outcomeSkippedValidation, outcomeSkippedExisting, outcomeSkippedNothingToIndex, outcomeSkippedUnsupportedPlatform, outcomeSkippedImageDeleted or outcomeFailed
+	Status       string   `json:"status"`
+	Repository   string   `json:"repository"`
+	ImageDigest  string   `json:"imageDigest,omitempty"`
+	IndexDigests []string `json:"indexDigests"`
+	// Code of the failed step, such as ImagePullError
+	ErrorCode string `json:"errorCode,omitempty"`
+	// Category of the error, such as network, and whether retrying may help
+	ErrorCategory string `json:"errorCategory,omitempty"`
+	Retryable     bool   `json:"retryable"`
+	Message       string `json:"message"`
+}
+
+func newLambdaResult(build *buildResult) *lambdaResult {
+	result := &lambdaResult{
+		Status:       build.Outcome,
+		Repository:   build.Repository,
+		ImageDigest:  build.Digest,
+		IndexDigests: []string{},
+		Message:      build.Message,
+	}
+	for _, index := range build.Indices {
+		result.IndexDigests = append(result.IndexDigests, index.Digest)
+	}
+	if build.Error != nil {
+		result.ErrorCode = build.Error.Code
+		result.ErrorCategory = build.Error.Category
+		result.Retryable = build.Error.Retryable
+	}
+	return result
+}
+
+// Serve ECR push events as a Lambda function with aws-lambda-go.
+// Never returns, as the Lambda environment is frozen or shut down between invocations.
+func lambdaMain() {
+	// A function failing to initialize exits, and Lambda reports its log lines along with Runtime.ExitError
+	if err := configureLogLevel("", false); err != nil {
+		lambdaError(context.TODO(), "Log level configuration error", err)
+	}
+	if err := registryutils.ConfigureAws(context.TODO(), registryutils.AwsOptions{}); err != nil {
+		lambdaError(context.TODO(), "AWS credentials configuration error", err)
+		os.Exit(1)
+	}
+	metrics, err := lambdaMetrics()
+	if err != nil {
+		lambdaError(context.TODO(), "Metrics configuration error", err)
+		os.Exit(1)
+	}
+	if maxMemory := lambdaMemorySize(); maxMemory > 0 {
+		log.Info(context.TODO(), fmt.Sprintf("Decompressing up to %d layers at once within %d bytes of memory", registryutils.LimitMemory(maxMemory), maxMemory))
+	}
+
+	lambda.Start(func(ctx context.Context, payload json.RawMessage) (*lambdaResult, error) {
+		return handleLambdaInvocation(ctx, payload, metrics)
+	})
+}
+
+// Handle an invocation of the function, with the request id and the X-Ray trace header set by aws-lambda-go.
+// The error fails the invocation with its error type.
+func handleLambdaInvocation(ctx context.Context, payload []byte, metrics string) (*lambdaResult, error) {
+	if lambdaContext, ok := lambdacontext.FromContext(ctx); ok {
+		ctx = logctx.WithRequestId(ctx, lambdaContext.AwsRequestID)
+	}
+	// The spans of the invocation join the X-Ray trace of the service that invoked the function
+	if traceHeader, ok := ctx.Value("x-amzn-trace-id").(string); ok {
+		ctx = tracing.ContextWithXrayTraceHeader(ctx, traceHeader)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		// The build is canceled early enough to remove its temporary directory and report the failure before Lambda stops the function
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-lambdaCleanupMargin))
+		defer cancel()
+	}
+	result, errorType, err := handleLambdaEvent(ctx, payload, metrics)
+	if err != nil {
+		return nil, messages.InvokeResponse_Error{Message: err.Error(), Type: errorType}
+	}
+	return result, nil
+}
+
+// Handle either an EventBridge ECR Image Action event, or a build request invoking the function directly,
+// e.g. from Step Functions, in the same format as the messages of serve-sqs.
+// Metrics are emitted as configured by lambdaMetrics.
+// Returns the outcome of the build, or the error type and the error to fail the invocation with.
+func handleLambdaEvent(ctx context.Context, payload []byte, metrics string) (*lambdaResult, string, error) {
+	var event events.ECRImageActionEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, "EventParseError", err
+	}
+	if event.Source == "" {
+		return handleLambdaBuildRequest(ctx, payload, metrics), "", nil
+	}
+	if event.Source != "aws.ecr" || event.DetailType != "ECR Image Action" {
+		return nil, "UnsupportedEventError", fmt.Errorf("Expected an ECR Image Action event, got %s from %s", event.DetailType, event.Source)
+	}
+	detail := event.Detail
+	// Failed pushes and deletions are ignored rather than retried
+	if detail.ActionType != "PUSH" || detail.Result != "SUCCESS" {
+		msg := fmt.Sprintf("Ignoring %s %s of %s@%s", detail.Result, detail.ActionType, detail.RepositoryName, detail.ImageDigest)
+		log.Info(ctx, msg)
+		return &lambdaResult{Status: outcomeSkippedValidation, Repository: detail.RepositoryName, ImageDigest: detail.ImageDigest, IndexDigests: []string{}, Message: msg}, "", nil
+	}
+
+	build, err := buildLambdaImage(ctx, event.Region, event.Account, detail.RepositoryName, detail.ImageDigest, metrics)
+	if err != nil {
+		// Failing the invocation lets EventBridge retry the event and send it to the dead-letter queue.
+		// The error type is prefixed by the category of the error, e.g. network.ImagePullError
+		return nil, build.Error.Category + "." + build.Error.Code, err
+	}
+	return newLambdaResult(build), "", nil
+}
+
+// Handle a build request invoking the function directly.
+// Failures are returned as a result with the outcomeFailed status rather than failing the invocation,
+// so that the caller can branch on them.
+func handleLambdaBuildRequest(ctx context.Context, payload []byte, metrics string) *lambdaResult {
+	var request queuedBuildRequest
+	err := json.Unmarshal(payload, &request)
+	if err == nil {
+		err = request.validate()
+	}
+	if err != nil {
+		lambdaError(ctx, "Invalid build request", err)
+		return &lambdaResult{Status: outcomeFailed, Repository: request.Repo, ImageDigest: request.Digest, IndexDigests: []string{}, ErrorCode: "InvalidBuildRequest", ErrorCategory: errorCategoryValidation, Message: err.Error()}
+	}
+	build, _ := buildLambdaImage(ctx, request.Region, request.Account, request.Repo, request.Digest, metrics)
+	return newLambdaResult(build)
+}
+
+// Build and push the SOCI index of an image in ECR with the default options.
+// Images that already have a SOCI index are skipped, so that retries do not build them again.
+func buildLambdaImage(ctx context.Context, region string, account string, repo string, digest string, metrics string) (*buildResult, error) {
+	registryUrl := registryutils.BuildEcrRegistryUrl(region, account, false)
+	ref := imageReference{registryUrl: registryUrl, account: account, region: region, repo: repo, digest: digest}
+	opts := defaultOptions()
+	opts.skipExisting = true
+	opts.output = outputJson
+	// EMF lines printed to stdout are turned into metrics by CloudWatch Logs
+	opts.metrics = metrics
+	opts.metricsNamespace = cmp.Or(os.Getenv("METRICS_NAMESPACE"), defaultMetricsNamespace)
+	opts.metricsOutput = os.Stdout
+	opts.maxMemory = lambdaMemorySize()
+	results, err := process(ctx, registryUrl, nil, listImages([]imageReference{ref}), opts)
+	if err == nil && len(results) != 1 {
+		err = errors.New("The image was not processed")
+	}
+	if err != nil {
+		msg := "Remote registry initialization error"
+		build := &buildResult{
+			Outcome:     outcomeFailed,
+			Repository:  repo,
+			Digest:      digest,
+			SociVersion: sociVersion,
+			Message:     msg,
+			Error:       newBuildError(msg, err),
+		}
+		emitMetrics(ctx, region, opts, build)
+		return build, err
+	}
+	if results[0].failed() {
+		return results[0].build, results[0].err
+	}
+	return results[0].build, nil
+}
+
+// Get how to emit the metrics of each build from the METRICS environment variable, either metricsNone,
+// metricsCloudWatchEmf or metricsCloudWatchApi. metricsStdout is not supported since the function never exits
+func lambdaMetrics() (string, error) {
+	metrics := cmp.Or(os.Getenv("METRICS"), metricsNone)
+	if metrics != metricsNone && metrics != metricsCloudWatchEmf && metrics != metricsCloudWatchApi {
+		return "", fmt.Errorf("METRICS must be either %s, %s or %s, got %q", metricsNone, metricsCloudWatchEmf, metricsCloudWatchApi, metrics)
+	}
+	return metrics, nil
+}
+
+// Get the memory configured for the function in bytes, or 0 if unknown
+func lambdaMemorySize() int64 {
+	megabytes, err := strconv.ParseInt(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return megabytes << 20
+}
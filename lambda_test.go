@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/lambda/messages"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+func TestHandleLambdaInvocation(t *testing.T) {
+	ctx := lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{AwsRequestID: "c0ffee"})
+	for _, tc := range []struct {
+		name    string
+		payload string
+		// Expected status of the result, or error type of the failed invocation
+		status    string
+		errorType string
+	}{
+		{"unparsable", `[]`, "", "EventParseError"},
+		{"other event", `{"source": "aws.s3", "detail-type": "Object Created"}`, "", "UnsupportedEventError"},
+		{"failed push", `{"source": "aws.ecr", "detail-type": "ECR Image Action", "detail": {"action-type": "PUSH", "result": "FAILURE", "repository-name": "repo"}}`, outcomeSkippedValidation, ""},
+		{"deletion", `{"source": "aws.ecr", "detail-type": "ECR Image Action", "detail": {"action-type": "DELETE", "result": "SUCCESS", "repository-name": "repo"}}`, outcomeSkippedValidation, ""},
+		{"invalid build request", `{"repo": "repo"}`, outcomeFailed, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := handleLambdaInvocation(ctx, []byte(tc.payload), metricsNone)
+			var invokeErr messages.InvokeResponse_Error
+			if tc.errorType != "" {
+				if !errors.As(err, &invokeErr) || invokeErr.Type != tc.errorType {
+					t.Fatalf("Expected the invocation to fail with %s, got %v", tc.errorType, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Status != tc.status {
+				t.Errorf("Expected the status %s, got %s", tc.status, result.Status)
+			}
+		})
+	}
+}
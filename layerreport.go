@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/pkg/builder"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Formats of --layer-report
+const (
+	layerReportJson = "json"
+	layerReportCsv  = "csv"
+)
+
+// A layer of an indexed image manifest in --layer-report
+type layerReportRow struct {
+	Repository  string `json:"repository"`
+	ImageDigest string `json:"imageDigest"`
+	Platform    string `json:"platform,omitempty"`
+	IndexDigest string `json:"indexDigest"`
+	builder.LayerResult
+}
+
+// List the layers of every SOCI index built in the run, from what was recorded while their ztocs were built
+func layerReportRows(results []imageResult) []layerReportRow {
+	rows := []layerReportRow{}
+	for _, result := range results {
+		if result.build == nil {
+			continue
+		}
+		for _, index := range result.build.Indices {
+			for _, layer := range index.layers {
+				rows = append(rows, layerReportRow{result.build.Repository, result.build.Digest, index.Platform, index.Digest, layer})
+			}
+		}
+	}
+	return rows
+}
+
+// Write the layers of every SOCI index built in the run in a format, either layerReportJson or layerReportCsv
+func writeLayerReport(w io.Writer, format string, results []imageResult) error {
+	rows := layerReportRows(results)
+	if format == layerReportJson {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(struct {
+			Layers []layerReportRow `json:"layers"`
+		}{rows})
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"repository", "imageDigest", "platform", "indexDigest", "layerDigest", "mediaType", "size", "ztocDigest", "ztocSize", "spans", "buildSeconds", "skipReason"})
+	for _, row := range rows {
+		writer.Write([]string{
+			row.Repository, row.ImageDigest, row.Platform, row.IndexDigest, row.Digest, row.MediaType,
+			strconv.FormatInt(row.Size, 10), row.ZtocDigest, strconv.FormatInt(row.ZtocSize, 10), strconv.Itoa(row.Spans),
+			strconv.FormatFloat(row.BuildSeconds, 'f', 3, 64), row.SkipReason,
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// Write the layer report to a file, or to stdout if path is empty
+func writeLayerReportFile(path string, format string, results []imageResult) error {
+	if path == "" {
+		return writeLayerReport(os.Stdout, format, results)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeLayerReport(file, format, results); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("Couldn't write %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/logctx"
+	registryutils "github.com/tmokmss/soci-wrapper/utils/registry"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// A SOCI index printed by the list subcommand
+type listEntry struct {
+	Digest      string     `json:"digest"`
+	SociVersion string     `json:"sociVersion"`
+	Created     *time.Time `json:"created,omitempty"`
+	Size        int64      `json:"size"`
+	Image       string     `json:"image,omitempty"`
+}
+
+// List the SOCI indices of an image, or of a whole ECR repository, as a table or JSON
+func listCommand(args []string) {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	repo := flags.String("repo", "", "Name of the repository")
+	digest := flags.String("digest", "", "Digest of the image to list the SOCI indices of. Every SOCI index in the repository is listed if omitted, which requires ECR")
+	region := flags.String("region", "", "AWS region of the ECR repository. Defaults to the region of the AWS configuration, e.g. $AWS_REGION")
+	account := flags.String("account", "", "AWS account ID of the ECR repository. Defaults to the account of the AWS credentials")
+	fips := flags.Bool("fips", false, "Use the FIPS endpoints of ECR")
+	registryHost := flags.String("registry", "", "Hostname of an OCI registry to use instead of ECR, e.g. harbor.example.com")
+	username := flags.String("username", "", "Username for --registry. Defaults to the "+registryutils.RegistryUsernameEnv+" environment variable or the docker config file")
+	password := flags.String("password", "", "Password for --registry. Defaults to the "+registryutils.RegistryPasswordEnv+" environment variable or the docker config file")
+	dockerConfig := flags.String("docker-config", "", "Path of the docker config file to read registry credentials from. Defaults to $DOCKER_CONFIG/config.json or ~/.docker/config.json")
+	plainHttp := flags.Bool("plain-http", false, "Connect to the registry over plain HTTP, e.g. for a local test registry")
+	caCert := flags.String("ca-cert", "", "PEM bundle of CA certificates to trust in addition to the system ones when connecting to the registry")
+	output := flags.String("output", outputText, "Format of the list printed to stdout, either text or json")
+	awsOptions := awsFlags(flags)
+	proxyUrl := proxyFlag(flags)
+	setRetryOptions := retryFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: soci-wrapper list --repo REPOSITORY_NAME [--digest IMAGE_DIGEST] --region AWS_REGION --account AWS_ACCOUNT [--output json]")
+		fmt.Fprintln(flags.Output(), "       soci-wrapper list --repo REPOSITORY_NAME --digest IMAGE_DIGEST --registry REGISTRY [--output json]")
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, args)
+
+	if *repo == "" || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *output != outputText && *output != outputJson {
+		fmt.Fprintf(flags.Output(), "--output must be either %s or %s\n", outputText, outputJson)
+		os.Exit(1)
+	}
+	isEcr := *registryHost == ""
+	if *digest == "" && !isEcr {
+		fmt.Fprintln(flags.Output(), "Listing every SOCI index in a repository requires ECR, pass --digest with --registry")
+		os.Exit(1)
+	}
+
+	ctx := context.TODO()
+	if err := registryutils.ConfigureProxy(ctx, *proxyUrl); err != nil {
+		lambdaError(ctx, "Proxy configuration error", err)
+		os.Exit(1)
+	}
+	if err := registryutils.ConfigureAws(ctx, awsOptions()); err != nil {
+		lambdaError(ctx, "AWS credentials configuration error", err)
+		os.Exit(1)
+	}
+	if isEcr {
+		detectRegionAndAccount(ctx, region, account)
+	}
+	registryUrl, ok := registryUrlFromFlags(*registryHost, *region, *account, *fips)
+	if !ok {
+		flags.Usage()
+		os.Exit(1)
+	}
+	ctx = logctx.WithRegistryURL(ctx, registryUrl)
+	repositoryName := registryutils.NormalizeRepositoryName(registryUrl, *repo)
+	ctx = logctx.WithRepositoryName(ctx, repositoryName)
+
+	registryOptions := registryutils.RegistryOptions{
+		Credential:       auth.Credential{Username: *username, Password: *password},
+		DockerConfigFile: *dockerConfig,
+		PlainHttp:        *plainHttp,
+		CaCertFile:       *caCert,
+	}
+	setRetryOptions(&registryOptions)
+	registry, err := registryutils.Init(ctx, registryUrl, registryOptions)
+	if err != nil {
+		lambdaError(ctx, "Remote registry initialization error", err)
+		os.Exit(1)
+	}
+
+	entries, err := listSociIndices(ctx, registry, registryUrl, repositoryName, *digest, isEcr)
+	if err != nil {
+		lambdaError(ctx, "SOCI index list error", err)
+		os.Exit(1)
+	}
+
+	if *output == outputJson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(struct {
+			Repository string      `json:"repository"`
+			Indices    []listEntry `json:"indices"`
+		}{repositoryName, entries})
+	} else {
+		err = printListTable(entries)
+	}
+	if err != nil {
+		lambdaError(ctx, "Output write error", err)
+		os.Exit(1)
+	}
+}
+
+// Describe the SOCI indices of an image, or of the whole repository if digest is empty, oldest first
+func listSociIndices(ctx context.Context, registry *registryutils.Registry, registryUrl string, repositoryName string, digest string, isEcr bool) ([]listEntry, error) {
+	var candidates []registryutils.SociIndexInfo
+	if digest != "" {
+		descs, err := registry.ListImageSociIndices(ctx, repositoryName, digest)
+		if err != nil {
+			return nil, err
+		}
+		for _, desc := range descs {
+			candidates = append(candidates, registryutils.SociIndexInfo{Digest: desc.Digest.String()})
+		}
+	} else {
+		var err error
+		candidates, err = registryutils.ListRepositorySociIndices(ctx, registryUrl, repositoryName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var indices []registryutils.SociIndexInfo
+	var unknownTimes []string
+	for _, candidate := range candidates {
+		info, err := registry.DescribeSociIndex(ctx, repositoryName, candidate.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", candidate.Digest, err)
+		}
+		// Artifacts with an empty config may be something else than a SOCI index
+		if info == nil {
+			continue
+		}
+		if !candidate.Created.IsZero() {
+			info.Created = candidate.Created
+		} else if isEcr {
+			unknownTimes = append(unknownTimes, info.Digest)
+		}
+		indices = append(indices, *info)
+	}
+
+	// ECR tells when the SOCI indices found as referrers were pushed
+	if len(unknownTimes) > 0 {
+		pushTimes, err := registryutils.GetImagePushTimes(ctx, registryUrl, repositoryName, unknownTimes)
+		if err != nil {
+			return nil, err
+		}
+		for i := range indices {
+			if pushTime, ok := pushTimes[indices[i].Digest]; ok {
+				indices[i].Created = pushTime
+			}
+		}
+	}
+
+	sort.SliceStable(indices, func(i, j int) bool {
+		return indices[i].Created.Before(indices[j].Created)
+	})
+	entries := []listEntry{}
+	for _, index := range indices {
+		entry := listEntry{
+			Digest:      index.Digest,
+			SociVersion: index.SociVersion,
+			Size:        index.Size,
+			Image:       index.Subject,
+		}
+		if !index.Created.IsZero() {
+			created := index.Created.UTC()
+			entry.Created = &created
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Print SOCI indices as a table
+func printListTable(entries []listEntry) error {
+	if len(entries) == 0 {
+		fmt.Println("No SOCI indices found")
+		return nil
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "DIGEST\tVERSION\tCREATED\tSIZE\tIMAGE")
+	for _, entry := range entries {
+		created := "-"
+		if entry.Created != nil {
+			created = entry.Created.Format(time.RFC3339)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%s\n", entry.Digest, entry.SociVersion, created, entry.Size, entry.Image)
+	}
+	return writer.Flush()
+}
@@ -1,53 +1,123 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"flag"
 	"fmt"
+	"io"
+	"maps"
+	"net/url"
 	"os"
-	"sort"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"errors"
+	metricsutils "github.com/tmokmss/soci-wrapper/internal/metrics"
+	"github.com/tmokmss/soci-wrapper/pkg/builder"
+	"github.com/tmokmss/soci-wrapper/utils/fs"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"github.com/tmokmss/soci-wrapper/utils/logctx"
+	registryutils "github.com/tmokmss/soci-wrapper/utils/registry"
+	"github.com/tmokmss/soci-wrapper/utils/tracing"
+	"github.com/tmokmss/soci-wrapper/utils/version"
 	"path"
-	"soci-wrapper/utils/fs"
-	"soci-wrapper/utils/log"
-	registryutils "soci-wrapper/utils/registry"
+	"slices"
 
 	"github.com/containerd/containerd/images"
+	"oras.land/oras-go/v2"
+	orascontent "oras.land/oras-go/v2/content"
 	"oras.land/oras-go/v2/content/oci"
+	orasregistry "oras.land/oras-go/v2/registry"
+	"oras.land/oras-go/v2/registry/remote/auth"
 
-	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/awslabs/soci-snapshotter/soci/store"
-	"github.com/containerd/containerd/content"
-	"github.com/containerd/containerd/content/local"
 	"github.com/containerd/containerd/platforms"
 
+	"github.com/google/uuid"
+	godigest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-const artifactsStoreName = "store"
-const artifactsDbName = "artifacts.db"
+// Annotation on SOCI indices pushed to another repository than their image, pointing back to the image as REPOSITORY@DIGEST
+const sourceImageAnnotation = "io.github.tmokmss.soci-wrapper.source-image"
 
-// Returns ecr registry url from an image action event
-func buildEcrRegistryUrl(region string, account string) string {
-	var awsDomain = ".amazonaws.com"
-	if strings.HasPrefix(region, "cn") {
-		awsDomain = ".amazonaws.com.cn"
+// Values of --source
+const (
+	sourceRegistry   = "registry"
+	sourceContainerd = "containerd"
+)
+
+// Directory in the data directory where layers are written while they are pulled with --resume
+const partialLayersDirName = "partial"
+
+// Directory in --work-dir where the data directories of the images are kept with --resume by default
+const defaultResumeDirName = "soci-wrapper-resume"
+
+// Identifies this run in the log lines and the names of the temporary directories.
+// In Lambda mode, the request id of each invocation is used instead.
+var runId = uuid.NewString()
+
+// Names of the temporary directories created by createTempDir: the id of the run or the Lambda's request id, then a random number
+var tempDirPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}-[0-9]+$`)
+
+// Remove the temporary directories left in dir by runs that stopped more than olderThan ago without cleaning up, e.g. killed ones.
+// Directories locked by running processes are left alone. Nothing is removed if olderThan is 0, and errors are only logged.
+func removeStaleTempDirs(ctx context.Context, dir string, olderThan time.Duration) {
+	if olderThan <= 0 {
+		return
+	}
+	removed, err := fs.RemoveStaleDirs(dir, tempDirPattern, olderThan)
+	for _, staleDir := range removed {
+		log.Info(ctx, fmt.Sprintf("Removed %s, left by a previous run", staleDir))
+	}
+	if err != nil {
+		log.Warn(ctx, fmt.Sprintf("Couldn't remove the directories left by previous runs: %v", err))
 	}
-	return account + ".dkr.ecr." + region + awsDomain
 }
 
-// Create a temp directory in /tmp
-// The directory is prefixed by the Lambda's request id
-func createTempDir(ctx context.Context) (string, error) {
+// Create a temp directory in dir, e.g. /tmp
+// The directory is prefixed by the Lambda's request id, or the id of the run
+func createTempDir(ctx context.Context, dir string) (string, error) {
 	// free space in bytes
-	freeSpace := fs.CalculateFreeSpace("/tmp")
-	log.Info(ctx, fmt.Sprintf("There are %d bytes of free space in /tmp directory", freeSpace))
+	freeSpace := fs.CalculateFreeSpace(dir)
+	log.Info(ctx, fmt.Sprintf("There are %d bytes of free space in %s directory", freeSpace, dir))
 	log.Info(ctx, "Creating a directory to store images and SOCI artifacts")
-	tempDir, err := os.MkdirTemp("/tmp", "TODO") // The temp dir name is prefixed by the request id
+	prefix := runId + "-"
+	if requestId := logctx.RequestIdFrom(ctx); requestId != "" {
+		prefix = requestId + "-"
+	}
+	tempDir, err := os.MkdirTemp(dir, prefix)
 	return tempDir, err
 }
 
+// Get the directory in resumeDir to store an image and its SOCI artifacts, named after the image digest,
+// creating it unless a previous run left it there
+func createResumeDir(ctx context.Context, resumeDir string, digest string) (string, error) {
+	dataDir := resumeDataDir(resumeDir, digest)
+	if _, err := os.Stat(dataDir); err == nil {
+		log.Info(ctx, fmt.Sprintf("Resuming from %s, left by a previous run", dataDir))
+		return dataDir, nil
+	}
+	return dataDir, os.MkdirAll(dataDir, 0755)
+}
+
+// Check if the data of an image is kept in --resume-dir after it failed with err, for a retry to resume from.
+// Skipped images are not retried, failures that are not retryable would fail the same way again,
+// and content that failed verification would be resumed from as is.
+func keepForResume(err error) bool {
+	return err != nil && !errors.Is(err, errImageSkipped) && !errors.Is(err, registryutils.ErrContentVerification) && isRetryable(errorCategory(err))
+}
+
+// The directory in resumeDir where an image and its SOCI artifacts are stored
+func resumeDataDir(resumeDir string, digest string) string {
+	return path.Join(resumeDir, strings.ReplaceAll(digest, ":", "-"))
+}
+
 // Clean up the data written by the Lambda
 func cleanUp(ctx context.Context, dataDir string) {
 	log.Info(ctx, fmt.Sprintf("Removing all files in %s", dataDir))
@@ -56,152 +126,1759 @@ func cleanUp(ctx context.Context, dataDir string) {
 	}
 }
 
-// Init containerd store
-func initContainerdStore(dataDir string) (content.Store, error) {
-	containerdStore, err := local.NewStore(path.Join(dataDir, artifactsStoreName))
-	return containerdStore, err
-}
+// Export a SOCI index to an OCI image layout directory and tag it there, so that it can be pushed later,
+// e.g. with oras cp --from-oci-layout. Only the SOCI index and its ztocs are exported, not the image it refers to.
+// The directory is kept when the data directory is cleaned up.
+func exportIndex(ctx context.Context, sociStore *store.SociStore, indexDesc ocispec.Descriptor, exportDir string, tag string) error {
+	log.Info(ctx, fmt.Sprintf("Exporting SOCI index to %s as %s", exportDir, tag))
+	layout, err := oci.NewWithContext(ctx, exportDir)
+	if err != nil {
+		return err
+	}
 
-// Init OCI artifact store
-func initOciStore(ctx context.Context, dataDir string) (*oci.Store, error) {
-	return oci.NewWithContext(ctx, path.Join(dataDir, artifactsStoreName))
+	copyOptions := oras.DefaultCopyGraphOptions
+	copyOptions.FindSuccessors = func(ctx context.Context, fetcher orascontent.Fetcher, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		successors, err := orascontent.Successors(ctx, fetcher, desc)
+		if err != nil {
+			return nil, err
+		}
+		// The subject of the SOCI index is the image
+		return slices.DeleteFunc(successors, func(successor ocispec.Descriptor) bool {
+			return images.IsManifestType(successor.MediaType) || images.IsIndexType(successor.MediaType)
+		}), nil
+	}
+	if err := oras.CopyGraph(ctx, sociStore, layout, indexDesc, copyOptions); err != nil {
+		return err
+	}
+	return layout.Tag(ctx, indexDesc, tag)
 }
 
-// Init SOCI artifact store
-func initSociStore(ctx context.Context, dataDir string) (*store.SociStore, error) {
-	// Note: We are wrapping an *oci.Store in a store.SociStore because soci.WriteSociIndex
-	// expects a store.Store, an interface that extends the oci.Store to provide support
-	// for garbage collection.
-	ociStore, err := oci.NewWithContext(ctx, path.Join(dataDir, artifactsStoreName))
-	return &store.SociStore{ociStore}, err
+// Get the tag of a SOCI index in an exported OCI image layout, e.g. sha256-DIGEST-linux-arm64
+// platformName is empty for a single-platform image
+func exportTag(digest string, platformName string) string {
+	tag := strings.ReplaceAll(digest, ":", "-")
+	if platformName != "" {
+		tag += "-" + strings.ReplaceAll(platformName, "/", "-")
+	}
+	return tag
 }
 
-// Init a new instance of SOCI artifacts DB
-func initSociArtifactsDb(dataDir string) (*soci.ArtifactsDb, error) {
-	artifactsDbPath := path.Join(dataDir, artifactsDbName)
-	artifactsDb, err := soci.NewDB(artifactsDbPath)
-	if err != nil {
-		return nil, err
+// Log and return the lambda handler error
+func lambdaError(ctx context.Context, msg string, err error) (string, error) {
+	if details := registryutils.DescribeError(err); details != nil {
+		ctx = logctx.WithErrorDetails(ctx, details.StatusCode, details.Code, details.RequestId)
+		if details.Hint != "" {
+			ctx = logctx.WithHint(ctx, details.Hint)
+		}
 	}
-	return artifactsDb, nil
+	log.Error(ctx, msg, err)
+	return msg, err
 }
 
-// Build soci index for an aimage and returns its ocispec.Descriptor
-func buildIndex(ctx context.Context, dataDir string, sociStore *store.SociStore, image images.Image) (*ocispec.Descriptor, error) {
-	log.Info(ctx, "Building SOCI index")
-	platform := platforms.DefaultSpec() // TODO: make this a user option
+// An image location parsed from a full image reference
+// account and region are empty for registries other than ECR
+type imageReference struct {
+	registryUrl string
+	account     string
+	region      string
+	repo        string
+	digest      string
+	tag         string
+}
 
-	artifactsDb, err := initSociArtifactsDb(dataDir)
+// Parse a full image reference in either tag or digest form
+// e.g. 123456789012.dkr.ecr.us-east-1.amazonaws.com/myrepo@sha256:... or public.ecr.aws/alias/myrepo:latest
+// References without a registry hostname, e.g. alpine:latest, refer to Docker Hub
+func parseImageReference(image string) (*imageReference, error) {
+	if domain, _, found := strings.Cut(image, "/"); !found || (!strings.ContainsAny(domain, ".:") && domain != "localhost") {
+		image = registryutils.DockerHubRegistryUrl + "/" + image
+	}
+	ref, err := orasregistry.ParseReference(image)
 	if err != nil {
 		return nil, err
 	}
+	account, region, _ := registryutils.ParseEcrRegistryUrl(ref.Registry)
+	if ref.Reference == "" {
+		return nil, fmt.Errorf("%s must include either a tag or a digest", image)
+	}
 
-	containerdStore, err := initContainerdStore(dataDir)
-	if err != nil {
-		return nil, err
+	parsed := &imageReference{
+		registryUrl: ref.Registry,
+		account:     account,
+		region:      region,
+		repo:        registryutils.NormalizeRepositoryName(ref.Registry, ref.Repository),
 	}
+	if _, err := ref.Digest(); err == nil {
+		parsed.digest = ref.Reference
+	} else {
+		parsed.tag = ref.Reference
+	}
+	return parsed, nil
+}
 
-	builder, err := soci.NewIndexBuilder(containerdStore, sociStore, artifactsDb, soci.WithMinLayerSize(0), soci.WithPlatform(platform))
-	if err != nil {
-		return nil, err
+// Resolve the image digest to build an index for.
+// If only a tag is given, the tag is resolved to its manifest digest through the registry.
+// If both are given, the tag must refer to the same manifest as the digest.
+func resolveImageDigest(ctx context.Context, registry *registryutils.Registry, repo string, digest string, tag string) (string, error) {
+	if tag == "" {
+		return digest, nil
 	}
 
-	// Build the SOCI index
-	index, err := builder.Build(ctx, image)
+	descriptor, err := registry.HeadManifest(ctx, repo, tag)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	resolvedDigest := descriptor.Digest.String()
+	log.Info(ctx, fmt.Sprintf("Resolved tag %s to digest %s", tag, resolvedDigest))
 
-	// Write the SOCI index to the OCI store
-	err = soci.WriteSociIndex(ctx, index, sociStore, artifactsDb)
-	if err != nil {
-		return nil, err
+	if digest != "" && digest != resolvedDigest {
+		return "", fmt.Errorf("Tag %s refers to %s, which does not match the given digest %s", tag, resolvedDigest, digest)
 	}
+	return resolvedDigest, nil
+}
 
-	// Get SOCI indices for the image from the OCI store
-	// TODO: consider making soci's WriteSociIndex to return the descriptor directly
-	indexDescriptorInfos, _, err := soci.GetIndexDescriptorCollection(ctx, containerdStore, artifactsDb, image, []ocispec.Platform{platform})
-	if err != nil {
-		return nil, err
+// Check if every image manifest already has a SOCI index in a repository.
+// Only referrers are queried, so no blob is downloaded.
+func hasSociIndices(ctx context.Context, registry *registryutils.Registry, repositoryName string, manifests []string) (bool, error) {
+	for _, manifest := range manifests {
+		exists, err := registry.HasSociIndex(ctx, repositoryName, manifest)
+		if err != nil || !exists {
+			return false, err
+		}
+	}
+	return len(manifests) > 0, nil
+}
+
+// Returned by processImage when the SOCI indices of an image were pushed but could not be signed
+var errSignature = errors.New("SOCI index signature failed")
+
+// Returned by process when the run was stopped by --timeout
+var errTimeout = errors.New("Run timed out")
+
+// Returned by processImage when an image is skipped without building an index.
+// A skipped image is not treated as a failure.
+var errImageSkipped = errors.New("Image skipped")
+
+// Why an image is skipped, wrapping errImageSkipped
+var (
+	errImageInvalid = fmt.Errorf("%w: invalid image manifest", errImageSkipped)
+	errImageIndexed = fmt.Errorf("%w: already indexed", errImageSkipped)
+	// No layer gets a ztoc, e.g. an image FROM scratch with a single small layer
+	errImageNothingToIndex = fmt.Errorf("%w: nothing worth indexing", errImageSkipped)
+	// The image is of a platform soci-snapshotter cannot run, such as Windows
+	errImageUnsupportedPlatform = fmt.Errorf("%w: unsupported platform", errImageSkipped)
+	// The image was deleted since it was validated, e.g. by a lifecycle policy, so it could never be built
+	errImageDeleted = fmt.Errorf("%w: image deleted", errImageSkipped)
+)
+
+// The outcome of building a SOCI index for a single image
+type imageResult struct {
+	reference string
+	message   string
+	err       error
+	build     *buildResult
+}
+
+func (result imageResult) skipped() bool {
+	return errors.Is(result.err, errImageSkipped)
+}
+
+func (result imageResult) failed() bool {
+	return result.err != nil && !result.skipped()
+}
+
+// Returns a printable REPOSITORY@DIGEST or REPOSITORY:TAG form of the image
+func (ref imageReference) String() string {
+	if ref.digest != "" {
+		return ref.repo + "@" + ref.digest
 	}
-	if len(indexDescriptorInfos) == 0 {
-		return nil, errors.New("No SOCI indices found in OCI store")
+	if ref.tag == "" {
+		// The only image of a local source
+		return ref.repo
 	}
-	sort.Slice(indexDescriptorInfos, func(i, j int) bool {
-		return indexDescriptorInfos[i].CreatedAt.Before(indexDescriptorInfos[j].CreatedAt)
-	})
+	return ref.repo + ":" + ref.tag
+}
 
-	return &indexDescriptorInfos[len(indexDescriptorInfos)-1].Descriptor, nil
+// Options applied to every image processed in a run
+type options struct {
+	// Continue with the remaining images when one of them fails
+	keepGoing bool
+	// Number of images processed at once. A single image at a time if 0
+	workers int
+	// Cancel the images in progress when one of them fails
+	failFast bool
+	// Fail images whose manifest is invalid, instead of skipping them
+	strict bool
+	// Exit with exitCodeOther instead of exitCodeSkipped when images were skipped
+	failOnSkip bool
+	// Disk space shared by the images processed at once. Set by process when there are several workers
+	diskBudget *diskBudget
+	// Skip images that already have a SOCI index
+	skipExisting bool
+	// Delete the SOCI indices that already referred to an image once its new SOCI indices have been pushed
+	replaceExisting bool
+	// Only index the images of these platforms. All platforms are indexed if empty
+	platforms []ocispec.Platform
+	// How to connect to the registries
+	registryOptions registryutils.RegistryOptions
+	// Where to push images and SOCI indices to. They are pushed to where images are pulled from if nil
+	destination *destination
+	// Repository to push SOCI indices to, in the destination registry if any. Defaults to the repository of the image
+	outputRepo string
+	// Annotations added to every SOCI index
+	annotations map[string]string
+	// How the layers of each image are indexed
+	index builder.IndexOptions
+	// How to emit the metrics of each build, either metricsNone, metricsCloudWatchEmf, metricsCloudWatchApi or metricsStdout
+	metrics string
+	// CloudWatch namespace of the metrics
+	metricsNamespace string
+	// Where to write the metrics in Embedded Metric Format. Defaults to stderr, since stdout is reserved for the results
+	metricsOutput io.Writer
+	// Format of the results printed to stdout, either outputText or outputJson
+	output string
+	// Path to write the results to as JSON. Not written if empty
+	outputFile string
+	// Directory to export SOCI indices to as an OCI image layout. Not exported if empty
+	exportDir string
+	// Path to package the exported SOCI indices into as a tar file, only if every image succeeded. Not written if empty
+	exportTar string
+	// Temporary OCI image layout the SOCI indices are exported to for exportTar, apart from exportDir
+	// so that the tar only holds the SOCI indices of this run, and exportDir gets no archive metadata
+	exportTarDir string
+	// Only build SOCI indices without pushing anything
+	noPush bool
+	// Skip checking that the pushed SOCI indices are complete in the registry
+	noVerify bool
+	// Skip checking the digests of the pulled manifests and blobs read back from disk before building SOCI indices
+	skipContentVerify bool
+	// Settings to create the repositories SOCI indices and images are pushed to with, unless they exist.
+	// The repositories are not created if nil
+	createRepo *registryutils.RepositorySettings
+	// Build SOCI indices and report them without writing anything to the registries
+	dryRun bool
+	// Keep the directory where each image and its SOCI indices are stored instead of removing it
+	keepTemp bool
+	// Pull only the manifests of images, and fetch their layers one at a time while building their ztocs
+	streamLayers bool
+	// Directory to keep the data directory of each image in until it succeeds, so that the next run resumes its pull.
+	// If empty, a temporary directory is used and removed whether the image succeeds or not
+	resumeDir string
+	// Where the data directory of each image is created, and whether its layers are staged in S3
+	store storeBackend
+	// Memory the process should stay within, capping the number of layers decompressed at once with registryutils.LimitMemory.
+	// Every layer is decompressed at once if 0
+	maxMemory int64
+	// Path to write the digests of the pushed SOCI indices to, only if every image succeeded. Not written if empty
+	digestOutput string
+	// Format of the report of the layers of the built SOCI indices written at the end of the run, or "" for none
+	layerReport string
+	// Path to write the layer report to, or "" for stdout
+	layerReportFile string
+	// SNS topic to publish the results of the run to. Not published if empty
+	notifySnsTopic string
+	// URL to POST the results of the run to. Not posted if empty
+	notifyWebhook string
+	// EventBridge event bus to put an event to for each pushed SOCI index. Not put if empty
+	emitEventBus string
+	// Registries where SOCI indices are pushed as well, e.g. ECR registries in the regions the destination is replicated to.
+	// The images must already exist there
+	replicaRegistryUrls []string
+	// How long to wait for each image to be replicated to the replicas before pushing its SOCI index there.
+	// SOCI indices are pushed right away if 0
+	replicationTimeout time.Duration
+	// Where images are read from instead of being pulled from the registry, if not nil
+	localSource *registryutils.LocalImageSource
+	// Content store of a containerd daemon to copy the blobs of images from instead of pulling them, if not nil.
+	// Unlike with localSource, the tag or digest is still resolved in the registry, and the manifest copied from
+	// containerd is verified against it
+	containerdSource *registryutils.ContainerdImageSource
+	// AWS session to pull images from an ECR source with, when a destination is given.
+	// Images are pulled with the same credentials as they are pushed if nil
+	sourceAwsSession *session.Session
+	// Signs the pushed SOCI indices with cosign signatures. Not signed if nil
+	signer registryutils.Signer
 }
 
-// Log and return the lambda handler error
-func lambdaError(ctx context.Context, msg string, err error) (string, error) {
-	log.Error(ctx, msg, err)
-	return msg, err
+// Options of a run with the defaults of every entry point: build, reindex, serve-sqs and the Lambda function
+func defaultOptions() options {
+	return options{
+		index: builder.IndexOptions{MinLayerSize: builder.DefaultMinLayerSize, SpanSize: builder.DefaultSpanSize},
+	}
+}
+
+// A registry and repository that images are copied to along with their SOCI indices
+type destination struct {
+	registryUrl string
+	repo        string
 }
 
-func process(ctx context.Context, repo string, digest string, region string, account string) (string, error) {
-	registryUrl := buildEcrRegistryUrl(region, account)
-	ctx = context.WithValue(ctx, "RegistryURL", registryUrl)
+// A registry where SOCI indices are pushed in addition to the destination
+// err is set if the registry client couldn't be initialized
+type replicaRegistry struct {
+	registryUrl string
+	registry    *registryutils.Registry
+	err         error
+}
 
-	registry, err := registryutils.Init(ctx, registryUrl)
+// Build and push SOCI indices for every image produced by forEachImage, sharing a single registry client.
+// If registry is nil, the registry client is initialized when the first image is read, so that nothing is done for an empty input.
+// Up to opts.workers images are processed at once. Each result is printed as soon as the image completes,
+// and the results are returned in the order of the images. Unless keepGoing is set, no more images are started after the first failure,
+// and the images in progress are canceled as well with failFast.
+func process(ctx context.Context, registryUrl string, registry *registryutils.Registry, forEachImage func(yield func(imageReference) bool) error, opts options) ([]imageResult, error) {
+	ctx = logctx.WithRegistryURL(ctx, registryUrl)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	workers := make(chan struct{}, max(1, opts.workers))
+	if opts.workers > 1 && opts.diskBudget == nil {
+		opts.diskBudget = newDiskBudget(opts.store.dataDirRoot())
+	}
+
+	var initErr error
+	var destinationRegistry *registryutils.Registry
+	var replicas []replicaRegistry
+	var slots []*imageResult
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := false
+	err := forEachImage(func(ref imageReference) bool {
+		// Wait for a worker before reading whether the images in progress failed
+		workers <- struct{}{}
+		mu.Lock()
+		stop := failed && !opts.keepGoing
+		mu.Unlock()
+		// The remaining images would fail right away once the run has timed out
+		if stop || ctx.Err() != nil {
+			<-workers
+			return false
+		}
+
+		if registry == nil {
+			sourceOptions := opts.registryOptions
+			sourceOptions.AwsSession = opts.sourceAwsSession
+			registry, initErr = registryutils.Init(ctx, registryUrl, sourceOptions)
+			if initErr != nil {
+				lambdaError(ctx, "Remote registry initialization error", initErr)
+				<-workers
+				return false
+			}
+			destinationRegistry = registry
+			// The destination has a registry client of its own if it is another registry, or is accessed with other credentials
+			if opts.destination != nil && (opts.destination.registryUrl != registryUrl || opts.sourceAwsSession != nil) {
+				destinationCtx := logctx.WithDestinationRegistryURL(ctx, opts.destination.registryUrl)
+				destinationRegistry, initErr = registryutils.Init(destinationCtx, opts.destination.registryUrl, opts.registryOptions)
+				if initErr != nil {
+					lambdaError(destinationCtx, "Destination registry initialization error", initErr)
+					<-workers
+					return false
+				}
+			}
+			// A replica failing to initialize fails the push to that replica only
+			for _, replicaUrl := range opts.replicaRegistryUrls {
+				replicaCtx := logctx.WithDestinationRegistryURL(ctx, replicaUrl)
+				replica, err := registryutils.Init(replicaCtx, replicaUrl, opts.registryOptions)
+				if err != nil {
+					lambdaError(replicaCtx, "Replica registry initialization error", err)
+				}
+				replicas = append(replicas, replicaRegistry{registryUrl: replicaUrl, registry: replica, err: err})
+			}
+			if opts.createRepo != nil && !opts.noPush && !opts.dryRun {
+				initErr = ensureRepositories(ctx, destinationRegistry, replicas, opts)
+				if initErr != nil {
+					<-workers
+					return false
+				}
+			}
+		}
+
+		ref.repo = registryutils.NormalizeRepositoryName(registryUrl, ref.repo)
+		slot := new(imageResult)
+		slots = append(slots, slot)
+		wg.Add(1)
+		go func() {
+			defer func() { <-workers; wg.Done() }()
+			build, err := processImage(ctx, registry, destinationRegistry, replicas, ref, opts)
+			*slot = imageResult{ref.String(), build.Message, err, build}
+			mu.Lock()
+			defer mu.Unlock()
+			if opts.output != outputJson {
+				printResult(*slot)
+			}
+			if slot.failed() {
+				failed = true
+				if opts.failFast {
+					cancel()
+				}
+			}
+		}()
+		return true
+	})
+	wg.Wait()
+	results := make([]imageResult, 0, len(slots))
+	for _, slot := range slots {
+		results = append(results, *slot)
+	}
+	if initErr != nil {
+		return results, initErr
+	}
 	if err != nil {
-		return lambdaError(ctx, "Remote registry initialization error", err)
+		log.Error(ctx, "Image list read error", err)
 	}
+	return results, err
+}
+
+// Name the repository a push failed because of, if it does not exist, and how to have it created
+func missingRepositoryError(err error, registryUrl string, repo string) error {
+	if !registryutils.IsRepositoryNotFound(err) {
+		return err
+	}
+	return fmt.Errorf("Repository %s does not exist in %s, create it or pass --create-repo: %w", repo, registryUrl, err)
+}
 
-	err = registry.ValidateImageManifest(ctx, repo, digest)
+// Create the repositories that SOCI indices and images are pushed to, in the destination registry and its replicas, unless they exist.
+// These are --output-repo and the repository images are copied to, since the repositories of the images exist already
+func ensureRepositories(ctx context.Context, destinationRegistry *registryutils.Registry, replicas []replicaRegistry, opts options) error {
+	var repositories []string
+	if opts.destination != nil {
+		repositories = append(repositories, registryutils.NormalizeRepositoryName(opts.destination.registryUrl, opts.destination.repo))
+	}
+	if opts.outputRepo != "" && !slices.Contains(repositories, opts.outputRepo) {
+		repositories = append(repositories, opts.outputRepo)
+	}
+	registries := []*registryutils.Registry{destinationRegistry}
+	for _, replica := range replicas {
+		// A replica failing to initialize fails the push to that replica only
+		if replica.err == nil {
+			registries = append(registries, replica.registry)
+		}
+	}
+	for _, repository := range repositories {
+		for _, registry := range registries {
+			repositoryCtx := logctx.WithRepositoryName(ctx, repository)
+			if _, err := registry.EnsureRepository(repositoryCtx, repository, *opts.createRepo); err != nil {
+				lambdaError(repositoryCtx, "Repository creation error", err)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Build and push a SOCI index for a single image, recording the details of the build in result
+// If a destination is given, the image is copied to destinationRegistry as is before its SOCI index is pushed there.
+// Otherwise destinationRegistry is the same as registry. The SOCI index is pushed to the replicas as well.
+func buildAndPush(ctx context.Context, registry *registryutils.Registry, destinationRegistry *registryutils.Registry, replicas []replicaRegistry, ref imageReference, opts options, result *buildResult) (msg string, err error) {
+	result.startPhase(phaseValidation)
+	repo := ref.repo
+	ctx = logctx.WithRepositoryName(ctx, repo)
+	if ref.tag != "" {
+		ctx = logctx.WithImageTag(ctx, ref.tag)
+	}
+	destinationRepo := repo
+	if opts.destination != nil {
+		destinationRepo = registryutils.NormalizeRepositoryName(opts.destination.registryUrl, opts.destination.repo)
+		ctx = logctx.WithDestinationRegistryURL(ctx, opts.destination.registryUrl)
+		ctx = logctx.WithDestinationRepositoryName(ctx, destinationRepo)
+	}
+	indexRepo := destinationRepo
+	if opts.outputRepo != "" {
+		indexRepo = opts.outputRepo
+		ctx = logctx.WithOutputRepositoryName(ctx, indexRepo)
+	}
+	result.indexRepo = indexRepo
+
+	var digest string
+	if opts.localSource != nil {
+		digest, err = opts.localSource.ResolveImageDigest(ctx, ref.digest, ref.tag)
+	} else {
+		digest, err = resolveImageDigest(ctx, registry, repo, ref.digest, ref.tag)
+	}
 	if err != nil {
-		log.Warn(ctx, fmt.Sprintf("Image manifest validation error: %v", err))
-		// Returning a non error to skip retries
-		return "Exited early due to manifest validation error", nil
+		return lambdaError(ctx, "Image tag resolution error", err)
 	}
+	ctx = logctx.WithImageDigest(ctx, digest)
+	result.Digest = digest
 
+	// A local image is usually pushed to the registry after its SOCI index, so it is not validated there
+	if opts.localSource == nil {
+		_, span := tracing.Start(ctx, "ValidateImageDigest")
+		err = registry.ValidateImageManifest(ctx, repo, digest)
+		tracing.End(span, err)
+		// A run interrupted or timed out during validation did not find the image invalid
+		if err != nil && ctx.Err() != nil {
+			return lambdaError(ctx, "Image manifest validation error", err)
+		}
+		// Images soci-snapshotter cannot run are skipped whether or not --strict is set, since they are valid images
+		if errors.Is(err, registryutils.ErrUnsupportedPlatform) {
+			log.Info(ctx, fmt.Sprintf("Skipping the image: %v", err))
+			return fmt.Sprintf("Skipped: %v", err), errImageUnsupportedPlatform
+		}
+		if err != nil && opts.strict {
+			return lambdaError(ctx, "Image manifest validation error", err)
+		}
+		if err != nil {
+			log.Warn(ctx, fmt.Sprintf("Image manifest validation error: %v", err))
+			// Returning a skip instead of a failure to skip retries
+			return fmt.Sprintf("Exited early due to manifest validation error: %v", err), errImageInvalid
+		}
+	}
+
+	if opts.skipExisting {
+		var manifests []string
+		switch {
+		case opts.localSource != nil:
+			manifests, err = opts.localSource.ImageManifestsToIndex(ctx, digest, opts.platforms)
+		case opts.containerdSource != nil:
+			manifests, err = opts.containerdSource.ImageManifestsToIndex(ctx, digest, opts.platforms)
+		default:
+			manifests, err = registry.ImageManifestsToIndex(ctx, repo, digest, opts.platforms)
+		}
+		if err != nil {
+			return lambdaError(ctx, "Image manifest read error", err)
+		}
+		indexed, err := hasSociIndices(ctx, destinationRegistry, indexRepo, manifests)
+		if err != nil {
+			return lambdaError(ctx, "Existing SOCI index lookup error", err)
+		}
+		if indexed {
+			log.Info(ctx, "Image already indexed, skipping")
+			return "Skipped because the image already has a SOCI index", errImageIndexed
+		}
+	}
+
+	// Fail before pulling anything rather than running out of space in the middle of the pull
+	if opts.localSource == nil && opts.containerdSource == nil {
+		size, largestLayer, err := registry.ImageSize(ctx, repo, digest, opts.platforms)
+		if err != nil {
+			return lambdaError(ctx, "Image size read error", err)
+		}
+		// Streamed layers are on disk one at a time
+		if opts.streamLayers {
+			size = largestLayer
+		}
+		spaceDir := opts.store.dataDirRoot()
+		if opts.resumeDir != "" {
+			// What a previous run pulled is already on disk
+			spaceDir = opts.resumeDir
+			if pulled, err := fs.CalculateDirSize(resumeDataDir(opts.resumeDir, digest)); err == nil {
+				size -= pulled
+			}
+		}
+		if opts.diskBudget != nil {
+			// The images processed at once share the free space
+			release, err := opts.diskBudget.reserve(ctx, uint64(max(0, size)))
+			if err != nil {
+				return lambdaError(ctx, "Insufficient disk space error", err)
+			}
+			defer release()
+		} else if freeSpace := fs.CalculateFreeSpace(spaceDir); size > 0 && uint64(size) > freeSpace {
+			return lambdaError(ctx, "Insufficient disk space error", fmt.Errorf("%w: need %d bytes, have %d bytes", errInsufficientDiskSpace, size, freeSpace))
+		}
+	}
+
+	result.startPhase(phasePull)
 	// Directory in lambda storage to store images and SOCI artifacts
-	dataDir, err := createTempDir(ctx)
+	var dataDir string
+	if opts.resumeDir != "" {
+		dataDir, err = createResumeDir(ctx, opts.resumeDir, digest)
+	} else {
+		dataDir, err = createTempDir(ctx, opts.store.dataDirRoot())
+	}
 	log.Info(ctx, fmt.Sprintf("The path to the dataDir: %s", dataDir))
 	if err != nil {
 		return lambdaError(ctx, "Directory create error", err)
 	}
-	defer cleanUp(ctx, dataDir)
+	// Runs cleaning up the directories left by killed runs leave this one alone while it is locked
+	if opts.resumeDir == "" {
+		unlock, err := fs.LockDir(dataDir)
+		if err != nil {
+			return lambdaError(ctx, "Directory lock error", err)
+		}
+		defer unlock()
+	}
+	switch {
+	case opts.keepTemp:
+		defer log.Info(ctx, fmt.Sprintf("Keeping %s", dataDir))
+		result.TempDir = dataDir
+	case opts.resumeDir != "":
+		// The next run with the same --resume-dir resumes a failed image from what it pulled
+		defer func() {
+			if keepForResume(err) {
+				log.Info(ctx, fmt.Sprintf("Keeping %s to resume from", dataDir))
+			} else {
+				cleanUp(ctx, dataDir)
+			}
+		}()
+	default:
+		forgetTempDir := trackTempDir(dataDir)
+		defer func() {
+			cleanUp(ctx, dataDir)
+			forgetTempDir()
+		}()
+	}
 
-	sociStore, err := initSociStore(ctx, dataDir)
+	sociStore, err := builder.InitSociStore(ctx, dataDir)
 	if err != nil {
 		return lambdaError(ctx, "OCI storage initialization error", err)
 	}
 
-	desc, err := registry.Pull(ctx, repo, sociStore, digest)
-	if err != nil {
+	// The image manifests to build SOCI indices for, and their platforms.
+	// A single image manifest is indexed as is, while every platform of an image index is indexed separately.
+	// When platforms are requested, only their image manifests are pulled. Blobs shared between
+	// platforms are pulled only once because they already exist in the local store.
+	pull := func(ctx context.Context, platform *ocispec.Platform) (*ocispec.Descriptor, error) {
+		if opts.localSource != nil {
+			return opts.localSource.Pull(ctx, sociStore, digest, platform)
+		}
+		if opts.containerdSource != nil {
+			return opts.containerdSource.Pull(ctx, sociStore, digest, platform)
+		}
+		if opts.streamLayers {
+			return registry.PullManifests(ctx, repo, sociStore, digest, platform)
+		}
+		if opts.resumeDir != "" {
+			return registry.PullResumable(ctx, repo, sociStore, digest, platform, path.Join(dataDir, partialLayersDirName))
+		}
+		return registry.Pull(ctx, repo, sociStore, digest, platform)
+	}
+	// Streamed layers are fetched while their ztoc is built, and counted as pulled
+	var fetchLayer builder.LayerFetcher
+	var bytesStreamed int64
+	if opts.streamLayers {
+		fetchLayer = opts.store.layerFetcher(func(ctx context.Context, layer ocispec.Descriptor, file *os.File) error {
+			bytesStreamed += layer.Size
+			return registry.FetchBlob(ctx, repo, layer, file)
+		})
+	}
+	var imagePlatforms []ocispec.Platform
+	var targets []ocispec.Descriptor
+	perPlatform := true
+	_, pullSpan := tracing.Start(ctx, "Pull")
+	// A pull failing because a manifest or blob is not found only means that the image was deleted if its manifest is gone as well.
+	// The image is then skipped rather than failed, since retrying it can never succeed
+	pullError := func(ctx context.Context, err error) (string, error) {
+		if opts.localSource == nil && opts.containerdSource == nil && registryutils.IsNotFound(err) {
+			if _, headErr := registry.HeadManifest(ctx, repo, digest); registryutils.IsNotFound(headErr) {
+				tracing.End(pullSpan, nil)
+				log.Warn(ctx, fmt.Sprintf("Skipping image %s@%s, which was deleted since it was validated: %v", repo, digest, err))
+				return fmt.Sprintf("Skipped: image %s@%s was deleted since it was validated", repo, digest), errImageDeleted
+			}
+		}
+		tracing.End(pullSpan, err)
 		return lambdaError(ctx, "Image pull error", err)
 	}
+	if len(opts.platforms) > 0 {
+		for _, platform := range opts.platforms {
+			platformCtx := logctx.WithPlatform(ctx, platforms.Format(platform))
+			desc, err := pull(platformCtx, &platform)
+			if err != nil {
+				return pullError(platformCtx, err)
+			}
+			if !opts.skipContentVerify {
+				if err = registryutils.VerifyPlatformContent(platformCtx, sociStore, *desc, digest); err != nil {
+					tracing.End(pullSpan, err)
+					return lambdaError(platformCtx, "Content verification error", err)
+				}
+			}
+			imagePlatforms = append(imagePlatforms, platform)
+			targets = append(targets, *desc)
+		}
+	} else {
+		desc, err := pull(ctx, nil)
+		if err != nil {
+			return pullError(ctx, err)
+		}
+		if !opts.skipContentVerify {
+			if err = registryutils.VerifyContent(ctx, sociStore, *desc, digest); err != nil {
+				tracing.End(pullSpan, err)
+				return lambdaError(ctx, "Content verification error", err)
+			}
+		}
+		imagePlatforms, perPlatform, err = builder.ImagePlatforms(ctx, dataDir, *desc)
+		// A local image is not validated before it is read
+		if errors.Is(err, registryutils.ErrUnsupportedPlatform) {
+			tracing.End(pullSpan, nil)
+			log.Info(ctx, fmt.Sprintf("Skipping the image: %v", err))
+			return fmt.Sprintf("Skipped: %v", err), errImageUnsupportedPlatform
+		}
+		if err != nil {
+			tracing.End(pullSpan, err)
+			return lambdaError(ctx, "Image index read error", err)
+		}
+		for range imagePlatforms {
+			targets = append(targets, *desc)
+		}
+	}
+
+	if size, err := fs.CalculateDirSize(builder.StoreDir(dataDir)); err == nil {
+		result.BytesPulled = size
+		metricsutils.TempDirBytesUsed.Add(float64(size))
+		defer metricsutils.TempDirBytesUsed.Add(-float64(size))
+	}
+	pullSpan.SetAttributes(attribute.Int64("soci.bytes.pulled", result.BytesPulled))
+	tracing.End(pullSpan, nil)
 
-	image := images.Image{
-		Name:   repo + "@" + digest,
-		Target: *desc,
+	if opts.destination != nil && !opts.noPush && !opts.dryRun {
+		result.startPhase(phasePush)
+		// The pulled manifests are pushed unmodified so that the image keeps its digest in the destination
+		for i, target := range targets {
+			if i > 0 && target.Digest == targets[i-1].Digest {
+				continue
+			}
+			err = destinationRegistry.Push(ctx, sociStore, target, destinationRepo)
+			if err != nil {
+				return lambdaError(ctx, "Image push error", missingRepositoryError(err, opts.destination.registryUrl, destinationRepo))
+			}
+		}
+		// Only the image as a whole is tagged, not the manifests of the requested platforms
+		if ref.tag != "" && len(opts.platforms) == 0 {
+			err = destinationRegistry.Tag(ctx, destinationRepo, targets[0], ref.tag)
+			if err != nil {
+				return lambdaError(ctx, "Image tag error", err)
+			}
+		}
+		result.BytesPushed += result.BytesPulled
 	}
 
-	indexDescriptor, err := buildIndex(ctx, dataDir, sociStore, image)
+	// SOCI indices pushed elsewhere than the image can be traced back to it
+	indexAnnotations := maps.Clone(opts.annotations)
+	if indexRepo != repo || opts.destination != nil {
+		if indexAnnotations == nil {
+			indexAnnotations = map[string]string{}
+		}
+		indexAnnotations[sourceImageAnnotation] = repo + "@" + digest
+	}
+
+	result.startPhase(phaseBuild)
+	builtIndices, err := builder.BuildIndices(ctx, dataDir, sociStore, repo+"@"+digest, targets, imagePlatforms, perPlatform, indexAnnotations, opts.index, fetchLayer)
+	result.BytesPulled += bytesStreamed
+	if errors.Is(err, builder.ErrNothingToIndex) {
+		msg := fmt.Sprintf("Skipped: %v", err)
+		log.Info(ctx, msg)
+		return msg, errImageNothingToIndex
+	}
 	if err != nil {
 		return lambdaError(ctx, "SOCI index build error", err)
 	}
-	ctx = context.WithValue(ctx, "SOCIIndexDigest", indexDescriptor.Digest.String())
+	indexDescriptors := make([]ocispec.Descriptor, 0, len(builtIndices))
+	// The manifests the SOCI indices refer to, which are the image manifests of each platform
+	var subjects []string
+	// The platforms that got a SOCI index, in the order of indexDescriptors
+	indexedPlatforms := make([]ocispec.Platform, 0, len(builtIndices))
+	for _, index := range builtIndices {
+		platformName := ""
+		if perPlatform {
+			platformName = platforms.Format(index.Platform)
+		}
+		indexDescriptors = append(indexDescriptors, index.Descriptor)
+		indexedPlatforms = append(indexedPlatforms, index.Platform)
+		if !slices.Contains(subjects, index.Index.Subject.Digest.String()) {
+			subjects = append(subjects, index.Index.Subject.Digest.String())
+		}
+		result.Indices = append(result.Indices, newIndexResult(platformName, index.Index, index.Descriptor, index.Layers))
+	}
+	imagePlatforms = indexedPlatforms
 
-	err = registry.Push(ctx, sociStore, *indexDescriptor, repo)
-	if err != nil {
-		return lambdaError(ctx, "SOCI index push error", err)
+	for _, exportDir := range []string{opts.exportDir, opts.exportTarDir} {
+		if exportDir == "" {
+			continue
+		}
+		for i, indexDescriptor := range indexDescriptors {
+			platformCtx := ctx
+			if perPlatform {
+				platformCtx = logctx.WithPlatform(ctx, result.Indices[i].Platform)
+			}
+			err = exportIndex(platformCtx, sociStore, indexDescriptor, exportDir, exportTag(digest, result.Indices[i].Platform))
+			if err != nil {
+				return lambdaError(platformCtx, "SOCI index export error", err)
+			}
+		}
+	}
+	if opts.noPush {
+		msg := fmt.Sprintf("Successfully built %d SOCI indices and exported them to %s", len(indexDescriptors), cmp.Or(opts.exportTar, opts.exportDir))
+		log.Info(ctx, msg)
+		return msg, nil
+	}
+	if opts.dryRun {
+		summaries := make([]string, 0, len(result.Indices))
+		for _, index := range result.Indices {
+			summary := fmt.Sprintf("%s (%d bytes, %d layers)", index.Digest, index.Size, len(index.Ztocs))
+			if perPlatform {
+				summary = index.Platform + "=" + summary
+			}
+			summaries = append(summaries, summary)
+		}
+		msg := fmt.Sprintf("Dry run, would push %d SOCI indices: %s", len(indexDescriptors), strings.Join(summaries, ", "))
+		log.Info(ctx, msg)
+		return msg, nil
+	}
+
+	result.startPhase(phasePush)
+	var bytesPushed int64
+	for _, index := range result.Indices {
+		bytesPushed += index.Size
+	}
+	_, pushSpan := tracing.Start(ctx, "Push", attribute.Int64("soci.bytes.pushed", bytesPushed))
+
+	// The SOCI indices are pushed to every replica even if another one fails
+	destinationRegistryUrl := logctx.RegistryURLFrom(ctx)
+	if opts.destination != nil {
+		destinationRegistryUrl = opts.destination.registryUrl
+	}
+	indexRegistries := append([]replicaRegistry{{registryUrl: destinationRegistryUrl, registry: destinationRegistry}}, replicas...)
+	mechanism := ""
+	replaced := 0
+	var failures []error
+	failedStep := "SOCI index push error"
+	for i, indexRegistry := range indexRegistries {
+		registryCtx := ctx
+		if len(replicas) > 0 {
+			registryCtx = logctx.WithDestinationRegistryURL(ctx, indexRegistry.registryUrl)
+		}
+		err := indexRegistry.err
+		// The SOCI index of a replica would refer to a missing image until the image is replicated
+		if err == nil && i > 0 && opts.replicationTimeout > 0 {
+			err = registryutils.WaitForReplication(registryCtx, destinationRegistryUrl, destinationRepo, digest, indexRegistry.registryUrl, opts.replicationTimeout)
+		}
+		// The existing SOCI indices are listed before the push, but only deleted after it,
+		// so that the image is never left without a SOCI index
+		var existing []ocispec.Descriptor
+		if err == nil && opts.replaceExisting {
+			existing, err = listExistingIndices(registryCtx, indexRegistry.registry, indexRepo, subjects, indexDescriptors)
+		}
+		if err == nil {
+			mechanism, err = builder.PushIndices(registryCtx, indexRegistry.registry, sociStore, indexRepo, indexDescriptors, imagePlatforms, perPlatform)
+			if err != nil {
+				err = missingRepositoryError(err, indexRegistry.registryUrl, indexRepo)
+				lambdaError(registryCtx, "SOCI index push error", err)
+			}
+		}
+		// A blob lost on the way would only be noticed when a container fails to lazily load it
+		if err == nil && !opts.noVerify {
+			err = builder.VerifyIndices(registryCtx, indexRegistry.registry, sociStore, indexRepo, indexDescriptors, mechanism)
+			if err != nil {
+				failedStep = "SOCI index verification error"
+				lambdaError(registryCtx, failedStep, err)
+			}
+		}
+		if err == nil {
+			result.BytesPushed += bytesPushed
+		}
+		if err == nil && len(existing) > 0 {
+			log.Info(registryCtx, fmt.Sprintf("Deleting %d existing SOCI indices", len(existing)))
+			err = indexRegistry.registry.DeleteReferrers(registryCtx, indexRepo, existing, mechanism)
+			if err != nil {
+				err = fmt.Errorf("The new SOCI indices were pushed, but the existing ones couldn't be deleted: %w", err)
+				lambdaError(registryCtx, "Existing SOCI index deletion error", err)
+			} else {
+				replaced += len(existing)
+			}
+		}
+		if err != nil {
+			if len(indexRegistries) == 1 {
+				tracing.End(pushSpan, err)
+				return failedStep, err
+			}
+			failures = append(failures, fmt.Errorf("%s: %w", indexRegistry.registryUrl, err))
+		}
+	}
+	if len(failures) > 0 {
+		err := fmt.Errorf("SOCI index push failed in %d of %d registries: %w", len(failures), len(indexRegistries), errors.Join(failures...))
+		tracing.End(pushSpan, err)
+		// The image is still being replicated, so it is worth retrying later
+		if errors.Is(err, registryutils.ErrReplicationTimeout) {
+			return "Replication wait timeout", err
+		}
+		return "SOCI index push error", err
+	}
+	tracing.End(pushSpan, nil)
+	ctx = logctx.WithReferrersMechanism(ctx, mechanism)
+	result.ReferrersMechanism = mechanism
+
+	built := "built and pushed"
+	if opts.signer != nil {
+		if msg, err := signIndices(ctx, opts.signer, indexRegistries, indexRepo, indexDescriptors, result); err != nil {
+			return msg, err
+		}
+		built = "built, pushed and signed"
+	}
+
+	emitIndexBuiltEvents(ctx, ref.region, opts, result)
+
+	destinations := ""
+	if len(replicas) > 0 {
+		destinations = fmt.Sprintf(" to %d registries", len(indexRegistries))
+	}
+	if replaced > 0 {
+		destinations += fmt.Sprintf(", replacing %d existing SOCI indices,", replaced)
+	}
+	if !perPlatform {
+		ctx = logctx.WithSociIndexDigest(ctx, indexDescriptors[0].Digest.String())
+		log.Info(ctx, "Successfully "+built+" SOCI index"+destinations)
+		return fmt.Sprintf("Successfully %s SOCI index%s with the %s", built, destinations, mechanism), nil
+	}
+
+	summaries := make([]string, 0, len(imagePlatforms))
+	for i, platform := range imagePlatforms {
+		summaries = append(summaries, fmt.Sprintf("%s=%s", platforms.Format(platform), indexDescriptors[i].Digest))
+	}
+	msg = fmt.Sprintf("Successfully %s SOCI indices for %d platforms%s with the %s: %s", built, len(imagePlatforms), destinations, mechanism, strings.Join(summaries, ", "))
+	log.Info(ctx, msg)
+	return msg, nil
+}
+
+// List the SOCI indices referring to any of subjects, other than the ones in indexDescriptors
+func listExistingIndices(ctx context.Context, registry *registryutils.Registry, indexRepo string, subjects []string, indexDescriptors []ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	var existing []ocispec.Descriptor
+	for _, subject := range subjects {
+		indices, err := registry.ListSociIndices(ctx, indexRepo, subject)
+		if err != nil {
+			lambdaError(ctx, "Existing SOCI index lookup error", err)
+			return nil, err
+		}
+		for _, index := range indices {
+			// A rebuilt SOCI index identical to an existing one is the same manifest
+			isNew := slices.ContainsFunc(indexDescriptors, func(desc ocispec.Descriptor) bool {
+				return desc.Digest == index.Digest
+			})
+			if !isNew {
+				existing = append(existing, index)
+			}
+		}
+	}
+	if len(existing) > 0 {
+		log.Info(ctx, fmt.Sprintf("Found %d existing SOCI indices to replace", len(existing)))
+	}
+	return existing, nil
+}
+
+// Sign pushed SOCI indices with cosign signatures, and push each signature to every registry its SOCI index was pushed to.
+// The digests of the signatures are added to result.
+func signIndices(ctx context.Context, signer registryutils.Signer, indexRegistries []replicaRegistry, indexRepo string, indexDescriptors []ocispec.Descriptor, result *buildResult) (string, error) {
+	for i, indexDescriptor := range indexDescriptors {
+		indexCtx := logctx.WithSociIndexDigest(ctx, indexDescriptor.Digest.String())
+		if result.Indices[i].Platform != "" {
+			indexCtx = logctx.WithPlatform(indexCtx, result.Indices[i].Platform)
+		}
+		signature, err := registryutils.SignManifest(indexCtx, signer, indexRegistries[0].registryUrl+"/"+indexRepo, indexDescriptor.Digest.String())
+		if err != nil {
+			return lambdaError(indexCtx, "SOCI index signature error", fmt.Errorf("%w: %w", errSignature, err))
+		}
+		for _, indexRegistry := range indexRegistries {
+			err := indexRegistry.registry.PushSignature(indexCtx, indexRepo, signature)
+			if err != nil {
+				return lambdaError(indexCtx, "SOCI index signature error", fmt.Errorf("%w: %s: %w", errSignature, indexRegistry.registryUrl, err))
+			}
+		}
+		result.Indices[i].Signature = signature.Digest()
+	}
+	return "", nil
+}
+
+// Print the outcome of a single image
+func printResult(result imageResult) {
+	switch {
+	case result.failed():
+		line := fmt.Sprintf("FAILED\t%s\t%s: %v", result.reference, result.message, result.err)
+		if result.build != nil && result.build.Error != nil && result.build.Error.RequestId != "" {
+			line += fmt.Sprintf(" (request id %s)", result.build.Error.RequestId)
+		}
+		if result.build != nil && result.build.Error != nil && result.build.Error.Hint != "" {
+			line += "\t" + result.build.Error.Hint
+		}
+		fmt.Println(line)
+	case result.skipped():
+		fmt.Printf("SKIPPED\t%s\t%s\n", result.reference, result.message)
+	default:
+		fmt.Printf("OK\t%s\t%s\n", result.reference, result.message)
+	}
+	if result.build != nil && result.build.TempDir != "" {
+		fmt.Printf("KEPT\t%s\t%s\n", result.reference, result.build.TempDir)
+	}
+}
+
+// Print the number of succeeded, failed and skipped images and return the number of failures
+func printSummary(results []imageResult) int {
+	failed, skipped := 0, 0
+	for _, result := range results {
+		if result.failed() {
+			failed++
+		} else if result.skipped() {
+			skipped++
+		}
+	}
+	fmt.Printf("%d succeeded, %d failed, %d skipped\n", len(results)-failed-skipped, failed, skipped)
+	return failed
+}
+
+// Print the summary of a run and exit with a non-zero code if any image failed or was skipped, see exitCode.
+// The results are printed and written as JSON instead if requested by opts
+func exitWithSummary(results []imageResult, err error, opts options) {
+	if len(results) > 0 {
+		log.Info(context.TODO(), summarize(results).String())
+	}
+	notify(context.TODO(), results, err, opts)
+	if opts.outputFile != "" {
+		if writeErr := writeJsonResultsFile(opts.outputFile, results, err); writeErr != nil {
+			log.Error(context.TODO(), "Output file write error", writeErr)
+			os.Exit(1)
+		}
+	}
+
+	switch {
+	case opts.output == outputJson:
+		if writeErr := writeJsonResults(os.Stdout, results, err); writeErr != nil {
+			log.Error(context.TODO(), "Output write error", writeErr)
+			os.Exit(1)
+		}
+	case len(results) == 0 && err == nil:
+		fmt.Println("Nothing to do")
+	default:
+		printSummary(results)
+	}
+	if opts.metrics == metricsStdout {
+		if writeErr := metricsutils.Write(os.Stdout); writeErr != nil {
+			log.Error(context.TODO(), "Metrics write error", writeErr)
+		}
+	}
+	if opts.layerReport != "" {
+		if writeErr := writeLayerReportFile(opts.layerReportFile, opts.layerReport, results); writeErr != nil {
+			log.Error(context.TODO(), "Layer report write error", writeErr)
+			os.Exit(1)
+		}
 	}
+	code := exitCode(results, err, opts.failOnSkip)
+	if code != 0 && code != exitCodeSkipped {
+		os.Exit(code)
+	}
+	if opts.digestOutput != "" && len(results) > 0 && !opts.dryRun {
+		if writeErr := writeDigestOutput(opts.digestOutput, results); writeErr != nil {
+			log.Error(context.TODO(), "Digest output write error", writeErr)
+			os.Exit(1)
+		}
+	}
+	if code != 0 {
+		os.Exit(code)
+	}
+}
 
-	log.Info(ctx, "Successfully built and pushed SOCI index")
-	return "Successfully built and pushed SOCI index", nil
+// The exit code of a run: 0 if every image was built, exitCodeSkipped if the others were skipped, or exitCodeOther with failOnSkip,
+// exitCodeSignature if the failed images were all pushed but not signed,
+// or the code of the category of the errors of the failed images if they all have the same one.
+func exitCode(results []imageResult, err error, failOnSkip bool) int {
+	// Stands for the category of signature failures, which are told apart from the other failures of their category
+	const signatureFailure = "signature"
+
+	switch {
+	case errors.Is(err, errInterrupted):
+		return exitCodeInterrupted
+	case errors.Is(err, errTimeout):
+		return exitCodeNetwork
+	case err != nil:
+		return categoryExitCode(errorCategory(err))
+	}
+	category, skipped := "", false
+	for _, result := range results {
+		switch {
+		case result.skipped():
+			skipped = true
+		case !result.failed():
+		case result.build.Error == nil:
+			return exitCodeOther
+		default:
+			failure := result.build.Error.Category
+			if errors.Is(result.err, errSignature) {
+				failure = signatureFailure
+			}
+			if category != "" && failure != category {
+				return exitCodeOther
+			}
+			category = failure
+		}
+	}
+	switch {
+	case category == signatureFailure:
+		return exitCodeSignature
+	case category != "":
+		return categoryExitCode(category)
+	case skipped && failOnSkip:
+		return exitCodeOther
+	case skipped:
+		return exitCodeSkipped
+	}
+	return 0
+}
+
+// Get the registry url from either --registry, or --region and --account of an ECR registry
+// Returns false unless exactly one of them is given
+func registryUrlFromFlags(registry string, region string, account string, fips bool) (string, bool) {
+	if registry != "" {
+		return registry, region == "" && account == ""
+	}
+	if region == "" || account == "" {
+		return "", false
+	}
+	return registryutils.BuildEcrRegistryUrl(region, account, fips), true
+}
+
+// Default an empty --region to the region of the AWS configuration, e.g. AWS_REGION in Lambda and ECS,
+// and an empty --account to the account of the AWS credentials, so ConfigureAws must be called first.
+// What cannot be detected is left empty, so that the missing arguments are reported as usual.
+func detectRegionAndAccount(ctx context.Context, region *string, account *string) {
+	if *region == "" {
+		if *region = registryutils.GetAwsRegion(); *region != "" {
+			log.Info(ctx, fmt.Sprintf("Detected region %s from the AWS configuration, pass --region to override it", *region))
+		}
+	}
+	if *account == "" {
+		detected, err := registryutils.GetAwsAccount(ctx, *region)
+		if err != nil {
+			log.Debug(ctx, fmt.Sprintf("Couldn't detect the account of the AWS credentials: %v", err))
+			return
+		}
+		*account = detected
+		log.Info(ctx, fmt.Sprintf("Detected account %s from the AWS credentials, pass --account to override it", *account))
+	}
 }
 
 func main() {
-	if len(os.Args) < 4 {
-		fmt.Println("Usage: soci-wrapper REPOSITORY_NAME IMAGE_DIGEST AWS_REGION AWS_ACCOUNT")
+	tracing.Configure(context.TODO())
+
+	// Running as a Lambda function with a custom runtime, triggered by ECR push events
+	if os.Getenv("AWS_LAMBDA_RUNTIME_API") != "" {
+		lambdaMain()
+	}
+	log.SetRunId(runId)
+	command, args := "", os.Args[1:]
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "build":
+		buildCommand(args[1:], false)
+	case "reindex":
+		reindexCommand(args[1:])
+	case "push-archive":
+		pushArchiveCommand(args[1:])
+	case "list":
+		listCommand(args[1:])
+	case "gc":
+		gcCommand(args[1:])
+	case "verify":
+		verifyCommand(args[1:])
+	case "preflight":
+		preflightCommand(args[1:])
+	case "serve-sqs":
+		serveSqsCommand(args[1:])
+	case "version", "--version", "-version":
+		fmt.Println(version.Get())
+	default:
+		// Automation written before the subcommands runs builds without one
+		buildCommand(args, true)
+	}
+}
+
+// Build and push SOCI indices for the images given by args.
+// If withoutSubcommand is set, the build was run without the build subcommand, which is deprecated.
+func buildCommand(args []string, withoutSubcommand bool) {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	// Print an error about the command line arguments and exit
+	usageError := func(err error) {
+		fmt.Fprintln(flags.Output(), err)
+		flags.Usage()
 		os.Exit(1)
 	}
-	repo := os.Args[1]
-	digest := os.Args[2]
-	region := os.Args[3]
-	account := os.Args[4]
-	process(context.TODO(), repo, digest, region, account)
+	image := flags.String("image", "", "Full image reference, e.g. ACCOUNT.dkr.ecr.REGION.amazonaws.com/REPOSITORY@DIGEST")
+	repo := flags.String("repo", "", "Name of the repository")
+	var digests stringsFlag
+	flags.Var(&digests, "digest", "Digest of the image manifest. Can be repeated or comma-separated to process multiple images")
+	tag := flags.String("tag", "", "Tag of the image, resolved to a digest when --digest is omitted")
+	var regions stringsFlag
+	flags.Var(&regions, "region", "AWS region of the ECR repository. Can be repeated or comma-separated to push SOCI indices to the replicas of the repository in the other regions as well. Defaults to the region of the AWS configuration, e.g. $AWS_REGION")
+	waitForReplication := flags.Bool("wait-for-replication", false, "Wait until the image has been replicated to each of the other --region values before pushing the SOCI index there")
+	replicationTimeout := flags.Duration("replication-timeout", registryutils.DefaultReplicationTimeout, "Maximum time to wait for the image to be replicated with --wait-for-replication, e.g. 15m")
+	account := flags.String("account", "", "AWS account ID of the ECR repository. Defaults to the account of the AWS credentials")
+	fips := flags.Bool("fips", false, "Use the FIPS endpoints of ECR")
+	registryEndpoint := flags.String("registry-endpoint", "", "Hostname to connect to instead of the registry, e.g. an interface VPC endpoint or localhost:4510 for LocalStack")
+	plainHttp := flags.Bool("plain-http", false, "Connect to the registry over plain HTTP, e.g. for a local test registry")
+	caCert := flags.String("ca-cert", "", "PEM bundle of CA certificates to trust in addition to the system ones when connecting to the registry")
+	insecureSkipTlsVerify := flags.Bool("insecure-skip-tls-verify", false, "Skip verifying the TLS certificate of the registry. Insecure, only for lab environments")
+	referrers := referrersFlagVar(flags)
+	sourceRepo := flags.String("source-repo", "", "Name of the ECR repository to pull images from. Images and SOCI indices are pushed to --repo. Defaults to --repo")
+	sourceRegion := flags.String("source-region", "", "AWS region of the ECR repository to pull images from. Defaults to --region")
+	sourceAccount := flags.String("source-account", "", "AWS account ID of the ECR repository to pull images from. Defaults to --account")
+	sourceRoleArn := flags.String("source-role-arn", "", "IAM role to assume to pull images from the source repository, e.g. a role in --source-account. Defaults to the credentials used for --repo")
+	sourceExternalId := flags.String("source-external-id", "", "External ID to pass when assuming --source-role-arn")
+	sourceOciLayout := flags.String("source-oci-layout", "", "OCI image layout directory to read the image from instead of pulling it, e.g. written by docker buildx build --output type=oci,tar=false")
+	source := flags.String("source", sourceRegistry, "Where to read images from, either registry or containerd. With containerd, images are read from the content store of the daemon instead of being pulled, and must match their digest in the registry")
+	containerdAddress := flags.String("containerd-address", registryutils.DefaultContainerdAddress, "Address of the containerd daemon to read images from with --source containerd")
+	namespace := flags.String("namespace", "default", "containerd namespace to read images from with --source containerd")
+	sourceDockerArchive := flags.String("source-docker-archive", "", "Tar file to read the image from instead of pulling it, written by docker save (Docker 25 or later) or docker buildx build --output type=docker")
+	registryHost := flags.String("registry", "", "Hostname of an OCI registry to use instead of ECR, e.g. harbor.example.com")
+	username := flags.String("username", "", "Username for --registry. Defaults to the "+registryutils.RegistryUsernameEnv+" environment variable or the docker config file")
+	password := flags.String("password", "", "Password for --registry. Defaults to the "+registryutils.RegistryPasswordEnv+" environment variable or the docker config file")
+	dockerConfig := flags.String("docker-config", "", "Path of the docker config file to read registry credentials from. Defaults to $DOCKER_CONFIG/config.json or ~/.docker/config.json")
+	inputFile := flags.String("input-file", "", "Path to a newline-delimited file of image references (REPOSITORY@DIGEST or REPOSITORY:TAG) to process")
+	stdin := flags.Bool("stdin", false, "Read newline-delimited image references (DIGEST or REPOSITORY@DIGEST) from stdin")
+	outputRepo := flags.String("output-repo", "", "Name of the repository to push SOCI indices to. Defaults to the repository of each image")
+	tagPrefix := flags.String("tag-prefix", "", "Process every image in --repo having a tag that starts with this prefix")
+	repoPattern := flags.String("repo-pattern", "", "Process the most recent images of every repository matching this glob pattern, e.g. svc-*")
+	var platformFlags stringsFlag
+	flags.Var(&platformFlags, "platform", "Only index the image of this platform, e.g. linux/arm64. Can be repeated or comma-separated. All platforms of a multi-arch image are indexed by default")
+	recentImages := flags.Int("recent-images", 1, "Number of the most recent images to process per repository with --repo-pattern")
+	skipExisting := flags.Bool("skip-existing", false, "Skip images whose image manifests already have a SOCI index, checked with manifest and referrers queries before pulling anything")
+	force := flags.Bool("force", false, "Build SOCI indices even for images that --skip-existing would skip")
+	signKmsKey := flags.String("sign-kms-key", "", "ARN of an AWS KMS key to sign the pushed SOCI indices with, as cosign signatures. The exit code is 7 if the SOCI indices were pushed but could not be signed")
+	signKey := flags.String("sign-key", "", "Path of an unencrypted PEM private key to sign the pushed SOCI indices with, as cosign signatures")
+	replaceExisting := flags.Bool("replace-existing", false, "Delete the SOCI indices that already refer to an image after its new SOCI index has been pushed, e.g. when rebuilding with a newer soci-snapshotter")
+	annotations := annotationsFlag{}
+	flags.Var(annotations, "annotation", "Annotation to add to SOCI indices as key=value, e.g. com.example.build-id=1234. Can be repeated")
+	awsOptions := awsFlags(flags)
+	proxyUrl := proxyFlag(flags)
+	setRetryOptions := retryFlags(flags)
+	output := flags.String("output", outputText, "Format of the results printed to stdout, either text or json")
+	outputFile := flags.String("output-file", "", "Path to write the results to as JSON, regardless of --output")
+	defaults := defaultOptions()
+	minLayerSize := sizeFlag(defaults.index.MinLayerSize)
+	flags.Var(&minLayerSize, "min-layer-size", "Minimum size of the layers to build ztocs for, e.g. 10MiB. Smaller layers are fetched entirely instead of being lazily loaded")
+	spanSize := sizeFlag(defaults.index.SpanSize)
+	flags.Var(&spanSize, "span-size", "Size of the uncompressed layer data between ztoc checkpoints, a power of two between 1MiB and 1GiB. Larger spans make smaller SOCI indices but fetch more data on each read")
+	var excludeLayers stringsFlag
+	flags.Var(&excludeLayers, "exclude-layer", "Digest of a layer to leave out of SOCI indices. Can be repeated or comma-separated")
+	var excludeLayerMediaTypes stringsFlag
+	flags.Var(&excludeLayerMediaTypes, "exclude-layer-media-type", "Media type of the layers to leave out of SOCI indices. Can be repeated or comma-separated")
+	metrics := flags.String("metrics", metricsNone, fmt.Sprintf("How to emit the metrics of each build, either %s, %s to write CloudWatch Embedded Metric Format lines to stderr, %s to call PutMetricData, or %s to write the metrics of the run to stdout in the Prometheus text format once it is over", metricsNone, metricsCloudWatchEmf, metricsCloudWatchApi, metricsStdout))
+	metricsNamespace := flags.String("metrics-namespace", defaultMetricsNamespace, "CloudWatch namespace of the metrics")
+	notifySnsTopic := flags.String("notify-sns-topic", "", "ARN of an SNS topic to publish the results of the run to as JSON, whether it succeeded or failed")
+	emitEventBus := flags.String("emit-event-bus", "", "Name or ARN of an EventBridge event bus to put a \""+eventDetailTypeIndexBuilt+"\" event to for each pushed SOCI index")
+	notifyWebhook := flags.String("notify-webhook", "", "URL to POST the results of the run to as JSON, whether it succeeded or failed. The body is signed with the "+registryutils.WebhookSecretEnv+" environment variable if set")
+	dryRun := flags.Bool("dry-run", false, "Pull the images and build their SOCI indices, then print what would be pushed without writing anything to the registries")
+	workDir := workDirFlag(flags)
+	removeStaleAfter := removeStaleAfterFlag(flags)
+	storeBackendName := flags.String("store-backend", "local", "Where images are stored while they are processed: local for --work-dir, the absolute path of a directory such as an EFS mount, or s3://bucket/prefix to stage the layers in S3 and keep a single layer on local disk at a time")
+	layerOrder := flags.String("layer-order", builder.LayerOrderManifest, fmt.Sprintf("Order to build the ztocs of the layers of an image in, either %s or %s for the largest layers first. The SOCI index lists them in the order of the manifest either way", builder.LayerOrderManifest, builder.LayerOrderSizeDesc))
+	streamLayers := flags.Bool("stream-layers", false, "Fetch the layers one at a time while building their ztocs instead of pulling the whole image first, so that only the largest layer must fit in --work-dir. Cannot be combined with a destination or a local image source")
+	resume := flags.Bool("resume", false, "Keep the pulled blobs and the partially pulled layers of failed images in --resume-dir, so that running again resumes their pulls with Range requests instead of starting from zero")
+	resumeDir := flags.String("resume-dir", "", "Directory to keep the data of failed images in for --resume, e.g. on a volume that outlives the host. Implies --resume. Defaults to "+defaultResumeDirName+" in --work-dir")
+	quiet := quietFlag(flags)
+	keepTemp := flags.Bool("keep-temp", false, "Keep the temporary directory where each image and its SOCI indices are stored, e.g. to inspect them after --dry-run or a failed build. Its path is printed")
+	noPush := flags.Bool("no-push", false, "Build SOCI indices without pushing anything. Requires --export-oci or --export-tar")
+	skipContentVerify := flags.Bool("skip-content-verify", false, "Skip reading the pulled manifests and blobs back from disk to check that they have the digest and size they are referenced with, starting from the requested image digest, before building SOCI indices")
+	createRepo := flags.Bool("create-repo", false, "Create --output-repo, or the repository images are copied to from --source-repo or a local source, if it does not exist in ECR. Requires ecr:DescribeRepositories and ecr:CreateRepository")
+	createRepoImmutableTags := flags.Bool("create-repo-immutable-tags", false, "Make the tags of the repositories created by --create-repo immutable")
+	createRepoScanOnPush := flags.Bool("create-repo-scan-on-push", false, "Scan the images pushed to the repositories created by --create-repo for vulnerabilities")
+	createRepoTags := tagsFlag{}
+	flags.Var(createRepoTags, "create-repo-tag", "Tag to add to the repositories created by --create-repo as key=value, e.g. team=platform. Can be repeated")
+	noVerify := flags.Bool("no-verify", false, "Skip checking that the manifest and every blob of each pushed SOCI index exist in the registry with the digest and size they were pushed with. Incomplete SOCI indices are deleted and fail the image with a retryable network error otherwise")
+	exportOci := flags.String("export-oci", "", "Directory to export SOCI indices to as an OCI image layout, e.g. for oras cp --from-oci-layout")
+	exportTar := flags.String("export-tar", "", "Path of a tar file to package the SOCI indices into as an OCI image layout, to be pushed later with soci-wrapper push-archive")
+	layerReport := flags.String("layer-report", "", fmt.Sprintf("Write a report of the layers of the built SOCI indices at the end of the run, either %s or %s, with the size, ztoc size, span count and ztoc build time of each layer, and why it got no ztoc if it got none", layerReportJson, layerReportCsv))
+	layerReportFile := flags.String("layer-report-file", "", "Path to write --layer-report to instead of stdout")
+	digestOutput := flags.String("digest-output", "", "Path to write the digest of each pushed SOCI index to, one per line. Written only if every image succeeded")
+	timeout := flags.Duration("timeout", 0, fmt.Sprintf("How long the whole run may take, e.g. 30m. In-progress pulls and pushes are canceled and the exit code is %d once it is exceeded. No limit by default", exitCodeNetwork))
+	pullConcurrency := flags.Int("pull-concurrency", registryutils.DefaultPullConcurrency, "Number of layers pulled at once")
+	maxMemory := maxMemoryFlag(flags)
+	profileDir := profileDirFlag(flags)
+	logFormat := logFormatFlag(flags)
+	logLevel := logLevelFlag(flags)
+	workers := flags.Int("workers", 1, "Number of images of --input-file, --stdin or repeated --digest values to process at once. Each image has its own data directory, and their pulls share the free space")
+	failFast := flags.Bool("fail-fast", false, "Cancel the images in progress with --workers as soon as one of them fails")
+	strict := flags.Bool("strict", true, fmt.Sprintf("Fail images whose manifest is not the manifest of an image, e.g. with an unsupported config media type, with the validation error. With --strict=false they are skipped, and the exit code is %d unless another image failed", exitCodeSkipped))
+	failOnSkip := flags.Bool("fail-on-skip", false, fmt.Sprintf("Exit with %d instead of %d when no image failed but some were skipped, e.g. because they already had a SOCI index or were invalid with --strict=false, so that skipped images fail the run", exitCodeOther, exitCodeSkipped))
+	keepGoing := flags.Bool("keep-going", false, "Continue processing the remaining images of --input-file or --stdin when one of them fails")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: soci-wrapper build --repo REPOSITORY_NAME (--digest IMAGE_DIGEST | --tag IMAGE_TAG) --region AWS_REGION --account AWS_ACCOUNT")
+		fmt.Fprintln(flags.Output(), "       soci-wrapper build --repo REPOSITORY_NAME (--digest IMAGE_DIGEST | --tag IMAGE_TAG) --registry REGISTRY [--username USERNAME --password PASSWORD]")
+		fmt.Fprintln(flags.Output(), "       soci-wrapper build --repo REPOSITORY_NAME (--digest IMAGE_DIGEST | --tag IMAGE_TAG) --region AWS_REGION --account AWS_ACCOUNT [--source-repo REPOSITORY_NAME] [--source-region AWS_REGION] [--source-account AWS_ACCOUNT] [--source-role-arn ROLE_ARN]")
+		fmt.Fprintln(flags.Output(), "       soci-wrapper build --repo REPOSITORY_NAME (--source-oci-layout DIRECTORY | --source-docker-archive FILE) [--digest IMAGE_DIGEST | --tag IMAGE_TAG] --region AWS_REGION --account AWS_ACCOUNT")
+		fmt.Fprintln(flags.Output(), "       soci-wrapper build --image IMAGE_REFERENCE")
+		fmt.Fprintln(flags.Output(), "       soci-wrapper build --input-file FILE [--keep-going] --region AWS_REGION --account AWS_ACCOUNT")
+		fmt.Fprintln(flags.Output(), "       soci-wrapper build --repo-pattern PATTERN [--recent-images N] --region AWS_REGION --account AWS_ACCOUNT")
+		fmt.Fprintln(flags.Output(), "       soci-wrapper build --repo REPOSITORY_NAME --tag-prefix TAG_PREFIX [--skip-existing [--force]] --region AWS_REGION --account AWS_ACCOUNT")
+		fmt.Fprintln(flags.Output(), "       soci-wrapper build --stdin [--repo REPOSITORY_NAME] [--keep-going] --region AWS_REGION --account AWS_ACCOUNT")
+		fmt.Fprintln(flags.Output(), "       soci-wrapper build REPOSITORY_NAME IMAGE_DIGEST AWS_REGION AWS_ACCOUNT")
+		fmt.Fprintln(flags.Output(), "       soci-wrapper reindex --repo REPOSITORY_NAME --region AWS_REGION --account AWS_ACCOUNT [--max-images N] [--dry-run]")
+		fmt.Fprintln(flags.Output(), "       soci-wrapper push-archive --archive FILE --region AWS_REGION --account AWS_ACCOUNT [--repo REPOSITORY_NAME]")
+		fmt.Fprintln(flags.Output(), "       soci-wrapper list --repo REPOSITORY_NAME [--digest IMAGE_DIGEST] --region AWS_REGION --account AWS_ACCOUNT [--output json]")
+		fmt.Fprintln(flags.Output(), "       soci-wrapper gc --repo REPOSITORY_NAME --region AWS_REGION --account AWS_ACCOUNT [--older-than DURATION] [--dry-run]")
+		fmt.Fprintln(flags.Output(), "       soci-wrapper verify --repo REPOSITORY_NAME --digest IMAGE_DIGEST [--index SOCI_INDEX_DIGEST] [--deep] --region AWS_REGION --account AWS_ACCOUNT")
+		fmt.Fprintln(flags.Output(), "       soci-wrapper preflight --repo REPOSITORY_NAME --region AWS_REGION --account AWS_ACCOUNT [--image-ref DIGEST_OR_TAG]")
+		fmt.Fprintln(flags.Output(), "       soci-wrapper serve-sqs --queue-url QUEUE_URL [--max-concurrent N] [--visibility-timeout DURATION]")
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, args)
+	if err := log.SetFormat(*logFormat); err != nil {
+		usageError(fmt.Errorf("--log-format: %w", err))
+	}
+	if err := configureLogLevel(*logLevel, *quiet); err != nil {
+		usageError(fmt.Errorf("--log-level: %w", err))
+	}
+	if withoutSubcommand {
+		log.Warn(context.TODO(), "Running soci-wrapper without a subcommand is deprecated, run soci-wrapper build with the same arguments instead")
+	}
+
+	// Images are pulled from the first region, and SOCI indices are pushed to the others as well
+	region := new(string)
+	if len(regions) > 0 {
+		*region = regions[0]
+	}
+	var replicaRegions []string
+	for _, replicaRegion := range regions {
+		if replicaRegion != *region && !slices.Contains(replicaRegions, replicaRegion) {
+			replicaRegions = append(replicaRegions, replicaRegion)
+		}
+	}
+	if len(replicaRegions) > 0 && (*repoPattern != "" || *tagPrefix != "" || *stdin || *inputFile != "" || *image != "" || *registryHost != "") {
+		usageError(errors.New("Multiple --region values can only be used with --repo, --account and --digest or --tag"))
+	}
+	if *waitForReplication && len(replicaRegions) == 0 {
+		usageError(errors.New("--wait-for-replication requires multiple --region values"))
+	}
+
+	// Positional arguments are kept for backward compatibility
+	if args := flags.Args(); len(args) == 4 {
+		*repo, *region, *account = args[0], args[2], args[3]
+		digests.Set(args[1])
+	} else if len(args) != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	// AWS is configured before the arguments are validated, so that the region and account can be detected
+	if err := registryutils.ConfigureProxy(context.TODO(), *proxyUrl); err != nil {
+		usageError(err)
+	}
+	if err := registryutils.ConfigureAws(context.TODO(), awsOptions()); err != nil {
+		lambdaError(context.TODO(), "AWS credentials configuration error", err)
+		os.Exit(categoryExitCode(errorCategory(err)))
+	}
+	hasImages := *repo != "" || *repoPattern != "" || *stdin || *inputFile != ""
+	if hasImages && *registryHost == "" && *image == "" && (*region == "" || *account == "") {
+		detectRegionAndAccount(context.TODO(), region, account)
+	}
+
+	hasSource := *sourceRepo != "" || *sourceRegion != "" || *sourceAccount != "" || *sourceRoleArn != ""
+	if hasSource && (*repoPattern != "" || *tagPrefix != "" || *stdin || *inputFile != "" || *image != "" || *registryHost != "") {
+		usageError(errors.New("--source-repo, --source-region, --source-account and --source-role-arn can only be used with --repo, --region, --account and --digest or --tag"))
+	}
+	if *sourceExternalId != "" && *sourceRoleArn == "" {
+		usageError(errors.New("--source-external-id requires --source-role-arn"))
+	}
+	if *source != sourceRegistry && *source != sourceContainerd {
+		usageError(fmt.Errorf("--source must be either %s or %s", sourceRegistry, sourceContainerd))
+	}
+	if *source == sourceContainerd && (*sourceOciLayout != "" || *sourceDockerArchive != "") {
+		usageError(errors.New("--source containerd cannot be combined with --source-oci-layout or --source-docker-archive"))
+	}
+
+	var registryUrl string
+	var dest *destination
+	var forEachImage func(yield func(imageReference) bool) error
+	switch {
+	case *sourceOciLayout != "" || *sourceDockerArchive != "":
+		if *sourceOciLayout != "" && *sourceDockerArchive != "" {
+			usageError(errors.New("--source-oci-layout and --source-docker-archive cannot be combined"))
+		}
+		if *repoPattern != "" || *tagPrefix != "" || *stdin || *inputFile != "" || *image != "" || hasSource || len(digests) > 1 {
+			usageError(errors.New("--source-oci-layout and --source-docker-archive cannot be combined with --repo-pattern, --tag-prefix, --stdin, --input-file, --image, source flags or multiple digests"))
+		}
+		var ok bool
+		registryUrl, ok = registryUrlFromFlags(*registryHost, *region, *account, *fips)
+		if *repo == "" || !ok {
+			usageError(errors.New("--source-oci-layout and --source-docker-archive require --repo, and either --registry, or --region and --account"))
+		}
+		// The image is the only one in the source unless --digest or --tag is given
+		ref := imageReference{repo: *repo, tag: *tag}
+		if len(digests) > 0 {
+			ref.digest = digests[0]
+		}
+		forEachImage = listImages([]imageReference{ref})
+	case *repoPattern != "":
+		if *repo != "" || *tagPrefix != "" || *stdin || *inputFile != "" || *image != "" || len(digests) != 0 || *tag != "" {
+			usageError(errors.New("--repo-pattern cannot be combined with --repo, --tag-prefix, --stdin, --input-file, --image, --digest or --tag"))
+		}
+		if *region == "" || *account == "" || *registryHost != "" {
+			usageError(errors.New("--repo-pattern requires --region and --account, and cannot be combined with --registry"))
+		}
+		registryUrl = registryutils.BuildEcrRegistryUrl(*region, *account, *fips)
+		forEachImage = func(yield func(imageReference) bool) error {
+			ctx := logctx.WithRegistryURL(context.TODO(), registryUrl)
+			repositories, err := registryutils.ListRepositories(ctx, registryUrl, *repoPattern)
+			if err != nil {
+				return err
+			}
+			log.Info(ctx, fmt.Sprintf("%d repositories matched %s: %s", len(repositories), *repoPattern, strings.Join(repositories, ", ")))
+			for _, repository := range repositories {
+				digests, err := registryutils.ListRecentImageDigests(ctx, registryUrl, repository, *recentImages)
+				if err != nil {
+					return err
+				}
+				for _, digest := range digests {
+					if !yield(imageReference{repo: repository, digest: digest}) {
+						return nil
+					}
+				}
+			}
+			return nil
+		}
+		// Every matching image is processed even if another one fails
+		*keepGoing = true
+	case *tagPrefix != "":
+		if *stdin || *inputFile != "" || *image != "" || len(digests) != 0 || *tag != "" {
+			usageError(errors.New("--tag-prefix cannot be combined with --stdin, --input-file, --image, --digest or --tag"))
+		}
+		if *repo == "" || *region == "" || *account == "" || *registryHost != "" {
+			usageError(errors.New("--tag-prefix requires --repo, --region and --account, and cannot be combined with --registry"))
+		}
+		registryUrl = registryutils.BuildEcrRegistryUrl(*region, *account, *fips)
+		forEachImage = func(yield func(imageReference) bool) error {
+			digests, err := registryutils.ListImageDigestsByTagPrefix(context.TODO(), registryUrl, *repo, *tagPrefix)
+			if err != nil {
+				return err
+			}
+			log.Info(context.TODO(), fmt.Sprintf("Found %d images with a tag starting with %s", len(digests), *tagPrefix))
+			refs := make([]imageReference, 0, len(digests))
+			for _, digest := range digests {
+				refs = append(refs, imageReference{repo: *repo, digest: digest})
+			}
+			return listImages(refs)(yield)
+		}
+		// Every matching image is processed even if another one fails
+		*keepGoing = true
+	case *stdin:
+		if *inputFile != "" || *image != "" || len(digests) != 0 || *tag != "" {
+			usageError(errors.New("--stdin cannot be combined with --input-file, --image, --digest or --tag"))
+		}
+		var ok bool
+		if registryUrl, ok = registryUrlFromFlags(*registryHost, *region, *account, *fips); !ok {
+			usageError(errors.New("--stdin requires either --registry, or --region and --account"))
+		}
+		// Bare digests refer to images in --repo
+		forEachImage = scanImageEntries(os.Stdin, *repo)
+	case *inputFile != "":
+		if *image != "" || *repo != "" || len(digests) != 0 || *tag != "" {
+			usageError(errors.New("--input-file cannot be combined with --image, --repo, --digest or --tag"))
+		}
+		var ok bool
+		if registryUrl, ok = registryUrlFromFlags(*registryHost, *region, *account, *fips); !ok {
+			usageError(errors.New("--input-file requires either --registry, or --region and --account"))
+		}
+		file, err := os.Open(*inputFile)
+		if err != nil {
+			usageError(err)
+		}
+		defer file.Close()
+		forEachImage = scanImageEntries(file, "")
+	case *image != "":
+		if *repo != "" || *region != "" || *account != "" || *registryHost != "" || len(digests) != 0 || *tag != "" {
+			usageError(errors.New("--image cannot be combined with --repo, --digest, --tag, --region, --account or --registry"))
+		}
+		ref, err := parseImageReference(*image)
+		if err != nil {
+			usageError(err)
+		}
+		registryUrl = ref.registryUrl
+		forEachImage = listImages([]imageReference{*ref})
+	default:
+		var ok bool
+		registryUrl, ok = registryUrlFromFlags(*registryHost, *region, *account, *fips)
+		if *repo == "" || (len(digests) == 0 && *tag == "") || !ok {
+			flags.Usage()
+			os.Exit(1)
+		}
+		if *tag != "" && len(digests) > 1 {
+			usageError(errors.New("--tag cannot be combined with multiple digests"))
+		}
+		pullRepo := *repo
+		if hasSource {
+			// Images are pulled from the source, and copied to the repository given by --repo, --region and --account
+			dest = &destination{registryUrl: registryUrl, repo: *repo}
+			registryUrl = registryutils.BuildEcrRegistryUrl(cmp.Or(*sourceRegion, *region), cmp.Or(*sourceAccount, *account), *fips)
+			pullRepo = cmp.Or(*sourceRepo, *repo)
+		}
+		refs := []imageReference{{repo: pullRepo, tag: *tag}}
+		if len(digests) > 0 {
+			refs = refs[:0]
+			for _, digest := range digests {
+				refs = append(refs, imageReference{repo: pullRepo, digest: digest, tag: *tag})
+			}
+		}
+		forEachImage = listImages(refs)
+		// Every digest given on the command line is processed even if another one fails
+		*keepGoing = true
+	}
+
+	var createRepoSettings *registryutils.RepositorySettings
+	if *createRepo {
+		createRepoSettings = &registryutils.RepositorySettings{ImmutableTags: *createRepoImmutableTags, ScanOnPush: *createRepoScanOnPush, Tags: createRepoTags}
+	} else if *createRepoImmutableTags || *createRepoScanOnPush || len(createRepoTags) > 0 {
+		usageError(errors.New("--create-repo-immutable-tags, --create-repo-scan-on-push and --create-repo-tag require --create-repo"))
+	}
+	opts := options{
+		keepGoing:       *keepGoing,
+		workers:         *workers,
+		failFast:        *failFast,
+		strict:          *strict,
+		failOnSkip:      *failOnSkip,
+		skipExisting:    *skipExisting && !*force,
+		replaceExisting: *replaceExisting,
+		registryOptions: registryutils.RegistryOptions{
+			Credential:            auth.Credential{Username: *username, Password: *password},
+			DockerConfigFile:      *dockerConfig,
+			Endpoint:              *registryEndpoint,
+			PlainHttp:             *plainHttp,
+			CaCertFile:            *caCert,
+			InsecureSkipTlsVerify: *insecureSkipTlsVerify,
+			Referrers:             string(*referrers),
+			// The image is copied as a whole, including the platforms that get no SOCI index
+			PullAllPlatforms: dest != nil,
+		},
+		destination:       dest,
+		outputRepo:        *outputRepo,
+		annotations:       annotations,
+		output:            *output,
+		outputFile:        *outputFile,
+		digestOutput:      *digestOutput,
+		layerReport:       *layerReport,
+		layerReportFile:   *layerReportFile,
+		exportDir:         *exportOci,
+		exportTar:         *exportTar,
+		noPush:            *noPush,
+		noVerify:          *noVerify,
+		skipContentVerify: *skipContentVerify,
+		createRepo:        createRepoSettings,
+		dryRun:            *dryRun,
+		index: builder.IndexOptions{
+			MinLayerSize:           int64(minLayerSize),
+			SpanSize:               int64(spanSize),
+			ExcludeLayers:          excludeLayers,
+			ExcludeLayerMediaTypes: excludeLayerMediaTypes,
+			LayerOrder:             *layerOrder,
+		},
+		keepTemp:         *keepTemp,
+		streamLayers:     *streamLayers,
+		metrics:          *metrics,
+		metricsNamespace: *metricsNamespace,
+		notifySnsTopic:   *notifySnsTopic,
+		notifyWebhook:    *notifyWebhook,
+		emitEventBus:     *emitEventBus,
+	}
+	if *quiet {
+		log.DisableProgress()
+	}
+	store, err := parseStoreBackend(*storeBackendName)
+	if err != nil {
+		usageError(fmt.Errorf("--store-backend: %w", err))
+	}
+	if err := store.setWorkDir(*workDir); err != nil {
+		usageError(err)
+	}
+	opts.store = store
+	if store.stagingUrl != "" {
+		if *resume || *resumeDir != "" || dest != nil || *sourceOciLayout != "" || *sourceDockerArchive != "" || *source == sourceContainerd {
+			usageError(errors.New("--store-backend s3:// cannot be combined with --resume, source flags, --source-oci-layout, --source-docker-archive or --source containerd"))
+		}
+		// Staged layers are fetched one at a time, like --stream-layers
+		opts.streamLayers = true
+	}
+	if *resume || *resumeDir != "" {
+		opts.resumeDir = cmp.Or(*resumeDir, path.Join(store.dataDirRoot(), defaultResumeDirName))
+		if opts.streamLayers || *sourceOciLayout != "" || *sourceDockerArchive != "" || *source == sourceContainerd {
+			usageError(errors.New("--resume and --resume-dir cannot be combined with --stream-layers, --source-oci-layout, --source-docker-archive or --source containerd"))
+		}
+		if err := os.MkdirAll(opts.resumeDir, 0755); err != nil {
+			usageError(err)
+		}
+	}
+	if opts.streamLayers && (dest != nil || *sourceOciLayout != "" || *sourceDockerArchive != "" || *source == sourceContainerd) {
+		usageError(errors.New("--stream-layers cannot be combined with source flags, --source-oci-layout, --source-docker-archive or --source containerd"))
+	}
+	if opts.noPush && ((opts.exportDir == "" && opts.exportTar == "") || dest != nil || len(replicaRegions) > 0) {
+		usageError(errors.New("--no-push requires --export-oci or --export-tar, and cannot be combined with source flags or multiple --region values"))
+	}
+	if opts.metrics != metricsNone && opts.metrics != metricsCloudWatchEmf && opts.metrics != metricsCloudWatchApi && opts.metrics != metricsStdout {
+		usageError(fmt.Errorf("--metrics must be either %s, %s, %s or %s", metricsNone, metricsCloudWatchEmf, metricsCloudWatchApi, metricsStdout))
+	}
+	// stdout is left to the JSON document
+	if opts.metrics == metricsStdout && opts.output == outputJson {
+		usageError(fmt.Errorf("--metrics %s cannot be combined with --output json", metricsStdout))
+	}
+	if opts.layerReport != "" && opts.layerReport != layerReportJson && opts.layerReport != layerReportCsv {
+		usageError(fmt.Errorf("--layer-report must be either %s or %s", layerReportJson, layerReportCsv))
+	}
+	if opts.layerReport == "" && opts.layerReportFile != "" {
+		usageError(errors.New("--layer-report-file requires --layer-report"))
+	}
+	if opts.layerReport != "" && opts.layerReportFile == "" && (opts.output == outputJson || opts.metrics == metricsStdout) {
+		usageError(fmt.Errorf("--layer-report cannot be written to stdout with --output json or --metrics %s, pass --layer-report-file", metricsStdout))
+	}
+	if builder.CheckSpanSize(opts.index.SpanSize) != nil {
+		usageError(errors.New("--span-size must be a power of two between 1MiB and 1GiB"))
+	}
+	for _, layer := range opts.index.ExcludeLayers {
+		if _, err := godigest.Parse(layer); err != nil {
+			usageError(fmt.Errorf("--exclude-layer %s is not a valid digest: %w", layer, err))
+		}
+	}
+	if *signKmsKey != "" && *signKey != "" {
+		usageError(errors.New("--sign-kms-key and --sign-key cannot be combined"))
+	}
+	if (*signKmsKey != "" || *signKey != "") && opts.noPush {
+		usageError(errors.New("--sign-kms-key and --sign-key cannot be combined with --no-push"))
+	}
+	// The repositories of the images exist already, so only the ones they are copied or their SOCI indices pushed to may be missing
+	if opts.createRepo != nil && opts.destination == nil && opts.outputRepo == "" {
+		usageError(errors.New("--create-repo requires --output-repo, --source-repo or a local source"))
+	}
+	if opts.replaceExisting && (opts.skipExisting || opts.noPush) {
+		usageError(errors.New("--replace-existing cannot be combined with --skip-existing or --no-push"))
+	}
+	// A digest left over from a previous run must never be mistaken for the result of this one
+	if opts.digestOutput != "" {
+		if err := os.Remove(opts.digestOutput); err != nil && !errors.Is(err, os.ErrNotExist) {
+			usageError(err)
+		}
+	}
+	if opts.notifyWebhook != "" {
+		if webhookUrl, err := url.Parse(opts.notifyWebhook); err != nil || (webhookUrl.Scheme != "http" && webhookUrl.Scheme != "https") {
+			usageError(errors.New("--notify-webhook must be an http or https URL"))
+		}
+	}
+	if opts.output != outputText && opts.output != outputJson {
+		usageError(fmt.Errorf("--output must be either %s or %s", outputText, outputJson))
+	}
+	if opts.index.LayerOrder != builder.LayerOrderManifest && opts.index.LayerOrder != builder.LayerOrderSizeDesc {
+		usageError(fmt.Errorf("--layer-order must be either %s or %s", builder.LayerOrderManifest, builder.LayerOrderSizeDesc))
+	}
+	setRetryOptions(&opts.registryOptions)
+	if *workers < 1 {
+		usageError(errors.New("--workers must be at least 1"))
+	}
+	if *pullConcurrency < 1 {
+		usageError(errors.New("--pull-concurrency must be at least 1"))
+	}
+	opts.registryOptions.PullConcurrency = *pullConcurrency
+	if *maxMemory > 0 {
+		opts.maxMemory = int64(*maxMemory)
+		log.Info(context.TODO(), fmt.Sprintf("Decompressing up to %d layers at once within %d bytes of memory", registryutils.LimitMemory(opts.maxMemory), opts.maxMemory))
+	}
+	if *waitForReplication {
+		opts.replicationTimeout = *replicationTimeout
+	}
+	for _, replicaRegion := range replicaRegions {
+		opts.replicaRegistryUrls = append(opts.replicaRegistryUrls, registryutils.BuildEcrRegistryUrl(replicaRegion, *account, *fips))
+	}
+	for _, platformFlag := range platformFlags {
+		platform, err := platforms.Parse(platformFlag)
+		if err != nil {
+			usageError(err)
+		}
+		if !registryutils.IsSupportedPlatform(platform) {
+			usageError(fmt.Errorf("--platform %s is not supported, since soci-snapshotter only runs Linux images", platformFlag))
+		}
+		if !slices.ContainsFunc(opts.platforms, platforms.OnlyStrict(platform).Match) {
+			opts.platforms = append(opts.platforms, platform)
+		}
+	}
+	if opts.store.stagingUrl != "" {
+		opts.store.staging, err = registryutils.NewS3Staging(context.TODO(), opts.store.stagingUrl)
+		if err != nil {
+			lambdaError(context.TODO(), "Store backend configuration error", err)
+			os.Exit(1)
+		}
+	}
+	if *signKmsKey != "" || *signKey != "" {
+		var err error
+		if *signKmsKey != "" {
+			opts.signer, err = registryutils.NewKmsSigner(context.TODO(), *signKmsKey)
+		} else {
+			opts.signer, err = registryutils.NewKeySigner(*signKey)
+		}
+		if err != nil {
+			lambdaError(context.TODO(), "Signer configuration error", err)
+			os.Exit(1)
+		}
+	}
+	if *sourceOciLayout != "" || *sourceDockerArchive != "" {
+		var err error
+		if *sourceOciLayout != "" {
+			opts.localSource, err = registryutils.OpenOciLayout(context.TODO(), *sourceOciLayout)
+		} else {
+			opts.localSource, err = registryutils.OpenDockerArchive(context.TODO(), *sourceDockerArchive)
+		}
+		if err != nil {
+			lambdaError(context.TODO(), "Image source open error", err)
+			os.Exit(1)
+		}
+	}
+	if *source == sourceContainerd {
+		containerdSource, err := registryutils.OpenContainerd(context.TODO(), *containerdAddress, *namespace)
+		if err != nil {
+			lambdaError(context.TODO(), "Image source open error", err)
+			os.Exit(1)
+		}
+		opts.containerdSource = containerdSource
+	}
+	if *sourceRoleArn != "" {
+		// The source role is assumed with the same base credentials as --role-arn, but independently of it
+		sourceAwsOptions := awsOptions()
+		sourceAwsOptions.RoleArn, sourceAwsOptions.ExternalId = *sourceRoleArn, *sourceExternalId
+		sourceSession, err := registryutils.NewAwsSession(logctx.WithRegistryURL(context.TODO(), registryUrl), sourceAwsOptions)
+		if err != nil {
+			lambdaError(context.TODO(), "Source AWS credentials configuration error", err)
+			os.Exit(categoryExitCode(errorCategory(err)))
+		}
+		opts.sourceAwsSession = sourceSession
+	}
+	// The SOCI indices are exported to a temporary OCI image layout to be packaged, even if --export-oci is given as well
+	forgetExportDir := func() {}
+	if opts.exportTar != "" {
+		exportDir, err := os.MkdirTemp(opts.store.dataDirRoot(), "soci-export-")
+		if err != nil {
+			lambdaError(context.TODO(), "Export directory creation error", err)
+			os.Exit(1)
+		}
+		opts.exportTarDir = exportDir
+		forgetExportDir = trackTempDir(exportDir)
+	}
+	stopProfiling := func() {}
+	if *profileDir != "" {
+		var err error
+		if stopProfiling, err = startProfiling(*profileDir); err != nil {
+			lambdaError(context.TODO(), "Profiling configuration error", err)
+			os.Exit(1)
+		}
+	}
+	removeStaleTempDirs(context.TODO(), opts.store.dataDirRoot(), *removeStaleAfter)
+	// The temporary directory of the image in progress is removed as its pull or build is canceled
+	ctx, stopHandlingInterrupts := handleInterrupts(context.TODO())
+	cancel := context.CancelFunc(func() {})
+	if *timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+	}
+	results, err := process(ctx, registryUrl, nil, forEachImage, opts)
+	stopHandlingInterrupts()
+	switch {
+	case interrupted(ctx):
+		err = errors.Join(errInterrupted, err)
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		err = errors.Join(fmt.Errorf("%w after %s", errTimeout, *timeout), err)
+	}
+	cancel()
+	if opts.exportTar != "" && err == nil && !slices.ContainsFunc(results, imageResult.failed) {
+		if archiveErr := writeExportArchive(opts.exportTarDir, opts.exportTar, results); archiveErr != nil {
+			err = fmt.Errorf("Couldn't write %s: %w", opts.exportTar, archiveErr)
+			lambdaError(context.TODO(), "Export archive write error", err)
+		}
+	}
+	if opts.exportTarDir != "" {
+		os.RemoveAll(opts.exportTarDir)
+		forgetExportDir()
+	}
+	if opts.containerdSource != nil {
+		opts.containerdSource.Close()
+	}
+	stopProfiling()
+	exitWithSummary(results, err, opts)
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	metricsutils "github.com/tmokmss/soci-wrapper/internal/metrics"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	registryutils "github.com/tmokmss/soci-wrapper/utils/registry"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// Values of --metrics
+const (
+	metricsNone          = "none"
+	metricsCloudWatchEmf = "cloudwatch-emf"
+	metricsCloudWatchApi = "cloudwatch-api"
+	// The metrics of the process in the Prometheus text format, written to stdout at the end of the run
+	metricsStdout = "stdout"
+)
+
+// CloudWatch namespace of the metrics by default
+const defaultMetricsNamespace = "SociWrapper"
+
+// The metrics of a build, emitted whatever its outcome
+func buildMetrics(result *buildResult) []registryutils.MetricDatum {
+	outcome := func(status string) float64 {
+		if result.status() == status {
+			return 1
+		}
+		return 0
+	}
+	durations := result.Durations
+	return []registryutils.MetricDatum{
+		{Name: "Builds", Unit: "Count", Value: 1},
+		{Name: "BuildsSucceeded", Unit: "Count", Value: outcome(statusSucceeded)},
+		{Name: "BuildsFailed", Unit: "Count", Value: outcome(statusFailed)},
+		{Name: "BuildsSkipped", Unit: "Count", Value: outcome(statusSkipped)},
+		{Name: "ValidationDuration", Unit: "Seconds", Value: durations.Validation},
+		{Name: "PullDuration", Unit: "Seconds", Value: durations.Pull},
+		{Name: "BuildDuration", Unit: "Seconds", Value: durations.Build},
+		{Name: "PushDuration", Unit: "Seconds", Value: durations.Push},
+		{Name: "TotalDuration", Unit: "Seconds", Value: durations.total()},
+		{Name: "BytesPulled", Unit: "Bytes", Value: float64(result.BytesPulled)},
+		{Name: "BytesPushed", Unit: "Bytes", Value: float64(result.BytesPushed)},
+		{Name: "IndexSize", Unit: "Bytes", Value: float64(result.indexSize())},
+	}
+}
+
+// Emit the metrics of a build as configured by opts, in the region of the image if CloudWatch is called.
+// A failure to emit metrics is logged without failing the build.
+func emitMetrics(ctx context.Context, region string, opts options, result *buildResult) {
+	recordBuildMetrics(result)
+	dimensions := map[string]string{"Repository": result.Repository, "SociVersion": result.SociVersion}
+	data := buildMetrics(result)
+	switch opts.metrics {
+	case metricsCloudWatchEmf:
+		output := opts.metricsOutput
+		if output == nil {
+			output = os.Stderr
+		}
+		if err := writeEmf(output, opts.metricsNamespace, dimensions, data); err != nil {
+			log.Warn(ctx, fmt.Sprintf("Couldn't write metrics: %v", err))
+		}
+	case metricsCloudWatchApi:
+		if err := registryutils.PutMetricData(ctx, region, opts.metricsNamespace, dimensions, data); err != nil {
+			log.Warn(ctx, fmt.Sprintf("Couldn't put metrics to CloudWatch: %v", err))
+		}
+	}
+}
+
+// Write metrics as a line of CloudWatch Embedded Metric Format, which CloudWatch Logs turns into metrics.
+// See https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+func writeEmf(w io.Writer, namespace string, dimensions map[string]string, data []registryutils.MetricDatum) error {
+	dimensionNames := make([]string, 0, len(dimensions))
+	line := map[string]any{}
+	for name, value := range dimensions {
+		dimensionNames = append(dimensionNames, name)
+		line[name] = value
+	}
+	sort.Strings(dimensionNames)
+	definitions := make([]map[string]string, 0, len(data))
+	for _, datum := range data {
+		definitions = append(definitions, map[string]string{"Name": datum.Name, "Unit": datum.Unit})
+		line[datum.Name] = datum.Value
+	}
+	line["_aws"] = map[string]any{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]any{{
+			"Namespace":  namespace,
+			"Dimensions": [][]string{dimensionNames},
+			"Metrics":    definitions,
+		}},
+	}
+	b, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+// Add a build to the metrics of the process, served with --metrics-addr or written with --metrics stdout
+func recordBuildMetrics(result *buildResult) {
+	metricsutils.BuildsTotal.Add(1, result.status())
+	metricsutils.BytesPulledTotal.Add(float64(result.BytesPulled))
+	metricsutils.BytesPushedTotal.Add(float64(result.BytesPushed))
+	durations := result.Durations
+	for phase, seconds := range map[string]float64{phaseValidation: durations.Validation, phasePull: durations.Pull, phaseBuild: durations.Build, phasePush: durations.Push} {
+		// Phases a build did not reach are not observed
+		if seconds > 0 {
+			metricsutils.BuildDurationSeconds.Observe(seconds, phase)
+		}
+	}
+}
+
+// Serve the metrics of the process under /metrics on addr until the process exits
+func serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsutils.Handler())
+	log.Info(ctx, fmt.Sprintf("Serving metrics on http://%s/metrics", addr))
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Error(ctx, "Metrics server error", err)
+		}
+	}()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	registryutils "github.com/tmokmss/soci-wrapper/utils/registry"
+	"os"
+)
+
+// Send the results of a run to the SNS topic and the webhook of opts, in the same JSON document as --output json.
+// A failure to notify is logged without changing the exit code.
+func notify(ctx context.Context, results []imageResult, err error, opts options) {
+	if opts.notifySnsTopic == "" && opts.notifyWebhook == "" {
+		return
+	}
+	var body bytes.Buffer
+	if writeErr := writeJsonResults(&body, results, err); writeErr != nil {
+		log.Warn(ctx, fmt.Sprintf("Couldn't encode the notification: %v", writeErr))
+		return
+	}
+
+	if opts.notifySnsTopic != "" {
+		if publishErr := registryutils.PublishSns(ctx, opts.notifySnsTopic, notificationSubject(results, err), body.String()); publishErr != nil {
+			log.Warn(ctx, fmt.Sprintf("Couldn't publish the results to %s: %v", opts.notifySnsTopic, publishErr))
+		}
+	}
+	if opts.notifyWebhook != "" {
+		if postErr := registryutils.PostWebhook(ctx, opts.notifyWebhook, body.Bytes(), os.Getenv(registryutils.WebhookSecretEnv)); postErr != nil {
+			log.Warn(ctx, fmt.Sprintf("Couldn't post the results to the webhook: %v", postErr))
+		}
+	}
+}
+
+// Summarize a run in the subject of an SNS message, e.g. for email subscriptions
+func notificationSubject(results []imageResult, err error) string {
+	failed, skipped := 0, 0
+	for _, result := range results {
+		if result.failed() {
+			failed++
+		} else if result.skipped() {
+			skipped++
+		}
+	}
+	if err != nil {
+		return fmt.Sprintf("soci-wrapper failed after %d images", len(results))
+	}
+	return fmt.Sprintf("soci-wrapper: %d succeeded, %d failed, %d skipped", len(results)-failed-skipped, failed, skipped)
+}
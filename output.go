@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	metricsutils "github.com/tmokmss/soci-wrapper/internal/metrics"
+	"github.com/tmokmss/soci-wrapper/pkg/builder"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"github.com/tmokmss/soci-wrapper/utils/logctx"
+	registryutils "github.com/tmokmss/soci-wrapper/utils/registry"
+	"github.com/tmokmss/soci-wrapper/utils/tracing"
+	"github.com/tmokmss/soci-wrapper/utils/version"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// Output formats of --output
+	outputText = "text"
+	outputJson = "json"
+
+	// Version of the SOCI indices built by this tool
+	sociVersion = builder.SociVersionV1
+)
+
+// Outcomes of a build, for Step Functions Choice states and other tools to branch on
+const (
+	outcomeBuilt             = "BUILT"
+	outcomeSkippedValidation = "SKIPPED_VALIDATION"
+	outcomeSkippedExisting   = "SKIPPED_EXISTING"
+	// No layer of the image is worth a ztoc, so no SOCI index was pushed
+	outcomeSkippedNothingToIndex = "SKIPPED_NOTHING_TO_INDEX"
+	// The image is of a platform soci-snapshotter cannot run, such as Windows
+	outcomeSkippedUnsupportedPlatform = "SKIPPED_UNSUPPORTED_PLATFORM"
+	// The image was deleted between its validation and its pull
+	outcomeSkippedImageDeleted = "SKIPPED_IMAGE_DELETED"
+	outcomeFailed              = "FAILED"
+)
+
+// Statuses of a build, which tell its outcome apart only as built, skipped or failed
+const (
+	statusSucceeded = "succeeded"
+	statusSkipped   = "skipped"
+	statusFailed    = "failed"
+)
+
+// The structured outcome of building SOCI indices for a single image, printed with --output json
+// along with its status, derived from Outcome
+type buildResult struct {
+	// Either outcomeBuilt, outcomeSkippedValidation, outcomeSkippedExisting, outcomeSkippedNothingToIndex, outcomeSkippedUnsupportedPlatform, outcomeSkippedImageDeleted or outcomeFailed
+	Outcome     string `json:"outcome"`
+	Repository  string `json:"repository"`
+	Digest      string `json:"digest,omitempty"`
+	Tag         string `json:"tag,omitempty"`
+	SociVersion string `json:"sociVersion"`
+	// Span size of the ztocs in bytes
+	SpanSize int64 `json:"spanSize"`
+	// How the SOCI indices were indexed as referrers of the image
+	ReferrersMechanism string         `json:"referrersMechanism,omitempty"`
+	Indices            []indexResult  `json:"indices,omitempty"`
+	Durations          buildDurations `json:"durations"`
+	Message            string         `json:"message"`
+	Error              *buildError    `json:"error,omitempty"`
+	// Total size of the blobs pulled to build the SOCI indices
+	BytesPulled int64 `json:"bytesPulled"`
+	// Total size of the blobs pushed, including the ones the registries already had
+	BytesPushed int64 `json:"bytesPushed"`
+	// Phase the build failed in, either phaseValidation, phasePull, phaseBuild or phasePush
+	FailedPhase string `json:"failedPhase,omitempty"`
+	// Temporary directory of the image, kept with --keep-temp
+	TempDir string `json:"tempDir,omitempty"`
+	// Repository the SOCI indices are pushed to
+	indexRepo string
+	// Phase in progress and when it started
+	phase      string
+	phaseStart time.Time
+}
+
+// Phases of a build, timed separately
+const (
+	phaseValidation = "validation"
+	phasePull       = "pull"
+	phaseBuild      = "build"
+	phasePush       = "push"
+)
+
+// The status of a build: statusSucceeded if it was built, statusFailed if it failed, or statusSkipped otherwise
+func (result *buildResult) status() string {
+	switch result.Outcome {
+	case outcomeBuilt:
+		return statusSucceeded
+	case outcomeFailed:
+		return statusFailed
+	}
+	return statusSkipped
+}
+
+func (result *buildResult) MarshalJSON() ([]byte, error) {
+	// Without its methods, so that the fields are marshaled as usual
+	type fields buildResult
+	return json.Marshal(struct {
+		Status string `json:"status"`
+		*fields
+	}{result.status(), (*fields)(result)})
+}
+
+// Start timing phase, ending the phase in progress
+func (result *buildResult) startPhase(phase string) {
+	result.endPhase()
+	result.phase = phase
+}
+
+// Add the time spent since the phase in progress started to its duration.
+// The phase is kept so that a failure can be attributed to it.
+func (result *buildResult) endPhase() {
+	seconds := time.Since(result.phaseStart).Seconds()
+	result.phaseStart = time.Now()
+	switch result.phase {
+	case phaseValidation:
+		result.Durations.Validation += seconds
+	case phasePull:
+		result.Durations.Pull += seconds
+	case phaseBuild:
+		result.Durations.Build += seconds
+	case phasePush:
+		result.Durations.Push += seconds
+	}
+}
+
+// Total size of the built SOCI indices
+func (result *buildResult) indexSize() int64 {
+	var size int64
+	for _, index := range result.Indices {
+		size += index.Size
+	}
+	return size
+}
+
+// Number of layers of the indexed image manifests, with or without a ztoc
+func (result *buildResult) layerCount() int {
+	layers := 0
+	for _, index := range result.Indices {
+		layers += len(index.Ztocs) + len(index.SkippedLayers)
+	}
+	return layers
+}
+
+// A SOCI index built for a platform of an image
+type indexResult struct {
+	Platform string `json:"platform,omitempty"`
+	Digest   string `json:"digest"`
+	// Total size of the SOCI index manifest and its ztocs
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Ztocs       []ztocResult      `json:"ztocs"`
+	// Digest of the cosign signature of the SOCI index, if it was signed
+	Signature string `json:"signature,omitempty"`
+	// Layers of the image that got no ztoc
+	SkippedLayers []skippedLayerResult `json:"skippedLayers,omitempty"`
+	// Every layer of the image manifest, listed by --layer-report
+	layers []builder.LayerResult
+}
+
+// A layer of an image that got no ztoc, so that it is pulled as a whole
+type skippedLayerResult struct {
+	LayerDigest string `json:"layerDigest"`
+	MediaType   string `json:"mediaType"`
+	Reason      string `json:"reason"`
+}
+
+// A ztoc of an image layer in a SOCI index
+type ztocResult struct {
+	LayerDigest string `json:"layerDigest"`
+	Digest      string `json:"digest"`
+	Size        int64  `json:"size"`
+}
+
+// Time spent in each phase of a build, in seconds
+type buildDurations struct {
+	Validation float64 `json:"validationSeconds"`
+	Pull       float64 `json:"pullSeconds"`
+	Build      float64 `json:"buildSeconds"`
+	Push       float64 `json:"pushSeconds"`
+}
+
+func (durations buildDurations) total() float64 {
+	return durations.Validation + durations.Pull + durations.Build + durations.Push
+}
+
+func (durations *buildDurations) add(other buildDurations) {
+	durations.Validation += other.Validation
+	durations.Pull += other.Pull
+	durations.Build += other.Build
+	durations.Push += other.Push
+}
+
+// Totals of a run over all of its images
+type runSummary struct {
+	Durations   buildDurations `json:"durations"`
+	BytesPulled int64          `json:"bytesPulled"`
+	BytesPushed int64          `json:"bytesPushed"`
+	Layers      int            `json:"layers"`
+	IndexSize   int64          `json:"indexSize"`
+	// Number of failed images by the phase they failed in
+	FailedPhases map[string]int `json:"failedPhases,omitempty"`
+}
+
+func summarize(results []imageResult) runSummary {
+	var summary runSummary
+	for _, result := range results {
+		build := result.build
+		if build == nil {
+			continue
+		}
+		summary.Durations.add(build.Durations)
+		summary.BytesPulled += build.BytesPulled
+		summary.BytesPushed += build.BytesPushed
+		summary.Layers += build.layerCount()
+		summary.IndexSize += build.indexSize()
+		if build.FailedPhase != "" {
+			if summary.FailedPhases == nil {
+				summary.FailedPhases = map[string]int{}
+			}
+			summary.FailedPhases[build.FailedPhase]++
+		}
+	}
+	return summary
+}
+
+func (summary runSummary) String() string {
+	durations := summary.Durations
+	msg := fmt.Sprintf("Spent %.1fs validating, %.1fs pulling, %.1fs building and %.1fs pushing. Pulled %d bytes and pushed %d bytes, indexing %d layers into %d bytes of SOCI indices",
+		durations.Validation, durations.Pull, durations.Build, durations.Push, summary.BytesPulled, summary.BytesPushed, summary.Layers, summary.IndexSize)
+	if len(summary.FailedPhases) > 0 {
+		failures := make([]string, 0, len(summary.FailedPhases))
+		for _, phase := range []string{phaseValidation, phasePull, phaseBuild, phasePush} {
+			if n := summary.FailedPhases[phase]; n > 0 {
+				failures = append(failures, fmt.Sprintf("%d in %s", n, phase))
+			}
+		}
+		msg += fmt.Sprintf(". Failed %s", strings.Join(failures, ", "))
+	}
+	return msg
+}
+
+// Why a build failed. Code is a stable identifier of the failed step, e.g. ImagePullError
+type buildError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Either errorCategoryValidation, errorCategoryNotFound, errorCategoryAuth, errorCategoryThrottled,
+	// errorCategoryNetwork, errorCategoryDisk or errorCategoryInternal
+	Category  string `json:"category"`
+	Retryable bool   `json:"retryable"`
+	// What the registry or AWS API answered to the failed request, if the build failed on one
+	HttpStatus   int    `json:"httpStatus,omitempty"`
+	RegistryCode string `json:"registryCode,omitempty"`
+	RequestId    string `json:"requestId,omitempty"`
+	// What to do about a well-known registry error
+	Hint string `json:"hint,omitempty"`
+}
+
+func newBuildError(msg string, err error) *buildError {
+	category := errorCategory(err)
+	buildErr := &buildError{Code: errorCode(msg), Message: err.Error(), Category: category, Retryable: isRetryable(category)}
+	if details := registryutils.DescribeError(err); details != nil {
+		buildErr.HttpStatus = details.StatusCode
+		buildErr.RegistryCode = details.Code
+		buildErr.RequestId = details.RequestId
+		buildErr.Hint = details.Hint
+	}
+	return buildErr
+}
+
+// Build and push a SOCI index for a single image, and return the outcome of the build
+func processImage(ctx context.Context, registry *registryutils.Registry, destinationRegistry *registryutils.Registry, replicas []replicaRegistry, ref imageReference, opts options) (*buildResult, error) {
+	result := &buildResult{
+		Repository:  ref.repo,
+		Digest:      ref.digest,
+		Tag:         ref.tag,
+		SociVersion: sociVersion,
+		SpanSize:    opts.index.SpanSize,
+		phaseStart:  time.Now(),
+	}
+	ctx, span := tracing.Start(ctx, "BuildImage", attribute.String("soci.repository", ref.repo))
+	metricsutils.InflightBuilds.Add(1)
+	msg, err := buildAndPush(ctx, registry, destinationRegistry, replicas, ref, opts, result)
+	metricsutils.InflightBuilds.Add(-1)
+	result.endPhase()
+	result.Message = msg
+	switch {
+	case errors.Is(err, errImageSkipped):
+		result.Outcome = outcomeSkippedExisting
+		if errors.Is(err, errImageInvalid) {
+			result.Outcome = outcomeSkippedValidation
+		}
+		if errors.Is(err, errImageNothingToIndex) {
+			result.Outcome = outcomeSkippedNothingToIndex
+		}
+		if errors.Is(err, errImageUnsupportedPlatform) {
+			result.Outcome = outcomeSkippedUnsupportedPlatform
+		}
+		if errors.Is(err, errImageDeleted) {
+			result.Outcome = outcomeSkippedImageDeleted
+		}
+	case err != nil:
+		result.Outcome = outcomeFailed
+		result.Error = newBuildError(msg, err)
+		result.FailedPhase = result.phase
+	default:
+		result.Outcome = outcomeBuilt
+	}
+	span.SetAttributes(attribute.String("soci.image.digest", result.Digest), attribute.String("soci.outcome", result.Outcome))
+	// Skipped images are not errors in traces either
+	var spanErr error
+	if result.Outcome == outcomeFailed {
+		spanErr = err
+	}
+	tracing.End(span, spanErr)
+	summaryCtx := logctx.WithRepositoryName(ctx, ref.repo)
+	if result.Digest != "" {
+		summaryCtx = logctx.WithImageDigest(summaryCtx, result.Digest)
+	}
+	log.Info(summaryCtx, summarize([]imageResult{{build: result}}).String())
+	// Metrics are emitted on failures as well, to track the success rate
+	emitMetrics(ctx, ref.region, opts, result)
+	return result, err
+}
+
+// Describe a built SOCI index
+func newIndexResult(platform string, index *soci.Index, desc ocispec.Descriptor, layers []builder.LayerResult) indexResult {
+	size := desc.Size
+	ztocs := make([]ztocResult, 0, len(index.Blobs))
+	for _, blob := range index.Blobs {
+		size += blob.Size
+		ztocs = append(ztocs, ztocResult{
+			LayerDigest: blob.Annotations[soci.IndexAnnotationImageLayerDigest],
+			Digest:      blob.Digest.String(),
+			Size:        blob.Size,
+		})
+	}
+	var skippedLayers []skippedLayerResult
+	for _, layer := range layers {
+		if layer.SkipReason != "" {
+			skippedLayers = append(skippedLayers, skippedLayerResult{LayerDigest: layer.Digest, MediaType: layer.MediaType, Reason: layer.SkipReason})
+		}
+	}
+	return indexResult{
+		Platform:    platform,
+		Digest:      desc.Digest.String(),
+		Size:        size,
+		Annotations: index.Annotations,
+		Ztocs:       ztocs,
+
+		SkippedLayers: skippedLayers,
+		layers:        layers,
+	}
+}
+
+// Turn an error message such as "Image pull error" into an error code such as ImagePullError
+func errorCode(msg string) string {
+	var code strings.Builder
+	for _, word := range strings.Fields(msg) {
+		first, size := utf8.DecodeRuneInString(word)
+		code.WriteRune(unicode.ToUpper(first))
+		code.WriteString(word[size:])
+	}
+	return code.String()
+}
+
+// Write the outcome of every image as a JSON document
+func writeJsonResults(w io.Writer, results []imageResult, err error) error {
+	document := struct {
+		Results   []*buildResult `json:"results"`
+		Succeeded int            `json:"succeeded"`
+		Failed    int            `json:"failed"`
+		Skipped   int            `json:"skipped"`
+		Summary   runSummary     `json:"summary"`
+		Error     string         `json:"error,omitempty"`
+		// Build of soci-wrapper the SOCI indices were built with
+		Version version.Info `json:"version"`
+	}{Results: []*buildResult{}, Summary: summarize(results), Version: version.Get()}
+	for _, result := range results {
+		document.Results = append(document.Results, result.build)
+		switch {
+		case result.failed():
+			document.Failed++
+		case result.skipped():
+			document.Skipped++
+		default:
+			document.Succeeded++
+		}
+	}
+	if err != nil {
+		document.Error = err.Error()
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(document)
+}
+
+// Write the outcome of every image to a JSON file
+func writeJsonResultsFile(path string, results []imageResult, err error) error {
+	file, createErr := os.Create(path)
+	if createErr != nil {
+		return createErr
+	}
+	if writeErr := writeJsonResults(file, results, err); writeErr != nil {
+		file.Close()
+		return writeErr
+	}
+	if closeErr := file.Close(); closeErr != nil {
+		return fmt.Errorf("Couldn't write %s: %w", path, closeErr)
+	}
+	return nil
+}
+
+// Write the digest of every pushed SOCI index to a file, one per line.
+// The file is written atomically, so a partially written file is never read.
+// Nothing is written if no SOCI index was pushed, e.g. when every image was skipped.
+func writeDigestOutput(path string, results []imageResult) error {
+	var digests strings.Builder
+	for _, result := range results {
+		for _, index := range result.build.Indices {
+			digests.WriteString(index.Digest + "\n")
+		}
+	}
+	if digests.Len() == 0 {
+		return nil
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(digests.String()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
@@ -0,0 +1,209 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package builder builds and pushes the SOCI index of an image in ECR, as soci-wrapper build does,
+// for Go programs such as a CDK custom resource Lambda that would rather not run the binary.
+//
+//	b, err := builder.New(builder.Options{
+//		Repo:    "my-app",
+//		Digest:  "sha256:...",
+//		Region:  "us-west-2",
+//		Account: "123456789012",
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	result, err := b.Build(ctx)
+//	if err != nil {
+//		return err
+//	}
+//	for _, index := range result.Indices {
+//		fmt.Println(index.Platform, index.Digest)
+//	}
+//
+// AWS credentials are resolved with the default credential chain of the AWS SDK, as for the CLI.
+// The lower-level functions of this package, such as BuildIndices, PushIndices and VerifyIndices, are the steps Build and the CLI share.
+//
+// The API of this package follows the semantic version of the module: it is only changed incompatibly in a new major version.
+// The other packages of the module are details of the CLI and may change in any release.
+package builder
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"github.com/tmokmss/soci-wrapper/utils/logctx"
+	registryutils "github.com/tmokmss/soci-wrapper/utils/registry"
+
+	"github.com/containerd/containerd/platforms"
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog"
+)
+
+// Version of the SOCI indices built
+const SociVersionV1 = "v1"
+
+// What to build the SOCI index of, and how
+type Options struct {
+	// Name of the ECR repository of the image, where its SOCI index is pushed as well
+	Repo string
+	// Digest of the image manifest or image index. Every platform of an image index gets its own SOCI index
+	Digest string
+	// AWS region of the ECR repository
+	Region string
+	// AWS account ID of the ECR repository
+	Account string
+	// Version of the SOCI index, which can only be SociVersionV1, the default
+	SociVersion string
+	// Tag to push the SOCI index with. Not supported, since SOCI v1 indices are not tagged
+	OutputTag string
+	// Layers smaller than this number of bytes get no ztoc. DefaultMinLayerSize if 0
+	MinLayerSize int64
+	// Size of the uncompressed layer data between the checkpoints of the ztocs, checked by CheckSpanSize. DefaultSpanSize if 0
+	SpanSize int64
+	// Directory to create the temporary directory of the image in. The default directory for temporary files if empty
+	WorkDir string
+	// Skip checking that the pulled manifests and blobs, read back from disk, have the digests they are referenced with from Digest.
+	// Content that does not match fails the build with an error wrapping registryutils.ErrContentVerification otherwise
+	SkipContentVerify bool
+	// Skip checking that the pushed SOCI indices are complete in the repository. Incomplete ones are deleted and fail the build otherwise
+	NoVerify bool
+	// Logger to write the log lines of the build with. The logger of soci-wrapper, writing JSON lines to stderr, if nil
+	Logger *zerolog.Logger
+}
+
+// Builds and pushes the SOCI index of an image, created by New
+type Builder struct {
+	opts Options
+}
+
+// Outcome of a build
+type Result struct {
+	Repository  string `json:"repository"`
+	Digest      string `json:"digest"`
+	SociVersion string `json:"sociVersion"`
+	// SOCI indices pushed, one per platform of an image index, or a single one for an image manifest
+	Indices []IndexResult `json:"indices"`
+	// How the SOCI indices are indexed as referrers of their image, either registryutils.ReferrersApi or registryutils.ReferrersTagSchema
+	ReferrersMechanism string `json:"referrersMechanism"`
+}
+
+// A SOCI index pushed by a build
+type IndexResult struct {
+	// Platform of the image manifest the SOCI index refers to, e.g. linux/arm64, or empty for an image manifest
+	Platform string `json:"platform,omitempty"`
+	// Digest of the SOCI index manifest
+	Digest string `json:"digest"`
+	// Every layer of the image manifest, with its ztoc if it got one
+	Layers []LayerResult `json:"layers"`
+}
+
+// Check the options of a build and create its Builder
+func New(opts Options) (*Builder, error) {
+	if opts.Repo == "" || opts.Digest == "" || opts.Region == "" || opts.Account == "" {
+		return nil, errors.New("Repo, Digest, Region and Account are required")
+	}
+	if _, err := godigest.Parse(opts.Digest); err != nil {
+		return nil, fmt.Errorf("Invalid digest %s: %w", opts.Digest, err)
+	}
+	if opts.SociVersion != "" && opts.SociVersion != SociVersionV1 {
+		return nil, fmt.Errorf("SOCI version %s is not supported, only %s indices are built", opts.SociVersion, SociVersionV1)
+	}
+	if opts.OutputTag != "" {
+		return nil, errors.New("OutputTag is not supported, since SOCI v1 indices are not tagged")
+	}
+	opts.SociVersion = SociVersionV1
+	opts.MinLayerSize = cmp.Or(opts.MinLayerSize, DefaultMinLayerSize)
+	opts.SpanSize = cmp.Or(opts.SpanSize, DefaultSpanSize)
+	if err := CheckSpanSize(opts.SpanSize); err != nil {
+		return nil, err
+	}
+	return &Builder{opts: opts}, nil
+}
+
+// Pull the image to a temporary directory, build its SOCI index and push it to the repository of the image.
+// The temporary directory is removed before returning, whether the build succeeded or not.
+// Platforms with no layer worth a ztoc get no SOCI index, and if no platform gets one, the error wraps ErrNothingToIndex.
+func (b *Builder) Build(ctx context.Context) (*Result, error) {
+	opts := b.opts
+	if opts.Logger != nil {
+		ctx = log.WithLogger(ctx, *opts.Logger)
+	}
+	registryUrl := registryutils.BuildEcrRegistryUrl(opts.Region, opts.Account, false)
+	ctx = logctx.WithRegistryURL(ctx, registryUrl)
+	ctx = logctx.WithRepositoryName(ctx, opts.Repo)
+	ctx = logctx.WithImageDigest(ctx, opts.Digest)
+
+	registry, err := registryutils.Init(ctx, registryUrl, registryutils.RegistryOptions{
+		MaxRetries:   registryutils.DefaultMaxRetries,
+		RetryMaxWait: registryutils.DefaultRetryMaxWait,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't initialize the registry client: %w", err)
+	}
+	if err := registry.ValidateImageManifest(ctx, opts.Repo, opts.Digest); err != nil {
+		return nil, err
+	}
+
+	dataDir, err := os.MkdirTemp(opts.WorkDir, "soci-wrapper-")
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create the temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dataDir)
+	sociStore, err := InitSociStore(ctx, dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	desc, err := registry.Pull(ctx, opts.Repo, sociStore, opts.Digest, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't pull the image: %w", err)
+	}
+	if !opts.SkipContentVerify {
+		if err := registryutils.VerifyContent(ctx, sociStore, *desc, opts.Digest); err != nil {
+			return nil, err
+		}
+	}
+	imagePlatforms, perPlatform, err := ImagePlatforms(ctx, dataDir, *desc)
+	if err != nil {
+		return nil, err
+	}
+
+	indexOptions := IndexOptions{MinLayerSize: opts.MinLayerSize, SpanSize: opts.SpanSize}
+	targets := make([]ocispec.Descriptor, len(imagePlatforms))
+	for i := range targets {
+		targets[i] = *desc
+	}
+	built, err := BuildIndices(ctx, dataDir, sociStore, opts.Repo+"@"+opts.Digest, targets, imagePlatforms, perPlatform, nil, indexOptions, nil)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{Repository: opts.Repo, Digest: opts.Digest, SociVersion: opts.SociVersion}
+	indexDescriptors := make([]ocispec.Descriptor, 0, len(built))
+	indexedPlatforms := make([]ocispec.Platform, 0, len(built))
+	for _, index := range built {
+		platformName := ""
+		if perPlatform {
+			platformName = platforms.Format(index.Platform)
+		}
+		indexDescriptors = append(indexDescriptors, index.Descriptor)
+		indexedPlatforms = append(indexedPlatforms, index.Platform)
+		result.Indices = append(result.Indices, IndexResult{Platform: platformName, Digest: index.Descriptor.Digest.String(), Layers: index.Layers})
+	}
+	result.ReferrersMechanism, err = PushIndices(ctx, registry, sociStore, opts.Repo, indexDescriptors, indexedPlatforms, perPlatform)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.NoVerify {
+		if err := VerifyIndices(ctx, registry, sociStore, opts.Repo, indexDescriptors, result.ReferrersMechanism); err != nil {
+			return nil, err
+		}
+	}
+	log.Info(ctx, fmt.Sprintf("Successfully built and pushed %d SOCI indices with the %s", len(result.Indices), result.ReferrersMechanism))
+	return result, nil
+}
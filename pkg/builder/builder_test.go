@@ -0,0 +1,50 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package builder
+
+import (
+	"testing"
+)
+
+const testDigest = "sha256:bb4b312b0d0bd3fd0b2d8a0b1e0ed2a2e6c1dfe4e9f3b0f1c6f04c1b6a1bd0f5"
+
+func TestNew(t *testing.T) {
+	valid := Options{Repo: "my-app", Digest: testDigest, Region: "us-west-2", Account: "123456789012"}
+	tests := []struct {
+		name  string
+		opts  func(Options) Options
+		valid bool
+	}{
+		{"defaults", func(opts Options) Options { return opts }, true},
+		{"no repository", func(opts Options) Options { opts.Repo = ""; return opts }, false},
+		{"no account", func(opts Options) Options { opts.Account = ""; return opts }, false},
+		{"invalid digest", func(opts Options) Options { opts.Digest = "latest"; return opts }, false},
+		{"v1", func(opts Options) Options { opts.SociVersion = SociVersionV1; return opts }, true},
+		{"v2", func(opts Options) Options { opts.SociVersion = "v2"; return opts }, false},
+		{"output tag", func(opts Options) Options { opts.OutputTag = "soci"; return opts }, false},
+		{"span size", func(opts Options) Options { opts.SpanSize = 1 << 21; return opts }, true},
+		{"span size not a power of two", func(opts Options) Options { opts.SpanSize = 3 << 20; return opts }, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := New(test.opts(valid))
+			if test.valid && err != nil {
+				t.Fatalf("Expected the options to be valid, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatalf("Expected the options to be invalid")
+			}
+		})
+	}
+}
+
+func TestNewDefaults(t *testing.T) {
+	b, err := New(Options{Repo: "my-app", Digest: testDigest, Region: "us-west-2", Account: "123456789012"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.opts.SociVersion != SociVersionV1 || b.opts.MinLayerSize != DefaultMinLayerSize || b.opts.SpanSize != DefaultSpanSize {
+		t.Fatalf("Expected the default SOCI version, minimum layer size and span size, got %+v", b.opts)
+	}
+}
@@ -0,0 +1,379 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package builder
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"github.com/tmokmss/soci-wrapper/utils/logctx"
+	registryutils "github.com/tmokmss/soci-wrapper/utils/registry"
+	"github.com/tmokmss/soci-wrapper/utils/tracing"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+// Minimum size of the layers to build ztocs for by default, the same as soci-snapshotter
+const DefaultMinLayerSize = 10 << 20
+
+// Span size of the ztocs by default, the same as soci-snapshotter
+const DefaultSpanSize = 4 << 20
+
+// Bounds of the span size. Smaller spans make huge ztocs, and larger spans make each read fetch too much
+const (
+	MinSpanSize = 1 << 20
+	MaxSpanSize = 1 << 30
+)
+
+const artifactsStoreName = "store"
+const artifactsDbName = "artifacts.db"
+
+// How the layers of an image are indexed
+type IndexOptions struct {
+	// Layers smaller than this number of bytes get no ztoc, since lazy loading them is not worth it
+	MinLayerSize int64
+	// Size of the uncompressed layer data between the checkpoints of the ztocs
+	SpanSize int64
+	// Layers of these digests get no ztoc
+	ExcludeLayers []string
+	// Layers of these media types get no ztoc
+	ExcludeLayerMediaTypes []string
+	// Order to build the ztocs of the layers of an image in, either LayerOrderManifest, the default, or LayerOrderSizeDesc
+	LayerOrder string
+}
+
+// Check if a layer is left out of SOCI indices by ExcludeLayers or ExcludeLayerMediaTypes
+func (opts IndexOptions) isLayerExcluded(layer ocispec.Descriptor) bool {
+	return slices.Contains(opts.ExcludeLayers, layer.Digest.String()) || slices.Contains(opts.ExcludeLayerMediaTypes, layer.MediaType)
+}
+
+// A layer of an image manifest and its ztoc, if it got one
+type LayerResult struct {
+	Digest    string `json:"layerDigest"`
+	MediaType string `json:"mediaType"`
+	// Compressed size of the layer
+	Size int64 `json:"size"`
+	// Set if the layer got a ztoc
+	ZtocDigest   string  `json:"ztocDigest,omitempty"`
+	ZtocSize     int64   `json:"ztocSize"`
+	Spans        int     `json:"spans"`
+	BuildSeconds float64 `json:"buildSeconds"`
+	// Set if the layer got no ztoc, either SkipReasonExcluded, SkipReasonMinLayerSize or SkipReasonUnsupportedCompression
+	SkipReason string `json:"skipReason,omitempty"`
+}
+
+// Why a layer got no ztoc
+const (
+	SkipReasonExcluded               = "excluded"
+	SkipReasonMinLayerSize           = "belowMinLayerSize"
+	SkipReasonUnsupportedCompression = "unsupportedCompression"
+)
+
+// Returned by BuildIndex when no layer of an image gets a ztoc, wrapped with the reason, since a SOCI index of no ztocs is of no use
+var ErrNothingToIndex = errors.New("Nothing worth indexing")
+
+// Directory in a data directory where the images and SOCI artifacts are stored
+func StoreDir(dataDir string) string {
+	return path.Join(dataDir, artifactsStoreName)
+}
+
+// Init containerd store, which shares its blobs with the OCI store
+func initContainerdStore(dataDir string) (content.Store, error) {
+	containerdStore, err := local.NewStore(StoreDir(dataDir))
+	return containerdStore, err
+}
+
+// Init the SOCI artifact store of a data directory, to pull images to and build their SOCI indices in
+func InitSociStore(ctx context.Context, dataDir string) (*store.SociStore, error) {
+	// Note: We are wrapping an *oci.Store in a store.SociStore because soci.WriteSociIndex
+	// expects a store.Store, an interface that extends the oci.Store to provide support
+	// for garbage collection.
+	ociStore, err := oci.NewWithContext(ctx, StoreDir(dataDir))
+	return &store.SociStore{Store: ociStore}, err
+}
+
+// Init a new instance of SOCI artifacts DB
+func initSociArtifactsDb(dataDir string) (*soci.ArtifactsDb, error) {
+	artifactsDbPath := path.Join(dataDir, artifactsDbName)
+	artifactsDb, err := soci.NewDB(artifactsDbPath)
+	if err != nil {
+		return nil, err
+	}
+	return artifactsDb, nil
+}
+
+// List the platforms of the image manifests in an image index pulled to a data directory.
+// Manifests that are not images of a known platform, such as attestation manifests, are skipped,
+// and so are the image manifests of platforms soci-snapshotter cannot run, such as Windows.
+func ListIndexPlatforms(ctx context.Context, dataDir string, index ocispec.Descriptor) ([]ocispec.Platform, error) {
+	containerdStore, err := initContainerdStore(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	children, err := images.Children(ctx, containerdStore, index)
+	if err != nil {
+		return nil, err
+	}
+
+	var indexPlatforms []ocispec.Platform
+	var unsupported []string
+	for _, child := range children {
+		if !registryutils.IsPlatformImageManifest(child) {
+			log.Info(ctx, fmt.Sprintf("Skipping manifest %s in the image index because it is not an image of a known platform", child.Digest))
+			continue
+		}
+		if !registryutils.IsSupportedPlatform(*child.Platform) {
+			unsupported = append(unsupported, platforms.Format(*child.Platform))
+			continue
+		}
+		indexPlatforms = append(indexPlatforms, *child.Platform)
+	}
+	if len(unsupported) > 0 {
+		log.Info(ctx, fmt.Sprintf("Skipping the manifests of %s in the image index, since soci-snapshotter only runs Linux images", strings.Join(unsupported, ", ")))
+	}
+	if len(indexPlatforms) == 0 && len(unsupported) > 0 {
+		return nil, fmt.Errorf("%w: the image index has no Linux image manifests, and soci-snapshotter only runs Linux images", registryutils.ErrUnsupportedPlatform)
+	}
+	if len(indexPlatforms) == 0 {
+		return nil, errors.New("No image manifests of a known platform found in the image index")
+	}
+	return indexPlatforms, nil
+}
+
+// List the platforms to build SOCI indices for of an image pulled to a data directory, which are those of an image index,
+// or the default platform for an image manifest. Also returns if the image has SOCI indices per platform, i.e. is an image index
+func ImagePlatforms(ctx context.Context, dataDir string, desc ocispec.Descriptor) ([]ocispec.Platform, bool, error) {
+	if !images.IsIndexType(desc.MediaType) {
+		return []ocispec.Platform{platforms.DefaultSpec()}, false, nil
+	}
+	indexPlatforms, err := ListIndexPlatforms(ctx, dataDir, desc)
+	return indexPlatforms, true, err
+}
+
+// Push the SOCI indices of an image to a repository, and return how they were indexed as referrers.
+// Every SOCI index is pushed to the same repository, so they are indexed the same way.
+func PushIndices(ctx context.Context, registry *registryutils.Registry, sociStore *store.SociStore, repo string, indexDescriptors []ocispec.Descriptor, imagePlatforms []ocispec.Platform, perPlatform bool) (string, error) {
+	mechanism := ""
+	for i, indexDescriptor := range indexDescriptors {
+		platformCtx := ctx
+		if perPlatform {
+			platformCtx = logctx.WithPlatform(ctx, platforms.Format(imagePlatforms[i]))
+		}
+		platformCtx = logctx.WithSociIndexDigest(platformCtx, indexDescriptor.Digest.String())
+
+		var err error
+		mechanism, err = registry.PushReferrer(platformCtx, sociStore, indexDescriptor, repo)
+		if err != nil {
+			return "", fmt.Errorf("Couldn't push the SOCI index %s: %w", indexDescriptor.Digest, err)
+		}
+	}
+	return mechanism, nil
+}
+
+// Check that the SOCI indices of an image pushed to a repository are complete, with every blob they reference.
+// Incomplete SOCI indices are deleted so that they are not found as referrers of the image, and the error wraps registryutils.ErrPushVerification.
+// mechanism is how they were indexed as referrers, as returned by PushIndices
+func VerifyIndices(ctx context.Context, registry *registryutils.Registry, sociStore *store.SociStore, repo string, indexDescriptors []ocispec.Descriptor, mechanism string) error {
+	var incomplete []ocispec.Descriptor
+	var errs []error
+	for _, indexDescriptor := range indexDescriptors {
+		indexCtx := logctx.WithSociIndexDigest(ctx, indexDescriptor.Digest.String())
+		err := registry.VerifyPushed(indexCtx, repo, sociStore, indexDescriptor)
+		if errors.Is(err, registryutils.ErrPushVerification) {
+			incomplete = append(incomplete, indexDescriptor)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("SOCI index %s: %w", indexDescriptor.Digest, err))
+		}
+	}
+	if len(incomplete) > 0 {
+		log.Warn(ctx, fmt.Sprintf("Deleting %d incomplete SOCI indices", len(incomplete)))
+		if err := registry.DeleteReferrers(ctx, repo, incomplete, mechanism); err != nil {
+			errs = append(errs, fmt.Errorf("The incomplete SOCI indices couldn't be deleted: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// A SOCI index built by BuildIndices
+type BuiltIndex struct {
+	// Platform of the image manifest the SOCI index refers to
+	Platform ocispec.Platform
+	// Descriptor of the SOCI index manifest in the SOCI store
+	Descriptor ocispec.Descriptor
+	Index      *soci.Index
+	// Every layer of the image manifest, with its ztoc if it got one
+	Layers []LayerResult
+}
+
+// Build the SOCI index of each platform of an image pulled to a data directory, as listed by ImagePlatforms,
+// with BuildIndex. targets[i] is the image index or manifest pulled for imagePlatforms[i], usually the same for every platform.
+// Every SOCI index is built before any is pushed, so that a failed build pushes nothing.
+// Platforms with no layer worth a ztoc get no SOCI index, and if no platform gets one, the error wraps ErrNothingToIndex.
+func BuildIndices(ctx context.Context, dataDir string, sociStore *store.SociStore, name string, targets []ocispec.Descriptor, imagePlatforms []ocispec.Platform, perPlatform bool, annotations map[string]string, opts IndexOptions, fetchLayer LayerFetcher) ([]BuiltIndex, error) {
+	var built []BuiltIndex
+	var nothingToIndex error
+	for i, platform := range imagePlatforms {
+		platformCtx := ctx
+		platformName := ""
+		if perPlatform {
+			platformName = platforms.Format(platform)
+			platformCtx = logctx.WithPlatform(ctx, platformName)
+		}
+
+		image := images.Image{Name: name, Target: targets[i]}
+		spanCtx, span := tracing.Start(platformCtx, "BuildIndex", attribute.String("soci.platform", platforms.Format(platform)))
+		indexDescriptor, index, layers, err := BuildIndex(spanCtx, dataDir, sociStore, image, platform, annotations, opts, fetchLayer)
+		// A platform with nothing worth indexing is skipped rather than getting a SOCI index of no ztocs
+		if errors.Is(err, ErrNothingToIndex) {
+			tracing.End(span, nil)
+			log.Info(platformCtx, fmt.Sprintf("Skipping the SOCI index: %v", err))
+			nothingToIndex = err
+			continue
+		}
+		tracing.End(span, err)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't build the SOCI index of %s: %w", cmp.Or(platformName, "the image"), err)
+		}
+		built = append(built, BuiltIndex{Platform: platform, Descriptor: *indexDescriptor, Index: index, Layers: layers})
+	}
+	if len(built) == 0 {
+		if perPlatform {
+			return nil, fmt.Errorf("%w in any of the %d platforms", ErrNothingToIndex, len(imagePlatforms))
+		}
+		return nil, nothingToIndex
+	}
+	return built, nil
+}
+
+// Build soci index for an image on a platform and returns its ocispec.Descriptor along with the index
+// annotations are added to the SOCI index, and the layers are indexed as configured by opts
+// Also returns the layers that got no ztoc and why
+// If fetchLayer is not nil, the layers were not pulled and are fetched with it one at a time instead
+// If no layer would get a ztoc, ErrNothingToIndex is returned before anything is built
+func BuildIndex(ctx context.Context, dataDir string, sociStore *store.SociStore, image images.Image, platform ocispec.Platform, annotations map[string]string, opts IndexOptions, fetchLayer LayerFetcher) (*ocispec.Descriptor, *soci.Index, []LayerResult, error) {
+	minLayerSize, spanSize := opts.MinLayerSize, opts.SpanSize
+	log.Info(ctx, fmt.Sprintf("Building SOCI index with a span size of %d bytes", spanSize))
+
+	artifactsDb, err := initSociArtifactsDb(dataDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	containerdStore, err := initContainerdStore(dataDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Build the SOCI index
+	// soci-snapshotter's IndexBuilder decompresses every layer at once in the order of the manifest, so the ztocs are built here instead when that won't do
+	var index *soci.IndexWithMetadata
+	var layers []LayerResult
+	if fetchLayer == nil && !registryutils.MemoryLimited() && opts.LayerOrder != LayerOrderSizeDesc {
+		index, layers, err = buildIndexWithIndexBuilder(ctx, containerdStore, sociStore, artifactsDb, image, platform, opts)
+	} else {
+		index, layers, err = buildIndexFromLayers(ctx, dataDir, containerdStore, sociStore, artifactsDb, image, platform, opts, fetchLayer, fetchLayer == nil)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	manifest, err := images.Manifest(ctx, containerdStore, image.Target, platforms.OnlyStrict(platform))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("soci.layer.count", len(manifest.Layers)))
+	skipped := 0
+	var excluded []string
+	ztocBuilder := ztoc.NewBuilder("")
+	for i, layer := range manifest.Layers {
+		reason := ""
+		if opts.isLayerExcluded(layer) {
+			excluded = append(excluded, fmt.Sprintf("%s (%s)", layer.Digest, layer.MediaType))
+			reason = SkipReasonExcluded
+		} else if layer.Size < minLayerSize {
+			skipped++
+			reason = SkipReasonMinLayerSize
+		} else if algorithm, ok := layerCompression(ctx, ztocBuilder, layer); !ok {
+			log.Warn(ctx, fmt.Sprintf("Skipped layer %s (%s) compressed with %s, which soci-snapshotter cannot build ztocs for. It will be pulled as a whole", layer.Digest, layer.MediaType, cmp.Or(algorithm, "an unknown algorithm")))
+			reason = SkipReasonUnsupportedCompression
+		}
+		layers[i].SkipReason = reason
+	}
+	if skipped > 0 {
+		log.Info(ctx, fmt.Sprintf("Skipped %d of %d layers smaller than the minimum layer size of %d bytes", skipped, len(manifest.Layers), minLayerSize))
+	}
+	if len(excluded) > 0 {
+		log.Info(ctx, fmt.Sprintf("Excluded %d of %d layers: %s", len(excluded), len(manifest.Layers), strings.Join(excluded, ", ")))
+	}
+	for key, value := range annotations {
+		index.Index.Annotations[key] = value
+	}
+	annotationsJson, err := json.Marshal(index.Index.Annotations)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	log.Info(logctx.WithSociIndexAnnotations(ctx, string(annotationsJson)), "Built SOCI index")
+
+	// Write the SOCI index to the OCI store
+	err = soci.WriteSociIndex(ctx, index, sociStore, artifactsDb)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Get SOCI indices for the image from the OCI store
+	// TODO: consider making soci's WriteSociIndex to return the descriptor directly
+	indexDescriptorInfos, _, err := soci.GetIndexDescriptorCollection(ctx, containerdStore, artifactsDb, image, []ocispec.Platform{platform})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(indexDescriptorInfos) == 0 {
+		return nil, nil, nil, errors.New("No SOCI indices found in OCI store")
+	}
+	sort.Slice(indexDescriptorInfos, func(i, j int) bool {
+		return indexDescriptorInfos[i].CreatedAt.Before(indexDescriptorInfos[j].CreatedAt)
+	})
+
+	return &indexDescriptorInfos[len(indexDescriptorInfos)-1].Descriptor, index.Index, layers, nil
+}
+
+// Get the compression algorithm of a layer the same way as soci-snapshotter,
+// and check if soci-snapshotter can build a ztoc for it, e.g. not for zstd
+func layerCompression(ctx context.Context, ztocBuilder *ztoc.Builder, layer ocispec.Descriptor) (string, bool) {
+	algorithm, err := images.DiffCompression(ctx, layer.MediaType)
+	if err != nil {
+		return "", false
+	}
+	if algorithm == "" && layer.MediaType == ocispec.MediaTypeImageLayer {
+		algorithm = compression.Uncompressed
+	}
+	return algorithm, ztocBuilder.CheckCompressionAlgorithm(algorithm)
+}
+
+// Check that a span size is a power of two between MinSpanSize and MaxSpanSize
+func CheckSpanSize(spanSize int64) error {
+	if spanSize < MinSpanSize || spanSize > MaxSpanSize || spanSize&(spanSize-1) != 0 {
+		return errors.New("The span size must be a power of two between 1MiB and 1GiB")
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+
+	registryutils "github.com/tmokmss/soci-wrapper/utils/registry"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/platforms"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Write an image index of the given manifests to the store of a data directory
+func writeImageIndex(t *testing.T, dataDir string, manifests []ocispec.Descriptor) ocispec.Descriptor {
+	ctx := context.Background()
+	containerdStore, err := local.NewStore(StoreDir(dataDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := json.Marshal(ocispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: ocispec.MediaTypeImageIndex, Manifests: manifests})
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: godigest.FromBytes(blob), Size: int64(len(blob))}
+	if err := content.WriteBlob(ctx, containerdStore, desc.Digest.String(), bytes.NewReader(blob), desc); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+func TestImagePlatforms(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("image manifest", func(t *testing.T) {
+		desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: godigest.FromString("manifest")}
+		imagePlatforms, perPlatform, err := ImagePlatforms(ctx, t.TempDir(), desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perPlatform || len(imagePlatforms) != 1 || platforms.Format(imagePlatforms[0]) != platforms.Format(platforms.DefaultSpec()) {
+			t.Fatalf("Expected the default platform only, got %v (per platform: %v)", imagePlatforms, perPlatform)
+		}
+	})
+
+	t.Run("image index", func(t *testing.T) {
+		dataDir := t.TempDir()
+		attestation := ocispec.Descriptor{
+			MediaType:   ocispec.MediaTypeImageManifest,
+			Digest:      godigest.FromString("attestation"),
+			Platform:    &ocispec.Platform{OS: "unknown", Architecture: "unknown"},
+			Annotations: map[string]string{"vnd.docker.reference.type": "attestation-manifest"},
+		}
+		desc := writeImageIndex(t, dataDir, []ocispec.Descriptor{
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: godigest.FromString("amd64"), Platform: &ocispec.Platform{OS: "linux", Architecture: "amd64"}},
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: godigest.FromString("arm64"), Platform: &ocispec.Platform{OS: "linux", Architecture: "arm64"}},
+			attestation,
+		})
+		imagePlatforms, perPlatform, err := ImagePlatforms(ctx, dataDir, desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, platform := range imagePlatforms {
+			names = append(names, platforms.Format(platform))
+		}
+		if !perPlatform || !slices.Equal(names, []string{"linux/amd64", "linux/arm64"}) {
+			t.Fatalf("Expected linux/amd64 and linux/arm64 per platform, got %v (per platform: %v)", names, perPlatform)
+		}
+	})
+
+	t.Run("image index with windows images", func(t *testing.T) {
+		dataDir := t.TempDir()
+		windows := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: godigest.FromString("windows"), Platform: &ocispec.Platform{OS: "windows", Architecture: "amd64"}}
+		desc := writeImageIndex(t, dataDir, []ocispec.Descriptor{
+			windows,
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: godigest.FromString("arm64"), Platform: &ocispec.Platform{OS: "linux", Architecture: "arm64"}},
+		})
+		imagePlatforms, _, err := ImagePlatforms(ctx, dataDir, desc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(imagePlatforms) != 1 || platforms.Format(imagePlatforms[0]) != "linux/arm64" {
+			t.Fatalf("Expected linux/arm64 only, got %v", imagePlatforms)
+		}
+
+		dataDir = t.TempDir()
+		desc = writeImageIndex(t, dataDir, []ocispec.Descriptor{windows})
+		if _, _, err := ImagePlatforms(ctx, dataDir, desc); !errors.Is(err, registryutils.ErrUnsupportedPlatform) {
+			t.Fatalf("Expected an unsupported platform error for an image index of windows images only, got %v", err)
+		}
+	})
+
+	t.Run("image index without images", func(t *testing.T) {
+		dataDir := t.TempDir()
+		desc := writeImageIndex(t, dataDir, nil)
+		if _, _, err := ImagePlatforms(ctx, dataDir, desc); err == nil {
+			t.Fatalf("Expected an error for an image index without image manifests")
+		}
+	})
+}
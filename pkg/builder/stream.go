@@ -0,0 +1,276 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package builder
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	registryutils "github.com/tmokmss/soci-wrapper/utils/registry"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+)
+
+// Build tool annotation of SOCI indices built from streamed layers, the same as soci-snapshotter's IndexBuilder
+const sociBuildToolIdentifier = "AWS SOCI CLI v0.1"
+
+// Orders to build the ztocs of the layers of an image in, see IndexOptions.LayerOrder
+const (
+	LayerOrderManifest = "manifest"
+	LayerOrderSizeDesc = "size-desc"
+)
+
+// Fetches a layer to a file
+type LayerFetcher func(ctx context.Context, layer ocispec.Descriptor, file *os.File) error
+
+// Build the SOCI index of an image like soci-snapshotter's IndexBuilder does, but within the memory limit and in the layer order of opts.
+// If fetchLayer is nil, the ztocs are built in place from the layers pulled to the content store.
+// Otherwise each layer is fetched to a temporary file that is removed as soon as its ztoc is built.
+// Unless parallel is set, layers are indexed one at a time, so that a single fetched layer is on disk at a time instead of the whole image.
+// If it is, every layer is indexed at once, as many at a time as registryutils.LimitMemory allows.
+// Returns every layer of the image manifest as well, with its ztoc if it got one.
+func buildIndexFromLayers(ctx context.Context, dataDir string, containerdStore content.Store, sociStore *store.SociStore, artifactsDb *soci.ArtifactsDb, image images.Image, platform ocispec.Platform, opts IndexOptions, fetchLayer LayerFetcher, parallel bool) (*soci.IndexWithMetadata, []LayerResult, error) {
+	manifestDesc, err := soci.GetImageManifestDescriptor(ctx, containerdStore, image.Target, platforms.OnlyStrict(platform))
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest, err := images.Manifest(ctx, containerdStore, image.Target, platforms.OnlyStrict(platform))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ztocBuilder := ztoc.NewBuilder(sociBuildToolIdentifier)
+	algorithms, indexed, err := layerAlgorithms(ctx, ztocBuilder, manifest.Layers, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	progress := log.StartProgress(ctx, "Building ztocs", "layers", int64(indexed))
+	defer progress.Stop()
+
+	// The ztocs are built in the order of opts.LayerOrder, and kept in the order of the manifest in the SOCI index
+	order := make([]int, len(manifest.Layers))
+	for i := range order {
+		order[i] = i
+	}
+	if opts.LayerOrder == LayerOrderSizeDesc {
+		slices.SortStableFunc(order, func(i, j int) int {
+			return cmp.Compare(manifest.Layers[j].Size, manifest.Layers[i].Size)
+		})
+	}
+
+	layerZtocs := make([]*ocispec.Descriptor, len(manifest.Layers))
+	layers := make([]LayerResult, len(manifest.Layers))
+	for i, layer := range manifest.Layers {
+		layers[i] = LayerResult{Digest: layer.Digest.String(), MediaType: layer.MediaType, Size: layer.Size}
+	}
+	errs := make([]error, len(manifest.Layers))
+	var wg sync.WaitGroup
+	for _, i := range order {
+		layer := manifest.Layers[i]
+		algorithm := algorithms[i]
+		if algorithm == "" {
+			continue
+		}
+		build := func() {
+			start := time.Now()
+			ztocDesc, spans, err := buildLayerZtoc(ctx, dataDir, ztocBuilder, sociStore, artifactsDb, layer, algorithm, opts.SpanSize, fetchLayer)
+			if err != nil {
+				errs[i] = fmt.Errorf("Couldn't build the ztoc of layer %s: %w", layer.Digest, err)
+				return
+			}
+			elapsed := time.Since(start)
+			log.Info(ctx, fmt.Sprintf("Built ztoc %s of layer %s (%d of %d)", ztocDesc.Digest, layer.Digest, i+1, len(manifest.Layers)))
+			layerZtocs[i] = ztocDesc
+			layers[i].ZtocDigest, layers[i].ZtocSize, layers[i].Spans, layers[i].BuildSeconds = ztocDesc.Digest.String(), ztocDesc.Size, spans, elapsed.Seconds()
+			log.Debug(ctx, fmt.Sprintf("Built the ztoc of layer %s (%d bytes) in %s", layer.Digest, layer.Size, elapsed.Round(time.Millisecond)))
+			progress.Add(1)
+		}
+		if !parallel {
+			if build(); errs[i] != nil {
+				return nil, nil, errs[i]
+			}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			build()
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, nil, err
+	}
+	var ztocs []ocispec.Descriptor
+	for _, ztocDesc := range layerZtocs {
+		if ztocDesc != nil {
+			ztocs = append(ztocs, *ztocDesc)
+		}
+	}
+
+	subject := &ocispec.Descriptor{MediaType: manifestDesc.MediaType, Digest: manifestDesc.Digest, Size: manifestDesc.Size}
+	index := soci.NewIndex(ztocs, subject, map[string]string{soci.IndexAnnotationBuildToolIdentifier: sociBuildToolIdentifier})
+	return &soci.IndexWithMetadata{Index: index, Platform: &platform, ImageDigest: image.Target.Digest, CreatedAt: time.Now()}, layers, nil
+}
+
+// Get the compression algorithm of each layer that gets a ztoc, or "" for the layers that get none, which are reported by BuildIndex.
+// Also returns the number of layers that get a ztoc, and ErrNothingToIndex if there are none.
+func layerAlgorithms(ctx context.Context, ztocBuilder *ztoc.Builder, layers []ocispec.Descriptor, opts IndexOptions) ([]string, int, error) {
+	algorithms := make([]string, len(layers))
+	indexed := 0
+	for i, layer := range layers {
+		if algorithm, ok := layerCompression(ctx, ztocBuilder, layer); ok && !opts.isLayerExcluded(layer) && layer.Size >= opts.MinLayerSize {
+			algorithms[i] = algorithm
+			indexed++
+		}
+	}
+	// Images FROM scratch with a single small layer and the like would get a SOCI index of no ztocs, which is of no use
+	if indexed == 0 && len(layers) == 0 {
+		return nil, 0, fmt.Errorf("%w: the image has no layers", ErrNothingToIndex)
+	}
+	if indexed == 0 {
+		return nil, 0, fmt.Errorf("%w: none of the %d layers is at least %d bytes, compressed with a supported algorithm and not excluded", ErrNothingToIndex, len(layers), opts.MinLayerSize)
+	}
+	return algorithms, indexed, nil
+}
+
+// Build the SOCI index of the layers pulled to the content store with soci-snapshotter's IndexBuilder, which decompresses every layer at once.
+// The IndexBuilder indexes excluded layers as well, so their ztocs are left out of the SOCI index afterwards.
+// Returns every layer of the image manifest as well, with its ztoc if it got one, but not the time its ztoc took to build.
+func buildIndexWithIndexBuilder(ctx context.Context, containerdStore content.Store, sociStore *store.SociStore, artifactsDb *soci.ArtifactsDb, image images.Image, platform ocispec.Platform, opts IndexOptions) (*soci.IndexWithMetadata, []LayerResult, error) {
+	manifest, err := images.Manifest(ctx, containerdStore, image.Target, platforms.OnlyStrict(platform))
+	if err != nil {
+		return nil, nil, err
+	}
+	_, indexed, err := layerAlgorithms(ctx, ztoc.NewBuilder(sociBuildToolIdentifier), manifest.Layers, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	builder, err := soci.NewIndexBuilder(containerdStore, sociStore, artifactsDb, soci.WithMinLayerSize(opts.MinLayerSize), soci.WithSpanSize(opts.SpanSize), soci.WithPlatform(platform))
+	if err != nil {
+		return nil, nil, err
+	}
+	progress := log.StartProgress(ctx, "Building ztocs", "layers", int64(indexed))
+	defer progress.Stop()
+	// soci-snapshotter prints the layers it skips to stdout, which is reserved for the results
+	restoreStdout := redirectStdoutToStderr()
+	index, err := builder.Build(ctx, image)
+	restoreStdout()
+	if err != nil {
+		return nil, nil, err
+	}
+	progress.Add(int64(indexed))
+
+	layerZtocs := map[string]ocispec.Descriptor{}
+	for _, ztocDesc := range index.Index.Blobs {
+		layerZtocs[ztocDesc.Annotations[soci.IndexAnnotationImageLayerDigest]] = ztocDesc
+	}
+	ztocs := make([]ocispec.Descriptor, 0, len(index.Index.Blobs))
+	layers := make([]LayerResult, len(manifest.Layers))
+	for i, layer := range manifest.Layers {
+		layers[i] = LayerResult{Digest: layer.Digest.String(), MediaType: layer.MediaType, Size: layer.Size}
+		ztocDesc, ok := layerZtocs[layer.Digest.String()]
+		if !ok || opts.isLayerExcluded(layer) {
+			continue
+		}
+		ztocContent, err := orascontent.FetchAll(ctx, sociStore, ztocDesc)
+		if err != nil {
+			return nil, nil, err
+		}
+		toc, err := ztoc.Unmarshal(bytes.NewReader(ztocContent))
+		if err != nil {
+			return nil, nil, err
+		}
+		ztocs = append(ztocs, ztocDesc)
+		layers[i].ZtocDigest, layers[i].ZtocSize, layers[i].Spans = ztocDesc.Digest.String(), ztocDesc.Size, int(toc.MaxSpanID)+1
+	}
+	index.Index.Blobs = ztocs
+	return index, layers, nil
+}
+
+// The stdout to restore once every concurrent build stops redirecting it to stderr
+var stdoutRedirect struct {
+	sync.Mutex
+	count  int
+	stdout *os.File
+}
+
+// Send whatever is printed to stdout to stderr instead until the returned function is called
+func redirectStdoutToStderr() func() {
+	stdoutRedirect.Lock()
+	defer stdoutRedirect.Unlock()
+	if stdoutRedirect.count == 0 {
+		stdoutRedirect.stdout = os.Stdout
+		os.Stdout = os.Stderr
+	}
+	stdoutRedirect.count++
+	return func() {
+		stdoutRedirect.Lock()
+		defer stdoutRedirect.Unlock()
+		stdoutRedirect.count--
+		if stdoutRedirect.count == 0 {
+			os.Stdout = stdoutRedirect.stdout
+		}
+	}
+}
+
+// Build the ztoc of a layer and store the ztoc.
+// The layer is read from the content store if fetchLayer is nil, and fetched to a temporary file removed afterwards otherwise.
+// Returns the number of spans of the ztoc as well.
+func buildLayerZtoc(ctx context.Context, dataDir string, ztocBuilder *ztoc.Builder, sociStore *store.SociStore, artifactsDb *soci.ArtifactsDb, layer ocispec.Descriptor, algorithm string, spanSize int64, fetchLayer LayerFetcher) (*ocispec.Descriptor, int, error) {
+	var toc *ztoc.Ztoc
+	var err error
+	if fetchLayer == nil {
+		toc, err = registryutils.BuildStoredLayerZtoc(ctx, ztocBuilder, path.Join(dataDir, artifactsStoreName), layer, algorithm, spanSize)
+	} else {
+		toc, err = registryutils.BuildLayerZtoc(ctx, ztocBuilder, dataDir, algorithm, spanSize, func(file *os.File) error {
+			return fetchLayer(ctx, layer, file)
+		})
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	ztocReader, ztocDesc, err := ztoc.Marshal(toc)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := sociStore.Push(ctx, ztocDesc, ztocReader); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return nil, 0, err
+	}
+	err = artifactsDb.WriteArtifactEntry(&soci.ArtifactEntry{
+		Size:           ztocDesc.Size,
+		Digest:         ztocDesc.Digest.String(),
+		OriginalDigest: layer.Digest.String(),
+		Type:           soci.ArtifactEntryTypeLayer,
+		Location:       layer.Digest.String(),
+		MediaType:      soci.SociLayerMediaType,
+		CreatedAt:      time.Now(),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ztocDesc.MediaType = soci.SociLayerMediaType
+	ztocDesc.Annotations = map[string]string{
+		soci.IndexAnnotationImageLayerMediaType: layer.MediaType,
+		soci.IndexAnnotationImageLayerDigest:    layer.Digest.String(),
+	}
+	return &ztocDesc, int(toc.MaxSpanID) + 1, nil
+}
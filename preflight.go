@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/logctx"
+	registryutils "github.com/tmokmss/soci-wrapper/utils/registry"
+	"os"
+)
+
+// Verify that a full run against an ECR repository would have the permissions and connectivity it needs.
+// Every check prints pass or fail with the underlying error, and the exit code is non-zero if any of them failed.
+func preflightCommand(args []string) {
+	flags := flag.NewFlagSet("preflight", flag.ContinueOnError)
+	repo := flags.String("repo", "", "Name of the ECR repository")
+	region := flags.String("region", "", "AWS region of the ECR repository")
+	account := flags.String("account", "", "AWS account ID of the ECR repository")
+	fips := flags.Bool("fips", false, "Use the FIPS endpoints of ECR")
+	reference := flags.String("image-ref", "", "Digest or tag of the image to pull the manifest of. Defaults to the most recent image in the repository")
+	awsOptions := awsFlags(flags)
+	proxyUrl := proxyFlag(flags)
+	setRetryOptions := retryFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: soci-wrapper preflight --repo REPOSITORY_NAME --region AWS_REGION --account AWS_ACCOUNT [--image-ref DIGEST_OR_TAG]")
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, args)
+
+	if *repo == "" || *region == "" || *account == "" || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.TODO()
+	registryUrl := registryutils.BuildEcrRegistryUrl(*region, *account, *fips)
+	ctx = logctx.WithRegistryURL(ctx, registryUrl)
+	ctx = logctx.WithRepositoryName(ctx, *repo)
+
+	failed := false
+	check := func(name string, err error, detail string) bool {
+		if err != nil {
+			failed = true
+			fmt.Printf("FAIL  %s: %v\n", name, err)
+			return false
+		}
+		fmt.Printf("PASS  %s%s\n", name, detail)
+		return true
+	}
+	skip := func(name string, reason string) {
+		fmt.Printf("SKIP  %s: %s\n", name, reason)
+	}
+	defer func() {
+		if failed {
+			os.Exit(1)
+		}
+	}()
+
+	if *proxyUrl != "" {
+		if err := registryutils.ConfigureProxy(ctx, *proxyUrl); !check("Proxy configuration", err, "") {
+			return
+		}
+	}
+	err := registryutils.ConfigureAws(ctx, awsOptions())
+	identity := ""
+	if err == nil {
+		identity, err = registryutils.GetAwsIdentity(ctx, *region)
+	}
+	if !check("AWS credentials", err, " ("+identity+")") {
+		return
+	}
+
+	var registryOptions registryutils.RegistryOptions
+	setRetryOptions(&registryOptions)
+	registry, err := registryutils.Init(ctx, registryUrl, registryOptions)
+	authorized := check("ECR GetAuthorizationToken", err, "")
+
+	if !check("Repository exists", registryutils.DescribeRepository(ctx, registryUrl, *repo), "") || !authorized {
+		skip("Manifest pull", "requires an existing repository and an authorization token")
+		skip("Blob upload (push permission)", "requires an existing repository and an authorization token")
+		return
+	}
+
+	pullReference := *reference
+	if pullReference == "" {
+		digests, err := registryutils.ListRecentImageDigests(ctx, registryUrl, *repo, 1)
+		switch {
+		case err != nil:
+			check("Manifest pull", fmt.Errorf("Couldn't list images to pull: %w", err), "")
+		case len(digests) == 0:
+			skip("Manifest pull", "the repository has no images")
+		default:
+			pullReference = digests[0]
+		}
+	}
+	if pullReference != "" {
+		desc, err := registry.HeadManifest(ctx, *repo, pullReference)
+		if err == nil {
+			_, err = registry.GetManifest(ctx, *repo, desc.Digest.String())
+		}
+		check("Manifest pull", err, " ("+pullReference+")")
+	}
+
+	check("Blob upload (push permission)", registry.CheckPushPermission(ctx, *repo), "")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"runtime/trace"
+)
+
+// Names of the profiles written to --profile-dir
+const (
+	cpuProfileName  = "cpu.pprof"
+	heapProfileName = "heap.pprof"
+	traceName       = "trace.out"
+)
+
+// Start writing a CPU profile and an execution trace of the run to dir, creating dir if needed.
+// The returned function stops them and writes a heap profile, and must be called before exiting.
+func startProfiling(dir string) (func(), error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	cpuFile, err := os.Create(path.Join(dir, cpuProfileName))
+	if err != nil {
+		return nil, err
+	}
+	if err := runtimepprof.StartCPUProfile(cpuFile); err != nil {
+		cpuFile.Close()
+		return nil, err
+	}
+	traceFile, err := os.Create(path.Join(dir, traceName))
+	if err == nil {
+		if err = trace.Start(traceFile); err != nil {
+			traceFile.Close()
+		}
+	}
+	if err != nil {
+		runtimepprof.StopCPUProfile()
+		cpuFile.Close()
+		return nil, err
+	}
+	log.Info(context.TODO(), fmt.Sprintf("Writing %s, %s and %s to %s", cpuProfileName, heapProfileName, traceName, dir))
+
+	return func() {
+		runtimepprof.StopCPUProfile()
+		trace.Stop()
+		err := errors.Join(cpuFile.Close(), traceFile.Close(), writeHeapProfile(path.Join(dir, heapProfileName)))
+		if err != nil {
+			log.Error(context.TODO(), "Profile write error", err)
+		}
+	}, nil
+}
+
+// Write a heap profile of the memory in use after a garbage collection to name
+func writeHeapProfile(name string) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	runtime.GC()
+	err = runtimepprof.Lookup("heap").WriteTo(file, 0)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Serve the net/http/pprof endpoints under /debug/pprof/ on addr until the process exits
+func servePprof(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	log.Info(ctx, fmt.Sprintf("Serving pprof on http://%s/debug/pprof/", addr))
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Error(ctx, "Profiling server error", err)
+		}
+	}()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"github.com/tmokmss/soci-wrapper/utils/logctx"
+	registryutils "github.com/tmokmss/soci-wrapper/utils/registry"
+	"os"
+)
+
+// Scan an entire ECR repository and build SOCI indices only for the images that do not have one yet
+func reindexCommand(args []string) {
+	flags := flag.NewFlagSet("reindex", flag.ContinueOnError)
+	repo := flags.String("repo", "", "Name of the ECR repository")
+	region := flags.String("region", "", "AWS region of the ECR repository. Defaults to the region of the AWS configuration, e.g. $AWS_REGION")
+	account := flags.String("account", "", "AWS account ID of the ECR repository. Defaults to the account of the AWS credentials")
+	fips := flags.Bool("fips", false, "Use the FIPS endpoints of ECR")
+	maxImages := flags.Int("max-images", 0, "Maximum number of images to build SOCI indices for. 0 means no limit")
+	dryRun := flags.Bool("dry-run", false, "List the images that would be indexed without building anything")
+	workDir := workDirFlag(flags)
+	removeStaleAfter := removeStaleAfterFlag(flags)
+	awsOptions := awsFlags(flags)
+	proxyUrl := proxyFlag(flags)
+	setRetryOptions := retryFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: soci-wrapper reindex --repo REPOSITORY_NAME --region AWS_REGION --account AWS_ACCOUNT [--max-images N] [--dry-run]")
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, args)
+
+	if *repo == "" || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	var store storeBackend
+	if err := store.setWorkDir(*workDir); err != nil {
+		fmt.Fprintln(flags.Output(), err)
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.TODO()
+	if err := registryutils.ConfigureProxy(ctx, *proxyUrl); err != nil {
+		lambdaError(ctx, "Proxy configuration error", err)
+		os.Exit(1)
+	}
+	if err := registryutils.ConfigureAws(ctx, awsOptions()); err != nil {
+		lambdaError(ctx, "AWS credentials configuration error", err)
+		os.Exit(1)
+	}
+	detectRegionAndAccount(ctx, region, account)
+	if *region == "" || *account == "" {
+		flags.Usage()
+		os.Exit(1)
+	}
+	registryUrl := registryutils.BuildEcrRegistryUrl(*region, *account, *fips)
+	ctx = logctx.WithRegistryURL(ctx, registryUrl)
+	ctx = logctx.WithRepositoryName(ctx, *repo)
+
+	var registryOptions registryutils.RegistryOptions
+	setRetryOptions(&registryOptions)
+	registry, err := registryutils.Init(ctx, registryUrl, registryOptions)
+	if err != nil {
+		lambdaError(ctx, "Remote registry initialization error", err)
+		os.Exit(1)
+	}
+
+	log.Info(ctx, "Listing images in the repository")
+	digests, err := registryutils.ListImageDigests(ctx, registryUrl, *repo)
+	if err != nil {
+		lambdaError(ctx, "Image list error", err)
+		os.Exit(1)
+	}
+
+	var refs []imageReference
+	for _, digest := range digests {
+		if *maxImages > 0 && len(refs) >= *maxImages {
+			break
+		}
+		manifests, err := registry.ImageManifestsToIndex(ctx, *repo, digest, nil)
+		exists := false
+		if err == nil {
+			exists, err = hasSociIndices(ctx, registry, *repo, manifests)
+		}
+		if err != nil {
+			lambdaError(logctx.WithImageDigest(ctx, digest), "Existing SOCI index lookup error", err)
+			os.Exit(1)
+		}
+		if !exists {
+			refs = append(refs, imageReference{repo: *repo, digest: digest})
+		}
+	}
+	fmt.Printf("Selected %d images without a SOCI index out of %d images in the repository\n", len(refs), len(digests))
+
+	if *dryRun {
+		for _, ref := range refs {
+			fmt.Printf("Would build a SOCI index for %s\n", ref)
+		}
+		return
+	}
+
+	opts := reindexOptions(store)
+	removeStaleTempDirs(ctx, store.dataDirRoot(), *removeStaleAfter)
+	ctx, stopHandlingInterrupts := handleInterrupts(ctx)
+	results, err := process(ctx, registryUrl, registry, listImages(refs), opts)
+	stopHandlingInterrupts()
+	if interrupted(ctx) {
+		err = errors.Join(errInterrupted, err)
+	}
+	exitWithSummary(results, err, opts)
+}
+
+// Options of the builds of reindex, which keeps going when an image fails
+func reindexOptions(store storeBackend) options {
+	opts := defaultOptions()
+	opts.keepGoing = true
+	opts.store = store
+	return opts
+}
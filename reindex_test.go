@@ -0,0 +1,16 @@
+package main
+
+import (
+	"github.com/tmokmss/soci-wrapper/pkg/builder"
+	"testing"
+)
+
+func TestReindexOptions(t *testing.T) {
+	opts := reindexOptions(storeBackend{})
+	if opts.index.MinLayerSize != builder.DefaultMinLayerSize || opts.index.SpanSize != builder.DefaultSpanSize {
+		t.Errorf("Expected the default min layer size %d and span size %d, got %d and %d", builder.DefaultMinLayerSize, builder.DefaultSpanSize, opts.index.MinLayerSize, opts.index.SpanSize)
+	}
+	if !opts.keepGoing {
+		t.Errorf("Expected reindex to keep going when an image fails")
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"github.com/tmokmss/soci-wrapper/utils/logctx"
+	registryutils "github.com/tmokmss/soci-wrapper/utils/registry"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// A request to build the SOCI index of an image, received as an SQS message
+type queuedBuildRequest struct {
+	Repo        string `json:"repo"`
+	Digest      string `json:"digest"`
+	Region      string `json:"region"`
+	Account     string `json:"account"`
+	SociVersion string `json:"sociVersion"`
+	OutputTag   string `json:"outputTag"`
+}
+
+// Validate a build request. Invalid requests are never retried.
+func (request queuedBuildRequest) validate() error {
+	if request.Repo == "" || request.Digest == "" || request.Region == "" || request.Account == "" {
+		return errors.New("repo, digest, region and account are required")
+	}
+	if _, err := digest.Parse(request.Digest); err != nil {
+		return err
+	}
+	if request.SociVersion != "" && request.SociVersion != sociVersion {
+		return fmt.Errorf("SOCI version %s is not supported, only %s indices are built", request.SociVersion, sociVersion)
+	}
+	if request.OutputTag != "" {
+		return errors.New("outputTag is not supported, since SOCI v1 indices are not tagged")
+	}
+	return nil
+}
+
+// Build SOCI indices for the requests received from an SQS queue until SIGTERM or SIGINT is received
+func serveSqsCommand(args []string) {
+	flags := flag.NewFlagSet("serve-sqs", flag.ContinueOnError)
+	queueUrl := flags.String("queue-url", "", "URL of the SQS queue to receive build requests from")
+	maxConcurrent := flags.Int("max-concurrent", 1, "Number of build requests to handle at once")
+	visibilityTimeout := flags.Duration("visibility-timeout", 5*time.Minute, "How long a received message is hidden from other consumers. It is extended while its build is running")
+	fips := flags.Bool("fips", false, "Use the FIPS endpoints of ECR")
+	awsOptions := awsFlags(flags)
+	proxyUrl := proxyFlag(flags)
+	setRetryOptions := retryFlags(flags)
+	maxMemory := maxMemoryFlag(flags)
+	workDir := workDirFlag(flags)
+	removeStaleAfter := removeStaleAfterFlag(flags)
+	profileDir := profileDirFlag(flags)
+	logFormat := logFormatFlag(flags)
+	logLevel := logLevelFlag(flags)
+	quiet := quietFlag(flags)
+	pprofAddr := flags.String("pprof-addr", "", "Address to serve the net/http/pprof endpoints on while running, e.g. localhost:6060. Not served if empty")
+	metricsAddr := flags.String("metrics-addr", "", "Address to serve Prometheus metrics on under /metrics while running, e.g. :9090. Not served if empty")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: soci-wrapper serve-sqs --queue-url QUEUE_URL [--max-concurrent N] [--visibility-timeout DURATION]")
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, args)
+
+	if err := errors.Join(log.SetFormat(*logFormat), configureLogLevel(*logLevel, *quiet)); err != nil {
+		fmt.Fprintln(flags.Output(), err)
+		flags.Usage()
+		os.Exit(1)
+	}
+	if *quiet {
+		log.DisableProgress()
+	}
+	if *queueUrl == "" || *maxConcurrent < 1 || *visibilityTimeout < time.Minute || *visibilityTimeout > 12*time.Hour || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	var store storeBackend
+	if err := store.setWorkDir(*workDir); err != nil {
+		fmt.Fprintln(flags.Output(), err)
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.TODO()
+	if err := registryutils.ConfigureProxy(ctx, *proxyUrl); err != nil {
+		lambdaError(ctx, "Proxy configuration error", err)
+		os.Exit(1)
+	}
+	if err := registryutils.ConfigureAws(ctx, awsOptions()); err != nil {
+		lambdaError(ctx, "AWS credentials configuration error", err)
+		os.Exit(1)
+	}
+	queue, err := registryutils.NewQueue(*queueUrl)
+	if err != nil {
+		lambdaError(ctx, "Queue configuration error", err)
+		os.Exit(1)
+	}
+
+	opts := defaultOptions()
+	// Redelivered requests skip the images indexed by a previous attempt
+	opts.skipExisting = true
+	opts.output = outputJson
+	// The layers of every worker count towards the same limit
+	opts.maxMemory = int64(*maxMemory)
+	opts.store = store
+	setRetryOptions(&opts.registryOptions)
+	if opts.maxMemory > 0 {
+		log.Info(ctx, fmt.Sprintf("Decompressing up to %d layers at once within %d bytes of memory", registryutils.LimitMemory(opts.maxMemory), opts.maxMemory))
+	}
+
+	removeStaleTempDirs(ctx, store.dataDirRoot(), *removeStaleAfter)
+
+	if *profileDir != "" {
+		stopProfiling, err := startProfiling(*profileDir)
+		if err != nil {
+			lambdaError(ctx, "Profiling configuration error", err)
+			os.Exit(1)
+		}
+		defer stopProfiling()
+	}
+	if *pprofAddr != "" {
+		servePprof(ctx, *pprofAddr)
+	}
+	if *metricsAddr != "" {
+		serveMetrics(ctx, *metricsAddr)
+	}
+
+	// Polling stops on SIGTERM, while the builds in progress go on until they finish
+	pollCtx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	workers := make(chan struct{}, *maxConcurrent)
+	var wg sync.WaitGroup
+	log.Info(ctx, fmt.Sprintf("Receiving build requests from %s with %d workers", *queueUrl, *maxConcurrent))
+	for pollCtx.Err() == nil {
+		// Receive as many messages as there are idle workers, waiting for one if all of them are busy
+		select {
+		case workers <- struct{}{}:
+		case <-pollCtx.Done():
+			continue
+		}
+		idle := 1
+		for idle < *maxConcurrent && len(workers) < cap(workers) {
+			workers <- struct{}{}
+			idle++
+		}
+
+		messages, err := queue.Receive(pollCtx, idle, *visibilityTimeout)
+		for range idle - len(messages) {
+			<-workers
+		}
+		if err != nil {
+			if pollCtx.Err() == nil {
+				lambdaError(ctx, "Queue receive error", err)
+				time.Sleep(5 * time.Second)
+			}
+			continue
+		}
+		for _, message := range messages {
+			wg.Add(1)
+			go func() {
+				defer func() { <-workers; wg.Done() }()
+				handleQueuedBuildRequest(ctx, queue, message, *visibilityTimeout, *fips, opts)
+			}()
+		}
+	}
+	log.Info(ctx, fmt.Sprintf("Stopped receiving build requests, waiting for %d builds in progress", len(workers)))
+	wg.Wait()
+}
+
+// Build the SOCI index requested by a message, and delete the message unless the build failed and may succeed if retried.
+// The message is kept hidden from other consumers while the build is running.
+func handleQueuedBuildRequest(ctx context.Context, queue *registryutils.Queue, message registryutils.QueueMessage, visibilityTimeout time.Duration, fips bool, opts options) {
+	ctx = logctx.WithMessageId(ctx, message.Id)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(visibilityTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := queue.ExtendVisibility(ctx, message, visibilityTimeout); err != nil {
+					lambdaError(ctx, "Message visibility extension error", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var request queuedBuildRequest
+	err := json.Unmarshal([]byte(message.Body), &request)
+	if err == nil {
+		err = request.validate()
+	}
+	if err != nil {
+		lambdaError(ctx, "Invalid build request, deleting it without retrying", err)
+		deleteQueuedBuildRequest(ctx, queue, message)
+		return
+	}
+
+	registryUrl := registryutils.BuildEcrRegistryUrl(request.Region, request.Account, fips)
+	ref := imageReference{registryUrl: registryUrl, account: request.Account, region: request.Region, repo: request.Repo, digest: request.Digest}
+	log.Info(ctx, fmt.Sprintf("Received build request for %s, received %d times", ref, message.ReceiveCount))
+	results, err := process(ctx, registryUrl, nil, listImages([]imageReference{ref}), opts)
+	if err == nil && len(results) == 1 {
+		err = results[0].err
+	}
+	// Invalid and deleted images would fail again, while other errors are left to the redrive policy
+	if err != nil && len(results) == 1 && results[0].build.Error != nil && slices.Contains([]string{errorCategoryValidation, errorCategoryNotFound}, results[0].build.Error.Category) {
+		lambdaError(ctx, fmt.Sprintf("Build request failed with a %s error, deleting it without retrying", results[0].build.Error.Category), err)
+		deleteQueuedBuildRequest(ctx, queue, message)
+		return
+	}
+	if err != nil && !errors.Is(err, errImageSkipped) {
+		// The message is received again once its visibility timeout expires, or moved to the dead-letter queue by the redrive policy
+		lambdaError(ctx, "Build request failed, leaving it to be retried", err)
+		return
+	}
+	deleteQueuedBuildRequest(ctx, queue, message)
+}
+
+func deleteQueuedBuildRequest(ctx context.Context, queue *registryutils.Queue, message registryutils.QueueMessage) {
+	if err := queue.Delete(ctx, message); err != nil {
+		lambdaError(ctx, "Message deletion error", err)
+	}
+}
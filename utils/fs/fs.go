@@ -1,10 +1,17 @@
 // Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
 // SPDX-License-Identifier: Apache-2.0
 
-// Package fs contains utilities for checking free space in a directory
+// Package fs contains utilities for checking free space in a directory and for tar archives
 package fs
 
-import "golang.org/x/sys/unix"
+import (
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
 
 // Calculate free splace in bytes of a directory
 func CalculateFreeSpace(path string) uint64 {
@@ -16,3 +23,37 @@ func CalculateFreeSpace(path string) uint64 {
 	// Available blocks * size per block = available space in bytes
 	return stat.Bavail * uint64(stat.Bsize)
 }
+
+// Calculate the total size in bytes of the files in a directory and its subdirectories
+func CalculateDirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// Size of the buffers layers are copied through
+const copyBufferSize = 256 << 10
+
+// Buffers reused across copies, so that copying many layers at once does not allocate a buffer per copy
+var copyBuffers = sync.Pool{New: func() any {
+	buffer := make([]byte, copyBufferSize)
+	return &buffer
+}}
+
+// Copy from src to dst through a pooled fixed-size buffer, never holding more than the buffer in memory
+func Copy(dst io.Writer, src io.Reader) (int64, error) {
+	buffer := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buffer)
+	// Hiding ReadFrom and WriteTo makes io.CopyBuffer use the pooled buffer instead of allocating its own
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buffer)
+}
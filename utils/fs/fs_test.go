@@ -3,10 +3,109 @@
 
 package fs
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+)
 
 func TestGetFreeSpace(t *testing.T) {
 	if CalculateFreeSpace("/tmp") <= 0 {
 		t.Fatalf("Expected free space of /tmp to be greater than 0")
 	}
 }
+
+func TestCalculateDirSize(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "blobs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "blobs", "abc"), []byte("ztoc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := CalculateDirSize(dir)
+	if err != nil {
+		t.Fatalf("Failed to calculate the size of %s: %v", dir, err)
+	}
+	if size != 6 {
+		t.Fatalf("Expected a size of 6 bytes, got %d", size)
+	}
+}
+
+func TestTarRoundTrip(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(srcDir, "blobs", "sha256"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "blobs", "sha256", "abc"), []byte("ztoc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tarPath := filepath.Join(t.TempDir(), "export.tar")
+	if err := CreateTar(srcDir, tarPath); err != nil {
+		t.Fatalf("Failed to create tar: %v", err)
+	}
+	destDir := t.TempDir()
+	if err := ExtractTar(tarPath, destDir); err != nil {
+		t.Fatalf("Failed to extract tar: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(destDir, "blobs", "sha256", "abc"))
+	if err != nil || string(content) != "ztoc" {
+		t.Fatalf("Expected the extracted file to contain ztoc, got %q: %v", content, err)
+	}
+}
+
+func TestRemoveStaleDirs(t *testing.T) {
+	root := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	mkdir := func(name string, lock bool, modTime time.Time) string {
+		dir := filepath.Join(root, name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if lock {
+			unlock, err := LockDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			unlock()
+		}
+		if err := os.Chtimes(dir, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+	stale := mkdir("run-1", true, old)
+	inUse := mkdir("run-2", true, old)
+	unlock, err := LockDir(inUse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	if err := os.Chtimes(inUse, old, old); err != nil {
+		t.Fatal(err)
+	}
+	unlocked := mkdir("run-3", false, old)
+	recent := mkdir("run-4", true, time.Now())
+	other := mkdir("other", true, old)
+
+	removed, err := RemoveStaleDirs(root, regexp.MustCompile(`^run-\d+$`), 24*time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to remove stale directories: %v", err)
+	}
+	if !slices.Equal(removed, []string{stale}) {
+		t.Fatalf("Expected only %s to be removed, got %v", stale, removed)
+	}
+	for _, dir := range []string{inUse, unlocked, recent, other} {
+		if _, err := os.Stat(dir); err != nil {
+			t.Fatalf("Expected %s to be left alone: %v", dir, err)
+		}
+	}
+}
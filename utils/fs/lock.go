@@ -0,0 +1,80 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package fs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Lock file in a directory, locked by the process using the directory
+const lockFileName = ".soci-wrapper.lock"
+
+// Lock a directory as used by this process until the returned function is called, so that RemoveStaleDirs leaves it alone.
+// The lock is released when the process exits as well, however it exits.
+func LockDir(dir string) (func(), error) {
+	file, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() { file.Close() }, nil
+}
+
+// Remove the directories in root named after pattern and last modified longer than olderThan ago,
+// unless their lock file is held by a running process. Directories without a lock file are left alone,
+// since they may belong to a process that does not lock them. Returns the directories removed.
+func RemoveStaleDirs(root string, pattern *regexp.Regexp, olderThan time.Duration) ([]string, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	var errs []error
+	for _, entry := range entries {
+		if !entry.IsDir() || !pattern.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < olderThan {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		ok, err := removeUnlockedDir(dir)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if ok {
+			removed = append(removed, dir)
+		}
+	}
+	return removed, errors.Join(errs...)
+}
+
+// Remove a directory while holding its lock, unless it has no lock file or its lock is held
+func removeUnlockedDir(dir string) (bool, error) {
+	file, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, os.RemoveAll(dir)
+}
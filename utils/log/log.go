@@ -6,41 +6,119 @@ package log
 
 import (
 	"context"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/logctx"
+	"io"
+	"os"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+// Formats of the log lines written to stderr
+const (
+	// A JSON object per line, with the time, level, message and context of each line as fields
+	FormatJson = "json"
+	// A human-readable line per line, with the context of each line as key=value pairs
+	FormatText = "text"
+)
+
+// Add the id of the run to every log line, to correlate the lines of concurrent runs
+func SetRunId(runId string) {
+	log.Logger = log.With().Str("RunId", runId).Logger()
+}
+
+// Environment variable of the log level, used when it is not given on the command line
+const LevelEnv = "SOCI_WRAPPER_LOG_LEVEL"
+
+// Set the lowest level of the lines written, either debug, info, warn or error
+func SetLevel(level string) error {
+	switch level {
+	case "debug", "info", "warn", "error":
+		parsed, err := zerolog.ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		zerolog.SetGlobalLevel(parsed)
+		return nil
+	default:
+		return fmt.Errorf("unknown log level %q, expected debug, info, warn or error", level)
+	}
+}
+
+// Whether debug lines are written, e.g. to skip collecting what they would report otherwise
+func DebugEnabled() bool {
+	return zerolog.GlobalLevel() <= zerolog.DebugLevel
+}
+
+func init() {
+	setOutput(stderr, FormatJson, false)
+}
+
+// Set the format of the log lines, either FormatJson, the default, or FormatText
+func SetFormat(format string) error {
+	return setOutput(stderr, format, isTerminal(os.Stderr))
+}
+
+// Write the log lines to out in a format, redacting their secrets. Text lines are colored on a terminal.
+func setOutput(out io.Writer, format string, terminal bool) error {
+	out = redactingWriter{out}
+	switch format {
+	case FormatJson:
+		log.Logger = log.Output(out)
+	case FormatText:
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: out, NoColor: !terminal, TimeFormat: time.RFC3339})
+	default:
+		return fmt.Errorf("unknown log format %q, expected %s or %s", format, FormatJson, FormatText)
+	}
+	return nil
+}
+
+// Context key of the logger set by WithLogger
+type loggerKey struct{}
+
+// Write the log lines of a context with logger instead of the logger of the process, e.g. when soci-wrapper is used as a library.
+// The lines are not redacted unless the output of logger is, and the level set by SetLevel still applies.
+func WithLogger(ctx context.Context, logger zerolog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, &logger)
+}
+
+// Get the logger of a context, set by WithLogger, or else the logger of the process
+func loggerFrom(ctx context.Context) *zerolog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*zerolog.Logger); ok {
+		return logger
+	}
+	return &log.Logger
+}
+
 func Error(ctx context.Context, msg string, err error) {
-	logEvent := log.Error().Err(err)
+	logEvent := loggerFrom(ctx).Error().Err(err)
+	addContext(ctx, logEvent)
+	logEvent.Msg(msg)
+}
+
+func Debug(ctx context.Context, msg string) {
+	logEvent := loggerFrom(ctx).Debug()
 	addContext(ctx, logEvent)
 	logEvent.Msg(msg)
 }
 
 func Warn(ctx context.Context, msg string) {
-	logEvent := log.Warn()
+	logEvent := loggerFrom(ctx).Warn()
 	addContext(ctx, logEvent)
 	logEvent.Msg(msg)
 }
 
 func Info(ctx context.Context, msg string) {
-	logEvent := log.Info()
+	logEvent := loggerFrom(ctx).Info()
 	addContext(ctx, logEvent)
 	logEvent.Msg(msg)
 }
 
-// Add more context to the log event
+// Add the fields of the context to the log event
 func addContext(ctx context.Context, logEvent *zerolog.Event) {
-	contextKeys := []string{
-		"RegistryURL",
-		"RepositoryName",
-		"ImageDigest",
-		"ImageTag",
-		"SOCIIndexDigest"}
-
-	for _, contextKey := range contextKeys {
-		if value := ctx.Value(contextKey); value != nil {
-			logEvent.Str(contextKey, value.(string))
-		}
-	}
+	logctx.Fields(ctx, func(name string, value string) {
+		logEvent.Str(name, value)
+	})
 }
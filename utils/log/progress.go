@@ -0,0 +1,185 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package log
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Interval between two reports of the progress of an operation
+const progressInterval = 5 * time.Second
+
+// Set by DisableProgress
+var progressDisabled atomic.Bool
+
+// Stop reporting the progress of operations, e.g. for --quiet. Other log lines, errors included, are still written
+func DisableProgress() {
+	progressDisabled.Store(true)
+}
+
+// Stderr, which log lines and progress lines are written to one at a time so that they do not interleave.
+// On a terminal, the progresses of every operation at once share a line updated in place, which is cleared
+// before a log line is written and drawn again below it.
+var stderr = &progressWriter{out: os.Stderr}
+
+type progressWriter struct {
+	out io.Writer
+
+	mu sync.Mutex
+	// The operations whose progress is drawn, in the order they started
+	active []*Progress
+	// Whether the progress line is drawn
+	drawn bool
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.clear()
+	n, err := w.out.Write(p)
+	w.draw()
+	return n, err
+}
+
+// Draw the progress of every active operation on one line, over the one drawn before if any. Must be called with mu locked
+func (w *progressWriter) draw() {
+	if len(w.active) == 0 {
+		return
+	}
+	lines := make([]string, len(w.active))
+	for i, progress := range w.active {
+		lines[i] = progress.String()
+	}
+	fmt.Fprintf(w.out, "\r\033[K%s", strings.Join(lines, " | "))
+	w.drawn = true
+}
+
+// Clear the progress line. Must be called with mu locked
+func (w *progressWriter) clear() {
+	if w.drawn {
+		fmt.Fprint(w.out, "\r\033[K")
+		w.drawn = false
+	}
+}
+
+// Add the progress of an operation to the progress line and draw it
+func (w *progressWriter) render(progress *Progress) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !slices.Contains(w.active, progress) {
+		w.active = append(w.active, progress)
+	}
+	w.draw()
+}
+
+// Remove the progress of an operation from the progress line, completing it with the final progress on a line of its own
+func (w *progressWriter) finish(progress *Progress) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	i := slices.Index(w.active, progress)
+	if i < 0 {
+		return
+	}
+	w.active = slices.Delete(w.active, i, i+1)
+	w.clear()
+	fmt.Fprintln(w.out, progress)
+	w.draw()
+}
+
+// Progress of an operation, e.g. the bytes of an image pulled so far, reported every progressInterval until Stop is called.
+// It is rendered on the progress line of stderr if it is a terminal, and logged with the context of ctx otherwise.
+type Progress struct {
+	ctx   context.Context
+	phase string
+	unit  string
+	done  atomic.Int64
+	total atomic.Int64
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// Start reporting the progress of phase, e.g. "Pulling image", counted in unit, e.g. "bytes".
+// total can be 0 if it is not known yet and added with AddTotal instead.
+func StartProgress(ctx context.Context, phase string, unit string, total int64) *Progress {
+	progress := &Progress{ctx: ctx, phase: phase, unit: unit, stop: make(chan struct{})}
+	progress.total.Store(total)
+	if progressDisabled.Load() {
+		return progress
+	}
+	terminal := isTerminal(os.Stderr)
+	progress.wg.Add(1)
+	go func() {
+		defer progress.wg.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		reported := false
+		for {
+			select {
+			case <-progress.stop:
+				// The line updated in place is completed with the final progress
+				if terminal && reported {
+					stderr.finish(progress)
+				}
+				return
+			case <-ticker.C:
+				if terminal {
+					stderr.render(progress)
+				} else {
+					progress.log()
+				}
+				reported = true
+			}
+		}
+	}()
+	return progress
+}
+
+// Count n more units done
+func (progress *Progress) Add(n int64) {
+	progress.done.Add(n)
+}
+
+// Count n more units to do
+func (progress *Progress) AddTotal(n int64) {
+	progress.total.Add(n)
+}
+
+// Start counting again from nothing done out of nothing to do, e.g. when the operation is retried
+func (progress *Progress) Reset() {
+	progress.done.Store(0)
+	progress.total.Store(0)
+}
+
+// Stop reporting the progress
+func (progress *Progress) Stop() {
+	close(progress.stop)
+	progress.wg.Wait()
+}
+
+func (progress *Progress) String() string {
+	done, total := progress.done.Load(), progress.total.Load()
+	if total <= 0 {
+		return fmt.Sprintf("%s: %d %s", progress.phase, done, progress.unit)
+	}
+	return fmt.Sprintf("%s: %d of %d %s (%d%%)", progress.phase, done, total, progress.unit, min(100, done*100/total))
+}
+
+func (progress *Progress) log() {
+	logEvent := loggerFrom(progress.ctx).Info().Str("Phase", progress.phase).Int64("Done", progress.done.Load()).Int64("Total", progress.total.Load()).Str("Unit", progress.unit)
+	addContext(progress.ctx, logEvent)
+	logEvent.Msg(progress.String())
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,56 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package log
+
+import (
+	"io"
+	"regexp"
+)
+
+const redacted = "REDACTED"
+
+// Secrets that can end up in log lines, e.g. in the error of a failed request, and what they are replaced with.
+// The values of headers and query parameters end at a quote, a backslash escaping a character of a JSON string,
+// a bracket closing the values of a printed http.Header, or a newline.
+var secretPatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	// Basic, Bearer and AWS signature authorization headers
+	{regexp.MustCompile(`(?i)(\bauthorization["']?\s*[:=]\s*\[?["']?)[^"'\\\]\r\n]+`), "${1}" + redacted},
+	// Session tokens and signatures of AWS requests, as headers or presigned URL query parameters
+	{regexp.MustCompile(`(?i)(\bx-amz-(?:security-token|signature|credential)["']?\s*[:=]\s*\[?["']?)[^"'&\\\],:\s]+`), "${1}" + redacted},
+	// ECR authorization tokens, the base64 of AWS: followed by the password
+	{regexp.MustCompile(`QVdTO[ik][A-Za-z0-9+/=_-]{16,}`), redacted},
+	// ECR passwords, the base64 of a JSON document with the payload and the data key of the token
+	{regexp.MustCompile(`eyJwYXlsb2FkIjoi[A-Za-z0-9+/=_-]+`), redacted},
+	// Passwords in the user info of URLs
+	{regexp.MustCompile(`(://[^/\s:@"'\\]+:)[^/\s@"'\\]+@`), "${1}" + redacted + "@"},
+}
+
+// Replace the secrets in a log line
+func redact(line []byte) []byte {
+	for _, secret := range secretPatterns {
+		line = secret.pattern.ReplaceAll(line, []byte(secret.replacement))
+	}
+	return line
+}
+
+// Replace the secrets in a value printed outside of log lines
+func Redact(value string) string {
+	return string(redact([]byte(value)))
+}
+
+// Writes log lines with their secrets redacted, whatever their format.
+// zerolog writes each line with a single call to Write, so a secret is never split between calls.
+type redactingWriter struct {
+	out io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := w.out.Write(redact(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
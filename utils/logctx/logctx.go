@@ -0,0 +1,155 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package logctx stores what a context is about, such as the registry, repository and image being processed,
+// under typed keys that cannot collide with the keys of other packages. Every log line written with the context has them as fields.
+package logctx
+
+import (
+	"context"
+	"strconv"
+)
+
+// A context key, named after the log field of its value
+type key string
+
+const (
+	requestId                 key = "RequestId"
+	messageId                 key = "MessageId"
+	registryUrl               key = "RegistryURL"
+	repositoryName            key = "RepositoryName"
+	destinationRegistryUrl    key = "DestinationRegistryURL"
+	destinationRepositoryName key = "DestinationRepositoryName"
+	outputRepositoryName      key = "OutputRepositoryName"
+	imageDigest               key = "ImageDigest"
+	imageTag                  key = "ImageTag"
+	platform                  key = "Platform"
+	sociIndexDigest           key = "SOCIIndexDigest"
+	sociIndexAnnotations      key = "SOCIIndexAnnotations"
+	referrersMechanism        key = "ReferrersMechanism"
+	httpStatus                key = "HttpStatus"
+	errorCode                 key = "ErrorCode"
+	awsRequestId              key = "AwsRequestId"
+	hint                      key = "Hint"
+)
+
+// Every key, in the order of the fields of the log lines
+var keys = []key{
+	requestId,
+	messageId,
+	registryUrl,
+	repositoryName,
+	destinationRegistryUrl,
+	destinationRepositoryName,
+	outputRepositoryName,
+	imageDigest,
+	imageTag,
+	platform,
+	sociIndexDigest,
+	sociIndexAnnotations,
+	referrersMechanism,
+	httpStatus,
+	errorCode,
+	awsRequestId,
+	hint,
+}
+
+// Call fn with the name and the value of each field set in ctx
+func Fields(ctx context.Context, fn func(name string, value string)) {
+	for _, k := range keys {
+		if value, ok := ctx.Value(k).(string); ok {
+			fn(string(k), value)
+		}
+	}
+}
+
+func from(ctx context.Context, k key) string {
+	value, _ := ctx.Value(k).(string)
+	return value
+}
+
+// The id of the Lambda invocation
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestId, id)
+}
+
+func RequestIdFrom(ctx context.Context) string {
+	return from(ctx, requestId)
+}
+
+// The id of the SQS message of a build request
+func WithMessageId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, messageId, id)
+}
+
+// The registry images are pulled from
+func WithRegistryURL(ctx context.Context, url string) context.Context {
+	return context.WithValue(ctx, registryUrl, url)
+}
+
+func RegistryURLFrom(ctx context.Context) string {
+	return from(ctx, registryUrl)
+}
+
+func WithRepositoryName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, repositoryName, name)
+}
+
+// The registry images or SOCI indices are pushed to, when it is not the one they are pulled from
+func WithDestinationRegistryURL(ctx context.Context, url string) context.Context {
+	return context.WithValue(ctx, destinationRegistryUrl, url)
+}
+
+func WithDestinationRepositoryName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, destinationRepositoryName, name)
+}
+
+// The repository SOCI indices are pushed to, when it is not the one of their image
+func WithOutputRepositoryName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, outputRepositoryName, name)
+}
+
+func WithImageDigest(ctx context.Context, digest string) context.Context {
+	return context.WithValue(ctx, imageDigest, digest)
+}
+
+func WithImageTag(ctx context.Context, tag string) context.Context {
+	return context.WithValue(ctx, imageTag, tag)
+}
+
+func WithPlatform(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, platform, name)
+}
+
+func WithSociIndexDigest(ctx context.Context, digest string) context.Context {
+	return context.WithValue(ctx, sociIndexDigest, digest)
+}
+
+// The annotations of a SOCI index as JSON
+func WithSociIndexAnnotations(ctx context.Context, annotations string) context.Context {
+	return context.WithValue(ctx, sociIndexAnnotations, annotations)
+}
+
+// How SOCI indices are indexed as referrers of their image
+func WithReferrersMechanism(ctx context.Context, mechanism string) context.Context {
+	return context.WithValue(ctx, referrersMechanism, mechanism)
+}
+
+// What a registry or an AWS API said about the request an error is logged for
+func WithErrorDetails(ctx context.Context, status int, code string, requestId string) context.Context {
+	if status > 0 {
+		ctx = context.WithValue(ctx, httpStatus, strconv.Itoa(status))
+	}
+	if code != "" {
+		ctx = context.WithValue(ctx, errorCode, code)
+	}
+	if requestId != "" {
+		ctx = context.WithValue(ctx, awsRequestId, requestId)
+	}
+	return ctx
+}
+
+// What to do about the error logged
+func WithHint(ctx context.Context, text string) context.Context {
+	return context.WithValue(ctx, hint, text)
+}
@@ -0,0 +1,178 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Options for the AWS credentials used by every AWS API client
+type AwsOptions struct {
+	// Profile in the shared config files to load the credentials and region from. The default profile is used if empty
+	Profile string
+	// IAM role to assume with the credentials of Profile. They are used as is if empty
+	RoleArn string
+	// External ID to pass when assuming RoleArn
+	ExternalId string
+	// Session name of the assumed role session
+	RoleSessionName string
+	// Endpoint URL of the ECR API, e.g. for LocalStack or an interface VPC endpoint. Overrides the ECR_ENDPOINT environment variable
+	EcrEndpointUrl string
+}
+
+const (
+	// Assumed role credentials are refreshed this long before they expire
+	assumeRoleExpiryWindow = time.Minute
+
+	// Region of the STS endpoint used if no region is configured
+	stsDefaultRegion = "us-east-1"
+)
+
+// Retryer of AWS API calls
+// Throttling errors such as ThrottlingException are retried more than by default, honoring Retry-After,
+// so that many concurrent runs slow down instead of failing
+var awsApiRetryer = client.DefaultRetryer{
+	NumMaxRetries:    10,
+	MaxThrottleDelay: time.Minute,
+}
+
+// The AWS session configured with ConfigureAws, which every AWS API client is created from if set
+var configuredAwsSession atomic.Pointer[session.Session]
+
+// The AWS session of the default credential chain, created on first use
+var defaultAwsSession = sync.OnceValues(func() (*session.Session, error) {
+	config := awsBaseConfig()
+	sess, err := session.NewSession(&config)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create AWS session: %w", err)
+	}
+	return sess, nil
+})
+
+// Endpoint URL of the ECR API. The default endpoint of the region is used if empty
+var ecrEndpointUrl string
+
+// Configure the AWS credentials used by every AWS API client.
+// The profile is loaded first, then the role is assumed with its credentials. The role is assumed right away
+// so that a misconfiguration fails fast, and the assumed role credentials are refreshed automatically before they expire.
+func ConfigureAws(ctx context.Context, opts AwsOptions) error {
+	ecrEndpointUrl = opts.EcrEndpointUrl
+	sess, err := NewAwsSession(ctx, opts)
+	if err != nil {
+		return err
+	}
+	configuredAwsSession.Store(sess)
+	return nil
+}
+
+// Create an AWS session with the credentials of a profile and a role, as configured by ConfigureAws.
+// Returns nil if neither a profile nor a role is given, so that the default session is used.
+// EcrEndpointUrl is ignored.
+func NewAwsSession(ctx context.Context, opts AwsOptions) (*session.Session, error) {
+	if opts.Profile == "" && opts.RoleArn == "" {
+		return nil, nil
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            awsBaseConfig(),
+		Profile:           opts.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't load AWS profile %s: %w", opts.Profile, err)
+	}
+	// The SDK silently falls back to other credential providers if the profile does not exist
+	if opts.Profile != "" {
+		if _, err := sess.Config.Credentials.GetWithContext(ctx); err != nil {
+			return nil, fmt.Errorf("Couldn't load credentials of AWS profile %s, check that the profile exists in ~/.aws/config or ~/.aws/credentials: %w", opts.Profile, err)
+		}
+	}
+	if opts.RoleArn == "" {
+		return sess, nil
+	}
+
+	// STS has a global endpoint, so no region has to be configured to assume a role
+	stsSession := sess
+	if aws.StringValue(sess.Config.Region) == "" {
+		stsSession = sess.Copy(&aws.Config{Region: aws.String(stsDefaultRegion)})
+	}
+	sess = sess.Copy(&aws.Config{
+		Credentials: stscreds.NewCredentials(stsSession, opts.RoleArn, func(provider *stscreds.AssumeRoleProvider) {
+			if opts.ExternalId != "" {
+				provider.ExternalID = aws.String(opts.ExternalId)
+			}
+			if opts.RoleSessionName != "" {
+				provider.RoleSessionName = opts.RoleSessionName
+			}
+			provider.ExpiryWindow = assumeRoleExpiryWindow
+		}),
+	})
+
+	identity, err := sts.New(sess, &aws.Config{Region: stsSession.Config.Region}).GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't assume role %s: %w", opts.RoleArn, err)
+	}
+	log.Info(ctx, fmt.Sprintf("Assumed role %s in account %s", aws.StringValue(identity.Arn), aws.StringValue(identity.Account)))
+	return sess, nil
+}
+
+// Get the AWS session to create AWS API clients from
+func getAwsSession() (*session.Session, error) {
+	if sess := configuredAwsSession.Load(); sess != nil {
+		return sess, nil
+	}
+	return defaultAwsSession()
+}
+
+// Get sess, or the AWS session configured with ConfigureAws if nil
+func awsSessionOr(sess *session.Session) (*session.Session, error) {
+	if sess != nil {
+		return sess, nil
+	}
+	return getAwsSession()
+}
+
+// Get the config common to every AWS session
+// AWS API calls go through the same proxy as registry requests
+func awsBaseConfig() aws.Config {
+	return aws.Config{
+		HTTPClient: &http.Client{Transport: httpTransport},
+	}
+}
+
+// Get the region of the AWS configuration, e.g. from AWS_REGION or the profile, or "" if none is configured
+// or the AWS configuration cannot be loaded
+func GetAwsRegion() string {
+	sess, err := getAwsSession()
+	if err != nil {
+		return ""
+	}
+	return aws.StringValue(sess.Config.Region)
+}
+
+// Get the account the AWS credentials belong to, calling STS in region, or in the default STS region if empty
+func GetAwsAccount(ctx context.Context, region string) (string, error) {
+	sess, err := getAwsSession()
+	if err != nil {
+		return "", err
+	}
+	identity, err := sts.New(sess, &aws.Config{Region: aws.String(cmp.Or(region, stsDefaultRegion))}).GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(identity.Account), nil
+}
@@ -0,0 +1,155 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"io"
+
+	"oras.land/oras-go/v2"
+
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd"
+	ccontent "github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
+
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Default address of the containerd daemon
+const DefaultContainerdAddress = "/run/containerd/containerd.sock"
+
+// Images read from the content store of a containerd daemon instead of being pulled from a registry.
+// The content store is only read from.
+type ContainerdImageSource struct {
+	client    *containerd.Client
+	namespace string
+}
+
+// Connect to a containerd daemon, reading images of a namespace
+func OpenContainerd(ctx context.Context, address string, namespace string) (*ContainerdImageSource, error) {
+	log.Info(ctx, fmt.Sprintf("Connecting to containerd at %s", address))
+	client, err := containerd.New(address, containerd.WithDefaultNamespace(namespace))
+	if err != nil {
+		return nil, err
+	}
+	return &ContainerdImageSource{client, namespace}, nil
+}
+
+// Close the connection to the containerd daemon
+func (source *ContainerdImageSource) Close() error {
+	return source.client.Close()
+}
+
+// Copy an image from the content store to a local OCI Store, the same way as it is pulled from a registry
+// The manifest is verified against digest, so that the SOCI index refers to the image as it is in the registry.
+// If platform is not nil, only the image manifest of the platform is copied
+func (source *ContainerdImageSource) Pull(ctx context.Context, sociStore *store.SociStore, digest string, platform *ocispec.Platform) (*ocispec.Descriptor, error) {
+	log.Info(ctx, fmt.Sprintf("Loading image from containerd namespace %s", source.namespace))
+	ctx = namespaces.WithNamespace(ctx, source.namespace)
+	return pullFromContentStore(ctx, containerdStorage{source.client.ContentStore(), source.namespace}, sociStore, digest, platform)
+}
+
+// Copy an image from a containerd content store to a local OCI Store
+func pullFromContentStore(ctx context.Context, storage containerdStorage, sociStore *store.SociStore, digest string, platform *ocispec.Platform) (*ocispec.Descriptor, error) {
+	root, err := resolveContentStoreManifest(ctx, storage, digest)
+	if err != nil {
+		return nil, err
+	}
+	if platform != nil {
+		root, err = selectAndStorePlatformManifest(ctx, storage, sociStore, root, *platform)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := oras.CopyGraph(ctx, storage, sociStore, root, oras.DefaultCopyGraphOptions); err != nil {
+		return nil, err
+	}
+	if err := sociStore.Tag(ctx, root, digest); err != nil {
+		return nil, err
+	}
+	return &root, nil
+}
+
+// Get the descriptor of a manifest in a containerd content store, verified against its digest
+func resolveContentStoreManifest(ctx context.Context, storage containerdStorage, digest string) (ocispec.Descriptor, error) {
+	info, err := storage.store.Info(ctx, godigest.Digest(digest))
+	if err != nil {
+		return ocispec.Descriptor{}, storage.wrapError(digest, err)
+	}
+	manifest, err := ccontent.ReadBlob(ctx, storage.store, ocispec.Descriptor{Digest: info.Digest, Size: info.Size})
+	if err != nil {
+		return ocispec.Descriptor{}, storage.wrapError(digest, err)
+	}
+	if actual := godigest.FromBytes(manifest).String(); actual != digest {
+		return ocispec.Descriptor{}, fmt.Errorf("The manifest in containerd has digest %s instead of %s", actual, digest)
+	}
+
+	var parsed struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(manifest, &parsed); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	root := ocispec.Descriptor{MediaType: parsed.MediaType, Digest: info.Digest, Size: info.Size}
+	if root.MediaType == "" {
+		root.MediaType = ocispec.MediaTypeImageManifest
+		if parsed.Manifests != nil {
+			root.MediaType = ocispec.MediaTypeImageIndex
+		}
+	}
+	return root, nil
+}
+
+// List the digests of the image manifests SOCI indices are built for in an image in the content store.
+// If platforms is not empty, only the manifests of these platforms are listed.
+func (source *ContainerdImageSource) ImageManifestsToIndex(ctx context.Context, digest string, platforms []ocispec.Platform) ([]string, error) {
+	ctx = namespaces.WithNamespace(ctx, source.namespace)
+	storage := containerdStorage{source.client.ContentStore(), source.namespace}
+	root, err := resolveContentStoreManifest(ctx, storage, digest)
+	if err != nil {
+		return nil, err
+	}
+	return imageManifestsToIndex(ctx, storage, root, platforms)
+}
+
+// A containerd content store, read as an oras content storage
+type containerdStorage struct {
+	store     ccontent.Store
+	namespace string
+}
+
+func (storage containerdStorage) Fetch(ctx context.Context, target ocispec.Descriptor) (io.ReadCloser, error) {
+	readerAt, err := storage.store.ReaderAt(ctx, target)
+	if err != nil {
+		return nil, storage.wrapError(target.Digest.String(), err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{ccontent.NewReader(readerAt), readerAt}, nil
+}
+
+func (storage containerdStorage) Exists(ctx context.Context, target ocispec.Descriptor) (bool, error) {
+	_, err := storage.store.Info(ctx, target.Digest)
+	if errdefs.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Explain a missing blob, which is not pulled from the registry instead
+func (storage containerdStorage) wrapError(digest string, err error) error {
+	if errdefs.IsNotFound(err) {
+		return fmt.Errorf("%s is not in the content store of containerd namespace %s. Only the platforms pulled with containerd can be indexed, e.g. with --platform: %w", digest, storage.namespace, err)
+	}
+	return err
+}
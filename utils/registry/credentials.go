@@ -0,0 +1,174 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+const (
+	// Environment variables to pass registry credentials with
+	RegistryUsernameEnv = "REGISTRY_USERNAME"
+	RegistryPasswordEnv = "REGISTRY_PASSWORD"
+
+	// Server URL of Docker Hub in docker credential helpers
+	dockerHubServerUrl = "https://index.docker.io/v1/"
+	// Error message of docker credential helpers without a credential for the server
+	credentialsNotFoundMessage = "credentials not found in native keychain"
+)
+
+// An entry of the auths section in a docker config file
+type dockerAuthConfig struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// Resolve the credential for a registry that is neither ECR nor ECR Public.
+// An explicitly given credential takes precedence over the environment variables,
+// which take precedence over the docker config file. The registry is accessed
+// anonymously if none of them has a credential.
+// The docker config file is read from dockerConfigFile, or from the default location if it is empty.
+func ResolveCredential(registryUrl string, credential auth.Credential, dockerConfigFile string) (auth.Credential, error) {
+	if credential != auth.EmptyCredential {
+		return credential, nil
+	}
+
+	username, password := os.Getenv(RegistryUsernameEnv), os.Getenv(RegistryPasswordEnv)
+	if username != "" || password != "" {
+		return auth.Credential{Username: username, Password: password}, nil
+	}
+
+	return loadDockerConfigCredential(registryUrl, dockerConfigFile)
+}
+
+// Read the credential of a registry from the docker config file.
+// Like the docker CLI, the credential helper configured for the registry in credHelpers is used first,
+// then the credential store in credsStore, then the credentials stored in the auths section of the file itself.
+func loadDockerConfigCredential(registryUrl string, configFile string) (auth.Credential, error) {
+	if configFile == "" {
+		configDir := os.Getenv("DOCKER_CONFIG")
+		if configDir == "" {
+			homeDir, err := os.UserHomeDir()
+			if err != nil {
+				return auth.EmptyCredential, nil
+			}
+			configDir = filepath.Join(homeDir, ".docker")
+		}
+		configFile = filepath.Join(configDir, "config.json")
+	}
+
+	content, err := os.ReadFile(configFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return auth.EmptyCredential, nil
+	}
+	if err != nil {
+		return auth.EmptyCredential, err
+	}
+
+	var config struct {
+		Auths       map[string]dockerAuthConfig `json:"auths"`
+		CredHelpers map[string]string           `json:"credHelpers"`
+		CredsStore  string                      `json:"credsStore"`
+	}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return auth.EmptyCredential, fmt.Errorf("Invalid docker config file: %w", err)
+	}
+
+	helper := config.CredsStore
+	for key, credHelper := range config.CredHelpers {
+		if dockerConfigHost(key) == registryUrl {
+			helper = credHelper
+			break
+		}
+	}
+	if helper != "" {
+		credential, err := getCredentialFromHelper(helper, registryUrl)
+		if err != nil || credential != auth.EmptyCredential {
+			return credential, err
+		}
+	}
+
+	for key, authConfig := range config.Auths {
+		if dockerConfigHost(key) != registryUrl {
+			continue
+		}
+		if authConfig.IdentityToken != "" {
+			return auth.Credential{RefreshToken: authConfig.IdentityToken}, nil
+		}
+		if authConfig.Auth == "" {
+			return auth.Credential{Username: authConfig.Username, Password: authConfig.Password}, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(authConfig.Auth)
+		if err != nil {
+			return auth.EmptyCredential, fmt.Errorf("Invalid auth of %s in docker config file: %w", key, err)
+		}
+		username, password, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			return auth.EmptyCredential, fmt.Errorf("Invalid auth of %s in docker config file", key)
+		}
+		return auth.Credential{Username: username, Password: password}, nil
+	}
+	return auth.EmptyCredential, nil
+}
+
+// Get the credential of a registry by executing a docker credential helper, e.g. docker-credential-osxkeychain.
+// An empty credential is returned if the helper has no credential for the registry.
+func getCredentialFromHelper(helper string, registryUrl string) (auth.Credential, error) {
+	serverUrl := registryUrl
+	// Docker Hub credentials are stored under its legacy index URL
+	if registryUrl == DockerHubRegistryUrl {
+		serverUrl = dockerHubServerUrl
+	}
+
+	program := "docker-credential-" + helper
+	cmd := exec.Command(program, "get")
+	cmd.Stdin = strings.NewReader(serverUrl)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// Helpers print the error to stdout
+		message := strings.TrimSpace(stdout.String() + " " + stderr.String())
+		if strings.Contains(message, credentialsNotFoundMessage) {
+			return auth.EmptyCredential, nil
+		}
+		return auth.EmptyCredential, fmt.Errorf("Credential helper %s failed for %s: %w: %s", program, registryUrl, err, message)
+	}
+
+	var output struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		return auth.EmptyCredential, fmt.Errorf("Invalid output of credential helper %s: %w", program, err)
+	}
+	// Helpers return identity tokens with this username
+	if output.Username == "<token>" {
+		return auth.Credential{RefreshToken: output.Secret}, nil
+	}
+	return auth.Credential{Username: output.Username, Password: output.Secret}, nil
+}
+
+// Get the registry host of a key in the auths section of a docker config file.
+// Keys can be written as URLs such as https://index.docker.io/v1/, which is Docker Hub
+func dockerConfigHost(key string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	host, _, _ = strings.Cut(host, "/")
+	if host == "index.docker.io" || host == "registry-1.docker.io" {
+		return DockerHubRegistryUrl
+	}
+	return host
+}
@@ -0,0 +1,53 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Query parameters whose values are replaced in the URLs of the logged requests, e.g. of presigned S3 URLs that blobs are redirected to
+var sensitiveQueryParameters = []string{"signature", "credential", "token", "security"}
+
+// An HTTP transport logging each registry request with its status and duration at the debug level.
+// Only the method and the URL of a request are logged, never its headers, so the Authorization header is left out.
+type debugTransport struct {
+	base http.RoundTripper
+}
+
+func (transport *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := transport.base.RoundTrip(req)
+	status := ""
+	if err != nil {
+		status = err.Error()
+	} else {
+		status = resp.Status
+	}
+	log.Debug(req.Context(), fmt.Sprintf("%s %s: %s in %s", req.Method, redactUrl(req.URL), status, time.Since(start).Round(time.Millisecond)))
+	return resp, err
+}
+
+// Replace the user info and the values of sensitive query parameters of a URL
+func redactUrl(u *url.URL) string {
+	redacted := *u
+	if redacted.User != nil {
+		redacted.User = url.User("REDACTED")
+	}
+	query := redacted.Query()
+	for key := range query {
+		for _, sensitive := range sensitiveQueryParameters {
+			if strings.Contains(strings.ToLower(key), sensitive) {
+				query.Set(key, "REDACTED")
+			}
+		}
+	}
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
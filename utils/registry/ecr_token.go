@@ -0,0 +1,91 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// ECR authorization tokens are refreshed this long before they expire
+const ecrTokenRefreshMargin = 30 * time.Minute
+
+// An auth cache holding the ECR authorization token of an ECR registry as its basic auth token.
+// A new token is fetched from ECR GetAuthorizationToken when the current one is about to expire,
+// or when the registry rejects it with 401 Unauthorized. Only the failed request is retried,
+// so a push in progress carries on with the blobs it has not uploaded yet.
+type ecrTokenCache struct {
+	ecrClient *ecr.ECR
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+var _ auth.Cache = (*ecrTokenCache)(nil)
+
+// ECR registries always use basic auth
+func (cache *ecrTokenCache) GetScheme(ctx context.Context, registry string) (auth.Scheme, error) {
+	return auth.SchemeBasic, nil
+}
+
+// Get the current token, fetching a new one if it is about to expire
+func (cache *ecrTokenCache) GetToken(ctx context.Context, registry string, scheme auth.Scheme, key string) (string, error) {
+	if scheme != auth.SchemeBasic {
+		return "", errdef.ErrNotFound
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if time.Until(cache.expiresAt) < ecrTokenRefreshMargin {
+		if err := cache.refresh(ctx); err != nil {
+			return "", err
+		}
+	}
+	return cache.token, nil
+}
+
+// Set is called by the auth client only when the registry rejected the current token
+func (cache *ecrTokenCache) Set(ctx context.Context, registry string, scheme auth.Scheme, key string, fetch func(context.Context) (string, error)) (string, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	log.Warn(ctx, "ECR authorization token was rejected, fetching a new one")
+	if err := cache.refresh(ctx); err != nil {
+		return "", err
+	}
+	return cache.token, nil
+}
+
+// Fetch a new token from ECR GetAuthorizationToken
+// The caller must hold the lock
+func (cache *ecrTokenCache) refresh(ctx context.Context) error {
+	getAuthorizationTokenResponse, err := cache.ecrClient.GetAuthorizationTokenWithContext(ctx, &ecr.GetAuthorizationTokenInput{})
+	if err != nil {
+		return err
+	}
+
+	if len(getAuthorizationTokenResponse.AuthorizationData) == 0 {
+		return errors.New("Couldn't authorize with ECR: empty authorization data returned")
+	}
+
+	authorizationData := getAuthorizationTokenResponse.AuthorizationData[0]
+	if len(aws.StringValue(authorizationData.AuthorizationToken)) == 0 {
+		return errors.New("Couldn't authorize with ECR: empty authorization token returned")
+	}
+
+	cache.token = aws.StringValue(authorizationData.AuthorizationToken)
+	cache.expiresAt = aws.TimeValue(authorizationData.ExpiresAt)
+	log.Info(ctx, fmt.Sprintf("Fetched ECR authorization token expiring at %s", cache.expiresAt.Format(time.RFC3339)))
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+)
+
+// Headers of the id AWS assigns to a request, to quote in support cases
+var requestIdHeaders = []string{"X-Amzn-Requestid", "X-Amz-Request-Id"}
+
+// Number of failed requests whose ids are kept until their error is described
+const maxFailedRequestIds = 1024
+
+// Ids of the failed registry requests by method and URL, which registry error responses are identified by
+var failedRequestIds = struct {
+	mu  sync.Mutex
+	ids map[string]string
+}{ids: map[string]string{}}
+
+// An HTTP transport keeping the AWS request id of failed registry requests,
+// since the errors oras returns for them only have the status and the body of the response
+type requestIdTransport struct {
+	base http.RoundTripper
+}
+
+func (transport *requestIdTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := transport.base.RoundTrip(req)
+	if err != nil || resp.StatusCode < 400 {
+		return resp, err
+	}
+	for _, header := range requestIdHeaders {
+		if id := resp.Header.Get(header); id != "" {
+			failedRequestIds.mu.Lock()
+			if len(failedRequestIds.ids) >= maxFailedRequestIds {
+				clear(failedRequestIds.ids)
+			}
+			failedRequestIds.ids[req.Method+" "+req.URL.String()] = id
+			failedRequestIds.mu.Unlock()
+			break
+		}
+	}
+	return resp, err
+}
+
+// What a registry or an AWS API said about a failed request
+type ErrorDetails struct {
+	StatusCode int
+	// Error code of the response, e.g. DENIED for a registry or AccessDeniedException for an AWS API
+	Code      string
+	RequestId string
+	// What to do about the error, if it is a well-known one
+	Hint string
+}
+
+// Get the details of the failed registry or AWS API request an error comes from, or nil if it does not come from one
+func DescribeError(err error) *ErrorDetails {
+	var responseErr *errcode.ErrorResponse
+	if errors.As(err, &responseErr) {
+		details := &ErrorDetails{StatusCode: responseErr.StatusCode}
+		if len(responseErr.Errors) > 0 {
+			details.Code = responseErr.Errors[0].Code
+		}
+		if responseErr.URL != nil {
+			failedRequestIds.mu.Lock()
+			details.RequestId = failedRequestIds.ids[responseErr.Method+" "+responseErr.URL.String()]
+			failedRequestIds.mu.Unlock()
+		}
+		// Responses to HEAD requests have no body to take the code from
+		code := details.Code
+		if code == "" {
+			code = statusErrorCodes[details.StatusCode]
+		}
+		details.Hint = errorHint(code, responseErr.Method)
+		return details
+	}
+	var requestErr awserr.RequestFailure
+	if errors.As(err, &requestErr) {
+		return &ErrorDetails{
+			StatusCode: requestErr.StatusCode(),
+			Code:       requestErr.Code(),
+			RequestId:  requestErr.RequestID(),
+			Hint:       errorHint(requestErr.Code(), ""),
+		}
+	}
+	return nil
+}
+
+// Check if an error is from a registry request for a repository, manifest or blob that does not exist, e.g. of a deleted image
+func IsNotFound(err error) bool {
+	if errors.Is(err, errdef.ErrNotFound) {
+		return true
+	}
+	details := DescribeError(err)
+	return details != nil && details.StatusCode == http.StatusNotFound
+}
+
+// Registry error codes of the statuses of responses without a body
+var statusErrorCodes = map[int]string{
+	http.StatusUnauthorized:    "UNAUTHORIZED",
+	http.StatusForbidden:       "DENIED",
+	http.StatusTooManyRequests: "TOOMANYREQUESTS",
+}
+
+// Suggest what to do about a well-known registry or ECR error code.
+// method is the HTTP method of a failed registry request, telling the IAM actions it needed, or "" for an AWS API call.
+func errorHint(code string, method string) string {
+	switch code {
+	case "DENIED", "DeniedException", "AccessDeniedException":
+		switch method {
+		case http.MethodGet, http.MethodHead:
+			return "Allow ecr:BatchGetImage, ecr:GetDownloadUrlForLayer and ecr:BatchCheckLayerAvailability on the repository to the IAM role of soci-wrapper"
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+			return "Allow ecr:InitiateLayerUpload, ecr:UploadLayerPart, ecr:CompleteLayerUpload, ecr:PutImage and ecr:BatchCheckLayerAvailability on the repository to the IAM role of soci-wrapper"
+		case http.MethodDelete:
+			return "Allow ecr:BatchDeleteImage on the repository to the IAM role of soci-wrapper"
+		}
+		return "Allow the action named in the error message to the IAM role of soci-wrapper"
+	case "UNAUTHORIZED", "UnrecognizedClientException", "ExpiredTokenException", "InvalidSignatureException":
+		return "Check that the credentials are valid and not expired, and that the clock of the host is correct"
+	case "NAME_UNKNOWN", "RepositoryNotFoundException":
+		return "Check the repository name and region, or create the repository"
+	case "MANIFEST_UNKNOWN", "ImageNotFoundException":
+		return "Check the image digest or tag, the image may have been deleted"
+	case "TOOMANYREQUESTS", "ThrottlingException", "TooManyRequestsException":
+		return "Lower --workers or --max-requests-per-second, or ask for a higher quota"
+	case "ImageTagAlreadyExistsException":
+		return "The repository has immutable tags, so the tag cannot be moved to another image"
+	case "KmsException":
+		return "Allow kms:Decrypt and kms:GenerateDataKey on the KMS key of the repository to the IAM role of soci-wrapper"
+	case "LimitExceededException":
+		return "Ask for a higher ECR quota, or delete unused images"
+	}
+	if strings.HasPrefix(code, "MANIFEST_") || code == "UNSUPPORTED" {
+		return "The registry may not support OCI artifacts or image manifests with a subject"
+	}
+	return ""
+}
@@ -0,0 +1,56 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/eventbridge"
+)
+
+// PutEvents accepts up to 10 events at once
+const maxEventsPerPut = 10
+
+// Put events with the same source and detail type to an EventBridge event bus, given by its name or ARN.
+// The events are put in the region of the bus if it is an ARN, and in region otherwise, or the region of the AWS session if empty.
+func PutEvents(ctx context.Context, region string, eventBus string, source string, detailType string, details []string) error {
+	if parsed, err := arn.Parse(eventBus); err == nil {
+		region = parsed.Region
+	}
+	config := &aws.Config{Retryer: awsApiRetryer}
+	if region != "" {
+		config.Region = aws.String(region)
+	}
+	sess, err := getAwsSession()
+	if err != nil {
+		return err
+	}
+	client := eventbridge.New(sess, config)
+
+	for start := 0; start < len(details); start += maxEventsPerPut {
+		var entries []*eventbridge.PutEventsRequestEntry
+		for _, detail := range details[start:min(start+maxEventsPerPut, len(details))] {
+			entries = append(entries, &eventbridge.PutEventsRequestEntry{
+				EventBusName: aws.String(eventBus),
+				Source:       aws.String(source),
+				DetailType:   aws.String(detailType),
+				Detail:       aws.String(detail),
+			})
+		}
+		output, err := client.PutEventsWithContext(ctx, &eventbridge.PutEventsInput{Entries: entries})
+		if err != nil {
+			return err
+		}
+		// Events can fail individually even if the call succeeds
+		for _, entry := range output.Entries {
+			if entry.ErrorCode != nil {
+				return fmt.Errorf("%d of %d events were not put: %s: %s", aws.Int64Value(output.FailedEntryCount), len(entries), aws.StringValue(entry.ErrorCode), aws.StringValue(entry.ErrorMessage))
+			}
+		}
+	}
+	return nil
+}
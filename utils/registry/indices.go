@@ -0,0 +1,379 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/images"
+	"oras.land/oras-go/v2/content"
+
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// Artifact type of the SOCI indices built by newer versions of soci-snapshotter, which this tool does not build
+	SociIndexArtifactTypeV2 = "application/vnd.amazon.soci.index.v2+json"
+
+	// Config media type of artifacts that are identified by their artifact type instead
+	mediaTypeEmptyConfig = "application/vnd.oci.empty.v1+json"
+)
+
+// Artifact media types reported by ECR for SOCI indices.
+// Artifacts with an empty config may be SOCI indices of another version, so they are included as well.
+var sociArtifactMediaTypes = []string{soci.SociIndexArtifactType, SociIndexArtifactTypeV2, mediaTypeEmptyConfig}
+
+// A SOCI index stored in a repository
+type SociIndexInfo struct {
+	Digest string
+	// Either v1 or v2
+	SociVersion string
+	// Total size of the SOCI index manifest and its ztocs
+	Size int64
+	// When the SOCI index was pushed, or created if the registry does not tell. Zero if unknown
+	Created time.Time
+	// Digest of the image manifest the SOCI index refers to
+	Subject string
+	// Annotations of the SOCI index manifest
+	Annotations map[string]string
+}
+
+// Get the SOCI version of an artifact from its artifact type or config media type.
+// Returns an empty string if it is not a SOCI index.
+func sociVersion(artifactType string) string {
+	switch artifactType {
+	case soci.SociIndexArtifactType:
+		return "v1"
+	case SociIndexArtifactTypeV2:
+		return "v2"
+	}
+	return ""
+}
+
+// List the SOCI indices of any version referring to an image.
+// SOCI indices refer to image manifests, so for an image index the SOCI indices of its platform manifests are listed.
+func (registry *Registry) ListImageSociIndices(ctx context.Context, repositoryName string, digest string) ([]ocispec.Descriptor, error) {
+	repo, err := registry.repository(ctx, repositoryName)
+	if err != nil {
+		return nil, err
+	}
+
+	desc, rc, err := repo.FetchReference(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	subjects := []ocispec.Descriptor{desc}
+	if images.IsIndexType(desc.MediaType) {
+		var index ocispec.Index
+		if err := json.NewDecoder(rc).Decode(&index); err != nil {
+			return nil, err
+		}
+		subjects = append(subjects, index.Manifests...)
+	}
+
+	var indices []ocispec.Descriptor
+	for _, subject := range subjects {
+		// Referrers are looked up by the digest alone
+		err := repo.Referrers(ctx, ocispec.Descriptor{Digest: subject.Digest}, "", func(referrers []ocispec.Descriptor) error {
+			for _, referrer := range referrers {
+				if sociVersion(referrer.ArtifactType) != "" {
+					indices = append(indices, referrer)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return indices, nil
+}
+
+// List the digests of the image manifests SOCI indices are built for, fetching manifests only.
+// An image manifest is returned as is. For an image index, the manifests of the requested platforms are returned,
+// or those of every known platform if platforms is empty.
+func imageManifestsToIndex(ctx context.Context, src content.ReadOnlyStorage, root ocispec.Descriptor, platforms []ocispec.Platform) ([]string, error) {
+	if !images.IsIndexType(root.MediaType) {
+		return []string{root.Digest.String()}, nil
+	}
+
+	var digests []string
+	if len(platforms) > 0 {
+		for _, platform := range platforms {
+			manifest, err := selectPlatformManifest(ctx, src, root, platform)
+			if err != nil {
+				return nil, err
+			}
+			digests = append(digests, manifest.Digest.String())
+		}
+		return digests, nil
+	}
+
+	children, err := content.Successors(ctx, src, root)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		if IsPlatformImageManifest(child) && IsSupportedPlatform(*child.Platform) {
+			digests = append(digests, child.Digest.String())
+		}
+	}
+	return digests, nil
+}
+
+// List the digests of the image manifests SOCI indices are built for in an image in the repository.
+// If platforms is not empty, only the manifests of these platforms are listed.
+func (registry *Registry) ImageManifestsToIndex(ctx context.Context, repositoryName string, digest string, platforms []ocispec.Platform) ([]string, error) {
+	repo, err := registry.repository(ctx, repositoryName)
+	if err != nil {
+		return nil, err
+	}
+	root, err := repo.Resolve(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	return imageManifestsToIndex(ctx, repo, root, platforms)
+}
+
+// Calculate the compressed size of the blobs pulled to build SOCI indices for an image, and the size of its largest layer,
+// fetching manifests only. Blobs shared between platforms are counted once, as they are pulled once.
+func (registry *Registry) ImageSize(ctx context.Context, repositoryName string, digest string, platforms []ocispec.Platform) (size int64, largestLayer int64, err error) {
+	repo, err := registry.repository(ctx, repositoryName)
+	if err != nil {
+		return 0, 0, err
+	}
+	root, err := repo.Resolve(ctx, digest)
+	if err != nil {
+		return 0, 0, err
+	}
+	manifestDigests, err := imageManifestsToIndex(ctx, repo, root, platforms)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	blobs := map[godigest.Digest]int64{}
+	for _, manifestDigest := range manifestDigests {
+		desc, err := repo.Resolve(ctx, manifestDigest)
+		if err != nil {
+			return 0, 0, err
+		}
+		b, err := content.FetchAll(ctx, repo, desc)
+		if err != nil {
+			return 0, 0, err
+		}
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			return 0, 0, err
+		}
+		blobs[manifest.Config.Digest] = manifest.Config.Size
+		for _, layer := range manifest.Layers {
+			blobs[layer.Digest] = layer.Size
+			largestLayer = max(largestLayer, layer.Size)
+		}
+	}
+	for _, blobSize := range blobs {
+		size += blobSize
+	}
+	return size, largestLayer, nil
+}
+
+// Describe a SOCI index in a repository.
+// Returns nil if the manifest is not a SOCI index.
+func (registry *Registry) DescribeSociIndex(ctx context.Context, repositoryName string, digest string) (*SociIndexInfo, error) {
+	repo, err := registry.repository(ctx, repositoryName)
+	if err != nil {
+		return nil, err
+	}
+
+	desc, rc, err := repo.FetchReference(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	content, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return parseSociIndex(desc.Digest.String(), content)
+}
+
+// Describe a SOCI index from its manifest.
+// Returns nil if the manifest is not a SOCI index.
+func parseSociIndex(digest string, content []byte) (*SociIndexInfo, error) {
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, err
+	}
+
+	version := sociVersion(manifest.ArtifactType)
+	if version == "" {
+		version = sociVersion(manifest.Config.MediaType)
+	}
+	if version == "" {
+		return nil, nil
+	}
+	info := &SociIndexInfo{Digest: digest, SociVersion: version, Size: int64(len(content))}
+	for _, layer := range manifest.Layers {
+		info.Size += layer.Size
+	}
+	if manifest.Subject != nil {
+		info.Subject = manifest.Subject.Digest.String()
+	}
+	info.Annotations = manifest.Annotations
+	if created, ok := manifest.Annotations[ocispec.AnnotationCreated]; ok {
+		info.Created, _ = time.Parse(time.RFC3339, created)
+	}
+	return info, nil
+}
+
+// List every SOCI index in an ECR repository, with the digest and push time only.
+// Artifacts with an empty config may be SOCI indices of another version, so they are listed as well.
+func ListRepositorySociIndices(ctx context.Context, registryUrl string, repositoryName string) ([]SociIndexInfo, error) {
+	var indices []SociIndexInfo
+	err := describeImages(ctx, registryUrl, repositoryName, nil, func(image *ecr.ImageDetail) {
+		if slices.Contains(sociArtifactMediaTypes, aws.StringValue(image.ArtifactMediaType)) {
+			indices = append(indices, SociIndexInfo{
+				Digest:  aws.StringValue(image.ImageDigest),
+				Created: aws.TimeValue(image.ImagePushedAt),
+			})
+		}
+	})
+	return indices, err
+}
+
+// Get when manifests were pushed to an ECR repository, by digest
+func GetImagePushTimes(ctx context.Context, registryUrl string, repositoryName string, digests []string) (map[string]time.Time, error) {
+	account, _, ok := ParseEcrRegistryUrl(registryUrl)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ECR registry", registryUrl)
+	}
+
+	pushTimes := map[string]time.Time{}
+	client, err := newEcrClient(registryUrl)
+	if err != nil {
+		return nil, err
+	}
+	// DescribeImages accepts up to 100 images at once
+	for start := 0; start < len(digests); start += 100 {
+		imageIds := make([]*ecr.ImageIdentifier, 0, 100)
+		for _, digest := range digests[start:min(start+100, len(digests))] {
+			if _, err := godigest.Parse(digest); err != nil {
+				return nil, err
+			}
+			imageIds = append(imageIds, &ecr.ImageIdentifier{ImageDigest: aws.String(digest)})
+		}
+		output, err := client.DescribeImagesWithContext(ctx, &ecr.DescribeImagesInput{
+			RegistryId:     aws.String(account),
+			RepositoryName: aws.String(repositoryName),
+			ImageIds:       imageIds,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range output.ImageDetails {
+			pushTimes[aws.StringValue(image.ImageDigest)] = aws.TimeValue(image.ImagePushedAt)
+		}
+	}
+	return pushTimes, nil
+}
+
+// A manifest stored in an ECR repository
+type RepositoryManifest struct {
+	Digest string
+	Tags   []string
+	// Artifact type or config media type of the manifest
+	ArtifactMediaType string
+	PushedAt          time.Time
+}
+
+// Check if a manifest may be a SOCI index from its artifact media type, without fetching it
+func (manifest RepositoryManifest) MayBeSociIndex() bool {
+	return slices.Contains(sociArtifactMediaTypes, manifest.ArtifactMediaType)
+}
+
+// List every manifest in an ECR repository, including the untagged ones
+func ListRepositoryManifests(ctx context.Context, registryUrl string, repositoryName string) ([]RepositoryManifest, error) {
+	var manifests []RepositoryManifest
+	err := describeImages(ctx, registryUrl, repositoryName, nil, func(image *ecr.ImageDetail) {
+		manifests = append(manifests, RepositoryManifest{
+			Digest:            aws.StringValue(image.ImageDigest),
+			Tags:              aws.StringValueSlice(image.ImageTags),
+			ArtifactMediaType: aws.StringValue(image.ArtifactMediaType),
+			PushedAt:          aws.TimeValue(image.ImagePushedAt),
+		})
+	})
+	return manifests, err
+}
+
+// Describe SOCI indices in an ECR repository with the BatchGetImage API, which fetches up to 100 manifests at once.
+// Manifests that are not SOCI indices are left out.
+func DescribeRepositorySociIndices(ctx context.Context, registryUrl string, repositoryName string, digests []string) ([]SociIndexInfo, error) {
+	account, _, ok := ParseEcrRegistryUrl(registryUrl)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ECR registry", registryUrl)
+	}
+
+	var indices []SociIndexInfo
+	client, err := newEcrClient(registryUrl)
+	if err != nil {
+		return nil, err
+	}
+	for start := 0; start < len(digests); start += 100 {
+		imageIds := make([]*ecr.ImageIdentifier, 0, 100)
+		for _, digest := range digests[start:min(start+100, len(digests))] {
+			imageIds = append(imageIds, &ecr.ImageIdentifier{ImageDigest: aws.String(digest)})
+		}
+		output, err := client.BatchGetImageWithContext(ctx, &ecr.BatchGetImageInput{
+			RegistryId:         aws.String(account),
+			RepositoryName:     aws.String(repositoryName),
+			ImageIds:           imageIds,
+			AcceptedMediaTypes: aws.StringSlice([]string{ocispec.MediaTypeImageManifest}),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, image := range output.Images {
+			digest := aws.StringValue(image.ImageId.ImageDigest)
+			info, err := parseSociIndex(digest, []byte(aws.StringValue(image.ImageManifest)))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", digest, err)
+			}
+			if info != nil {
+				indices = append(indices, *info)
+			}
+		}
+		for _, failure := range output.Failures {
+			// A manifest deleted in the meantime is not a SOCI index to describe anymore
+			if aws.StringValue(failure.FailureCode) == ecr.ImageFailureCodeImageNotFound {
+				continue
+			}
+			return nil, fmt.Errorf("%s: %s: %s", aws.StringValue(failure.ImageId.ImageDigest), aws.StringValue(failure.FailureCode), aws.StringValue(failure.FailureReason))
+		}
+	}
+	return indices, nil
+}
+
+// Delete manifests from an ECR repository with the BatchDeleteImage API.
+// Manifests that do not exist anymore are ignored.
+func BatchDeleteImages(ctx context.Context, registryUrl string, repositoryName string, digests []string) error {
+	descs := make([]ocispec.Descriptor, 0, len(digests))
+	for _, digest := range digests {
+		parsed, err := godigest.Parse(digest)
+		if err != nil {
+			return err
+		}
+		descs = append(descs, ocispec.Descriptor{Digest: parsed})
+	}
+	return batchDeleteImages(ctx, registryUrl, nil, repositoryName, descs)
+}
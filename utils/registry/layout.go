@@ -0,0 +1,164 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/oci"
+
+	"github.com/awslabs/soci-snapshotter/soci/store"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Name of the file listing the images of an OCI image layout
+const ociLayoutIndexFile = "index.json"
+
+// Images on the local filesystem, read from an OCI image layout instead of being pulled from a registry
+type LocalImageSource struct {
+	path  string
+	store *oci.ReadOnlyStore
+	// The images of the layout as listed in its index.json
+	manifests []ocispec.Descriptor
+}
+
+// Open an OCI image layout directory, e.g. written by docker buildx build --output type=oci,tar=false
+func OpenOciLayout(ctx context.Context, dir string) (*LocalImageSource, error) {
+	layoutStore, err := oci.NewFromFS(ctx, os.DirFS(dir))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not an OCI image layout: %w", dir, err)
+	}
+	indexContent, err := os.ReadFile(filepath.Join(dir, ociLayoutIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	return newLocalImageSource(dir, layoutStore, indexContent)
+}
+
+// Open a tar archive of an image, e.g. written by docker save or docker buildx build --output type=docker.
+// The archive must contain an OCI image layout, which docker save writes since Docker 25.
+// The manifests of older archives are not the ones pushed to a registry, so SOCI indices built from them would refer to no image.
+func OpenDockerArchive(ctx context.Context, path string) (*LocalImageSource, error) {
+	layoutStore, err := oci.NewFromTar(ctx, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s does not contain an OCI image layout. It is written by docker save since Docker 25, and by docker buildx build --output type=docker: %w", path, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	indexContent, err := readTarFile(path, ociLayoutIndexFile)
+	if err != nil {
+		return nil, err
+	}
+	return newLocalImageSource(path, layoutStore, indexContent)
+}
+
+func newLocalImageSource(path string, layoutStore *oci.ReadOnlyStore, indexContent []byte) (*LocalImageSource, error) {
+	var index ocispec.Index
+	if err := json.Unmarshal(indexContent, &index); err != nil {
+		return nil, fmt.Errorf("Invalid %s in %s: %w", ociLayoutIndexFile, path, err)
+	}
+	return &LocalImageSource{path, layoutStore, index.Manifests}, nil
+}
+
+// Read a single file from a tar archive
+func readTarFile(path string, name string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%s not found in %s", name, path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimPrefix(header.Name, "./") == name {
+			return io.ReadAll(reader)
+		}
+	}
+}
+
+// Get the digest of an image in the layout, computed from its manifest as loaded from the layout.
+// tag is matched against the org.opencontainers.image.ref.name annotation of the images.
+// If neither digest nor tag is given, the layout must contain a single image.
+func (source *LocalImageSource) ResolveImageDigest(ctx context.Context, digest string, tag string) (string, error) {
+	var desc ocispec.Descriptor
+	switch {
+	case tag != "":
+		var err error
+		desc, err = source.store.Resolve(ctx, tag)
+		if err != nil {
+			return "", fmt.Errorf("Tag %s not found in %s: %w", tag, source.path, err)
+		}
+		log.Info(ctx, fmt.Sprintf("Resolved tag %s to digest %s", tag, desc.Digest))
+		if digest != "" && digest != desc.Digest.String() {
+			return "", fmt.Errorf("Tag %s refers to %s, which does not match the given digest %s", tag, desc.Digest, digest)
+		}
+	case digest != "":
+		found := false
+		for _, manifest := range source.manifests {
+			if manifest.Digest.String() == digest {
+				desc, found = manifest, true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("Image %s not found in %s", digest, source.path)
+		}
+	default:
+		if len(source.manifests) != 1 {
+			return "", fmt.Errorf("%s contains %d images, the image to index must be given with its digest or tag", source.path, len(source.manifests))
+		}
+		desc = source.manifests[0]
+	}
+	return desc.Digest.String(), nil
+}
+
+// Copy an image from the layout to a local OCI Store, the same way as it is pulled from a registry
+// Every blob is verified against its digest as it is copied, so the image matches the digest it was resolved to.
+// If platform is not nil, only the image manifest of the platform is copied
+func (source *LocalImageSource) Pull(ctx context.Context, sociStore *store.SociStore, digest string, platform *ocispec.Platform) (*ocispec.Descriptor, error) {
+	log.Info(ctx, fmt.Sprintf("Loading image from %s", source.path))
+	copyOptions := oras.DefaultCopyOptions
+	if platform != nil {
+		copyOptions.MapRoot = func(ctx context.Context, src content.ReadOnlyStorage, root ocispec.Descriptor) (ocispec.Descriptor, error) {
+			return selectAndStorePlatformManifest(ctx, src, sociStore, root, *platform)
+		}
+	}
+
+	imageDescriptor, err := oras.Copy(ctx, source.store, digest, sociStore, digest, copyOptions)
+	if err != nil {
+		return nil, err
+	}
+	return &imageDescriptor, nil
+}
+
+// List the digests of the image manifests SOCI indices are built for in an image in the layout.
+// If platforms is not empty, only the manifests of these platforms are listed.
+func (source *LocalImageSource) ImageManifestsToIndex(ctx context.Context, digest string, platforms []ocispec.Platform) ([]string, error) {
+	root, err := source.store.Resolve(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	return imageManifestsToIndex(ctx, source.store, root, platforms)
+}
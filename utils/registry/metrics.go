@@ -0,0 +1,55 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// A value of a CloudWatch metric, with a unit such as Count, Seconds or Bytes
+type MetricDatum struct {
+	Name  string
+	Unit  string
+	Value float64
+}
+
+// Put metric values with the same dimensions to CloudWatch with the PutMetricData API.
+// The region of the AWS session is used if region is empty.
+func PutMetricData(ctx context.Context, region string, namespace string, dimensions map[string]string, data []MetricDatum) error {
+	config := &aws.Config{Retryer: awsApiRetryer}
+	if region != "" {
+		config.Region = aws.String(region)
+	}
+	sess, err := getAwsSession()
+	if err != nil {
+		return err
+	}
+	client := cloudwatch.New(sess, config)
+
+	var metricDimensions []*cloudwatch.Dimension
+	for name, value := range dimensions {
+		metricDimensions = append(metricDimensions, &cloudwatch.Dimension{Name: aws.String(name), Value: aws.String(value)})
+	}
+	now := time.Now()
+	metricData := make([]*cloudwatch.MetricDatum, 0, len(data))
+	for _, datum := range data {
+		metricData = append(metricData, &cloudwatch.MetricDatum{
+			MetricName: aws.String(datum.Name),
+			Unit:       aws.String(datum.Unit),
+			Value:      aws.Float64(datum.Value),
+			Dimensions: metricDimensions,
+			Timestamp:  aws.Time(now),
+		})
+	}
+	// PutMetricData accepts up to 1000 metric values at once, more than a build emits
+	_, err = client.PutMetricDataWithContext(ctx, &cloudwatch.PutMetricDataInput{
+		Namespace:  aws.String(namespace),
+		MetricData: metricData,
+	})
+	return err
+}
@@ -0,0 +1,89 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+// Repositories of a registry where blobs are known to exist, because they were pulled from or pushed to them in this run
+type blobLocations struct {
+	repositories sync.Map
+}
+
+func (locations *blobLocations) record(digest godigest.Digest, repositoryName string) {
+	locations.repositories.Store(digest, repositoryName)
+}
+
+func (locations *blobLocations) repository(digest godigest.Digest) (string, bool) {
+	repositoryName, ok := locations.repositories.Load(digest)
+	if !ok {
+		return "", false
+	}
+	return repositoryName.(string), true
+}
+
+// A repository that blobs known to exist in another repository of the same registry are mounted to
+// instead of being uploaded again. Registries that do not support mounting get the blob uploaded instead.
+type mountingRepository struct {
+	*remote.Repository
+	locations *blobLocations
+	// Bytes of the blobs mounted rather than uploaded
+	mounted *atomic.Int64
+}
+
+func (repo mountingRepository) Push(ctx context.Context, desc ocispec.Descriptor, r io.Reader) error {
+	if !isProgressBlob(desc) {
+		return repo.Repository.Push(ctx, desc, r)
+	}
+	repositoryName := repo.Reference.Repository
+	fromRepo, ok := repo.locations.repository(desc.Digest)
+	if !ok || fromRepo == repositoryName {
+		if err := repo.Repository.Push(ctx, desc, r); err != nil {
+			return err
+		}
+		repo.locations.record(desc.Digest, repositoryName)
+		return nil
+	}
+
+	uploaded := false
+	err := repo.Repository.Mount(ctx, desc, fromRepo, func() (io.ReadCloser, error) {
+		uploaded = true
+		return io.NopCloser(r), nil
+	})
+	if err != nil {
+		return err
+	}
+	if !uploaded {
+		log.Info(ctx, fmt.Sprintf("Mounted blob %s (%d bytes) from %s", desc.Digest, desc.Size, fromRepo))
+		repo.mounted.Add(desc.Size)
+	}
+	repo.locations.record(desc.Digest, repositoryName)
+	return nil
+}
+
+// Record the blobs found in a repository by a copy with copyOptions, and count the bytes of the blobs that already existed in skipped
+func trackExistingBlobs(copyOptions *oras.CopyGraphOptions, locations *blobLocations, repositoryName string, skipped *atomic.Int64) {
+	onCopySkipped := copyOptions.OnCopySkipped
+	copyOptions.OnCopySkipped = func(ctx context.Context, desc ocispec.Descriptor) error {
+		if isProgressBlob(desc) {
+			locations.record(desc.Digest, repositoryName)
+			skipped.Add(desc.Size)
+		}
+		if onCopySkipped != nil {
+			return onCopySkipped(ctx, desc)
+		}
+		return nil
+	}
+}
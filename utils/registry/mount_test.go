@@ -0,0 +1,53 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+func TestMountingRepositoryPush(t *testing.T) {
+	blob := []byte("ztoc")
+	desc := ocispec.Descriptor{MediaType: "application/octet-stream", Digest: godigest.FromBytes(blob), Size: int64(len(blob))}
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		if r.Method == http.MethodPost && r.URL.Query().Get("mount") == desc.Digest.String() && r.URL.Query().Get("from") == "base" {
+			w.Header().Set("Location", "/v2/app/blobs/"+desc.Digest.String())
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}))
+	defer server.Close()
+	repository, err := remote.NewRepository(strings.TrimPrefix(server.URL, "http://") + "/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repository.PlainHTTP = true
+
+	// The blob was pushed to another repository of the registry earlier in the run
+	locations := &blobLocations{}
+	locations.record(desc.Digest, "base")
+	var mounted atomic.Int64
+	if err := (mountingRepository{repository, locations, &mounted}).Push(context.Background(), desc, bytes.NewReader(blob)); err != nil {
+		t.Fatalf("Failed to push the blob: %v (requests %q)", err, requests)
+	}
+	if len(requests) != 1 || mounted.Load() != desc.Size {
+		t.Fatalf("Expected the blob to be mounted with a single request, got %d bytes mounted with requests %q", mounted.Load(), requests)
+	}
+	if repositoryName, _ := locations.repository(desc.Digest); repositoryName != "app" {
+		t.Fatalf("Expected the blob to be recorded in the repository it was mounted to, got %q", repositoryName)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// Environment variable with the shared secret to sign webhook requests with
+const WebhookSecretEnv = "SOCI_WRAPPER_WEBHOOK_SECRET"
+
+// Header of webhook requests with the HMAC-SHA256 of the body, as sha256=HEX
+const webhookSignatureHeader = "X-Soci-Wrapper-Signature-256"
+
+// How long a webhook request may take, so that an unresponsive receiver does not hold up the exit
+const webhookTimeout = 10 * time.Second
+
+// Publish a message to an SNS topic, in the region of the topic
+func PublishSns(ctx context.Context, topicArn string, subject string, message string) error {
+	parsed, err := arn.Parse(topicArn)
+	if err != nil || parsed.Service != "sns" {
+		return fmt.Errorf("%s is not the ARN of an SNS topic", topicArn)
+	}
+	sess, err := getAwsSession()
+	if err != nil {
+		return err
+	}
+	client := sns.New(sess, &aws.Config{Region: aws.String(parsed.Region), Retryer: awsApiRetryer})
+	_, err = client.PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn: aws.String(topicArn),
+		Subject:  aws.String(subject),
+		Message:  aws.String(message),
+	})
+	return err
+}
+
+// POST a JSON body to a webhook, retrying once if it fails.
+// The body is signed with secret unless it is empty, so that the receiver can verify where it comes from.
+func PostWebhook(ctx context.Context, url string, body []byte, secret string) error {
+	client := &http.Client{Transport: httpTransport, Timeout: webhookTimeout}
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if attempt > 0 {
+			log.Warn(ctx, fmt.Sprintf("Webhook request failed, retrying: %v", err))
+			time.Sleep(time.Second)
+		}
+		err = postWebhookOnce(ctx, client, url, body, secret)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func postWebhookOnce(ctx context.Context, client *http.Client, url string, body []byte, secret string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook returned %s", resp.Status)
+	}
+	return nil
+}
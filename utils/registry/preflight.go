@@ -0,0 +1,102 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// Maximum length of a registry error response included in an error
+const maxErrorBodyLength = 1024
+
+// Check that AWS credentials resolve, and return the ARN of the identity they belong to
+func GetAwsIdentity(ctx context.Context, region string) (string, error) {
+	sess, err := getAwsSession()
+	if err != nil {
+		return "", err
+	}
+	if _, err := sess.Config.Credentials.GetWithContext(ctx); err != nil {
+		return "", err
+	}
+	identity, err := sts.New(sess, &aws.Config{Region: aws.String(region)}).GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(identity.Arn), nil
+}
+
+// Check that a repository exists in an ECR registry
+func DescribeRepository(ctx context.Context, registryUrl string, repositoryName string) error {
+	account, _, ok := ParseEcrRegistryUrl(registryUrl)
+	if !ok {
+		return fmt.Errorf("%s is not an ECR registry", registryUrl)
+	}
+	client, err := newEcrClient(registryUrl)
+	if err != nil {
+		return err
+	}
+	_, err = client.DescribeRepositoriesWithContext(ctx, &ecr.DescribeRepositoriesInput{
+		RegistryId:      aws.String(account),
+		RepositoryNames: []*string{aws.String(repositoryName)},
+	})
+	return err
+}
+
+// Check that blobs can be pushed to a repository by initiating an upload and aborting it right away.
+// Nothing is written to the repository. Registries that cannot abort uploads let them expire on their own.
+func (registry *Registry) CheckPushPermission(ctx context.Context, repositoryName string) error {
+	repo, err := registry.repository(ctx, repositoryName)
+	if err != nil {
+		return err
+	}
+	ctx = auth.AppendScopes(ctx, auth.ScopeRepository(repositoryName, auth.ActionPull, auth.ActionPush))
+
+	scheme := "https"
+	if repo.PlainHTTP {
+		scheme = "http"
+	}
+	url := fmt.Sprintf("%s://%s/v2/%s/blobs/uploads/", scheme, repo.Reference.Registry, repositoryName)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := repo.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyLength))
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return nil
+	}
+	abortReq, err := http.NewRequestWithContext(ctx, http.MethodDelete, location.String(), nil)
+	if err != nil {
+		return nil
+	}
+	abortResp, err := repo.Client.Do(abortReq)
+	if err != nil {
+		log.Warn(ctx, fmt.Sprintf("Couldn't abort the upload, it expires on its own: %v", err))
+		return nil
+	}
+	abortResp.Body.Close()
+	if abortResp.StatusCode != http.StatusNoContent && abortResp.StatusCode != http.StatusOK {
+		log.Warn(ctx, fmt.Sprintf("Couldn't abort the upload, it expires on its own: %s", abortResp.Status))
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"io"
+
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+)
+
+// A target counting the bytes of the blobs pushed to it in a progress
+type progressTarget struct {
+	oras.Target
+	progress *log.Progress
+}
+
+func (target progressTarget) Push(ctx context.Context, desc ocispec.Descriptor, r io.Reader) error {
+	if isProgressBlob(desc) {
+		r = progressReader{r, target.progress}
+	}
+	return target.Target.Push(ctx, desc, r)
+}
+
+type progressReader struct {
+	io.Reader
+	progress *log.Progress
+}
+
+func (r progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.progress.Add(int64(n))
+	return n, err
+}
+
+// Count the bytes of the blobs copied with copyOptions to a progressTarget in progress, out of the blobs of the manifests found,
+// including the blobs that already exist in the target
+func trackCopyProgress(copyOptions *oras.CopyGraphOptions, progress *log.Progress) {
+	findSuccessors := copyOptions.FindSuccessors
+	if findSuccessors == nil {
+		findSuccessors = content.Successors
+	}
+	copyOptions.FindSuccessors = func(ctx context.Context, fetcher content.Fetcher, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		successors, err := findSuccessors(ctx, fetcher, desc)
+		for _, successor := range successors {
+			if isProgressBlob(successor) {
+				progress.AddTotal(successor.Size)
+			}
+		}
+		return successors, err
+	}
+	onCopySkipped := copyOptions.OnCopySkipped
+	copyOptions.OnCopySkipped = func(ctx context.Context, desc ocispec.Descriptor) error {
+		if isProgressBlob(desc) {
+			progress.Add(desc.Size)
+		}
+		if onCopySkipped != nil {
+			return onCopySkipped(ctx, desc)
+		}
+		return nil
+	}
+}
+
+// Whether a node is counted in the progress of a copy, which leaves out manifests and indices since their size is only known once fetched
+func isProgressBlob(desc ocispec.Descriptor) bool {
+	return !images.IsManifestType(desc.MediaType) && !images.IsIndexType(desc.MediaType)
+}
@@ -0,0 +1,101 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// Longest time a receive waits for messages, which is the maximum of SQS long polling
+const queueWaitTime = 20 * time.Second
+
+// An SQS queue to receive build requests from
+type Queue struct {
+	client *sqs.SQS
+	url    string
+}
+
+// A message received from a queue
+type QueueMessage struct {
+	Id   string
+	Body string
+	// Identifies this receipt of the message, to delete it or change its visibility
+	ReceiptHandle string
+	// How many times the message has been received, including this time
+	ReceiveCount int
+}
+
+// Open an SQS queue by its URL, e.g. https://sqs.us-east-1.amazonaws.com/123456789012/NAME.
+// Requests are sent to the host of the URL, so that VPC endpoints and emulators work as well.
+func NewQueue(queueUrl string) (*Queue, error) {
+	parsed, err := url.Parse(queueUrl)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("%s is not the URL of an SQS queue", queueUrl)
+	}
+	config := &aws.Config{
+		Endpoint: aws.String(parsed.Scheme + "://" + parsed.Host),
+		Retryer:  awsApiRetryer,
+	}
+	if labels := strings.Split(parsed.Host, "."); len(labels) > 2 && labels[0] == "sqs" {
+		config.Region = aws.String(labels[1])
+	}
+	sess, err := getAwsSession()
+	if err != nil {
+		return nil, err
+	}
+	return &Queue{sqs.New(sess, config), queueUrl}, nil
+}
+
+// Receive up to max messages, waiting for them with long polling.
+// The messages are hidden from other consumers for visibilityTimeout.
+func (queue *Queue) Receive(ctx context.Context, max int, visibilityTimeout time.Duration) ([]QueueMessage, error) {
+	output, err := queue.client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(queue.url),
+		MaxNumberOfMessages: aws.Int64(int64(min(max, 10))),
+		VisibilityTimeout:   aws.Int64(int64(visibilityTimeout.Seconds())),
+		WaitTimeSeconds:     aws.Int64(int64(queueWaitTime.Seconds())),
+		AttributeNames:      aws.StringSlice([]string{sqs.MessageSystemAttributeNameApproximateReceiveCount}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]QueueMessage, 0, len(output.Messages))
+	for _, message := range output.Messages {
+		var receiveCount int
+		fmt.Sscan(aws.StringValue(message.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]), &receiveCount)
+		messages = append(messages, QueueMessage{
+			Id:            aws.StringValue(message.MessageId),
+			Body:          aws.StringValue(message.Body),
+			ReceiptHandle: aws.StringValue(message.ReceiptHandle),
+			ReceiveCount:  receiveCount,
+		})
+	}
+	return messages, nil
+}
+
+// Delete a message once it has been handled
+func (queue *Queue) Delete(ctx context.Context, message QueueMessage) error {
+	_, err := queue.client.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(queue.url),
+		ReceiptHandle: aws.String(message.ReceiptHandle),
+	})
+	return err
+}
+
+// Keep a message hidden from other consumers for visibilityTimeout from now, e.g. while a long build is running
+func (queue *Queue) ExtendVisibility(ctx context.Context, message QueueMessage, visibilityTimeout time.Duration) error {
+	_, err := queue.client.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(queue.url),
+		ReceiptHandle:     aws.String(message.ReceiptHandle),
+		VisibilityTimeout: aws.Int64(int64(visibilityTimeout.Seconds())),
+	})
+	return err
+}
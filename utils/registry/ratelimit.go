@@ -0,0 +1,94 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"golang.org/x/time/rate"
+)
+
+// Create a token bucket holding up to a second worth of tokens, so that short bursts are let through right away
+func newLimiter(perSecond float64) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(perSecond), max(1, int(perSecond)))
+}
+
+// An HTTP transport limiting the rate of registry requests
+type rateLimitTransport struct {
+	base    http.RoundTripper
+	limiter *rate.Limiter
+}
+
+func newRateLimitTransport(base http.RoundTripper, requestsPerSecond float64) *rateLimitTransport {
+	return &rateLimitTransport{base: base, limiter: newLimiter(requestsPerSecond)}
+}
+
+func (transport *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := transport.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return transport.base.RoundTrip(req)
+}
+
+// Limits of the bytes per second downloaded from and uploaded to registries, across every transfer at once
+// of every registry initialized with them
+type BandwidthLimits struct {
+	download *rate.Limiter
+	upload   *rate.Limiter
+}
+
+// Create limits of the bytes per second downloaded from and uploaded to registries, to set as RegistryOptions.Bandwidth.
+// A direction is unlimited if its limit is 0, and nil is returned if both are
+func NewBandwidthLimits(downloadBytesPerSecond int64, uploadBytesPerSecond int64) *BandwidthLimits {
+	if downloadBytesPerSecond <= 0 && uploadBytesPerSecond <= 0 {
+		return nil
+	}
+	return &BandwidthLimits{newBandwidthLimiter(downloadBytesPerSecond), newBandwidthLimiter(uploadBytesPerSecond)}
+}
+
+// Create a token bucket of bytes, shared by the transfers it limits, or nil if unlimited
+func newBandwidthLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return newLimiter(float64(bytesPerSecond))
+}
+
+// A request or response body whose reads are limited by a token bucket of bytes.
+// Each read is at most the size of the bucket, and waits for the bytes it read.
+type limitedBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func (body limitedBody) Read(p []byte) (int, error) {
+	p = p[:min(len(p), body.limiter.Burst())]
+	n, err := body.ReadCloser.Read(p)
+	if waitErr := body.limiter.WaitN(body.ctx, n); waitErr != nil && err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+// An HTTP transport limiting the bytes per second of request bodies with upload and response bodies with download
+type bandwidthLimitTransport struct {
+	base     http.RoundTripper
+	download *rate.Limiter
+	upload   *rate.Limiter
+}
+
+func (transport *bandwidthLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if transport.upload != nil && req.Body != nil && req.Body != http.NoBody {
+		req = req.Clone(req.Context())
+		req.Body = limitedBody{req.Body, req.Context(), transport.upload}
+	}
+	resp, err := transport.base.RoundTrip(req)
+	if err == nil && transport.download != nil {
+		resp.Body = limitedBody{resp.Body, req.Context(), transport.download}
+	}
+	return resp, err
+}
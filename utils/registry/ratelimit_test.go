@@ -0,0 +1,82 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiterBurst(t *testing.T) {
+	const size = 1 << 20
+	limiter := newBandwidthLimiter(size)
+	start := time.Unix(0, 0)
+
+	testCases := []struct {
+		name    string
+		elapsed time.Duration
+		bytes   int
+		wait    time.Duration
+	}{
+		// The bucket holds a second worth of bytes
+		{"burst", 0, size, 0},
+		{"empty bucket", 0, size, time.Second},
+		{"partially refilled bucket", 2500 * time.Millisecond, size / 2, 0},
+		// Idle time beyond a second does not add to the burst
+		{"idle", 10 * time.Second, size, 0},
+		{"beyond the burst", 10 * time.Second, size / 2, 500 * time.Millisecond},
+	}
+	for _, tc := range testCases {
+		now := start.Add(tc.elapsed)
+		if wait := limiter.ReserveN(now, tc.bytes).DelayFrom(now); wait != tc.wait {
+			t.Errorf("%s: expected to wait %s, got %s", tc.name, tc.wait, wait)
+		}
+	}
+	if requests := newLimiter(0.5); requests.Burst() != 1 {
+		t.Errorf("Expected a burst of at least a request, got %d", requests.Burst())
+	}
+}
+
+func TestBandwidthLimitTransportLimitsConcurrentTransfers(t *testing.T) {
+	const size = 1 << 10
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte{0}, size))
+	}))
+	defer server.Close()
+	limits := NewBandwidthLimits(size, 0)
+	client := newHttpClient(http.DefaultTransport, RegistryOptions{Bandwidth: limits})
+
+	// Both downloads take from the same bucket
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			if n, err := io.Copy(io.Discard, resp.Body); err != nil || n != size {
+				t.Errorf("Expected %d bytes, got %d: %v", size, n, err)
+			}
+		}()
+	}
+	wg.Wait()
+	end := time.Now()
+	// The bucket was full when the downloads started, and has refilled since for the time they took
+	if tokens, expected := limits.download.TokensAt(end), size*(end.Sub(start).Seconds()-1); tokens > expected+1 {
+		t.Errorf("Expected both downloads to take from the bucket, leaving at most %.0f bytes in it, got %.0f", expected, tokens)
+	}
+	if limits.upload != nil {
+		t.Errorf("Expected uploads to be unlimited")
+	}
+}
@@ -4,26 +4,44 @@
 package registry
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/fs"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"github.com/tmokmss/soci-wrapper/utils/version"
 	"io"
 	"net/http"
 	"os"
+	"path"
 	"regexp"
-	"soci-wrapper/utils/log"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
 	"oras.land/oras-go/v2/registry/remote"
 	"oras.land/oras-go/v2/registry/remote/auth"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecrpublic"
+	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
 
+	godigest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -34,43 +52,236 @@ const (
 
 	MediaTypeDockerImageConfig = "application/vnd.docker.container.image.v1+json"
 	MediaTypeOCIImageConfig    = "application/vnd.oci.image.config.v1+json"
+
+	// Registry hostname of ECR Public
+	EcrPublicRegistryUrl = "public.ecr.aws"
+
+	// ECR Public authorization tokens are only issued in us-east-1
+	ecrPublicRegion = "us-east-1"
+
+	// Registry hostname of Docker Hub
+	DockerHubRegistryUrl = "docker.io"
+
+	// How an artifact is indexed as a referrer of its subject
+	ReferrersApi       = "referrers API"
+	ReferrersTagSchema = "tag schema"
+
+	// BuildKit annotates attestation manifests in an image index with this annotation
+	AttestationReferenceTypeAnnotation = "vnd.docker.reference.type"
 )
 
 // List of config's media type for images
 var ImageConfigMediaTypes = []string{MediaTypeDockerImageConfig, MediaTypeOCIImageConfig}
 
+// List of media types of image manifests and image indices
+var ImageMediaTypes = []string{MediaTypeDockerManifest, MediaTypeOCIManifest, MediaTypeDockerManifestList, ocispec.MediaTypeImageIndex}
+
 type Registry struct {
 	registry *remote.Registry
+	options  RegistryOptions
+	// The registry url as given to Init, even if another endpoint is connected to
+	registryUrl string
+	// Where the blobs pulled and pushed so far exist, to mount them to other repositories
+	blobLocations *blobLocations
 }
 
 var RegistryNotSupportingOciArtifacts = errors.New("Registry does not support OCI artifacts")
 
+// Returned by ValidateImageManifest when a manifest is not the manifest of an image, wrapped with the reason
+var ErrInvalidImageManifest = errors.New("Invalid image manifest")
+
+// Returned by ValidateImageManifest when an image is of a platform soci-snapshotter cannot run, such as Windows, wrapped with the reason
+var ErrUnsupportedPlatform = errors.New("Unsupported platform")
+
+// Options for connecting to a remote registry
+type RegistryOptions struct {
+	// Credential for registries other than ECR and ECR Public, which are authorized with AWS credentials.
+	// If it is empty, the credential is resolved from the environment or the docker config file.
+	Credential auth.Credential
+	// Path of the docker config file to resolve credentials from. ~/.docker/config.json is used if empty
+	DockerConfigFile string
+	// Hostname to connect to instead of the registry url, e.g. an interface VPC endpoint or LocalStack.
+	// The registry url still determines how the registry is authorized.
+	Endpoint string
+	// Connect to the registry over plain HTTP instead of HTTPS
+	PlainHttp bool
+	// Number of retries of a failed registry request
+	MaxRetries int
+	// Maximum wait between retries of a failed registry request
+	RetryMaxWait time.Duration
+	// Maximum number of requests per second sent to the registry. Unlimited if 0
+	MaxRequestsPerSecond float64
+	// Maximum bytes per second downloaded from and uploaded to the registry, shared with every registry
+	// initialized with the same limits. Unlimited if nil
+	Bandwidth *BandwidthLimits
+	// PEM bundle of CA certificates to trust in addition to the system ones, e.g. for a mirror with an internal CA
+	CaCertFile string
+	// Skip verifying the TLS certificate of the registry. Only for lab environments
+	InsecureSkipTlsVerify bool
+	// AWS session to authorize with an ECR registry, e.g. of a role in the account owning the registry.
+	// The session configured with ConfigureAws is used if nil
+	AwsSession *session.Session
+	// How to index referrers such as SOCI indices. If empty, the referrers API is used if the registry supports it,
+	// and the tag schema otherwise. With ReferrersApi, falling back to the tag schema is logged as a warning,
+	// and with ReferrersTagSchema the tag schema is always used
+	Referrers string
+	// Number of blobs pulled at once. DefaultPullConcurrency if 0
+	PullConcurrency int
+	// Pull the image manifests of every platform of an image index, e.g. to copy the image as a whole.
+	// Only those of the platforms soci-snapshotter can run are pulled otherwise
+	PullAllPlatforms bool
+}
+
+// Number of blobs pulled at once by default
+const DefaultPullConcurrency = 4
+
 // Initialize a remote registry
-func Init(ctx context.Context, registryUrl string) (*Registry, error) {
+func Init(ctx context.Context, registryUrl string, opts RegistryOptions) (*Registry, error) {
 	log.Info(ctx, "Initializing registry client")
 	registry, err := remote.NewRegistry(registryUrl)
 	if err != nil {
 		return nil, err
 	}
+	registry.PlainHTTP = opts.PlainHttp
+	host := registryUrl
+	if opts.Endpoint != "" {
+		host = opts.Endpoint
+		log.Info(ctx, fmt.Sprintf("Connecting to the registry at %s", host))
+	}
+	transport, err := newRegistryTransport(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := newHttpClient(transport, opts)
 	if isEcrRegistry(registryUrl) {
-		err := authorizeEcr(registry)
+		sess, err := awsSessionOr(opts.AwsSession)
 		if err != nil {
 			return nil, err
 		}
+		err = authorizeEcr(ctx, registry, httpClient, sess)
+		if err != nil {
+			return nil, err
+		}
+	} else if IsEcrPublicRegistry(registryUrl) {
+		authorizeEcrPublic(ctx, registry, httpClient, host)
+	} else {
+		credential, err := ResolveCredential(registryUrl, opts.Credential, opts.DockerConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		if credential == auth.EmptyCredential {
+			log.Info(ctx, "No credential found for the registry, accessing it anonymously")
+		}
+		client := &auth.Client{
+			Client:     httpClient,
+			Cache:      auth.NewCache(),
+			Credential: auth.StaticCredential(host, credential),
+		}
+		client.SetUserAgent(version.UserAgent())
+		registry.RepositoryOptions.Client = client
+	}
+	// The authorization above is based on the registry url, so the host is replaced afterwards
+	registry.Reference.Registry = host
+	return &Registry{registry, opts, registryUrl, &blobLocations{}}, nil
+}
+
+// Get a repository of the remote registry.
+// ECR Public does not support the referrers API, so referrers are always managed with the tag schema there.
+func (registry *Registry) repository(ctx context.Context, repositoryName string) (*remote.Repository, error) {
+	repo, err := registry.registry.Repository(ctx, repositoryName)
+	if err != nil {
+		return nil, err
+	}
+	remoteRepo := repo.(*remote.Repository)
+	if IsEcrPublicRegistry(registry.registryUrl) {
+		remoteRepo.SetReferrersCapability(false)
 	}
-	return &Registry{registry}, nil
+	return remoteRepo, nil
 }
 
 // Pull an image from the remote registry to a local OCI Store
 // imageReference can be either a digest or a tag
-func (registry *Registry) Pull(ctx context.Context, repositoryName string, sociStore *store.SociStore, imageReference string) (*ocispec.Descriptor, error) {
+// If platform is not nil, only the image manifest of the platform is pulled
+func (registry *Registry) Pull(ctx context.Context, repositoryName string, sociStore *store.SociStore, imageReference string, platform *ocispec.Platform) (*ocispec.Descriptor, error) {
 	log.Info(ctx, "Pulling image")
-	repo, err := registry.registry.Repository(ctx, repositoryName)
+	return registry.pull(ctx, repositoryName, sociStore, imageReference, platform, true, "")
+}
+
+// Pull an image like Pull, writing its layers to partial files in partialDir first along with a journal of their progress.
+// A pull interrupted by a failure or by the loss of the host resumes from the partial files when called again with the same partialDir,
+// and the layers already in sociStore are not pulled again.
+func (registry *Registry) PullResumable(ctx context.Context, repositoryName string, sociStore *store.SociStore, imageReference string, platform *ocispec.Platform, partialDir string) (*ocispec.Descriptor, error) {
+	log.Info(ctx, fmt.Sprintf("Pulling image, resuming from %s", partialDir))
+	return registry.pull(ctx, repositoryName, sociStore, imageReference, platform, true, partialDir)
+}
+
+// Pull the manifests and configs of an image like Pull, but not its layers, e.g. to fetch them one by one with FetchBlob
+func (registry *Registry) PullManifests(ctx context.Context, repositoryName string, sociStore *store.SociStore, imageReference string, platform *ocispec.Platform) (*ocispec.Descriptor, error) {
+	log.Info(ctx, "Pulling image manifests without their layers")
+	return registry.pull(ctx, repositoryName, sociStore, imageReference, platform, false, "")
+}
+
+func (registry *Registry) pull(ctx context.Context, repositoryName string, sociStore *store.SociStore, imageReference string, platform *ocispec.Platform, layers bool, partialDir string) (*ocispec.Descriptor, error) {
+	repo, err := registry.repository(ctx, repositoryName)
 	if err != nil {
 		return nil, err
 	}
+	var src oras.ReadOnlyTarget = repo
+	if partialDir != "" {
+		journal, err := openPullJournal(partialDir)
+		if err != nil {
+			return nil, err
+		}
+		src = resumableRepository{repo, journal}
+	}
+
+	// Blobs are verified against their digest as they are pulled, and the first failure cancels the other pulls
+	copyOptions := oras.DefaultCopyOptions
+	copyOptions.Concurrency = cmp.Or(registry.options.PullConcurrency, DefaultPullConcurrency)
+	pulled := atomic.Int64{}
+	var pullStarts sync.Map
+	copyOptions.PreCopy = func(ctx context.Context, desc ocispec.Descriptor) error {
+		pullStarts.Store(desc.Digest, time.Now())
+		return nil
+	}
+	copyOptions.PostCopy = func(ctx context.Context, desc ocispec.Descriptor) error {
+		if images.IsLayerType(desc.MediaType) {
+			log.Info(ctx, fmt.Sprintf("Pulled layer %s (%d bytes), %d layers pulled so far", desc.Digest, desc.Size, pulled.Add(1)))
+			if start, ok := pullStarts.Load(desc.Digest); ok {
+				log.Debug(ctx, fmt.Sprintf("Pulled layer %s in %s", desc.Digest, time.Since(start.(time.Time)).Round(time.Millisecond)))
+			}
+		}
+		if isProgressBlob(desc) {
+			registry.blobLocations.record(desc.Digest, repositoryName)
+		}
+		return nil
+	}
+	copyOptions.FindSuccessors = func(ctx context.Context, fetcher content.Fetcher, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		successors, err := content.Successors(ctx, fetcher, desc)
+		return slices.DeleteFunc(successors, func(successor ocispec.Descriptor) bool {
+			if !layers && images.IsLayerType(successor.MediaType) {
+				return true
+			}
+			// The layers of Windows images are not worth pulling, and their foreign layers are not even in the registry
+			return !registry.options.PullAllPlatforms && IsPlatformImageManifest(successor) && !IsSupportedPlatform(*successor.Platform)
+		}), err
+	}
+	if platform != nil {
+		copyOptions.MapRoot = func(ctx context.Context, src content.ReadOnlyStorage, root ocispec.Descriptor) (ocispec.Descriptor, error) {
+			return selectAndStorePlatformManifest(ctx, src, sociStore, root, *platform)
+		}
+	}
+
+	progress := log.StartProgress(ctx, "Pulling image", "bytes", 0)
+	defer progress.Stop()
+	trackCopyProgress(&copyOptions.CopyGraphOptions, progress)
 
-	imageDescriptor, err := oras.Copy(ctx, repo, imageReference, sociStore, imageReference, oras.DefaultCopyOptions)
+	var imageDescriptor ocispec.Descriptor
+	err = registry.retryOperation(ctx, "image pull", func() error {
+		progress.Reset()
+		imageDescriptor, err = oras.Copy(ctx, src, imageReference, progressTarget{sociStore, progress}, imageReference, copyOptions)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -78,18 +289,105 @@ func (registry *Registry) Pull(ctx context.Context, repositoryName string, sociS
 	return &imageDescriptor, nil
 }
 
+// Fetch a blob to a file, verifying it against its digest.
+// The file is truncated and written again if the fetch is retried.
+func (registry *Registry) FetchBlob(ctx context.Context, repositoryName string, desc ocispec.Descriptor, file *os.File) error {
+	repo, err := registry.repository(ctx, repositoryName)
+	if err != nil {
+		return err
+	}
+	return registry.retryOperation(ctx, "blob fetch", func() error {
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		rc, err := repo.Blobs().Fetch(ctx, desc)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		verifier := content.NewVerifyReader(rc, desc)
+		if _, err := fs.Copy(file, verifier); err != nil {
+			return err
+		}
+		return verifier.Verify()
+	})
+}
+
 // Push a OCI artifact to remote registry
 // descriptor: ocispec Descriptor of the artifact
 // ociStore: the local OCI store
 func (registry *Registry) Push(ctx context.Context, sociStore *store.SociStore, indexDesc ocispec.Descriptor, repositoryName string) error {
 	log.Info(ctx, "Pushing artifact")
 
-	repo, err := registry.registry.Repository(ctx, repositoryName)
+	repo, err := registry.repository(ctx, repositoryName)
 	if err != nil {
 		return err
 	}
+	return registry.push(ctx, sociStore, indexDesc, repo, oras.DefaultCopyGraphOptions)
+}
+
+// Push an artifact having a subject, such as a SOCI index, to remote registry, and return how it was indexed
+// as a referrer of its subject, either ReferrersApi or ReferrersTagSchema.
+// The referrers API is used unless the registry returns 404 for it or the Referrers option is ReferrersTagSchema.
+func (registry *Registry) PushReferrer(ctx context.Context, sociStore *store.SociStore, desc ocispec.Descriptor, repositoryName string) (string, error) {
+	log.Info(ctx, "Pushing artifact")
+
+	repo, err := registry.repository(ctx, repositoryName)
+	if err != nil {
+		return "", err
+	}
+	if registry.options.Referrers == ReferrersTagSchema {
+		repo.SetReferrersCapability(false)
+	}
 
-	err = oras.CopyGraph(ctx, sociStore, repo, indexDesc, oras.DefaultCopyGraphOptions)
+	// The subject is left out, so that an artifact can be pushed before its subject, e.g. for an image loaded from a local layout
+	copyOptions := oras.DefaultCopyGraphOptions
+	copyOptions.FindSuccessors = func(ctx context.Context, fetcher content.Fetcher, node ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		successors, err := content.Successors(ctx, fetcher, node)
+		if err != nil || node.Digest != desc.Digest {
+			return successors, err
+		}
+		return slices.DeleteFunc(successors, func(successor ocispec.Descriptor) bool {
+			return slices.Contains(ImageMediaTypes, successor.MediaType)
+		}), nil
+	}
+	if err := registry.push(ctx, sociStore, desc, repo, copyOptions); err != nil {
+		return "", err
+	}
+
+	// The capability has been detected by pushing the subject, so it can only be set to the same value
+	mechanism := ReferrersApi
+	if repo.SetReferrersCapability(true) != nil {
+		mechanism = ReferrersTagSchema
+		if registry.options.Referrers == ReferrersApi {
+			log.Warn(ctx, "The registry does not support the referrers API, fell back to the tag schema")
+		}
+	}
+	log.Info(ctx, fmt.Sprintf("Indexed the artifact as a referrer with the %s", mechanism))
+	return mechanism, nil
+}
+
+// Push an artifact to a repository.
+// Blobs already in the repository are not uploaded again, and blobs known to exist in another repository of the registry are mounted from it.
+func (registry *Registry) push(ctx context.Context, sociStore *store.SociStore, indexDesc ocispec.Descriptor, repo *remote.Repository, copyOptions oras.CopyGraphOptions) error {
+	progress := log.StartProgress(ctx, "Pushing artifact", "bytes", 0)
+	defer progress.Stop()
+	trackCopyProgress(&copyOptions, progress)
+	var skipped, mounted atomic.Int64
+	trackExistingBlobs(&copyOptions, registry.blobLocations, repo.Reference.Repository, &skipped)
+	dst := progressTarget{mountingRepository{repo, registry.blobLocations, &mounted}, progress}
+	err := registry.retryOperation(ctx, "artifact push", func() error {
+		progress.Reset()
+		skipped.Store(0)
+		mounted.Store(0)
+		return oras.CopyGraph(ctx, sociStore, dst, indexDesc, copyOptions)
+	})
+	if saved := skipped.Load() + mounted.Load(); saved > 0 {
+		log.Info(ctx, fmt.Sprintf("Saved uploading %d bytes: %d bytes of blobs already in the repository, %d bytes mounted from other repositories", saved, skipped.Load(), mounted.Load()))
+	}
 	if err != nil {
 		// TODO: There might be a better way to check if a registry supporting OCI or not
 		if strings.Contains(err.Error(), "Response status code 405: unsupported: Invalid parameter at 'ImageManifest' failed to satisfy constraint: 'Invalid JSON syntax'") {
@@ -101,9 +399,117 @@ func (registry *Registry) Push(ctx context.Context, sociStore *store.SociStore,
 	return nil
 }
 
+// Tag a manifest in the remote registry
+func (registry *Registry) Tag(ctx context.Context, repositoryName string, desc ocispec.Descriptor, tag string) error {
+	log.Info(ctx, fmt.Sprintf("Tagging %s as %s", desc.Digest, tag))
+	repo, err := registry.repository(ctx, repositoryName)
+	if err != nil {
+		return err
+	}
+	return repo.Tag(ctx, desc, tag)
+}
+
+// Check if soci-snapshotter can run images of a platform, which must be Linux
+func IsSupportedPlatform(platform ocispec.Platform) bool {
+	return platform.OS == "linux"
+}
+
+// Check if a layer is a foreign or non-distributable layer, such as the base layers of Windows images,
+// which are downloaded from their URLs rather than from the registry
+func isForeignLayer(layer ocispec.Descriptor) bool {
+	return len(layer.URLs) > 0 || strings.Contains(layer.MediaType, ".foreign.") || strings.Contains(layer.MediaType, ".nondistributable.")
+}
+
+// Check if a manifest in an image index is an image of a known platform.
+// Attestation manifests added by BuildKit are not, and their platform is unknown/unknown.
+func IsPlatformImageManifest(desc ocispec.Descriptor) bool {
+	if desc.MediaType != MediaTypeDockerManifest && desc.MediaType != MediaTypeOCIManifest {
+		return false
+	}
+	if desc.Platform == nil || desc.Platform.OS == "unknown" {
+		return false
+	}
+	return desc.Annotations[AttestationReferenceTypeAnnotation] == ""
+}
+
+// Select the image manifest of a platform from an image.
+// If root is an image index, its first image manifest matching the platform is returned.
+// If root is an image manifest, it is returned if its config matches the platform.
+// Otherwise, the returned error lists the available platforms.
+func selectPlatformManifest(ctx context.Context, src content.ReadOnlyStorage, root ocispec.Descriptor, platform ocispec.Platform) (ocispec.Descriptor, error) {
+	matcher := platforms.OnlyStrict(platform)
+	var available []string
+	switch root.MediaType {
+	case MediaTypeDockerManifestList, ocispec.MediaTypeImageIndex:
+		children, err := content.Successors(ctx, src, root)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		for _, child := range children {
+			if !IsPlatformImageManifest(child) {
+				continue
+			}
+			if matcher.Match(*child.Platform) {
+				return child, nil
+			}
+			available = append(available, platforms.Format(*child.Platform))
+		}
+	case MediaTypeDockerManifest, MediaTypeOCIManifest:
+		manifestPlatform, err := fetchManifestPlatform(ctx, src, root)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if matcher.Match(manifestPlatform) {
+			return root, nil
+		}
+		available = append(available, platforms.Format(manifestPlatform))
+	default:
+		return ocispec.Descriptor{}, fmt.Errorf("Unexpected manifest media type: %s", root.MediaType)
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("Platform %s not found in the image, available platforms: [%s]", platforms.Format(platform), strings.Join(available, ", "))
+}
+
+// Select the image manifest of a platform like selectPlatformManifest, and store the image index it was selected from in dst,
+// without the manifests of the other platforms, so that VerifyPlatformContent can check the manifest against the digest of the image
+func selectAndStorePlatformManifest(ctx context.Context, src content.ReadOnlyStorage, dst content.Storage, root ocispec.Descriptor, platform ocispec.Platform) (ocispec.Descriptor, error) {
+	manifest, err := selectPlatformManifest(ctx, src, root, platform)
+	if err != nil || manifest.Digest == root.Digest {
+		return manifest, err
+	}
+	index, err := content.FetchAll(ctx, src, root)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	exists, err := dst.Exists(ctx, root)
+	if err == nil && !exists {
+		err = dst.Push(ctx, root, bytes.NewReader(index))
+	}
+	return manifest, err
+}
+
+// Read the platform of an image manifest from its config
+func fetchManifestPlatform(ctx context.Context, src content.ReadOnlyStorage, desc ocispec.Descriptor) (ocispec.Platform, error) {
+	var manifest ocispec.Manifest
+	var platform ocispec.Platform
+	bytes, err := content.FetchAll(ctx, src, desc)
+	if err != nil {
+		return platform, err
+	}
+	if err = json.Unmarshal(bytes, &manifest); err != nil {
+		return platform, err
+	}
+
+	bytes, err = content.FetchAll(ctx, src, manifest.Config)
+	if err != nil {
+		return platform, err
+	}
+	err = json.Unmarshal(bytes, &platform)
+	return platform, err
+}
+
 // Call registry's headManifest and return the manifest's descriptor
 func (registry *Registry) HeadManifest(ctx context.Context, repositoryName string, reference string) (ocispec.Descriptor, error) {
-	repo, err := registry.registry.Repository(ctx, repositoryName)
+	repo, err := registry.repository(ctx, repositoryName)
 	if err != nil {
 		return ocispec.Descriptor{}, err
 	}
@@ -119,7 +525,7 @@ func (registry *Registry) HeadManifest(ctx context.Context, repositoryName strin
 // Call registry's getManifest and return the image's manifest
 // The image reference must be a digest because that's what oras-go FetchReference takes
 func (registry *Registry) GetManifest(ctx context.Context, repositoryName string, digest string) (ocispec.Manifest, error) {
-	repo, err := registry.registry.Repository(ctx, repositoryName)
+	repo, err := registry.repository(ctx, repositoryName)
 	var manifest ocispec.Manifest
 	if err != nil {
 		return manifest, err
@@ -143,66 +549,462 @@ func (registry *Registry) GetManifest(ctx context.Context, repositoryName string
 	return manifest, nil
 }
 
-// Validate if a digest is a valid image manifest
+// Validate if a digest is a valid image manifest, or an image index of at least one image manifest.
+// Docker and OCI media types are handled alike
 func (registry *Registry) ValidateImageManifest(ctx context.Context, repositoryName string, digest string) error {
-	manifest, err := registry.GetManifest(ctx, repositoryName, digest)
+	repo, err := registry.repository(ctx, repositoryName)
+	if err != nil {
+		return err
+	}
+	desc, rc, err := repo.FetchReference(ctx, digest)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	manifestBytes, err := io.ReadAll(rc)
 	if err != nil {
 		return err
 	}
+	if err := validateImageManifest(desc.MediaType, manifestBytes); err != nil {
+		return err
+	}
 
-	if manifest.Config.MediaType == "" {
-		return fmt.Errorf("Empty config media type.")
+	// The OS of an image manifest is only in its config, which is small enough to fetch before pulling the layers
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil || manifest.Config.Digest == "" {
+		return nil
+	}
+	configBytes, err := content.FetchAll(ctx, repo.Blobs(), manifest.Config)
+	if err != nil {
+		return err
 	}
+	return validateImageConfig(configBytes)
+}
+
+// Validate that the config of an image manifest is of a platform that soci-snapshotter can run
+func validateImageConfig(configBytes []byte) error {
+	var config ocispec.Image
+	if err := json.Unmarshal(configBytes, &config); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidImageManifest, err)
+	}
+	if config.OS != "" && !IsSupportedPlatform(config.Platform) {
+		return fmt.Errorf("%w: the image is a %s image, and soci-snapshotter only runs Linux images", ErrUnsupportedPlatform, platforms.Format(config.Platform))
+	}
+	return nil
+}
+
+// Validate the content of a manifest of a media type, given by the registry or else by the manifest itself
+func validateImageManifest(mediaType string, manifestBytes []byte) error {
+	var manifest struct {
+		ocispec.Manifest
+		Manifests []ocispec.Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidImageManifest, err)
+	}
+	mediaType = cmp.Or(mediaType, manifest.MediaType)
 
-	for _, configMediaType := range ImageConfigMediaTypes {
-		if manifest.Config.MediaType == configMediaType {
-			return nil
+	switch mediaType {
+	case MediaTypeDockerManifestList, ocispec.MediaTypeImageIndex:
+		// Attestation manifests and the like are not indexed, so an image index of those only has nothing to build
+		if !slices.ContainsFunc(manifest.Manifests, IsPlatformImageManifest) {
+			return fmt.Errorf("%w: image index %s has no image manifests of a known platform", ErrInvalidImageManifest, mediaType)
 		}
+		// The manifests of other platforms are skipped as long as there is one to index
+		if !slices.ContainsFunc(manifest.Manifests, func(desc ocispec.Descriptor) bool {
+			return IsPlatformImageManifest(desc) && IsSupportedPlatform(*desc.Platform)
+		}) {
+			return fmt.Errorf("%w: the image index has no Linux image manifests, and soci-snapshotter only runs Linux images", ErrUnsupportedPlatform)
+		}
+		return nil
+	case MediaTypeDockerManifest, MediaTypeOCIManifest:
+		if manifest.Config.MediaType == "" {
+			return fmt.Errorf("%w: empty config media type", ErrInvalidImageManifest)
+		}
+		if !slices.Contains(ImageConfigMediaTypes, manifest.Config.MediaType) {
+			return fmt.Errorf("%w: unexpected config media type %s, expected one of %v", ErrInvalidImageManifest, manifest.Config.MediaType, ImageConfigMediaTypes)
+		}
+		if i := slices.IndexFunc(manifest.Layers, isForeignLayer); i >= 0 {
+			return fmt.Errorf("%w: layer %s is a foreign layer (%s), which Windows images have and soci-snapshotter cannot run", ErrUnsupportedPlatform, manifest.Layers[i].Digest, manifest.Layers[i].MediaType)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unexpected media type %s, expected one of %v", ErrInvalidImageManifest, cmp.Or(mediaType, "(empty)"), ImageMediaTypes)
+	}
+}
+
+// Call ECR DescribeImages over every page of a repository's images
+func describeImages(ctx context.Context, registryUrl string, repositoryName string, filter *ecr.DescribeImagesFilter, fn func(image *ecr.ImageDetail)) error {
+	account, _, ok := ParseEcrRegistryUrl(registryUrl)
+	if !ok {
+		return fmt.Errorf("%s is not an ECR registry", registryUrl)
 	}
 
-	return fmt.Errorf("Unexpected config media type: %s, expected one of: %v.", manifest.Config.MediaType, ImageConfigMediaTypes)
+	input := &ecr.DescribeImagesInput{
+		RegistryId:     aws.String(account),
+		RepositoryName: aws.String(repositoryName),
+		Filter:         filter,
+	}
+	client, err := newEcrClient(registryUrl)
+	if err != nil {
+		return err
+	}
+	return client.DescribeImagesPagesWithContext(ctx, input, func(page *ecr.DescribeImagesOutput, lastPage bool) bool {
+		for _, image := range page.ImageDetails {
+			fn(image)
+		}
+		return true
+	})
+}
+
+// List the digests of images in an ECR repository having at least one tag that starts with tagPrefix.
+// Digests are deduplicated because multiple tags can point to the same manifest.
+func ListImageDigestsByTagPrefix(ctx context.Context, registryUrl string, repositoryName string, tagPrefix string) ([]string, error) {
+	var digests []string
+	seen := map[string]bool{}
+	filter := &ecr.DescribeImagesFilter{TagStatus: aws.String(ecr.TagStatusTagged)}
+	err := describeImages(ctx, registryUrl, repositoryName, filter, func(image *ecr.ImageDetail) {
+		digest := aws.StringValue(image.ImageDigest)
+		if seen[digest] {
+			return
+		}
+		for _, tag := range image.ImageTags {
+			if strings.HasPrefix(aws.StringValue(tag), tagPrefix) {
+				seen[digest] = true
+				digests = append(digests, digest)
+				return
+			}
+		}
+	})
+	return digests, err
+}
+
+// List every single-platform image manifest in an ECR repository, tagged or not.
+// Other artifacts such as SOCI indices and image indices are left out. The platform manifests
+// of an image index are listed on their own.
+func listImageDetails(ctx context.Context, registryUrl string, repositoryName string) ([]*ecr.ImageDetail, error) {
+	var details []*ecr.ImageDetail
+	err := describeImages(ctx, registryUrl, repositoryName, nil, func(image *ecr.ImageDetail) {
+		artifactMediaType := aws.StringValue(image.ArtifactMediaType)
+		for _, configMediaType := range ImageConfigMediaTypes {
+			if artifactMediaType == configMediaType {
+				details = append(details, image)
+				return
+			}
+		}
+	})
+	return details, err
+}
+
+// List the digests of every single-platform image manifest in an ECR repository
+func ListImageDigests(ctx context.Context, registryUrl string, repositoryName string) ([]string, error) {
+	details, err := listImageDetails(ctx, registryUrl, repositoryName)
+	if err != nil {
+		return nil, err
+	}
+	digests := make([]string, 0, len(details))
+	for _, detail := range details {
+		digests = append(digests, aws.StringValue(detail.ImageDigest))
+	}
+	return digests, nil
+}
+
+// List the digests of the most recently pushed single-platform image manifests in an ECR repository, newest first
+func ListRecentImageDigests(ctx context.Context, registryUrl string, repositoryName string, count int) ([]string, error) {
+	details, err := listImageDetails(ctx, registryUrl, repositoryName)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(details, func(i, j int) bool {
+		return aws.TimeValue(details[i].ImagePushedAt).After(aws.TimeValue(details[j].ImagePushedAt))
+	})
+	digests := make([]string, 0, count)
+	for _, detail := range details {
+		if len(digests) >= count {
+			break
+		}
+		digests = append(digests, aws.StringValue(detail.ImageDigest))
+	}
+	return digests, nil
+}
+
+// List the names of repositories in an ECR registry matching a glob pattern
+func ListRepositories(ctx context.Context, registryUrl string, pattern string) ([]string, error) {
+	account, _, ok := ParseEcrRegistryUrl(registryUrl)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ECR registry", registryUrl)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("Invalid repository pattern %s: %w", pattern, err)
+	}
+
+	input := &ecr.DescribeRepositoriesInput{
+		RegistryId: aws.String(account),
+	}
+	client, err := newEcrClient(registryUrl)
+	if err != nil {
+		return nil, err
+	}
+	var repositories []string
+	err = client.DescribeRepositoriesPagesWithContext(ctx, input, func(page *ecr.DescribeRepositoriesOutput, lastPage bool) bool {
+		for _, repository := range page.Repositories {
+			name := aws.StringValue(repository.RepositoryName)
+			if match, _ := path.Match(pattern, name); match {
+				repositories = append(repositories, name)
+			}
+		}
+		return true
+	})
+	return repositories, err
+}
+
+// Check if an image already has a SOCI index referring to it
+// The image itself does not have to exist in the repository, e.g. when SOCI indices are pushed to another repository
+func (registry *Registry) HasSociIndex(ctx context.Context, repositoryName string, digest string) (bool, error) {
+	indices, err := registry.ListSociIndices(ctx, repositoryName, digest)
+	return len(indices) > 0, err
+}
+
+// List the SOCI indices referring to a manifest
+func (registry *Registry) ListSociIndices(ctx context.Context, repositoryName string, digest string) ([]ocispec.Descriptor, error) {
+	repo, err := registry.repository(ctx, repositoryName)
+	if err != nil {
+		return nil, err
+	}
+
+	manifestDigest, err := godigest.Parse(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	// Referrers are looked up by the digest alone
+	var indices []ocispec.Descriptor
+	err = repo.Referrers(ctx, ocispec.Descriptor{Digest: manifestDigest}, soci.SociIndexArtifactType, func(referrers []ocispec.Descriptor) error {
+		indices = append(indices, referrers...)
+		return nil
+	})
+	return indices, err
+}
+
+// Delete artifacts having a subject, such as SOCI indices, from a repository.
+// mechanism is how they are indexed as referrers, as returned by PushReferrer. With the referrers API, ECR deletes
+// them with BatchDeleteImage. Otherwise they are deleted one by one through the registry, so that the referrers
+// index of their subject is updated as well.
+func (registry *Registry) DeleteReferrers(ctx context.Context, repositoryName string, descs []ocispec.Descriptor, mechanism string) error {
+	if isEcrRegistry(registry.registryUrl) && mechanism == ReferrersApi {
+		return batchDeleteImages(ctx, registry.registryUrl, registry.options.AwsSession, repositoryName, descs)
+	}
+
+	repo, err := registry.repository(ctx, repositoryName)
+	if err != nil {
+		return err
+	}
+	repo.SetReferrersCapability(mechanism == ReferrersApi)
+	for _, desc := range descs {
+		log.Info(ctx, fmt.Sprintf("Deleting %s", desc.Digest))
+		err := registry.retryOperation(ctx, "artifact delete", func() error {
+			return repo.Delete(ctx, desc)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete manifests from an ECR repository with BatchDeleteImage
+// sess is the AWS session to call ECR with. The session configured with ConfigureAws is used if nil
+func batchDeleteImages(ctx context.Context, registryUrl string, sess *session.Session, repositoryName string, descs []ocispec.Descriptor) error {
+	account, _, _ := ParseEcrRegistryUrl(registryUrl)
+	sess, err := awsSessionOr(sess)
+	if err != nil {
+		return err
+	}
+	client := newEcrClientWithSession(sess, registryUrl)
+
+	// BatchDeleteImage accepts up to 100 images at once
+	for start := 0; start < len(descs); start += 100 {
+		chunk := descs[start:min(start+100, len(descs))]
+		imageIds := make([]*ecr.ImageIdentifier, 0, len(chunk))
+		for _, desc := range chunk {
+			log.Info(ctx, fmt.Sprintf("Deleting %s", desc.Digest))
+			imageIds = append(imageIds, &ecr.ImageIdentifier{ImageDigest: aws.String(desc.Digest.String())})
+		}
+		output, err := client.BatchDeleteImageWithContext(ctx, &ecr.BatchDeleteImageInput{
+			RegistryId:     aws.String(account),
+			RepositoryName: aws.String(repositoryName),
+			ImageIds:       imageIds,
+		})
+		if err != nil {
+			return err
+		}
+		var failures []error
+		for _, failure := range output.Failures {
+			// An image deleted in the meantime is as good as deleted
+			if aws.StringValue(failure.FailureCode) == ecr.ImageFailureCodeImageNotFound {
+				continue
+			}
+			failures = append(failures, fmt.Errorf("%s: %s: %s", aws.StringValue(failure.ImageId.ImageDigest), aws.StringValue(failure.FailureCode), aws.StringValue(failure.FailureReason)))
+		}
+		if len(failures) > 0 {
+			return errors.Join(failures...)
+		}
+	}
+	return nil
+}
+
+// Returns ecr registry url of an account in a region
+// The DNS suffix depends on the partition of the region, e.g. amazonaws.com.cn in China regions.
+// FIPS registries have an ecr-fips hostname instead of ecr.
+func BuildEcrRegistryUrl(region string, account string, fips bool) string {
+	dnsSuffix := "amazonaws.com"
+	if partition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		dnsSuffix = partition.DNSSuffix()
+	}
+	service := "ecr"
+	if fips {
+		service = "ecr-fips"
+	}
+	return account + ".dkr." + service + "." + region + "." + dnsSuffix
 }
 
 // Check if a registry is an ECR registry
 func isEcrRegistry(registryUrl string) bool {
-	ecrRegistryUrlRegex := "\\d{12}\\.dkr\\.ecr\\.\\S+\\.amazonaws\\.com"
-	match, err := regexp.MatchString(ecrRegistryUrlRegex, registryUrl)
+	_, _, ok := ParseEcrRegistryUrl(registryUrl)
+	return ok
+}
+
+// Check if a registry is an ECR registry with a FIPS endpoint
+func isFipsEcrRegistry(registryUrl string) bool {
+	return strings.Contains(registryUrl, ".dkr.ecr-fips.")
+}
+
+// Check if a registry is ECR Public
+func IsEcrPublicRegistry(registryUrl string) bool {
+	return registryUrl == EcrPublicRegistryUrl
+}
+
+// Check if a registry is Docker Hub
+func IsDockerHubRegistry(registryUrl string) bool {
+	return registryUrl == DockerHubRegistryUrl
+}
+
+// Normalize a repository name of a registry
+// Official images on Docker Hub live under the library namespace, e.g. alpine is library/alpine
+func NormalizeRepositoryName(registryUrl string, repositoryName string) string {
+	if IsDockerHubRegistry(registryUrl) && !strings.Contains(repositoryName, "/") {
+		return "library/" + repositoryName
+	}
+	return repositoryName
+}
+
+// Parse the account and region out of an ECR registry url
+// Returns false if the registry url is not an ECR registry
+func ParseEcrRegistryUrl(registryUrl string) (account string, region string, ok bool) {
+	ecrRegistryUrlRegex := regexp.MustCompile("^(\\d{12})\\.dkr\\.ecr(?:-fips)?\\.([a-z0-9-]+)\\.(?:amazonaws\\.com(?:\\.cn)?|c2s\\.ic\\.gov|sc2s\\.sgov\\.gov)$")
+	match := ecrRegistryUrlRegex.FindStringSubmatch(registryUrl)
+	if match == nil {
+		return "", "", false
+	}
+	return match[1], match[2], true
+}
+
+// Create an ECR API client for the region of an ECR registry
+// The FIPS endpoint of the ECR API is used for FIPS registries
+func newEcrClient(registryUrl string) (*ecr.ECR, error) {
+	sess, err := getAwsSession()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return match
+	return newEcrClientWithSession(sess, registryUrl), nil
 }
 
-// Authorize ECR registry
-func authorizeEcr(ecrRegistry *remote.Registry) error {
-	// getting ecr auth token
-	input := &ecr.GetAuthorizationTokenInput{}
-	var ecrClient *ecr.ECR
-	ecrEndpoint := os.Getenv("ECR_ENDPOINT") // set this env var for custom, i.e. non default, aws ecr endpoint
+// Create an ECR API client for the region of an ECR registry from an AWS session
+func newEcrClientWithSession(sess *session.Session, registryUrl string) *ecr.ECR {
+	config := &aws.Config{}
+	if _, region, _ := ParseEcrRegistryUrl(registryUrl); region != "" {
+		config.Region = aws.String(region)
+	}
+	if isFipsEcrRegistry(registryUrl) {
+		config.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	config.Retryer = awsApiRetryer
+	ecrEndpoint := ecrEndpointUrl
+	if ecrEndpoint == "" {
+		ecrEndpoint = os.Getenv("ECR_ENDPOINT") // set this env var for custom, i.e. non default, aws ecr endpoint
+	}
 	if ecrEndpoint != "" {
-		ecrClient = ecr.New(session.New(&aws.Config{Endpoint: aws.String(ecrEndpoint)}))
-	} else {
-		ecrClient = ecr.New(session.New())
+		config.Endpoint = aws.String(ecrEndpoint)
 	}
-	getAuthorizationTokenResponse, err := ecrClient.GetAuthorizationToken(input)
+	return ecr.New(sess, config)
+}
+
+// Authorize ECR registry
+// The authorization token is fetched right away, and refreshed by the auth cache when needed
+func authorizeEcr(ctx context.Context, ecrRegistry *remote.Registry, httpClient *http.Client, sess *session.Session) error {
+	cache := &ecrTokenCache{ecrClient: newEcrClientWithSession(sess, ecrRegistry.Reference.Registry)}
+	cache.mu.Lock()
+	err := cache.refresh(ctx)
+	cache.mu.Unlock()
 	if err != nil {
 		return err
 	}
 
-	if len(getAuthorizationTokenResponse.AuthorizationData) == 0 {
-		return errors.New("Couldn't authorize with ECR: empty authorization data returned")
+	client := &auth.Client{
+		Client: httpClient,
+		Cache:  cache,
 	}
+	client.SetUserAgent(version.UserAgent())
+	ecrRegistry.RepositoryOptions.Client = client
+	return nil
+}
 
-	ecrAuthorizationToken := getAuthorizationTokenResponse.AuthorizationData[0].AuthorizationToken
-	if len(*ecrAuthorizationToken) == 0 {
-		return errors.New("Couldn't authorize with ECR: empty authorization token returned")
+// Authorize ECR Public registry
+// ECR Public uses token auth, so the credential from ECR Public GetAuthorizationToken is exchanged
+// for a registry token by the client. Images are pulled anonymously if no AWS credentials are available.
+// The credential is only sent to host, the hostname connected to, which may differ from the registry url.
+func authorizeEcrPublic(ctx context.Context, ecrPublicRegistry *remote.Registry, httpClient *http.Client, host string) {
+	client := &auth.Client{
+		Client: httpClient,
+		Cache:  auth.NewCache(),
 	}
+	client.SetUserAgent(version.UserAgent())
+	ecrPublicRegistry.RepositoryOptions.Client = client
 
-	ecrRegistry.RepositoryOptions.Client = &auth.Client{
-		Header: http.Header{
-			"Authorization": {"Basic " + *ecrAuthorizationToken},
-			"User-Agent":    {"SOCI Index Builder (oras-go)"},
-		},
+	credential, err := getEcrPublicCredential()
+	if err != nil {
+		log.Warn(ctx, fmt.Sprintf("Couldn't authorize with ECR Public, accessing it anonymously: %v", err))
+		return
 	}
-	return nil
+	client.Credential = auth.StaticCredential(host, credential)
+}
+
+// Get a registry credential from ECR Public GetAuthorizationToken
+func getEcrPublicCredential() (auth.Credential, error) {
+	config := &aws.Config{Region: aws.String(ecrPublicRegion), Retryer: awsApiRetryer}
+	sess, err := getAwsSession()
+	if err != nil {
+		return auth.EmptyCredential, err
+	}
+	ecrPublicClient := ecrpublic.New(sess, config)
+	getAuthorizationTokenResponse, err := ecrPublicClient.GetAuthorizationToken(&ecrpublic.GetAuthorizationTokenInput{})
+	if err != nil {
+		return auth.EmptyCredential, err
+	}
+
+	authorizationData := getAuthorizationTokenResponse.AuthorizationData
+	if authorizationData == nil || len(aws.StringValue(authorizationData.AuthorizationToken)) == 0 {
+		return auth.EmptyCredential, errors.New("empty authorization token returned")
+	}
+
+	// The token is a base64 encoded "username:password" pair
+	decoded, err := base64.StdEncoding.DecodeString(aws.StringValue(authorizationData.AuthorizationToken))
+	if err != nil {
+		return auth.EmptyCredential, err
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return auth.EmptyCredential, errors.New("malformed authorization token returned")
+	}
+	return auth.Credential{Username: username, Password: password}, nil
 }
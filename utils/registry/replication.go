@@ -0,0 +1,88 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"oras.land/oras-go/v2/registry/remote/retry"
+)
+
+const (
+	// Default time to wait for an image to be replicated
+	DefaultReplicationTimeout = 15 * time.Minute
+
+	// Maximum wait between polls of the replication status
+	replicationPollMaxWait = 30 * time.Second
+)
+
+// Returned when an image has not been replicated in time. Replication is still in progress,
+// so it is a failure worth retrying later, unlike a failed replication.
+var ErrReplicationTimeout = errors.New("Timed out waiting for ECR replication")
+
+// Backoff between polls of the replication status, starting from 2 seconds
+var replicationPollBackoff = retry.ExponentialBackoff(2*time.Second, 2, 0.1)
+
+// Wait until an image in an ECR registry has been replicated to another ECR registry, e.g. in another region.
+// The replication status is polled with exponential backoff until it is complete, has failed, or timeout has elapsed.
+func WaitForReplication(ctx context.Context, registryUrl string, repositoryName string, digest string, replicaRegistryUrl string, timeout time.Duration) error {
+	account, _, ok := ParseEcrRegistryUrl(registryUrl)
+	if !ok {
+		return fmt.Errorf("%s is not an ECR registry", registryUrl)
+	}
+	replicaAccount, replicaRegion, ok := ParseEcrRegistryUrl(replicaRegistryUrl)
+	if !ok {
+		return fmt.Errorf("%s is not an ECR registry", replicaRegistryUrl)
+	}
+
+	input := &ecr.DescribeImageReplicationStatusInput{
+		RegistryId:     aws.String(account),
+		RepositoryName: aws.String(repositoryName),
+		ImageId:        &ecr.ImageIdentifier{ImageDigest: aws.String(digest)},
+	}
+	client, err := newEcrClient(registryUrl)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for attempt := 0; ; attempt++ {
+		output, err := client.DescribeImageReplicationStatusWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+
+		status := "UNKNOWN"
+		for _, replicationStatus := range output.ReplicationStatuses {
+			if aws.StringValue(replicationStatus.Region) == replicaRegion && aws.StringValue(replicationStatus.RegistryId) == replicaAccount {
+				status = aws.StringValue(replicationStatus.Status)
+				if status == ecr.ReplicationStatusFailed {
+					return fmt.Errorf("Replication to %s failed: %s", replicaRegistryUrl, aws.StringValue(replicationStatus.FailureCode))
+				}
+			}
+		}
+		if status == ecr.ReplicationStatusComplete {
+			return nil
+		}
+
+		wait := min(replicationPollBackoff(attempt, nil), replicationPollMaxWait)
+		if time.Until(deadline) < wait {
+			return fmt.Errorf("%w to %s after %s, the replication status is %s", ErrReplicationTimeout, replicaRegistryUrl, timeout, status)
+		}
+		log.Info(ctx, fmt.Sprintf("Waiting %s for the image to be replicated to %s, the replication status is %s", wait.Round(time.Second), replicaRegistryUrl, status))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/tmokmss/soci-wrapper/utils/log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// Settings of the ECR repositories created by EnsureRepository
+type RepositorySettings struct {
+	// Make the tags of the repository immutable
+	ImmutableTags bool
+	// Scan images for vulnerabilities when they are pushed
+	ScanOnPush bool
+	// Tags of the repository, not of its images
+	Tags map[string]string
+}
+
+// Create a repository of an ECR registry unless it exists, and return if it was created.
+// A repository created by another process in the meantime counts as existing, so that concurrent runs can ensure the same repository.
+func (registry *Registry) EnsureRepository(ctx context.Context, repositoryName string, settings RepositorySettings) (bool, error) {
+	account, _, ok := ParseEcrRegistryUrl(registry.registryUrl)
+	if !ok {
+		return false, fmt.Errorf("%s is not an ECR registry, so repository %s cannot be created", registry.registryUrl, repositoryName)
+	}
+	sess, err := awsSessionOr(registry.options.AwsSession)
+	if err != nil {
+		return false, err
+	}
+	client := newEcrClientWithSession(sess, registry.registryUrl)
+
+	_, err = client.DescribeRepositoriesWithContext(ctx, &ecr.DescribeRepositoriesInput{
+		RegistryId:      aws.String(account),
+		RepositoryNames: []*string{aws.String(repositoryName)},
+	})
+	if err == nil {
+		return false, nil
+	}
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) || awsErr.Code() != ecr.ErrCodeRepositoryNotFoundException {
+		return false, err
+	}
+
+	input := &ecr.CreateRepositoryInput{
+		RegistryId:                 aws.String(account),
+		RepositoryName:             aws.String(repositoryName),
+		ImageTagMutability:         aws.String(ecr.ImageTagMutabilityMutable),
+		ImageScanningConfiguration: &ecr.ImageScanningConfiguration{ScanOnPush: aws.Bool(settings.ScanOnPush)},
+	}
+	if settings.ImmutableTags {
+		input.ImageTagMutability = aws.String(ecr.ImageTagMutabilityImmutable)
+	}
+	keys := make([]string, 0, len(settings.Tags))
+	for key := range settings.Tags {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		input.Tags = append(input.Tags, &ecr.Tag{Key: aws.String(key), Value: aws.String(settings.Tags[key])})
+	}
+	_, err = client.CreateRepositoryWithContext(ctx, input)
+	if errors.As(err, &awsErr) && awsErr.Code() == ecr.ErrCodeRepositoryAlreadyExistsException {
+		log.Info(ctx, fmt.Sprintf("Repository %s was created by another process in the meantime", repositoryName))
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	log.Info(ctx, fmt.Sprintf("Created repository %s", repositoryName))
+	return true, nil
+}
+
+// Check if an error is from a registry or ECR request to a repository that does not exist
+func IsRepositoryNotFound(err error) bool {
+	details := DescribeError(err)
+	return details != nil && (details.Code == "NAME_UNKNOWN" || details.Code == ecr.ErrCodeRepositoryNotFoundException)
+}
@@ -0,0 +1,79 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func TestEnsureRepository(t *testing.T) {
+	testCases := []struct {
+		name string
+		// Error code of each ECR API call, or "" if it succeeds
+		describeError string
+		createError   string
+		created       bool
+		// ECR API actions called, in order
+		calls []string
+	}{
+		{"exists", "", "", false, []string{"DescribeRepositories"}},
+		{"created", "RepositoryNotFoundException", "", true, []string{"DescribeRepositories", "CreateRepository"}},
+		{"created by another process in the meantime", "RepositoryNotFoundException", "RepositoryAlreadyExistsException", false, []string{"DescribeRepositories", "CreateRepository"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls []string
+			var created map[string]any
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, action, _ := strings.Cut(r.Header.Get("X-Amz-Target"), ".")
+				calls = append(calls, action)
+				errorCode := tc.describeError
+				if action == "CreateRepository" {
+					errorCode = tc.createError
+					json.NewDecoder(r.Body).Decode(&created)
+				}
+				w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+				if errorCode != "" {
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(map[string]string{"__type": errorCode, "message": errorCode})
+					return
+				}
+				w.Write([]byte("{}"))
+			}))
+			defer server.Close()
+			sess := session.Must(session.NewSession(&aws.Config{
+				Endpoint:    aws.String(server.URL),
+				Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+			}))
+			registry := &Registry{
+				registryUrl: "123456789012.dkr.ecr.us-west-2.amazonaws.com",
+				options:     RegistryOptions{AwsSession: sess},
+			}
+
+			ok, err := registry.EnsureRepository(context.Background(), "repo", RepositorySettings{ImmutableTags: true, Tags: map[string]string{"team": "build"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tc.created {
+				t.Errorf("Expected created to be %t, got %t", tc.created, ok)
+			}
+			if !slices.Equal(calls, tc.calls) {
+				t.Errorf("Expected the calls %q, got %q", tc.calls, calls)
+			}
+			if created != nil && (created["registryId"] != "123456789012" || created["repositoryName"] != "repo" || created["imageTagMutability"] != "IMMUTABLE") {
+				t.Errorf("Expected repo to be created with immutable tags in the account of the registry, got %v", created)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/fs"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/containerd/containerd/images"
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+// Name of the journal of a resumable pull in its directory
+const pullJournalName = "journal.json"
+
+// Bytes of a layer written between the points where its partial file is synced and recorded in the journal
+const pullCheckpointSize = 64 << 20
+
+// Records how many bytes of each layer are safely written to its partial file,
+// so that a pull interrupted even by the loss of the host resumes from what is known to be on disk
+type pullJournal struct {
+	dir string
+
+	mu      sync.Mutex
+	Offsets map[godigest.Digest]int64 `json:"offsets"`
+}
+
+// Open the journal of the partial layers in dir, creating dir if needed
+func openPullJournal(dir string) (*pullJournal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	journal := &pullJournal{dir: dir, Offsets: map[godigest.Digest]int64{}}
+	b, err := os.ReadFile(filepath.Join(dir, pullJournalName))
+	if errors.Is(err, os.ErrNotExist) {
+		return journal, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, journal); err != nil {
+		return nil, fmt.Errorf("Invalid pull journal in %s: %w", dir, err)
+	}
+	return journal, nil
+}
+
+func (journal *pullJournal) offset(digest godigest.Digest) int64 {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	return journal.Offsets[digest]
+}
+
+// Record the bytes written for a layer, removing it from the journal if offset is negative.
+// The journal is replaced atomically, so that it is never left half written.
+func (journal *pullJournal) record(digest godigest.Digest, offset int64) error {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	if offset < 0 {
+		delete(journal.Offsets, digest)
+	} else {
+		journal.Offsets[digest] = offset
+	}
+	b, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(journal.dir, "."+pullJournalName+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(b)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filepath.Join(journal.dir, pullJournalName))
+}
+
+// A repository whose layers are fetched to partial files before being read,
+// resuming each layer from the offset recorded in the journal with a Range request
+type resumableRepository struct {
+	*remote.Repository
+	journal *pullJournal
+}
+
+func (repo resumableRepository) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	if !images.IsLayerType(desc.MediaType) {
+		return repo.Repository.Fetch(ctx, desc)
+	}
+	path := filepath.Join(repo.journal.dir, desc.Digest.Encoded())
+	if err := repo.fetchPartial(ctx, desc, path); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &partialLayer{file: file, journal: repo.journal, digest: desc.Digest}, nil
+}
+
+// Fetch a layer to its partial file, verifying it against its digest.
+// The bytes written are synced and recorded every pullCheckpointSize bytes, and when the fetch fails.
+func (repo resumableRepository) fetchPartial(ctx context.Context, desc ocispec.Descriptor, path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	// Bytes past the recorded offset may not have reached the disk
+	offset := min(repo.journal.offset(desc.Digest), info.Size(), desc.Size)
+	if err := file.Truncate(offset); err != nil {
+		return err
+	}
+	digester := desc.Digest.Algorithm().Digester()
+	if _, err := fs.Copy(digester.Hash(), io.NewSectionReader(file, 0, offset)); err != nil {
+		return err
+	}
+
+	// A layer written entirely by a previous pull is only verified
+	if offset < desc.Size {
+		if offset, err = repo.resumeFetch(ctx, desc, file, offset, digester); err != nil {
+			return err
+		}
+	}
+	if offset != desc.Size || digester.Digest() != desc.Digest {
+		// The partial file cannot be resumed from, so the layer is pulled from the start on the next attempt
+		os.Remove(path)
+		repo.journal.record(desc.Digest, -1)
+		return fmt.Errorf("Layer %s does not match its descriptor, got %d bytes of digest %s", desc.Digest, offset, digester.Digest())
+	}
+	return nil
+}
+
+// Write a layer to file from offset, hashing what is written with digester.
+// Returns the offset reached, which is synced and recorded in the journal even if the fetch fails.
+func (repo resumableRepository) resumeFetch(ctx context.Context, desc ocispec.Descriptor, file *os.File, offset int64, digester godigest.Digester) (int64, error) {
+	rc, err := repo.Repository.Fetch(ctx, desc)
+	if err != nil {
+		return offset, err
+	}
+	defer rc.Close()
+	if offset > 0 {
+		seeker, ok := rc.(io.Seeker)
+		if ok {
+			_, err = seeker.Seek(offset, io.SeekStart)
+		}
+		if !ok || err != nil {
+			log.Warn(ctx, fmt.Sprintf("The registry does not support Range requests for layer %s, pulling it from the start", desc.Digest))
+			offset = 0
+			digester.Hash().Reset()
+			if err := file.Truncate(0); err != nil {
+				return offset, err
+			}
+		} else {
+			log.Info(ctx, fmt.Sprintf("Resuming layer %s from %d of %d bytes", desc.Digest, offset, desc.Size))
+		}
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+
+	writer := io.MultiWriter(file, digester.Hash())
+	for offset < desc.Size {
+		n, err := fs.Copy(writer, io.LimitReader(rc, min(pullCheckpointSize, desc.Size-offset)))
+		offset += n
+		if syncErr := file.Sync(); syncErr != nil {
+			return offset, syncErr
+		}
+		if recordErr := repo.journal.record(desc.Digest, offset); recordErr != nil {
+			return offset, recordErr
+		}
+		if err != nil {
+			return offset, err
+		}
+		if n == 0 {
+			return offset, io.ErrUnexpectedEOF
+		}
+	}
+	return offset, nil
+}
+
+// A complete and verified partial layer, removed once it has been read to the end and closed
+type partialLayer struct {
+	file    *os.File
+	journal *pullJournal
+	digest  godigest.Digest
+	eof     bool
+}
+
+func (layer *partialLayer) Read(p []byte) (int, error) {
+	n, err := layer.file.Read(p)
+	if err == io.EOF {
+		layer.eof = true
+	}
+	return n, err
+}
+
+func (layer *partialLayer) Close() error {
+	err := layer.file.Close()
+	if layer.eof {
+		os.Remove(layer.file.Name())
+		err = errors.Join(err, layer.journal.record(layer.digest, -1))
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+func TestResumableRepositoryFetch(t *testing.T) {
+	blob := bytes.Repeat([]byte("layer"), 1000)
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: godigest.FromBytes(blob), Size: int64(len(blob))}
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/test/blobs/"+desc.Digest.String() {
+			http.NotFound(w, r)
+			return
+		}
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer server.Close()
+	repository, err := remote.NewRepository(strings.TrimPrefix(server.URL, "http://") + "/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repository.PlainHTTP = true
+
+	// A previous pull wrote 2000 bytes and recorded 1500 of them
+	dir := t.TempDir()
+	journal, err := openPullJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, desc.Digest.Encoded()), blob[:2000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.record(desc.Digest, 1500); err != nil {
+		t.Fatal(err)
+	}
+	journal, err = openPullJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := resumableRepository{repository, journal}.Fetch(context.Background(), desc)
+	if err != nil {
+		t.Fatalf("Failed to fetch the layer: %v", err)
+	}
+	content, err := io.ReadAll(rc)
+	if closeErr := rc.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || !bytes.Equal(content, blob) {
+		t.Fatalf("Expected the whole layer, got %d bytes: %v", len(content), err)
+	}
+	if len(ranges) == 0 || !strings.HasPrefix(ranges[len(ranges)-1], "bytes=1500-") {
+		t.Fatalf("Expected the layer to be resumed from the recorded offset, got requests with ranges %q", ranges)
+	}
+	if _, err := os.Stat(filepath.Join(dir, desc.Digest.Encoded())); !os.IsNotExist(err) {
+		t.Fatalf("Expected the partial layer to be removed once read, got %v", err)
+	}
+	if journal.offset(desc.Digest) != 0 {
+		t.Fatalf("Expected the layer to be removed from the journal")
+	}
+}
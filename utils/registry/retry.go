@@ -0,0 +1,186 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"syscall"
+	"time"
+
+	"oras.land/oras-go/v2/registry/remote/retry"
+)
+
+const (
+	// Default number of retries of a registry request
+	DefaultMaxRetries = 5
+	// Default maximum wait between retries of a registry request
+	DefaultRetryMaxWait = 30 * time.Second
+
+	// Minimum wait between retries of a registry request
+	retryMinWait = 200 * time.Millisecond
+	// Maximum wait advertised by Retry-After that is honored when rate limited.
+	// e.g. Docker Hub advertises a long Retry-After when it rate limits pulls
+	retryAfterMaxWait = 10 * time.Minute
+)
+
+// Matches the blob or manifest a registry request is about, e.g. /v2/repo/blobs/sha256:...
+var registryRequestTargetRegex = regexp.MustCompile("/(blobs|manifests)/([^/]+)$")
+
+// A retry policy with exponential backoff and jitter.
+// Requests are retried on network errors, 408, 429 and 5xx responses other than 501.
+// Other 4xx responses are not retried. 401 Unauthorized is handled by the auth client instead.
+type retryPolicy struct {
+	maxRetries int
+	maxWait    time.Duration
+}
+
+var _ retry.Policy = (*retryPolicy)(nil)
+
+func (policy *retryPolicy) Retry(attempt int, resp *http.Response, err error) (time.Duration, error) {
+	if attempt >= policy.maxRetries || !isRetryableResponse(resp, err) {
+		return -1, nil
+	}
+
+	maxWait := policy.maxWait
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		maxWait = max(maxWait, retryAfterMaxWait)
+	}
+	// retry.DefaultBackoff uses Retry-After on 429 Too Many Requests
+	return min(max(retry.DefaultBackoff(attempt, resp), retryMinWait), maxWait), nil
+}
+
+// Check if a registry request failed in a way that is worth retrying
+func isRetryableResponse(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return true
+	case resp.StatusCode == http.StatusNotImplemented:
+		return false
+	default:
+		return resp.StatusCode >= 500
+	}
+}
+
+// An HTTP transport retrying each registry request, i.e. each blob, on its own
+type retryTransport struct {
+	base   http.RoundTripper
+	policy *retryPolicy
+}
+
+func (transport *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		resp, respErr := transport.base.RoundTrip(req)
+		wait, err := transport.policy.Retry(attempt, resp, respErr)
+		if err != nil || wait < 0 {
+			return resp, respErr
+		}
+
+		// The body has to be sent again
+		if req.Body != nil {
+			if req.GetBody == nil {
+				return resp, respErr
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return resp, respErr
+			}
+			req.Body = body
+		}
+
+		reason := ""
+		if respErr != nil {
+			reason = respErr.Error()
+		} else {
+			reason = resp.Status
+			resp.Body.Close()
+		}
+		log.Warn(ctx, fmt.Sprintf("Retrying %s %s in %s after %s (retry %d of %d)", req.Method, registryRequestTarget(req), wait, reason, attempt+1, transport.policy.maxRetries))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Describe what a registry request is about, e.g. "blob sha256:..."
+func registryRequestTarget(req *http.Request) string {
+	// Blob uploads are completed with the digest in the query
+	if digest := req.URL.Query().Get("digest"); digest != "" {
+		return "blob " + digest
+	}
+	if match := registryRequestTargetRegex.FindStringSubmatch(req.URL.Path); match != nil {
+		return match[1][:len(match[1])-1] + " " + match[2]
+	}
+	return req.URL.Path
+}
+
+// Create the HTTP client for a registry, retrying failed requests and limiting the rate of requests and the bandwidth
+func newHttpClient(transport http.RoundTripper, opts RegistryOptions) *http.Client {
+	policy := &retryPolicy{
+		maxRetries: opts.MaxRetries,
+		maxWait:    opts.RetryMaxWait,
+	}
+	// Retries are rate limited as well
+	base := transport
+	if log.DebugEnabled() {
+		base = &debugTransport{base}
+	}
+	if opts.Bandwidth != nil {
+		base = &bandwidthLimitTransport{base: base, download: opts.Bandwidth.download, upload: opts.Bandwidth.upload}
+	}
+	if opts.MaxRequestsPerSecond > 0 {
+		base = newRateLimitTransport(base, opts.MaxRequestsPerSecond)
+	}
+	// The request ids are taken from the responses the retries ended with
+	return &http.Client{
+		Transport: &requestIdTransport{&retryTransport{
+			base:   base,
+			policy: policy,
+		}},
+	}
+}
+
+// Check if an error of a whole registry operation is a transient network error,
+// e.g. a connection reset while a blob is being streamed
+func isTransientNetworkError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// Run a registry operation, running it again on transient network errors.
+// Blobs that have already been copied are skipped by oras, so the operation resumes where it failed.
+func (registry *Registry) retryOperation(ctx context.Context, operation string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= registry.options.MaxRetries || !isTransientNetworkError(err) {
+			return err
+		}
+		wait := min(max(retry.DefaultBackoff(attempt, nil), retryMinWait), registry.options.RetryMaxWait)
+		log.Warn(ctx, fmt.Sprintf("Retrying %s in %s after %v (retry %d of %d)", operation, wait, err, attempt+1, registry.options.MaxRetries))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
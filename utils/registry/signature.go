@@ -0,0 +1,239 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"os"
+	"slices"
+	"strings"
+
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content/memory"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/kms"
+
+	godigest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// Media type of the payload signed by cosign
+	cosignPayloadMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// Annotation of the payload layer holding its base64 encoded signature
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+)
+
+// Signs the payloads of cosign signatures
+type Signer interface {
+	// Sign a payload, hashed with SHA-256 unless the key signs messages as is
+	Sign(ctx context.Context, payload []byte) ([]byte, error)
+}
+
+// Signs with an asymmetric AWS KMS key
+type kmsSigner struct {
+	client    *kms.KMS
+	keyArn    string
+	algorithm string
+}
+
+// Create a signer using an AWS KMS key with the SIGN_VERIFY usage.
+// The key is given by its ARN, which tells the region of the key.
+func NewKmsSigner(ctx context.Context, keyArn string) (Signer, error) {
+	parsed, err := arn.Parse(keyArn)
+	if err != nil || parsed.Service != "kms" {
+		return nil, fmt.Errorf("%s is not the ARN of a KMS key", keyArn)
+	}
+
+	sess, err := getAwsSession()
+	if err != nil {
+		return nil, err
+	}
+	client := kms.New(sess, &aws.Config{Region: aws.String(parsed.Region), Retryer: awsApiRetryer})
+	output, err := client.GetPublicKeyWithContext(ctx, &kms.GetPublicKeyInput{KeyId: aws.String(keyArn)})
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(output.KeyUsage) != kms.KeyUsageTypeSignVerify {
+		return nil, fmt.Errorf("KMS key %s has the usage %s instead of %s", keyArn, aws.StringValue(output.KeyUsage), kms.KeyUsageTypeSignVerify)
+	}
+	// cosign verifies SHA-256 signatures of ECDSA and RSA keys
+	algorithms := aws.StringValueSlice(output.SigningAlgorithms)
+	for _, algorithm := range []string{kms.SigningAlgorithmSpecEcdsaSha256, kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256} {
+		if slices.Contains(algorithms, algorithm) {
+			log.Info(ctx, fmt.Sprintf("Signing with KMS key %s using %s", keyArn, algorithm))
+			return &kmsSigner{client, keyArn, algorithm}, nil
+		}
+	}
+	return nil, fmt.Errorf("KMS key %s supports none of the signing algorithms verified by cosign: [%s]", keyArn, strings.Join(algorithms, ", "))
+}
+
+func (signer *kmsSigner) Sign(ctx context.Context, payload []byte) ([]byte, error) {
+	// Only the digest is sent to KMS, which accepts messages up to 4096 bytes
+	digest := sha256.Sum256(payload)
+	output, err := signer.client.SignWithContext(ctx, &kms.SignInput{
+		KeyId:            aws.String(signer.keyArn),
+		Message:          digest[:],
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(signer.algorithm),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Signature, nil
+}
+
+// Signs with a private key read from a file
+type keySigner struct {
+	key crypto.Signer
+}
+
+// Create a signer using an unencrypted ECDSA, RSA or Ed25519 private key in a PEM file
+func NewKeySigner(path string) (Signer, error) {
+	keyPem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyPem)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "ENCRYPTED SIGSTORE PRIVATE KEY", "ENCRYPTED COSIGN PRIVATE KEY", "ENCRYPTED PRIVATE KEY":
+		return nil, fmt.Errorf("%s is encrypted, which is not supported. Pass an unencrypted PEM private key, e.g. generated with openssl genpkey -algorithm EC -pkeyopt ec_paramgen_curve:P-256", path)
+	default:
+		return nil, fmt.Errorf("%s contains a %s instead of a private key", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't parse the private key in %s: %w", path, err)
+	}
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey, *rsa.PrivateKey, ed25519.PrivateKey:
+		return &keySigner{key.(crypto.Signer)}, nil
+	}
+	return nil, fmt.Errorf("%s contains an unsupported type of private key %T", path, key)
+}
+
+func (signer *keySigner) Sign(ctx context.Context, payload []byte) ([]byte, error) {
+	// Ed25519 signs the message itself
+	if _, ok := signer.key.(ed25519.PrivateKey); ok {
+		return signer.key.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(payload)
+	return signer.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// A cosign signature of a manifest, ready to be pushed next to it
+type CosignSignature struct {
+	store *memory.Store
+	desc  ocispec.Descriptor
+	// Digest of the signed manifest
+	subject string
+}
+
+// Digest of the signature manifest
+func (signature *CosignSignature) Digest() string {
+	return signature.desc.Digest.String()
+}
+
+// Sign a manifest the same way as cosign sign, without uploading the signature to a transparency log.
+// dockerReference is the repository of the manifest, e.g. REGISTRY/REPOSITORY.
+// The signature manifest is created once, so that it has the same digest in every registry it is pushed to.
+func SignManifest(ctx context.Context, signer Signer, dockerReference string, digest string) (*CosignSignature, error) {
+	// The simple signing payload as written by cosign
+	payload, err := json.Marshal(map[string]any{
+		"critical": map[string]any{
+			"identity": map[string]string{"docker-reference": dockerReference},
+			"image":    map[string]string{"docker-manifest-digest": digest},
+			"type":     "cosign container image signature",
+		},
+		"optional": nil,
+	})
+	if err != nil {
+		return nil, err
+	}
+	signature, err := signer.Sign(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	store := memory.New()
+	push := func(mediaType string, blob []byte, annotations map[string]string) (ocispec.Descriptor, error) {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: godigest.FromBytes(blob), Size: int64(len(blob)), Annotations: annotations}
+		return desc, store.Push(ctx, desc, bytes.NewReader(blob))
+	}
+	layer, err := push(cosignPayloadMediaType, payload, map[string]string{
+		cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature),
+	})
+	if err != nil {
+		return nil, err
+	}
+	config, err := json.Marshal(ocispec.Image{RootFS: ocispec.RootFS{Type: "layers", DiffIDs: []godigest.Digest{layer.Digest}}})
+	if err != nil {
+		return nil, err
+	}
+	configDesc, err := push(ocispec.MediaTypeImageConfig, config, nil)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	if err != nil {
+		return nil, err
+	}
+	manifestDesc, err := push(ocispec.MediaTypeImageManifest, manifest, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &CosignSignature{store, manifestDesc, digest}, nil
+}
+
+// Push a cosign signature to a repository with the tag cosign looks it up by, e.g. sha256-DIGEST.sig
+func (registry *Registry) PushSignature(ctx context.Context, repositoryName string, signature *CosignSignature) error {
+	repo, err := registry.repository(ctx, repositoryName)
+	if err != nil {
+		return err
+	}
+	subject, err := godigest.Parse(signature.subject)
+	if err != nil {
+		return err
+	}
+	tag := fmt.Sprintf("%s-%s.sig", subject.Algorithm(), subject.Encoded())
+
+	log.Info(ctx, fmt.Sprintf("Pushing signature %s with tag %s", signature.Digest(), tag))
+	return registry.retryOperation(ctx, "signature push", func() error {
+		if err := oras.CopyGraph(ctx, signature.store, repo, signature.desc, oras.DefaultCopyGraphOptions); err != nil {
+			return err
+		}
+		return repo.Tag(ctx, signature.desc, tag)
+	})
+}
@@ -0,0 +1,121 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/fs"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+)
+
+// An S3 bucket where layers are staged, so that only the layer being read is on local disk.
+// Layers are laid out like the blobs of an OCI image layout under the prefix, and shared by every image staged there.
+type S3Staging struct {
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+	prefix   string
+}
+
+// Open the staging location of an s3://bucket/prefix URL, in the region of the bucket
+func NewS3Staging(ctx context.Context, stagingUrl string) (*S3Staging, error) {
+	parsed, err := url.Parse(stagingUrl)
+	if err != nil || parsed.Scheme != "s3" || parsed.Host == "" {
+		return nil, fmt.Errorf("%s is not an s3://bucket/prefix URL", stagingUrl)
+	}
+	sess, err := getAwsSession()
+	if err != nil {
+		return nil, err
+	}
+	// The bucket may be in another region than the AWS configuration, and S3 rejects requests sent to the wrong region
+	locationClient := s3.New(sess, &aws.Config{Region: aws.String(cmp.Or(aws.StringValue(sess.Config.Region), "us-east-1")), Retryer: awsApiRetryer})
+	location, err := locationClient.GetBucketLocationWithContext(ctx, &s3.GetBucketLocationInput{Bucket: aws.String(parsed.Host)})
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get the region of bucket %s: %w", parsed.Host, err)
+	}
+	region := s3.NormalizeBucketLocation(aws.StringValue(location.LocationConstraint))
+	return newS3Staging(s3.New(sess, &aws.Config{Region: aws.String(region), Retryer: awsApiRetryer}), parsed.Host, strings.Trim(parsed.Path, "/")), nil
+}
+
+func newS3Staging(client *s3.S3, bucket string, prefix string) *S3Staging {
+	return &S3Staging{
+		client:   client,
+		uploader: s3manager.NewUploaderWithClient(client),
+		bucket:   bucket,
+		prefix:   prefix,
+	}
+}
+
+func (staging *S3Staging) String() string {
+	return "s3://" + path.Join(staging.bucket, staging.prefix)
+}
+
+func (staging *S3Staging) key(desc ocispec.Descriptor) string {
+	return path.Join(staging.prefix, ocispec.ImageBlobsDir, desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+}
+
+// Read a layer to file through the staging location, verifying it against its digest.
+// A layer not staged yet is fetched to file with fetch, then uploaded to the staging location for the next reads.
+func (staging *S3Staging) FetchLayer(ctx context.Context, desc ocispec.Descriptor, file *os.File, fetch func(file *os.File) error) error {
+	object, err := staging.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(staging.bucket),
+		Key:    aws.String(staging.key(desc)),
+	})
+	// Without s3:ListBucket, S3 denies access to a missing key rather than reporting it as not found.
+	// A layer that really cannot be read is fetched and staged again, which fails if it cannot be written either
+	var requestErr awserr.RequestFailure
+	if errors.As(err, &requestErr) && (requestErr.StatusCode() == http.StatusNotFound || requestErr.StatusCode() == http.StatusForbidden) {
+		log.Debug(ctx, fmt.Sprintf("Layer %s is not staged in %s: %v", desc.Digest, staging, err))
+		return staging.stage(ctx, desc, file, fetch)
+	}
+	if err != nil {
+		return err
+	}
+	defer object.Body.Close()
+	verifier := content.NewVerifyReader(object.Body, desc)
+	if _, err := fs.Copy(file, verifier); err != nil {
+		return err
+	}
+	if err := verifier.Verify(); err != nil {
+		return fmt.Errorf("Staged layer s3://%s/%s does not match its descriptor: %w", staging.bucket, staging.key(desc), err)
+	}
+	log.Info(ctx, fmt.Sprintf("Read layer %s from %s", desc.Digest, staging))
+	return nil
+}
+
+// Fetch a layer to file and upload it to the staging location
+func (staging *S3Staging) stage(ctx context.Context, desc ocispec.Descriptor, file *os.File, fetch func(file *os.File) error) error {
+	if err := fetch(file); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := staging.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(staging.bucket),
+		Key:    aws.String(staging.key(desc)),
+		Body:   io.NewSectionReader(file, 0, desc.Size),
+	})
+	if err != nil {
+		return fmt.Errorf("Couldn't stage layer %s in %s: %w", desc.Digest, staging, err)
+	}
+	log.Info(ctx, fmt.Sprintf("Staged layer %s (%d bytes) in %s", desc.Digest, desc.Size, staging))
+	return nil
+}
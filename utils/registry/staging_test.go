@@ -0,0 +1,90 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestS3StagingFetchLayer(t *testing.T) {
+	layer := []byte("layer")
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: godigest.FromBytes(layer), Size: int64(len(layer))}
+
+	testCases := []struct {
+		name string
+		// Status of the response to a GET of a layer that is not staged
+		missingStatus int
+	}{
+		{"not found", http.StatusNotFound},
+		// S3 denies access to a missing key to those who cannot list the bucket
+		{"access denied without s3:ListBucket", http.StatusForbidden},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			objects := map[string][]byte{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch r.Method {
+				case http.MethodPut:
+					body, _ := io.ReadAll(r.Body)
+					objects[r.URL.Path] = body
+				case http.MethodGet:
+					object, ok := objects[r.URL.Path]
+					if !ok {
+						w.WriteHeader(tc.missingStatus)
+						return
+					}
+					w.Write(object)
+				}
+			}))
+			defer server.Close()
+			sess := session.Must(session.NewSession(&aws.Config{
+				Region:           aws.String("us-west-2"),
+				Endpoint:         aws.String(server.URL),
+				S3ForcePathStyle: aws.Bool(true),
+				Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+			}))
+			staging := newS3Staging(s3.New(sess), "bucket", "soci")
+
+			fetches := 0
+			fetch := func(file *os.File) error {
+				fetches++
+				_, err := file.Write(layer)
+				return err
+			}
+			for range 2 {
+				file, err := os.Create(filepath.Join(t.TempDir(), "layer"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer file.Close()
+				if err := staging.FetchLayer(context.Background(), desc, file, fetch); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if fetches != 1 {
+				t.Errorf("Expected the layer to be fetched once and then read from S3, got %d fetches", fetches)
+			}
+			if _, ok := objects["/bucket/"+staging.key(desc)]; !ok {
+				t.Errorf("Expected the layer to be staged as %s, got %v", staging.key(desc), objects)
+			}
+		})
+	}
+}
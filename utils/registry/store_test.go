@@ -0,0 +1,163 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/fs"
+	"io"
+	iofs "io/fs"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd/content/local"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// A gzip layer of a single file of random bytes, which do not compress
+func randomLayer(t *testing.T, seed int64, size int64) []byte {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: "random", Mode: 0644, Size: size, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.CopyN(tw, rand.New(rand.NewSource(seed)), size); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// A registry serving a single image of the given blobs, counting the bytes of the blobs it sent
+func imageRegistry(t *testing.T, manifest ocispec.Descriptor, blobs map[godigest.Digest][]byte, blobBytesSent *atomic.Int64) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		digest := godigest.Digest(r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+		blob, ok := blobs[digest]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if digest == manifest.Digest {
+			w.Header().Set("Content-Type", manifest.MediaType)
+		}
+		w.Header().Set("Docker-Content-Digest", digest.String())
+		w.Header().Set("Content-Length", fmt.Sprint(len(blob)))
+		if r.Method == http.MethodGet {
+			if strings.Contains(r.URL.Path, "/blobs/") {
+				blobBytesSent.Add(int64(len(blob)))
+			}
+			w.Write(blob)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestStoresShareBlobs(t *testing.T) {
+	ctx := context.Background()
+	blobs := map[godigest.Digest][]byte{}
+	add := func(mediaType string, blob []byte) ocispec.Descriptor {
+		blobs[godigest.FromBytes(blob)] = blob
+		return ocispec.Descriptor{MediaType: mediaType, Digest: godigest.FromBytes(blob), Size: int64(len(blob))}
+	}
+	var layers []ocispec.Descriptor
+	var imageSize int64
+	for i := range 3 {
+		layer := add(ocispec.MediaTypeImageLayerGzip, randomLayer(t, int64(i), 4<<20))
+		layers = append(layers, layer)
+		imageSize += layer.Size
+	}
+	config := add(ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	manifestBlob, err := json.Marshal(ocispec.Manifest{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: ocispec.MediaTypeImageManifest, Config: config, Layers: layers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := add(ocispec.MediaTypeImageManifest, manifestBlob)
+	var blobBytesSent atomic.Int64
+	server := imageRegistry(t, manifest, blobs, &blobBytesSent)
+	registry, err := Init(ctx, strings.TrimPrefix(server.URL, "http://"), RegistryOptions{PlainHttp: true, Credential: auth.Credential{Username: "user", Password: "password"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pull the image to the OCI store, then read its layers from the containerd store in the same directory
+	storeDir := t.TempDir()
+	pull := func() {
+		ociStore, err := oci.NewWithContext(ctx, storeDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := registry.Pull(ctx, "app", &store.SociStore{Store: ociStore}, manifest.Digest.String(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pull()
+	if sent := blobBytesSent.Load(); sent < imageSize {
+		t.Fatalf("Expected the layers to be pulled, got %d bytes", sent)
+	}
+	containerdStore, err := local.NewStore(storeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, layer := range layers {
+		if info, err := containerdStore.Info(ctx, layer.Digest); err != nil || info.Size != layer.Size {
+			t.Fatalf("Expected layer %s in the containerd store, got %+v: %v", layer.Digest, info, err)
+		}
+	}
+
+	// Each layer is a single file on disk, whichever store reads it
+	copies := map[godigest.Digest]int{}
+	err = filepath.WalkDir(storeDir, func(path string, entry iofs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		blob, err := os.ReadFile(path)
+		copies[godigest.FromBytes(blob)]++
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, layer := range layers {
+		if copies[layer.Digest] != 1 {
+			t.Errorf("Expected layer %s to be on disk once, got %d copies", layer.Digest, copies[layer.Digest])
+		}
+	}
+	size, err := fs.CalculateDirSize(storeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size < imageSize || size > imageSize+imageSize/10 {
+		t.Fatalf("Expected about %d bytes in the stores, the size of the image, got %d", imageSize, size)
+	}
+
+	// Pulling the image again to a store in the same directory finds every blob there already
+	blobBytesSent.Store(0)
+	pull()
+	if sent := blobBytesSent.Load(); sent != 0 {
+		t.Errorf("Expected no blob to be pulled again, got %d bytes", sent)
+	}
+}
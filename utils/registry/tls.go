@@ -0,0 +1,46 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"net/http"
+	"os"
+)
+
+// Create the HTTP transport of a registry client, trusting the CA certificates of the options
+// in addition to the system ones. AWS API clients are not affected.
+func newRegistryTransport(ctx context.Context, opts RegistryOptions) (*http.Transport, error) {
+	if opts.CaCertFile == "" && !opts.InsecureSkipTlsVerify {
+		return httpTransport, nil
+	}
+
+	transport := httpTransport.Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	if opts.CaCertFile != "" {
+		pem, err := os.ReadFile(opts.CaCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read CA certificates: %w", err)
+		}
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No PEM encoded certificate found in %s", opts.CaCertFile)
+		}
+		transport.TLSClientConfig.RootCAs = rootCAs
+	}
+	if opts.InsecureSkipTlsVerify {
+		log.Warn(ctx, "!!! TLS certificate verification of the registry is DISABLED. The connection is not protected against man-in-the-middle attacks, use it only in lab environments !!!")
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+	return transport, nil
+}
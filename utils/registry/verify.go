@@ -0,0 +1,374 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/tmokmss/soci-wrapper/utils/log"
+
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/images"
+
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Number of spans of each layer compared against the layer bytes by a deep verification
+const deepVerifySpans = 8
+
+// Returned by VerifyPushed when a pushed artifact is incomplete in the registry, wrapped with the problems found
+var ErrPushVerification = errors.New("Pushed artifact verification failed")
+
+// Check that an artifact pushed from a store, such as a SOCI index, is complete in a repository:
+// its manifest and every blob it references must exist with the digest and size they were pushed with.
+func (registry *Registry) VerifyPushed(ctx context.Context, repositoryName string, store content.ReadOnlyStorage, desc ocispec.Descriptor) error {
+	repo, err := registry.repository(ctx, repositoryName)
+	if err != nil {
+		return err
+	}
+	manifestContent, err := content.FetchAll(ctx, store, desc)
+	if err != nil {
+		return err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestContent, &manifest); err != nil {
+		return err
+	}
+
+	var problems []string
+	check := func(kind string, expected ocispec.Descriptor, resolve func(context.Context, string) (ocispec.Descriptor, error)) error {
+		actual, err := resolve(ctx, expected.Digest.String())
+		if errors.Is(err, errdef.ErrNotFound) {
+			problems = append(problems, fmt.Sprintf("%s %s is missing", kind, expected.Digest))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if actual.Digest != expected.Digest || actual.Size != expected.Size {
+			problems = append(problems, fmt.Sprintf("%s %s has digest %s and %d bytes, expected %d bytes", kind, expected.Digest, actual.Digest, actual.Size, expected.Size))
+		}
+		return nil
+	}
+	if err := check("Manifest", desc, repo.Manifests().Resolve); err != nil {
+		return err
+	}
+	for _, blob := range append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...) {
+		if err := check("Blob", blob, repo.Blobs().Resolve); err != nil {
+			return err
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrPushVerification, strings.Join(problems, ", "))
+	}
+	log.Info(ctx, fmt.Sprintf("Verified the pushed manifest and its %d blobs", len(manifest.Layers)+1))
+	return nil
+}
+
+// Returned by VerifyContent when pulled content does not match the digest and size it is referenced with, wrapped with the offending blob
+var ErrContentVerification = errors.New("Content verification failed")
+
+// Returned by VerifyContent and VerifyPlatformContent when the pulled image is another one than requested, e.g. served by a misconfigured proxy.
+// Unlike a corrupted blob, pulling the image again serves the same content, so it is not worth retrying. Wraps ErrContentVerification
+var ErrImageMismatch = fmt.Errorf("%w: the pulled image is not the requested one", ErrContentVerification)
+
+// Check that an image pulled to a store is exactly the one requested, e.g. when it is pulled through a caching proxy:
+// its root must have the requested digest, unless digest is empty, and every manifest, config and layer under it,
+// read back from the store, must have the digest and size it is referenced with.
+// Content that is not in the store is not checked, such as streamed layers, which are verified as they are fetched.
+func VerifyContent(ctx context.Context, store content.ReadOnlyStorage, root ocispec.Descriptor, digest string) error {
+	if digest != "" && root.Digest.String() != digest {
+		return fmt.Errorf("%w: manifest %s was pulled for image %s", ErrImageMismatch, root.Digest, digest)
+	}
+	verified := map[godigest.Digest]bool{}
+	var verify func(desc ocispec.Descriptor) error
+	verify = func(desc ocispec.Descriptor) error {
+		if verified[desc.Digest] {
+			return nil
+		}
+		if err := desc.Digest.Validate(); err != nil {
+			return fmt.Errorf("%w: %s %s: %v", ErrContentVerification, contentKind(desc), desc.Digest, err)
+		}
+		exists, err := store.Exists(ctx, desc)
+		if err != nil || !exists {
+			return err
+		}
+		rc, err := store.Fetch(ctx, desc)
+		if err != nil {
+			return err
+		}
+		digester := desc.Digest.Algorithm().Digester()
+		size, err := io.Copy(digester.Hash(), rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if actual := digester.Digest(); actual != desc.Digest || size != desc.Size {
+			return fmt.Errorf("%w: %s %s has digest %s and %d bytes, expected %d bytes", ErrContentVerification, contentKind(desc), desc.Digest, actual, size, desc.Size)
+		}
+		verified[desc.Digest] = true
+
+		successors, err := content.Successors(ctx, store, desc)
+		if err != nil {
+			return err
+		}
+		for _, successor := range successors {
+			if err := verify(successor); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := verify(root); err != nil {
+		return err
+	}
+	log.Info(ctx, fmt.Sprintf("Verified the digests of %d pulled manifests and blobs", len(verified)))
+	return nil
+}
+
+// Check that the image manifest of a platform pulled to a store belongs to the image requested by digest, like VerifyContent.
+// If digest is that of an image index, the image index stored by the pull is read back and must have that digest
+// and list manifest, which is then verified with its blobs. The manifests of the other platforms are not checked.
+func VerifyPlatformContent(ctx context.Context, store content.ReadOnlyStorage, manifest ocispec.Descriptor, digest string) error {
+	if manifest.Digest.String() == digest {
+		return VerifyContent(ctx, store, manifest, digest)
+	}
+	indexDigest, err := godigest.Parse(digest)
+	if err != nil {
+		return err
+	}
+	// The size of the image index is not known, so it is fetched by digest alone, as the OCI store pulls are written to allows,
+	// and only checked through its digest
+	rc, err := store.Fetch(ctx, ocispec.Descriptor{Digest: indexDigest})
+	if err != nil {
+		return fmt.Errorf("%w: image index %s was not pulled along with manifest %s: %v", ErrContentVerification, digest, manifest.Digest, err)
+	}
+	indexBytes, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	if actual := indexDigest.Algorithm().FromBytes(indexBytes); actual != indexDigest {
+		return fmt.Errorf("%w: image index %s has digest %s", ErrImageMismatch, digest, actual)
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(indexBytes, &index); err != nil {
+		return fmt.Errorf("%w: image index %s: %v", ErrInvalidImageManifest, digest, err)
+	}
+	if !slices.ContainsFunc(index.Manifests, func(child ocispec.Descriptor) bool {
+		return child.Digest == manifest.Digest && child.Size == manifest.Size && child.MediaType == manifest.MediaType
+	}) {
+		return fmt.Errorf("%w: manifest %s was pulled for image %s, which does not list it", ErrImageMismatch, manifest.Digest, digest)
+	}
+	return VerifyContent(ctx, store, manifest, "")
+}
+
+// Name the kind of content a descriptor is for in the errors of VerifyContent
+func contentKind(desc ocispec.Descriptor) string {
+	switch {
+	case images.IsManifestType(desc.MediaType), images.IsIndexType(desc.MediaType):
+		return "Manifest"
+	case images.IsLayerType(desc.MediaType):
+		return "Layer"
+	}
+	return "Blob"
+}
+
+// Check that a SOCI index in a repository is complete and consistent with the image it refers to.
+// Each problem found is returned as a message. The error is only for checks that could not be run at all.
+// If deep is true, some spans of each layer are downloaded and compared against the span digests of the ztocs.
+func (registry *Registry) VerifySociIndex(ctx context.Context, repositoryName string, imageDigest string, indexDigest string, deep bool) ([]string, error) {
+	repo, err := registry.repository(ctx, repositoryName)
+	if err != nil {
+		return nil, err
+	}
+
+	_, rc, err := repo.FetchReference(ctx, indexDigest)
+	if err != nil {
+		return []string{fmt.Sprintf("SOCI index manifest cannot be pulled: %v", err)}, nil
+	}
+	indexContent, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	var index ocispec.Manifest
+	if err := json.Unmarshal(indexContent, &index); err != nil {
+		return []string{fmt.Sprintf("SOCI index manifest is not valid JSON: %v", err)}, nil
+	}
+	version := sociVersion(index.ArtifactType)
+	if version == "" {
+		version = sociVersion(index.Config.MediaType)
+	}
+	switch version {
+	case "":
+		return []string{"Manifest is not a SOCI index"}, nil
+	case "v2":
+		return []string{"SOCI index v2 cannot be verified, only v1 indices are supported"}, nil
+	}
+
+	var problems []string
+	if _, err := content.FetchAll(ctx, repo.Blobs(), index.Config); err != nil {
+		problems = append(problems, fmt.Sprintf("Config blob %s: %v", index.Config.Digest, err))
+	}
+
+	var imageLayers []ocispec.Descriptor
+	subjects, err := imageManifestDigests(ctx, repo, imageDigest)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("Image %s cannot be pulled: %v", imageDigest, err))
+	} else if index.Subject == nil {
+		problems = append(problems, "SOCI index has no subject")
+	} else if !slices.Contains(subjects, index.Subject.Digest.String()) {
+		problems = append(problems, fmt.Sprintf("SOCI index refers to %s, which is not image %s or one of its platform manifests", index.Subject.Digest, imageDigest))
+	} else {
+		manifest, err := registry.GetManifest(ctx, repositoryName, index.Subject.Digest.String())
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Image manifest %s cannot be pulled: %v", index.Subject.Digest, err))
+		} else {
+			imageLayers = manifest.Layers
+		}
+	}
+
+	for _, ztocDesc := range index.Layers {
+		ztocContent, err := content.FetchAll(ctx, repo.Blobs(), ztocDesc)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Ztoc blob %s: %v", ztocDesc.Digest, err))
+			continue
+		}
+		// Ztocs can only be checked against the layers of the image if it was found
+		if imageLayers == nil {
+			continue
+		}
+		layerDigest := ztocDesc.Annotations[soci.IndexAnnotationImageLayerDigest]
+		layerIndex := slices.IndexFunc(imageLayers, func(layer ocispec.Descriptor) bool {
+			return layer.Digest.String() == layerDigest
+		})
+		if layerIndex < 0 {
+			problems = append(problems, fmt.Sprintf("Ztoc %s refers to layer %q, which is not in the image manifest", ztocDesc.Digest, layerDigest))
+			continue
+		}
+		layer := imageLayers[layerIndex]
+
+		zt, err := ztoc.Unmarshal(bytes.NewReader(ztocContent))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("Ztoc %s cannot be parsed: %v", ztocDesc.Digest, err))
+			continue
+		}
+		if int64(zt.CompressedArchiveSize) != layer.Size {
+			problems = append(problems, fmt.Sprintf("Ztoc %s is for a layer of %d bytes, but layer %s has %d bytes", ztocDesc.Digest, zt.CompressedArchiveSize, layer.Digest, layer.Size))
+			continue
+		}
+		if len(zt.SpanDigests) != int(zt.MaxSpanID)+1 {
+			problems = append(problems, fmt.Sprintf("Ztoc %s has %d span digests for %d spans", ztocDesc.Digest, len(zt.SpanDigests), zt.MaxSpanID+1))
+			continue
+		}
+		if deep {
+			spanProblems, err := verifySpans(ctx, repo, layer, zt)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("Layer %s cannot be read: %v", layer.Digest, err))
+			}
+			problems = append(problems, spanProblems...)
+		}
+	}
+	return problems, nil
+}
+
+// Get the digest of an image and, for an image index, the digests of its platform manifests
+func imageManifestDigests(ctx context.Context, repo *remote.Repository, digest string) ([]string, error) {
+	desc, rc, err := repo.FetchReference(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	digests := []string{desc.Digest.String()}
+	if images.IsIndexType(desc.MediaType) {
+		var index ocispec.Index
+		if err := json.NewDecoder(rc).Decode(&index); err != nil {
+			return nil, err
+		}
+		for _, manifest := range index.Manifests {
+			digests = append(digests, manifest.Digest.String())
+		}
+	}
+	return digests, nil
+}
+
+// Compare evenly spread spans of a layer against the span digests of its ztoc.
+// Only the compressed bytes of the spans are downloaded when the registry supports range requests.
+func verifySpans(ctx context.Context, repo *remote.Repository, layer ocispec.Descriptor, zt *ztoc.Ztoc) ([]string, error) {
+	zinfo, err := zt.Zinfo()
+	if err != nil {
+		return nil, err
+	}
+	defer zinfo.Close()
+
+	spanCount := int(zt.MaxSpanID) + 1
+	var spans []compression.SpanID
+	for i := 0; i < min(spanCount, deepVerifySpans); i++ {
+		spanID := compression.SpanID(0)
+		if sampled := min(spanCount, deepVerifySpans); sampled > 1 {
+			spanID = compression.SpanID(i * (spanCount - 1) / (sampled - 1))
+		}
+		spans = append(spans, spanID)
+	}
+
+	var rc io.ReadCloser
+	var position int64
+	defer func() {
+		if rc != nil {
+			rc.Close()
+		}
+	}()
+	var problems []string
+	for _, spanID := range spans {
+		start := int64(zinfo.StartCompressedOffset(spanID))
+		end := int64(zinfo.EndCompressedOffset(spanID, zt.CompressedArchiveSize))
+
+		// Consecutive spans may share a byte, which requires reading the layer again without range requests
+		seeker, seekable := rc.(io.Seeker)
+		if rc == nil || (start < position && !seekable) {
+			if rc != nil {
+				rc.Close()
+			}
+			if rc, err = repo.Blobs().Fetch(ctx, layer); err != nil {
+				return problems, err
+			}
+			position = 0
+			seeker, seekable = rc.(io.Seeker)
+		}
+		if seekable {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return problems, err
+			}
+			position = start
+		}
+		if _, err := io.CopyN(io.Discard, rc, start-position); err != nil {
+			return problems, err
+		}
+
+		digester := godigest.Canonical.Digester()
+		if _, err := io.CopyN(digester.Hash(), rc, end-start); err != nil {
+			return problems, err
+		}
+		position = end
+		if actual := digester.Digest(); actual != zt.SpanDigests[spanID] {
+			problems = append(problems, fmt.Sprintf("Span %d of layer %s at offsets %d-%d has digest %s, but the ztoc expects %s", spanID, layer.Digest, start, end, actual, zt.SpanDigests[spanID]))
+		}
+	}
+	return problems, nil
+}
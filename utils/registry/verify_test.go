@@ -0,0 +1,213 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+func TestVerifyPushed(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	push := func(mediaType string, blob []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: godigest.FromBytes(blob), Size: int64(len(blob))}
+		if err := store.Push(ctx, desc, bytes.NewReader(blob)); err != nil {
+			t.Fatal(err)
+		}
+		return desc
+	}
+	config := push(mediaTypeEmptyConfig, []byte("{}"))
+	ztocs := []ocispec.Descriptor{push("application/octet-stream", []byte("ztoc 1")), push("application/octet-stream", []byte("ztoc 2"))}
+	manifest, err := json.Marshal(ocispec.Manifest{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: ocispec.MediaTypeImageManifest, Config: config, Layers: ztocs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := push(ocispec.MediaTypeImageManifest, manifest)
+
+	testCases := []struct {
+		name string
+		// Sizes of the manifest and blobs in the registry by digest, which are missing if absent
+		sizes    map[godigest.Digest]int64
+		expected string
+	}{
+		{"complete", map[godigest.Digest]int64{index.Digest: index.Size, config.Digest: config.Size, ztocs[0].Digest: ztocs[0].Size, ztocs[1].Digest: ztocs[1].Size}, ""},
+		{"missing ztoc", map[godigest.Digest]int64{index.Digest: index.Size, config.Digest: config.Size, ztocs[0].Digest: ztocs[0].Size}, fmt.Sprintf("Blob %s is missing", ztocs[1].Digest)},
+		{"truncated ztoc", map[godigest.Digest]int64{index.Digest: index.Size, config.Digest: config.Size, ztocs[0].Digest: 1, ztocs[1].Digest: ztocs[1].Size}, fmt.Sprintf("Blob %s has digest %s and 1 bytes, expected %d bytes", ztocs[0].Digest, ztocs[0].Digest, ztocs[0].Size)},
+		{"missing manifest", map[godigest.Digest]int64{config.Digest: config.Size, ztocs[0].Digest: ztocs[0].Size, ztocs[1].Digest: ztocs[1].Size}, fmt.Sprintf("Manifest %s is missing", index.Digest)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				digest := godigest.Digest(r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+				size, ok := tc.sizes[digest]
+				if r.Method != http.MethodHead || !ok {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				if strings.Contains(r.URL.Path, "/manifests/") {
+					w.Header().Set("Content-Type", index.MediaType)
+				}
+				w.Header().Set("Docker-Content-Digest", digest.String())
+				w.Header().Set("Content-Length", fmt.Sprint(size))
+			}))
+			defer server.Close()
+			registry, err := Init(ctx, strings.TrimPrefix(server.URL, "http://"), RegistryOptions{PlainHttp: true, Credential: auth.Credential{Username: "user", Password: "password"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = registry.VerifyPushed(ctx, "app", store, index)
+			if tc.expected == "" {
+				if err != nil {
+					t.Fatalf("Expected the SOCI index to be complete, got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrPushVerification) || !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Expected a verification error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+// A store serving other bytes for one of its blobs, as a corrupted disk or caching proxy would
+type tamperedStorage struct {
+	content.ReadOnlyStorage
+	digest godigest.Digest
+	blob   []byte
+}
+
+func (s tamperedStorage) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	if desc.Digest == s.digest {
+		return io.NopCloser(bytes.NewReader(s.blob)), nil
+	}
+	return s.ReadOnlyStorage.Fetch(ctx, desc)
+}
+
+func TestVerifyContent(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	push := func(mediaType string, blob []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: godigest.FromBytes(blob), Size: int64(len(blob))}
+		if err := store.Push(ctx, desc, bytes.NewReader(blob)); err != nil {
+			t.Fatal(err)
+		}
+		return desc
+	}
+	config := push(ocispec.MediaTypeImageConfig, []byte(`{"os":"linux"}`))
+	layer := push(ocispec.MediaTypeImageLayerGzip, []byte("layer"))
+	// Layers streamed later are not in the store
+	streamed := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: godigest.FromString("streamed"), Size: 8}
+	manifest, err := json.Marshal(ocispec.Manifest{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: ocispec.MediaTypeImageManifest, Config: config, Layers: []ocispec.Descriptor{layer, streamed}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := push(ocispec.MediaTypeImageManifest, manifest)
+
+	testCases := []struct {
+		name     string
+		storage  content.ReadOnlyStorage
+		digest   string
+		expected string
+	}{
+		{"intact", store, image.Digest.String(), ""},
+		{"intact platform manifest", store, "", ""},
+		{"other image", store, godigest.FromString("other").String(), fmt.Sprintf("manifest %s was pulled for image %s", image.Digest, godigest.FromString("other"))},
+		{"corrupted layer", tamperedStorage{store, layer.Digest, []byte("LAYER")}, image.Digest.String(), fmt.Sprintf("Layer %s has digest %s and 5 bytes, expected 5 bytes", layer.Digest, godigest.FromString("LAYER"))},
+		{"truncated config", tamperedStorage{store, config.Digest, []byte("{}")}, image.Digest.String(), fmt.Sprintf("Blob %s has digest %s and 2 bytes, expected %d bytes", config.Digest, godigest.FromString("{}"), config.Size)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := VerifyContent(ctx, tc.storage, image, tc.digest)
+			if tc.expected == "" {
+				if err != nil {
+					t.Fatalf("Expected the content to be intact, got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrContentVerification) || !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Expected a content verification error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestVerifyPlatformContent(t *testing.T) {
+	ctx := context.Background()
+	store, err := oci.NewWithContext(ctx, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	push := func(mediaType string, blob []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: godigest.FromBytes(blob), Size: int64(len(blob))}
+		if err := store.Push(ctx, desc, bytes.NewReader(blob)); err != nil {
+			t.Fatal(err)
+		}
+		return desc
+	}
+	config := push(ocispec.MediaTypeImageConfig, []byte(`{"os":"linux","architecture":"arm64"}`))
+	manifest, err := json.Marshal(ocispec.Manifest{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: ocispec.MediaTypeImageManifest, Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := push(ocispec.MediaTypeImageManifest, manifest)
+	// The manifest of the other platform is not pulled
+	other := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: godigest.FromString("amd64"), Size: 5}
+	listed := image
+	listed.Platform = &ocispec.Platform{OS: "linux", Architecture: "arm64"}
+	indexBytes, err := json.Marshal(ocispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: ocispec.MediaTypeImageIndex, Manifests: []ocispec.Descriptor{other, listed}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := push(ocispec.MediaTypeImageIndex, indexBytes)
+	otherIndexBytes, err := json.Marshal(ocispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: ocispec.MediaTypeImageIndex, Manifests: []ocispec.Descriptor{other}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherIndex := push(ocispec.MediaTypeImageIndex, otherIndexBytes)
+
+	testCases := []struct {
+		name     string
+		storage  content.ReadOnlyStorage
+		digest   string
+		expected string
+	}{
+		{"listed in the image index", store, index.Digest.String(), ""},
+		{"image manifest requested", store, image.Digest.String(), ""},
+		{"not listed in the image index", store, otherIndex.Digest.String(), fmt.Sprintf("manifest %s was pulled for image %s, which does not list it", image.Digest, otherIndex.Digest)},
+		{"other image index", tamperedStorage{store, index.Digest, otherIndexBytes}, index.Digest.String(), fmt.Sprintf("image index %s has digest %s", index.Digest, otherIndex.Digest)},
+		{"image index not pulled", store, godigest.FromString("index").String(), fmt.Sprintf("image index %s was not pulled along with manifest %s", godigest.FromString("index"), image.Digest)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := VerifyPlatformContent(ctx, tc.storage, image, tc.digest)
+			if tc.expected == "" {
+				if err != nil {
+					t.Fatalf("Expected the content to be intact, got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrContentVerification) || !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Expected a content verification error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
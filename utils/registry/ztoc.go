@@ -0,0 +1,100 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	godigest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Memory budgeted for each layer decompressed at once to build its ztoc,
+// covering the decompressor state, the checkpoints of a large layer and the metadata of its files
+const DecompressionMemory = 128 << 20
+
+// Taken while a layer is decompressed by BuildLayerZtoc. The number of layers decompressed at once is unlimited if nil
+var decompressionSlots chan struct{}
+
+// Set maxMemory as the soft memory limit of the Go runtime, and cap the number of layers BuildLayerZtoc decompresses at once
+// so that their ztoc builds fit in it. At least one layer is decompressed at a time. Returns the number of layers decompressed at once.
+// Must be called before any ztoc is built.
+func LimitMemory(maxMemory int64) int {
+	debug.SetMemoryLimit(maxMemory)
+	slots := max(1, int(maxMemory/DecompressionMemory))
+	decompressionSlots = make(chan struct{}, slots)
+	return slots
+}
+
+// Build the ztoc of a layer compressed with algorithm, written by fetch to a temporary file in dir.
+// The file is removed once the ztoc is built. The layer is read from the file in spans rather than held in memory.
+// Waits until fewer layers than allowed by LimitMemory are being decompressed before fetching the layer, so that the temporary files are capped as well.
+func BuildLayerZtoc(ctx context.Context, builder *ztoc.Builder, dir string, algorithm string, spanSize int64, fetch func(file *os.File) error) (*ztoc.Ztoc, error) {
+	release, err := acquireDecompressionSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	file, err := os.CreateTemp(dir, "layer-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	err = fetch(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return builder.BuildZtoc(file.Name(), spanSize, ztoc.WithCompression(algorithm))
+}
+
+// Build the ztoc of a layer compressed with algorithm in place, from its blob in the content store at storeDir,
+// so that the layer is never copied on disk
+func BuildStoredLayerZtoc(ctx context.Context, builder *ztoc.Builder, storeDir string, layer ocispec.Descriptor, algorithm string, spanSize int64) (*ztoc.Ztoc, error) {
+	blobPath := BlobPath(storeDir, layer.Digest)
+	info, err := os.Stat(blobPath)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() != layer.Size {
+		return nil, fmt.Errorf("Layer %s in the content store has %d bytes, expected %d", layer.Digest, info.Size(), layer.Size)
+	}
+	release, err := acquireDecompressionSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return builder.BuildZtoc(blobPath, spanSize, ztoc.WithCompression(algorithm))
+}
+
+// Path of a blob in a content store at storeDir.
+// The containerd local store and the OCI store lay out blobs the same way, so both read and write the same file when they share storeDir.
+func BlobPath(storeDir string, digest godigest.Digest) string {
+	return filepath.Join(storeDir, ocispec.ImageBlobsDir, digest.Algorithm().String(), digest.Encoded())
+}
+
+// Check if LimitMemory caps the number of layers decompressed at once
+func MemoryLimited() bool {
+	return decompressionSlots != nil
+}
+
+// Wait until fewer layers than allowed by LimitMemory are being decompressed, and return the function that releases the slot taken
+func acquireDecompressionSlot(ctx context.Context) (func(), error) {
+	if decompressionSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case decompressionSlots <- struct{}{}:
+		return func() { <-decompressionSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package registry
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"github.com/tmokmss/soci-wrapper/utils/fs"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+// Reads zeros forever
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+func TestBuildLayerZtocWithinMemoryLimit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping indexing a 2GB layer in short mode")
+	}
+	const fileSize = 2 << 30
+	const memoryLimit = 512 << 20
+	LimitMemory(memoryLimit)
+	t.Cleanup(func() {
+		debug.SetMemoryLimit(math.MaxInt64)
+		decompressionSlots = nil
+	})
+
+	// Sample the memory in use until the ztoc is built
+	var peak uint64
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			peak = max(peak, stats.HeapInuse+stats.StackInuse)
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	// A single layer of a single file of zeros, compressed as it is written
+	toc, err := BuildLayerZtoc(context.Background(), ztoc.NewBuilder("test"), t.TempDir(), compression.Gzip, 4<<20, func(file *os.File) error {
+		gz, err := gzip.NewWriterLevel(file, gzip.BestSpeed)
+		if err != nil {
+			return err
+		}
+		tw := tar.NewWriter(gz)
+		if err := tw.WriteHeader(&tar.Header{Name: "zeros", Mode: 0644, Size: fileSize, Typeflag: tar.TypeReg}); err != nil {
+			return err
+		}
+		if _, err := fs.Copy(tw, io.LimitReader(zeroReader{}, fileSize)); err != nil {
+			return err
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return gz.Close()
+	})
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("Failed to build the ztoc: %v", err)
+	}
+
+	if len(toc.FileMetadata) != 1 || toc.FileMetadata[0].UncompressedSize != fileSize {
+		t.Fatalf("Expected a ztoc of a single %d bytes file, got %+v", fileSize, toc.FileMetadata)
+	}
+	if peak > memoryLimit {
+		t.Fatalf("Expected less than %d bytes in use while indexing, got %d", memoryLimit, peak)
+	}
+}
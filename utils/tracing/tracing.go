@@ -0,0 +1,403 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package tracing traces the phases of a build with OpenTelemetry spans, exported with OTLP over HTTP.
+// Spans are no-ops unless an OTLP endpoint is configured.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/embedded"
+)
+
+// Name of the tracer, and of the service unless OTEL_SERVICE_NAME is set
+const serviceName = "soci-wrapper"
+
+// How long an export may take, so that an unreachable collector does not hold up builds
+const exportTimeout = 10 * time.Second
+
+// Start a span as a child of the span in ctx, if any
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(serviceName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// End a span, recording the error it failed with if any
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Export spans with OTLP over HTTP if OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT is set.
+// Otherwise spans are left as no-ops.
+func Configure(ctx context.Context) {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if endpoint == "" {
+			return
+		}
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	headers := map[string]string{}
+	for _, header := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if key, value, ok := strings.Cut(header, "="); ok {
+			headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	name := os.Getenv("OTEL_SERVICE_NAME")
+	if name == "" {
+		name = serviceName
+	}
+	log.Info(ctx, fmt.Sprintf("Exporting traces to %s", endpoint))
+	otel.SetTracerProvider(&tracerProvider{endpoint: endpoint, headers: headers, serviceName: name})
+}
+
+// Make the spans started from ctx join the X-Ray trace of a trace header, e.g. the _X_AMZN_TRACE_ID of a Lambda invocation.
+// The header looks like Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1.
+func ContextWithXrayTraceHeader(ctx context.Context, header string) context.Context {
+	var config trace.SpanContextConfig
+	for _, field := range strings.Split(header, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch key {
+		case "Root":
+			// The epoch and the unique part of the root together make the trace ID
+			parts := strings.Split(value, "-")
+			if len(parts) != 3 || parts[0] != "1" {
+				return ctx
+			}
+			id, err := trace.TraceIDFromHex(parts[1] + parts[2])
+			if err != nil {
+				return ctx
+			}
+			config.TraceID = id
+		case "Parent":
+			id, err := trace.SpanIDFromHex(value)
+			if err != nil {
+				return ctx
+			}
+			config.SpanID = id
+		case "Sampled":
+			if value == "1" {
+				config.TraceFlags = trace.FlagsSampled
+			}
+		}
+	}
+	config.Remote = true
+	spanContext := trace.NewSpanContext(config)
+	if !spanContext.IsValid() {
+		return ctx
+	}
+	return trace.ContextWithRemoteSpanContext(ctx, spanContext)
+}
+
+// Records spans and exports those of a trace once its local root span ends
+type tracerProvider struct {
+	embedded.TracerProvider
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+
+	mutex sync.Mutex
+	// Ended spans waiting for their local root span to end, by trace ID
+	pending map[trace.TraceID][]*span
+	// Number of local root spans started and not ended yet, by trace ID
+	openRoots map[trace.TraceID]int
+}
+
+func (provider *tracerProvider) Tracer(name string, options ...trace.TracerOption) trace.Tracer {
+	return &tracer{provider: provider, name: name}
+}
+
+type tracer struct {
+	embedded.Tracer
+	provider *tracerProvider
+	name     string
+}
+
+func (tracer *tracer) Start(ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	config := trace.NewSpanStartConfig(options...)
+	parent := trace.SpanContextFromContext(ctx)
+	if config.NewRoot() {
+		parent = trace.SpanContext{}
+	}
+
+	start := config.Timestamp()
+	if start.IsZero() {
+		start = time.Now()
+	}
+	spanContextConfig := trace.SpanContextConfig{TraceFlags: trace.FlagsSampled}
+	if parent.IsValid() {
+		spanContextConfig.TraceID = parent.TraceID()
+	} else {
+		spanContextConfig.TraceID = newXrayTraceId(start)
+	}
+	rand.Read(spanContextConfig.SpanID[:])
+
+	s := &span{
+		tracer:      tracer,
+		spanContext: trace.NewSpanContext(spanContextConfig),
+		parent:      parent,
+		localRoot:   !parent.IsValid() || parent.IsRemote(),
+		name:        name,
+		kind:        config.SpanKind(),
+		start:       start,
+		attributes:  config.Attributes(),
+	}
+	if s.localRoot {
+		tracer.provider.mutex.Lock()
+		if tracer.provider.openRoots == nil {
+			tracer.provider.openRoots = map[trace.TraceID]int{}
+		}
+		tracer.provider.openRoots[spanContextConfig.TraceID]++
+		tracer.provider.mutex.Unlock()
+	}
+	return trace.ContextWithSpan(ctx, s), s
+}
+
+// Generate a trace ID that X-Ray accepts, whose first 4 bytes are the epoch seconds of the start of the trace
+func newXrayTraceId(start time.Time) trace.TraceID {
+	var id trace.TraceID
+	binary.BigEndian.PutUint32(id[:4], uint32(start.Unix()))
+	rand.Read(id[4:])
+	return id
+}
+
+// A span recorded in memory until it is exported
+type span struct {
+	embedded.Span
+	tracer      *tracer
+	spanContext trace.SpanContext
+	parent      trace.SpanContext
+	// Whether the parent of the span is in another process, if any
+	localRoot bool
+
+	mutex       sync.Mutex
+	name        string
+	kind        trace.SpanKind
+	start, end  time.Time
+	attributes  []attribute.KeyValue
+	events      []event
+	status      codes.Code
+	description string
+}
+
+type event struct {
+	name       string
+	time       time.Time
+	attributes []attribute.KeyValue
+}
+
+func (s *span) End(options ...trace.SpanEndOption) {
+	s.mutex.Lock()
+	if !s.end.IsZero() {
+		s.mutex.Unlock()
+		return
+	}
+	config := trace.NewSpanEndConfig(options...)
+	s.end = config.Timestamp()
+	if s.end.IsZero() {
+		s.end = time.Now()
+	}
+	s.mutex.Unlock()
+
+	provider := s.tracer.provider
+	provider.mutex.Lock()
+	if provider.pending == nil {
+		provider.pending = map[trace.TraceID][]*span{}
+	}
+	traceId := s.spanContext.TraceID()
+	provider.pending[traceId] = append(provider.pending[traceId], s)
+	if s.localRoot {
+		provider.openRoots[traceId]--
+	}
+	// The spans of a trace are exported once its local root spans have ended, and spans ending after them,
+	// e.g. of a goroutine outliving its build, are exported on their own rather than kept forever
+	var spans []*span
+	if provider.openRoots[traceId] <= 0 {
+		spans = provider.pending[traceId]
+		delete(provider.pending, traceId)
+		delete(provider.openRoots, traceId)
+	}
+	provider.mutex.Unlock()
+
+	if len(spans) > 0 {
+		if err := provider.export(spans); err != nil {
+			log.Warn(context.TODO(), fmt.Sprintf("Couldn't export %d spans: %v", len(spans), err))
+		}
+	}
+}
+
+func (s *span) AddEvent(name string, options ...trace.EventOption) {
+	config := trace.NewEventConfig(options...)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.events = append(s.events, event{name, config.Timestamp(), config.Attributes()})
+}
+
+func (s *span) IsRecording() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.end.IsZero()
+}
+
+func (s *span) RecordError(err error, options ...trace.EventOption) {
+	if err == nil {
+		return
+	}
+	options = append(options, trace.WithAttributes(
+		attribute.String("exception.type", fmt.Sprintf("%T", err)),
+		attribute.String("exception.message", err.Error()),
+	))
+	s.AddEvent("exception", options...)
+}
+
+func (s *span) SpanContext() trace.SpanContext {
+	return s.spanContext
+}
+
+func (s *span) SetStatus(code codes.Code, description string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status, s.description = code, description
+}
+
+func (s *span) SetName(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.name = name
+}
+
+func (s *span) SetAttributes(attributes ...attribute.KeyValue) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attributes = append(s.attributes, attributes...)
+}
+
+func (s *span) TracerProvider() trace.TracerProvider {
+	return s.tracer.provider
+}
+
+// Export spans as an OTLP/HTTP JSON request
+func (provider *tracerProvider) export(spans []*span) error {
+	otlpSpans := make([]map[string]any, 0, len(spans))
+	for _, s := range spans {
+		s.mutex.Lock()
+		otlpSpan := map[string]any{
+			"traceId":           s.spanContext.TraceID().String(),
+			"spanId":            s.spanContext.SpanID().String(),
+			"name":              s.name,
+			"kind":              otlpSpanKind(s.kind),
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attributes),
+			"status":            map[string]any{"code": otlpStatusCode(s.status), "message": s.description},
+		}
+		if s.parent.IsValid() {
+			otlpSpan["parentSpanId"] = s.parent.SpanID().String()
+		}
+		events := make([]map[string]any, 0, len(s.events))
+		for _, e := range s.events {
+			events = append(events, map[string]any{
+				"name":         e.name,
+				"timeUnixNano": strconv.FormatInt(e.time.UnixNano(), 10),
+				"attributes":   otlpAttributes(e.attributes),
+			})
+		}
+		otlpSpan["events"] = events
+		s.mutex.Unlock()
+		otlpSpans = append(otlpSpans, otlpSpan)
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []map[string]any{{
+			"resource": map[string]any{
+				"attributes": otlpAttributes([]attribute.KeyValue{attribute.String("service.name", provider.serviceName)}),
+			},
+			"scopeSpans": []map[string]any{{
+				"scope": map[string]any{"name": serviceName},
+				"spans": otlpSpans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range provider.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", provider.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// Encode attributes as OTLP key values
+func otlpAttributes(attributes []attribute.KeyValue) []map[string]any {
+	encoded := make([]map[string]any, 0, len(attributes))
+	for _, kv := range attributes {
+		var value map[string]any
+		switch kv.Value.Type() {
+		case attribute.BOOL:
+			value = map[string]any{"boolValue": kv.Value.AsBool()}
+		case attribute.INT64:
+			value = map[string]any{"intValue": strconv.FormatInt(kv.Value.AsInt64(), 10)}
+		case attribute.FLOAT64:
+			value = map[string]any{"doubleValue": kv.Value.AsFloat64()}
+		default:
+			value = map[string]any{"stringValue": kv.Value.Emit()}
+		}
+		encoded = append(encoded, map[string]any{"key": string(kv.Key), "value": value})
+	}
+	return encoded
+}
+
+// Encode a span kind as an OTLP SpanKind, which counts from 1 for internal spans
+func otlpSpanKind(kind trace.SpanKind) int {
+	if kind == trace.SpanKindUnspecified {
+		kind = trace.SpanKindInternal
+	}
+	return int(kind)
+}
+
+// Encode a status code as an OTLP StatusCode, where 1 is ok and 2 is error
+func otlpStatusCode(code codes.Code) int {
+	switch code {
+	case codes.Ok:
+		return 1
+	case codes.Error:
+		return 2
+	}
+	return 0
+}
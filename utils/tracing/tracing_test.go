@@ -0,0 +1,74 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSpansEndingAfterTheirRoot(t *testing.T) {
+	var mu sync.Mutex
+	var exports [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []struct {
+						Name string `json:"name"`
+					} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		var names []string
+		for _, s := range body.ResourceSpans[0].ScopeSpans[0].Spans {
+			names = append(names, s.Name)
+		}
+		mu.Lock()
+		exports = append(exports, names)
+		mu.Unlock()
+	}))
+	defer server.Close()
+	provider := &tracerProvider{endpoint: server.URL, serviceName: serviceName}
+	tracer := provider.Tracer(serviceName)
+
+	ctx, root := tracer.Start(context.Background(), "BuildImage")
+	_, pull := tracer.Start(ctx, "Pull")
+	_, upload := tracer.Start(ctx, "Upload")
+	pull.End()
+	root.End()
+	// A goroutine of the build outlives it
+	upload.End()
+
+	expected := [][]string{{"Pull", "BuildImage"}, {"Upload"}}
+	if len(exports) != len(expected) || !slices.Equal(exports[0], expected[0]) || !slices.Equal(exports[1], expected[1]) {
+		t.Errorf("Expected the exports %q, got %q", expected, exports)
+	}
+	if len(provider.pending) != 0 || len(provider.openRoots) != 0 {
+		t.Errorf("Expected no span to be left pending, got %d traces pending and %d open", len(provider.pending), len(provider.openRoots))
+	}
+}
+
+func TestXrayTraceId(t *testing.T) {
+	provider := &tracerProvider{}
+	before := time.Now().Unix()
+	_, root := provider.Tracer(serviceName).Start(context.Background(), "BuildImage")
+	traceId := root.SpanContext().TraceID()
+	if epoch := int64(binary.BigEndian.Uint32(traceId[:4])); epoch < before || epoch > time.Now().Unix() {
+		t.Errorf("Expected the trace ID %s to start with the epoch seconds of the trace, got %d", traceId, epoch)
+	}
+	if other := newXrayTraceId(time.Now()); other == traceId {
+		t.Errorf("Expected trace IDs to be unique, got %s twice", traceId)
+	}
+}
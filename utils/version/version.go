@@ -0,0 +1,82 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package version tells which build of soci-wrapper is running.
+// Release builds set the variables below with -ldflags, e.g.
+// -X github.com/tmokmss/soci-wrapper/utils/version.version=1.2.3 -X github.com/tmokmss/soci-wrapper/utils/version.commit=abc1234 -X github.com/tmokmss/soci-wrapper/utils/version.buildDate=2024-01-01T00:00:00Z,
+// and the build information embedded by the Go toolchain is used for those left unset.
+package version
+
+import (
+	"cmp"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+// Set with -ldflags
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// Module path of the soci-snapshotter library building the SOCI indices
+const sociSnapshotterModule = "github.com/awslabs/soci-snapshotter"
+
+// Reported for what neither -ldflags nor the build information tell
+const unknown = "unknown"
+
+// Which build of soci-wrapper is running
+type Info struct {
+	// Semantic version, e.g. 1.2.3, or (devel) for a build of a working copy
+	Version         string `json:"version"`
+	Commit          string `json:"commit"`
+	BuildDate       string `json:"buildDate"`
+	SociSnapshotter string `json:"sociSnapshotter"`
+	GoVersion       string `json:"goVersion"`
+}
+
+// Get the build of soci-wrapper running, from -ldflags or else the build information
+var Get = sync.OnceValue(func() Info {
+	info := Info{Version: strings.TrimPrefix(version, "v"), Commit: commit, BuildDate: buildDate}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		info.GoVersion = build.GoVersion
+		if info.Version == "" && build.Main.Version != "" {
+			info.Version = strings.TrimPrefix(build.Main.Version, "v")
+		}
+		for _, setting := range build.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				info.Commit = cmp.Or(info.Commit, setting.Value)
+			case "vcs.time":
+				info.BuildDate = cmp.Or(info.BuildDate, setting.Value)
+			}
+		}
+		for _, dep := range build.Deps {
+			if dep.Path == sociSnapshotterModule {
+				if dep.Replace != nil {
+					dep = dep.Replace
+				}
+				info.SociSnapshotter = dep.Version
+			}
+		}
+	}
+	info.Version = cmp.Or(info.Version, unknown)
+	info.Commit = cmp.Or(info.Commit, unknown)
+	info.BuildDate = cmp.Or(info.BuildDate, unknown)
+	info.SociSnapshotter = cmp.Or(info.SociSnapshotter, unknown)
+	info.GoVersion = cmp.Or(info.GoVersion, unknown)
+	return info
+})
+
+// Describe the build on a line, e.g. soci-wrapper 1.2.3 (commit abc1234, built 2024-01-01T00:00:00Z, soci-snapshotter v0.4.1, go1.22.0)
+func (info Info) String() string {
+	return fmt.Sprintf("soci-wrapper %s (commit %s, built %s, soci-snapshotter %s, %s)", info.Version, info.Commit, info.BuildDate, info.SociSnapshotter, info.GoVersion)
+}
+
+// User-Agent of the registry requests, naming the version of soci-wrapper sending them
+func UserAgent() string {
+	return fmt.Sprintf("SOCI Index Builder (oras-go) soci-wrapper/%s", Get().Version)
+}
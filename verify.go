@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/logctx"
+	registryutils "github.com/tmokmss/soci-wrapper/utils/registry"
+	"os"
+
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// Verify that SOCI indices in a registry are complete and consistent with the image they refer to.
+// Every problem found is printed, and the exit code is non-zero if any index has one.
+func verifyCommand(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	repo := flags.String("repo", "", "Name of the repository")
+	digest := flags.String("digest", "", "Digest of the image the SOCI index refers to")
+	index := flags.String("index", "", "Digest of the SOCI index to verify. Every SOCI index of the image is verified if omitted")
+	deep := flags.Bool("deep", false, "Also download some spans of each layer and compare them against the span digests of the ztocs")
+	region := flags.String("region", "", "AWS region of the ECR repository. Defaults to the region of the AWS configuration, e.g. $AWS_REGION")
+	account := flags.String("account", "", "AWS account ID of the ECR repository. Defaults to the account of the AWS credentials")
+	fips := flags.Bool("fips", false, "Use the FIPS endpoints of ECR")
+	registryHost := flags.String("registry", "", "Hostname of an OCI registry to use instead of ECR, e.g. harbor.example.com")
+	username := flags.String("username", "", "Username for --registry. Defaults to the "+registryutils.RegistryUsernameEnv+" environment variable or the docker config file")
+	password := flags.String("password", "", "Password for --registry. Defaults to the "+registryutils.RegistryPasswordEnv+" environment variable or the docker config file")
+	dockerConfig := flags.String("docker-config", "", "Path of the docker config file to read registry credentials from. Defaults to $DOCKER_CONFIG/config.json or ~/.docker/config.json")
+	plainHttp := flags.Bool("plain-http", false, "Connect to the registry over plain HTTP, e.g. for a local test registry")
+	caCert := flags.String("ca-cert", "", "PEM bundle of CA certificates to trust in addition to the system ones when connecting to the registry")
+	awsOptions := awsFlags(flags)
+	proxyUrl := proxyFlag(flags)
+	setRetryOptions := retryFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: soci-wrapper verify --repo REPOSITORY_NAME --digest IMAGE_DIGEST [--index SOCI_INDEX_DIGEST] [--deep] --region AWS_REGION --account AWS_ACCOUNT")
+		fmt.Fprintln(flags.Output(), "       soci-wrapper verify --repo REPOSITORY_NAME --digest IMAGE_DIGEST [--index SOCI_INDEX_DIGEST] [--deep] --registry REGISTRY")
+		flags.PrintDefaults()
+	}
+	parseFlags(flags, args)
+
+	if *repo == "" || *digest == "" || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	ctx := logctx.WithImageDigest(context.TODO(), *digest)
+	if err := registryutils.ConfigureProxy(ctx, *proxyUrl); err != nil {
+		lambdaError(ctx, "Proxy configuration error", err)
+		os.Exit(1)
+	}
+	if err := registryutils.ConfigureAws(ctx, awsOptions()); err != nil {
+		lambdaError(ctx, "AWS credentials configuration error", err)
+		os.Exit(1)
+	}
+	if *registryHost == "" {
+		detectRegionAndAccount(ctx, region, account)
+	}
+	registryUrl, ok := registryUrlFromFlags(*registryHost, *region, *account, *fips)
+	if !ok {
+		flags.Usage()
+		os.Exit(1)
+	}
+	ctx = logctx.WithRegistryURL(ctx, registryUrl)
+	repositoryName := registryutils.NormalizeRepositoryName(registryUrl, *repo)
+	ctx = logctx.WithRepositoryName(ctx, repositoryName)
+
+	registryOptions := registryutils.RegistryOptions{
+		Credential:       auth.Credential{Username: *username, Password: *password},
+		DockerConfigFile: *dockerConfig,
+		PlainHttp:        *plainHttp,
+		CaCertFile:       *caCert,
+	}
+	setRetryOptions(&registryOptions)
+	registry, err := registryutils.Init(ctx, registryUrl, registryOptions)
+	if err != nil {
+		lambdaError(ctx, "Remote registry initialization error", err)
+		os.Exit(1)
+	}
+
+	indices := []string{*index}
+	if *index == "" {
+		descs, err := registry.ListImageSociIndices(ctx, repositoryName, *digest)
+		if err != nil {
+			lambdaError(ctx, "SOCI index list error", err)
+			os.Exit(1)
+		}
+		if len(descs) == 0 {
+			fmt.Printf("FAIL  %s: no SOCI index refers to the image\n", *digest)
+			os.Exit(1)
+		}
+		indices = nil
+		for _, desc := range descs {
+			indices = append(indices, desc.Digest.String())
+		}
+	}
+
+	failed := false
+	for _, indexDigest := range indices {
+		problems, err := registry.VerifySociIndex(ctx, repositoryName, *digest, indexDigest, *deep)
+		if err != nil {
+			lambdaError(ctx, "SOCI index verification error", err)
+			os.Exit(1)
+		}
+		if len(problems) == 0 {
+			fmt.Printf("PASS  %s\n", indexDigest)
+			continue
+		}
+		failed = true
+		for _, problem := range problems {
+			fmt.Printf("FAIL  %s: %s\n", indexDigest, problem)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/tmokmss/soci-wrapper/utils/fs"
+	"github.com/tmokmss/soci-wrapper/utils/log"
+	"sync"
+)
+
+// Disk space shared by the images processed at once by --workers, so that their pulls fit in it together.
+// Each image reserves its compressed size before it is pulled, and waits for the images in progress to release theirs if needed.
+type diskBudget struct {
+	mu       sync.Mutex
+	total    uint64
+	reserved uint64
+	// Closed and replaced whenever space is released
+	released chan struct{}
+}
+
+// Create a budget of the free space in dir
+func newDiskBudget(dir string) *diskBudget {
+	return &diskBudget{total: fs.CalculateFreeSpace(dir), released: make(chan struct{})}
+}
+
+// Reserve size bytes, waiting until the images in progress leave enough of the budget.
+// Fails right away if size does not fit in the whole budget. Returns the function that releases the space.
+func (budget *diskBudget) reserve(ctx context.Context, size uint64) (func(), error) {
+	if size > budget.total {
+		return nil, fmt.Errorf("%w: need %d bytes, have %d bytes", errInsufficientDiskSpace, size, budget.total)
+	}
+	waiting := false
+	for {
+		budget.mu.Lock()
+		if budget.reserved+size <= budget.total {
+			budget.reserved += size
+			budget.mu.Unlock()
+			return func() { budget.release(size) }, nil
+		}
+		released := budget.released
+		available := budget.total - budget.reserved
+		budget.mu.Unlock()
+
+		if !waiting {
+			log.Info(ctx, fmt.Sprintf("Waiting for %d bytes of disk space, %d bytes are left by the images in progress", size, available))
+			waiting = true
+		}
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (budget *diskBudget) release(size uint64) {
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+	budget.reserved -= size
+	close(budget.released)
+	budget.released = make(chan struct{})
+}